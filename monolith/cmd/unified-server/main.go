@@ -4,14 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
 
 	// Outbox-Kafka components
 	"monolith/internal/config"
@@ -21,7 +26,10 @@ import (
 	// Token Bucket components
 	"monolith/internal/bucket"
 	"monolith/internal/handler"
+	"monolith/internal/headers"
+	"monolith/internal/metrics"
 	"monolith/internal/middleware"
+	"monolith/internal/rls"
 )
 
 type UnifiedServer struct {
@@ -62,14 +70,21 @@ func main() {
 	repo := database.NewRepository(db)
 	userService := service.NewUserService(repo, cfg.Kafka.Topic)
 
+	// Share one Redis connection pool between all token buckets. A comma separated
+	// REDIS_ADDRS selects cluster mode, or Sentinel when REDIS_MASTER_NAME is set.
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      strings.Split(getEnv("REDIS_ADDRS", getEnv("REDIS_ADDR", "localhost:6379")), ","),
+		MasterName: getEnv("REDIS_MASTER_NAME", ""),
+		Password:   getEnv("REDIS_PASSWORD", ""),
+		DB:         0,
+	})
+	defer redisClient.Close()
+
 	// Initialize Redis Token Bucket components for API usage
-	tb, err := bucket.NewRedisTokenBucket(&bucket.Config{
-		RedisAddr:     getEnv("REDIS_ADDR", "localhost:6379"),
-		RedisPassword: getEnv("REDIS_PASSWORD", ""),
-		RedisDB:       0,
-		Capacity:      100,             // 100 tokens max for API buckets
-		RefillRate:    10.0,            // 10 tokens per second for API buckets
-		TTL:           5 * time.Minute, // 5 minute TTL for API buckets
+	tb, err := bucket.NewRedisTokenBucketWithClient(redisClient, &bucket.Config{
+		Capacity:   100,             // 100 tokens max for API buckets
+		RefillRate: 10.0,            // 10 tokens per second for API buckets
+		TTL:        5 * time.Minute, // 5 minute TTL for API buckets
 	})
 	if err != nil {
 		log.Fatalf("Failed to initialize token bucket: %v", err)
@@ -79,13 +94,10 @@ func main() {
 	bucketHandler := handler.NewHandler(tb)
 
 	// Initialize separate token bucket for rate limiting with different config
-	rateLimitBucket, err := bucket.NewRedisTokenBucket(&bucket.Config{
-		RedisAddr:     getEnv("REDIS_ADDR", "localhost:6379"),
-		RedisPassword: getEnv("REDIS_PASSWORD", ""),
-		RedisDB:       0,
-		Capacity:      10,              // 10 token burst capacity for rate limiting
-		RefillRate:    0.1,             // 0.1 tokens per second (6/minute) for rate limiting - slower refill for testing
-		TTL:           2 * time.Minute, // 2 minute TTL for rate limit buckets
+	rateLimitBucket, err := bucket.NewRedisTokenBucketWithClient(redisClient, &bucket.Config{
+		Capacity:   10,              // 10 token burst capacity for rate limiting
+		RefillRate: 0.1,             // 0.1 tokens per second (6/minute) for rate limiting - slower refill for testing
+		TTL:        2 * time.Minute, // 2 minute TTL for rate limit buckets
 	})
 	if err != nil {
 		log.Fatalf("Failed to initialize rate limit bucket: %v", err)
@@ -98,14 +110,215 @@ func main() {
 		bucketHandler: bucketHandler,
 	}
 
+	// RATE_LIMIT_FAILURE_MODE decides what happens while Redis is down: closed, open or local
+	failureMode, err := middleware.ParseFailureMode(getEnv("RATE_LIMIT_FAILURE_MODE", "closed"))
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_FAILURE_MODE: %v", err)
+	}
+	expectedInstances, err := strconv.Atoi(getEnv("RATE_LIMIT_INSTANCES", "1"))
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_INSTANCES: %v", err)
+	}
+
+	// RATE_LIMIT_HEADERS selects the rate limit response headers: both (IETF RateLimit and
+	// RateLimit-Policy plus X-RateLimit-*), ietf or legacy
+	headerMode, err := headers.ParseMode(getEnv("RATE_LIMIT_HEADERS", "both"))
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_HEADERS: %v", err)
+	}
+	bucketHandler.SetHeaderMode(headerMode)
+
+	// RATE_LIMIT_TRUSTED_PROXIES lists the proxy networks whose forwarding header is believed,
+	// e.g. "10.0.0.0/8". Without it clients are identified by the connection address, so
+	// spoofed headers cannot pick a fresh bucket. RATE_LIMIT_PROXY_HEADER names the one header
+	// those proxies set: X-Forwarded-For (the default), Forwarded or X-Real-IP.
+	trustedProxies, err := middleware.ParseTrustedProxies(getEnv("RATE_LIMIT_TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_TRUSTED_PROXIES: %v", err)
+	}
+	proxyHeader, err := middleware.ParseProxyHeader(getEnv("RATE_LIMIT_PROXY_HEADER", middleware.HeaderXForwardedFor))
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_PROXY_HEADER: %v", err)
+	}
+	proxies := middleware.Proxies{Trusted: trustedProxies, Header: proxyHeader}
+
 	// Setup middleware for global rate limiting
 	rateLimitConfig := &middleware.RateLimitConfig{
 		RequestsPerMinute: 6,           // 6 requests per minute per client (0.1/second)
 		BurstSize:         10,          // Allow bursts of 10 requests
 		RefillRate:        time.Minute, // Refill every minute
+		FailureMode:       failureMode,
+		ExpectedInstances: expectedInstances, // The local fallback gets 1/N of the limit
+		HeaderMode:        headerMode,
+		Proxies:           proxies,
+	}
+
+	// QUOTA_LIMIT adds a calendar quota per client on top of the rate limit (0 disables).
+	// QUOTA_PERIOD is hour, day, week or month and QUOTA_TIMEZONE an IANA zone name.
+	// QUOTA_TIMEZONES overrides the zone per client identity, e.g. "tenant:acme=Asia/Tokyo,tenant:eu-*=Europe/Berlin".
+	var quotaHandler *handler.Handler
+	quotaLimit, err := strconv.ParseInt(getEnv("QUOTA_LIMIT", "0"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid QUOTA_LIMIT: %v", err)
 	}
+	if quotaLimit > 0 {
+		quotaPeriod, err := bucket.ParseQuotaPeriod(getEnv("QUOTA_PERIOD", "month"))
+		if err != nil {
+			log.Fatalf("Invalid QUOTA_PERIOD: %v", err)
+		}
+		quotaLocation, err := time.LoadLocation(getEnv("QUOTA_TIMEZONE", "UTC"))
+		if err != nil {
+			log.Fatalf("Invalid QUOTA_TIMEZONE: %v", err)
+		}
+		quotaLocations, err := bucket.ParseQuotaLocations(getEnv("QUOTA_TIMEZONES", ""))
+		if err != nil {
+			log.Fatalf("Invalid QUOTA_TIMEZONES: %v", err)
+		}
+		quota, err := bucket.NewRedisQuotaWithClient(redisClient, &bucket.QuotaConfig{
+			Limit:        quotaLimit,
+			Period:       quotaPeriod,
+			Location:     quotaLocation,
+			LocationFunc: quotaLocations,
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize quota: %v", err)
+		}
+		defer quota.Close()
+
+		// A request must pass both; tokens taken by the bucket are refunded when the quota denies.
+		// The quota is keyed by client identity alone, so it is shared by every policy.
+		rateLimitConfig.Quota = quota
+		quotaHandler = handler.NewHandler(quota)
+	}
+
+	// RATE_LIMIT_POLICY_FILE replaces the limits above with policies, route rules, client
+	// identity rules and exemptions from a YAML or JSON file. It is reloaded on SIGHUP and
+	// whenever it changes.
+	var policyWatcher *middleware.PolicyWatcher
+	if policyFile := getEnv("RATE_LIMIT_POLICY_FILE", ""); policyFile != "" {
+		// Route costs are charged to the bucket and the quota, which only counts whole requests
+		policyWatcher, err = middleware.NewPolicyWatcher(context.Background(), policyFile, rateLimitBucket,
+			rateLimitBucket, rateLimitConfig.Quota)
+		if err != nil {
+			log.Fatalf("Failed to load rate limit policy file: %v", err)
+		}
+		log.Printf("Loaded rate limit policy version %s from %s", policyWatcher.Current().Version, policyFile)
+
+		watchCtx, stopWatching := context.WithCancel(context.Background())
+		defer stopWatching()
+		go policyWatcher.Watch(watchCtx, 5*time.Second)
+
+		rateLimitConfig.Policies = policyWatcher
+	}
+
+	// RATE_LIMIT_ADAPTIVE_POLICY adjusts the refill rate of an existing policy (e.g. from the
+	// policy file) with AIMD: additive increase while p95 latency and the 5xx rate stay under
+	// target, multiplicative decrease when they exceed it. The rate is shared through Redis.
+	if adaptivePolicy := getEnv("RATE_LIMIT_ADAPTIVE_POLICY", ""); adaptivePolicy != "" {
+		targetLatency, err := time.ParseDuration(getEnv("RATE_LIMIT_ADAPTIVE_TARGET_P95", "250ms"))
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_ADAPTIVE_TARGET_P95: %v", err)
+		}
+		window, err := time.ParseDuration(getEnv("RATE_LIMIT_ADAPTIVE_WINDOW", "10s"))
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_ADAPTIVE_WINDOW: %v", err)
+		}
+		adaptive, err := bucket.NewAdaptiveRate(rateLimitBucket, &bucket.AdaptiveConfig{
+			Policy:         adaptivePolicy,
+			MinRate:        getEnvFloat("RATE_LIMIT_ADAPTIVE_MIN_RATE", 0.1),
+			MaxRate:        getEnvFloat("RATE_LIMIT_ADAPTIVE_MAX_RATE", 10),
+			IncreaseStep:   getEnvFloat("RATE_LIMIT_ADAPTIVE_STEP", 0.1),
+			DecreaseFactor: getEnvFloat("RATE_LIMIT_ADAPTIVE_FACTOR", 0.5),
+			TargetLatency:  targetLatency,
+			MaxErrorRate:   getEnvFloat("RATE_LIMIT_ADAPTIVE_MAX_ERROR_RATE", 0.01),
+			Window:         window,
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize adaptive rate limiting: %v", err)
+		}
+		defer adaptive.Close()
+		rateLimitConfig.Outcomes = adaptive
+	}
+
+	// RATE_LIMIT_PENALTY_THRESHOLD blocks clients rejected that many times within
+	// RATE_LIMIT_PENALTY_WINDOW (0 disables). Repeat offences escalate through
+	// RATE_LIMIT_PENALTY_BLOCKS; blocked clients get RATE_LIMIT_PENALTY_STATUS (429 or 403).
+	penaltyThreshold, err := strconv.ParseInt(getEnv("RATE_LIMIT_PENALTY_THRESHOLD", "0"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_PENALTY_THRESHOLD: %v", err)
+	}
+	if penaltyThreshold > 0 {
+		penaltyWindow, err := time.ParseDuration(getEnv("RATE_LIMIT_PENALTY_WINDOW", "1m"))
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_PENALTY_WINDOW: %v", err)
+		}
+		var blockDurations []time.Duration
+		for _, value := range strings.Split(getEnv("RATE_LIMIT_PENALTY_BLOCKS", "1m,10m,1h"), ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				log.Fatalf("Invalid RATE_LIMIT_PENALTY_BLOCKS: %v", err)
+			}
+			blockDurations = append(blockDurations, d)
+		}
+		blockedStatus, err := strconv.Atoi(getEnv("RATE_LIMIT_PENALTY_STATUS", "429"))
+		if err != nil || (blockedStatus != http.StatusTooManyRequests && blockedStatus != http.StatusForbidden) {
+			log.Fatalf("Invalid RATE_LIMIT_PENALTY_STATUS: must be 429 or 403")
+		}
+
+		penaltyConfig := bucket.DefaultPenaltyConfig()
+		penaltyConfig.Threshold = penaltyThreshold
+		penaltyConfig.ViolationWindow = penaltyWindow
+		penaltyConfig.BlockDurations = blockDurations
+		penalties, err := bucket.NewRedisPenaltyBoxWithClient(redisClient, penaltyConfig)
+		if err != nil {
+			log.Fatalf("Failed to initialize penalties: %v", err)
+		}
+		defer penalties.Close()
+
+		rateLimitConfig.Penalties = penalties
+		rateLimitConfig.BlockedStatus = blockedStatus
+		bucketHandler.SetPenaltyBox(penalties)
+	}
+
 	rateLimitMiddleware := middleware.NewRateLimitMiddleware(rateLimitBucket, rateLimitConfig)
 
+	// RATE_LIMIT_GRPC_CONFIG starts the Envoy rate limit service (ratelimit.v3) on
+	// RATE_LIMIT_GRPC_PORT, mapping descriptors to policies on the rate limit buckets
+	var rlsServer *grpc.Server
+	rlsAddr := ":" + getEnv("RATE_LIMIT_GRPC_PORT", "8082")
+	if rlsConfigFile := getEnv("RATE_LIMIT_GRPC_CONFIG", ""); rlsConfigFile != "" {
+		rlsConfig, err := rls.LoadConfig(rlsConfigFile)
+		if err != nil {
+			log.Fatalf("Failed to load rate limit service config: %v", err)
+		}
+		service, err := rls.NewServer(context.Background(), rateLimitBucket, rlsConfig)
+		if err != nil {
+			log.Fatalf("Failed to initialize rate limit service: %v", err)
+		}
+		rlsServer = grpc.NewServer()
+		service.Register(rlsServer)
+	}
+
+	// MAX_IN_FLIGHT_PER_CLIENT caps concurrent requests per client across all instances (0 disables)
+	maxInFlight, err := strconv.ParseInt(getEnv("MAX_IN_FLIGHT_PER_CLIENT", "0"), 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid MAX_IN_FLIGHT_PER_CLIENT: %v", err)
+	}
+	var concurrencyMiddleware *middleware.ConcurrencyLimitMiddleware
+	if maxInFlight > 0 {
+		sem, err := bucket.NewRedisSemaphoreWithClient(redisClient, &bucket.SemaphoreConfig{
+			Limit:    maxInFlight,
+			LeaseTTL: 30 * time.Second, // Slots of crashed instances free up after 30s
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize concurrency limiter: %v", err)
+		}
+		defer sem.Close()
+		concurrencyMiddleware = middleware.NewConcurrencyLimitMiddleware(sem, &middleware.ConcurrencyLimitConfig{
+			Proxies: proxies,
+		})
+	}
+
 	// Setup routes
 	r := mux.NewRouter()
 
@@ -114,6 +327,9 @@ func main() {
 	r.Use(middleware.LoggingMiddleware)
 	r.Use(middleware.CORSMiddleware)
 	r.Use(rateLimitMiddleware.Handler)
+	if concurrencyMiddleware != nil {
+		r.Use(concurrencyMiddleware.Handler)
+	}
 
 	// Token Bucket API routes (prefix with /api/bucket)
 	bucketAPI := r.PathPrefix("/api/bucket").Subrouter()
@@ -121,6 +337,42 @@ func main() {
 	bucketAPI.HandleFunc("/consume", bucketHandler.ConsumeTokens).Methods("POST")
 	bucketAPI.HandleFunc("/reset", bucketHandler.ResetBucket).Methods("POST")
 	bucketAPI.HandleFunc("/bulk-consume", bucketHandler.BulkConsume).Methods("POST")
+	bucketAPI.HandleFunc("/consume-hierarchy", bucketHandler.ConsumeHierarchy).Methods("POST")
+	if quotaHandler != nil {
+		bucketAPI.HandleFunc("/quota", quotaHandler.QuotaUsage).Methods("GET")
+	}
+
+	// Admin routes require "Authorization: Bearer $ADMIN_TOKEN" and are disabled without it.
+	// Policies are admin routes too: a policy assigned to "*" changes every client's limit.
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	policyAPI := bucketAPI.PathPrefix("/policies").Subrouter()
+	policyAPI.Use(bucketHandler.AdminAuth(adminToken))
+	policyAPI.HandleFunc("", bucketHandler.ListPolicies).Methods("GET")
+	policyAPI.HandleFunc("", bucketHandler.SetPolicy).Methods("POST", "PUT")
+	policyAPI.HandleFunc("", bucketHandler.DeletePolicy).Methods("DELETE")
+	policyAPI.HandleFunc("/assign", bucketHandler.AssignPolicy).Methods("POST")
+	policyAPI.HandleFunc("/assign", bucketHandler.UnassignPolicy).Methods("DELETE")
+
+	// Read-only view of the rate limit policy file in effect. It lists the routes, networks and
+	// identity headers that are exempt or limited differently, so it is an admin route too.
+	if policyWatcher != nil {
+		r.Handle("/api/ratelimit/policy", bucketHandler.AdminAuth(adminToken)(policyWatcher)).Methods("GET")
+	}
+
+	// Bucket administration: list, inspect, reset, export and import keys
+	adminAPI := r.PathPrefix("/api/admin/buckets").Subrouter()
+	adminAPI.Use(bucketHandler.AdminAuth(adminToken))
+	adminAPI.HandleFunc("", bucketHandler.ListBuckets).Methods("GET")
+	adminAPI.HandleFunc("/inspect", bucketHandler.InspectBucket).Methods("GET")
+	adminAPI.HandleFunc("/reset", bucketHandler.ResetBuckets).Methods("POST")
+	adminAPI.HandleFunc("/export", bucketHandler.ExportBuckets).Methods("GET")
+	adminAPI.HandleFunc("/import", bucketHandler.ImportBuckets).Methods("POST")
+
+	// Penalty blocks: list active blocks, lift one (501 unless penalties are enabled)
+	blocksAPI := r.PathPrefix("/api/admin/blocks").Subrouter()
+	blocksAPI.Use(bucketHandler.AdminAuth(adminToken))
+	blocksAPI.HandleFunc("", bucketHandler.ListBlocks).Methods("GET")
+	blocksAPI.HandleFunc("", bucketHandler.LiftBlock).Methods("DELETE")
 
 	// User Management API routes (prefix with /api/users)
 	userAPI := r.PathPrefix("/api/users").Subrouter()
@@ -142,12 +394,20 @@ func main() {
 	log.Printf("Unified server starting on port %s", port)
 	log.Println("Available endpoints:")
 	log.Println("  Token Bucket API: /api/bucket/*")
+	log.Println("  Bucket Admin API: /api/admin/buckets/*")
+	log.Println("  Blocks Admin API: /api/admin/blocks")
 	log.Println("  User Management API: /api/users/*")
 	log.Println("  Health: /health")
+	log.Println("  Metrics: /metrics")
+
+	// Serve metrics outside the router so scrapes are not rate limited
+	root := http.NewServeMux()
+	root.Handle("/metrics", metrics.Handler())
+	root.Handle("/", r)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: r,
+		Handler: root,
 	}
 
 	// Graceful shutdown
@@ -157,6 +417,19 @@ func main() {
 		}
 	}()
 
+	if rlsServer != nil {
+		listener, err := net.Listen("tcp", rlsAddr)
+		if err != nil {
+			log.Fatalf("Rate limit service failed to start: %v", err)
+		}
+		log.Printf("Envoy rate limit service (gRPC) listening on %s", rlsAddr)
+		go func() {
+			if err := rlsServer.Serve(listener); err != nil {
+				log.Fatalf("Rate limit service failed: %v", err)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -169,6 +442,9 @@ func main() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatal("Server forced to shutdown:", err)
 	}
+	if rlsServer != nil {
+		rlsServer.GracefulStop()
+	}
 
 	log.Println("Server exited")
 }
@@ -307,3 +583,15 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", key, err)
+	}
+	return f
+}
@@ -0,0 +1,495 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"monolith/internal/metrics"
+)
+
+// adaptiveLatencyBounds are the latency histogram buckets, in milliseconds, used to estimate
+// the p95 of a window. The target latency is always added as a bound, so comparing the p95
+// with the target is exact.
+var adaptiveLatencyBounds = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// adaptivePercentile is the latency percentile compared with the target
+const adaptivePercentile = 0.95
+
+// AdaptiveConfig holds configuration for additive increase / multiplicative decrease (AIMD)
+// of a policy's refill rate
+type AdaptiveConfig struct {
+	Policy         string        // Policy whose refill rate is adjusted; it must exist
+	MinRate        float64       // Lowest refill rate in tokens per second
+	MaxRate        float64       // Highest refill rate in tokens per second
+	IncreaseStep   float64       // Tokens per second added after a healthy window
+	DecreaseFactor float64       // Multiplier applied after an unhealthy window, between 0 and 1
+	TargetLatency  time.Duration // Highest healthy p95 latency
+	MaxErrorRate   float64       // Highest healthy share of 5xx responses, between 0 and 1
+	Window         time.Duration // Length of an evaluation window (default 10s)
+	MinSamples     int64         // Windows with fewer responses leave the rate alone (default 20)
+}
+
+// AdaptiveState is the shared state of an adaptive policy
+type AdaptiveState struct {
+	Policy     string   `json:"policy"`
+	Rate       float64  `json:"rate"`                  // Current refill rate in tokens per second
+	BaseRate   float64  `json:"base_rate"`             // Refill rate the policy was configured with, where the rate started
+	Window     int64    `json:"window"`                // Last evaluated window, -1 if none
+	Samples    int64    `json:"samples"`               // Responses in the last evaluated window
+	P95Millis  *float64 `json:"p95_ms"`                // Estimated p95 latency of the last window; nil above the largest bound
+	ErrorRate  float64  `json:"error_rate"`            // Share of 5xx responses in the last window
+	LastAction string   `json:"last_action,omitempty"` // increase, decrease, hold or reset
+}
+
+// Adaptive adjustments
+const (
+	AdaptiveIncrease = "increase"
+	AdaptiveDecrease = "decrease"
+	AdaptiveHold     = "hold"
+	AdaptiveReset    = "reset" // The policy was configured with a new rate, which the adaptive rate restarts from
+)
+
+// AdaptiveRate adjusts the refill rate of a policy from response latency and errors. Every
+// instance records its responses in a per-window histogram in Redis; after a window ends the
+// first instance to evaluate it applies one AIMD step to the policy for everyone. Since the
+// token bucket scripts read the refill rate from the policy, all instances converge on it.
+type AdaptiveRate struct {
+	bucket *RedisTokenBucket
+	config *AdaptiveConfig
+	bounds []float64 // Histogram bounds in milliseconds, including the target
+	script *redis.Script
+
+	mu      sync.Mutex
+	pending map[int64]*adaptiveSamples // Samples not yet sent to Redis, by window
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// adaptiveSamples counts the responses of one window on this instance
+type adaptiveSamples struct {
+	count   int64
+	errors  int64
+	buckets []int64 // One per bound, plus one for latencies above the largest bound
+}
+
+// NewAdaptiveRate starts adjusting the policy's refill rate. The policy keeps its capacity;
+// its refill rate starts where the shared state left it, or at the policy's current rate.
+// Storing the policy again, e.g. when a policy file is reloaded, is noticed within a quarter
+// window: the rate the adaptive state started from puts the adaptive rate back, and a new
+// rate resets the adaptive state to it. The bucket is not closed by Close.
+func NewAdaptiveRate(tb *RedisTokenBucket, config *AdaptiveConfig) (*AdaptiveRate, error) {
+	if config == nil {
+		return nil, fmt.Errorf("adaptive config is required")
+	}
+	if config.Policy == "" {
+		return nil, fmt.Errorf("adaptive policy is required")
+	}
+	if config.MinRate <= 0 || config.MaxRate < config.MinRate {
+		return nil, fmt.Errorf("adaptive rates must satisfy 0 < min rate <= max rate")
+	}
+	if config.IncreaseStep <= 0 {
+		return nil, fmt.Errorf("adaptive increase step must be positive")
+	}
+	if config.DecreaseFactor <= 0 || config.DecreaseFactor >= 1 {
+		return nil, fmt.Errorf("adaptive decrease factor must be between 0 and 1")
+	}
+	if config.TargetLatency <= 0 {
+		return nil, fmt.Errorf("adaptive target latency must be positive")
+	}
+	if config.MaxErrorRate < 0 || config.MaxErrorRate > 1 {
+		return nil, fmt.Errorf("adaptive max error rate must be between 0 and 1")
+	}
+	if config.Window <= 0 {
+		config.Window = 10 * time.Second
+	}
+	if config.MinSamples <= 0 {
+		config.MinSamples = 20
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := tb.GetPolicy(ctx, config.Policy); err != nil {
+		return nil, fmt.Errorf("adaptive policy %q: %w", config.Policy, err)
+	}
+
+	ar := &AdaptiveRate{
+		bucket:  tb,
+		config:  config,
+		bounds:  adaptiveBounds(config.TargetLatency),
+		script:  redis.NewScript(adaptiveAdjustScript),
+		pending: make(map[int64]*adaptiveSamples),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go ar.run()
+
+	return ar, nil
+}
+
+// adaptiveBounds returns the histogram bounds with the target latency added
+func adaptiveBounds(target time.Duration) []float64 {
+	targetMillis := float64(target) / float64(time.Millisecond)
+	bounds := []float64{targetMillis}
+	for _, bound := range adaptiveLatencyBounds {
+		if bound != targetMillis {
+			bounds = append(bounds, bound)
+		}
+	}
+	sort.Float64s(bounds)
+	return bounds
+}
+
+// Close sends the pending samples to Redis and stops adjusting the rate. The policy keeps its
+// last rate.
+func (ar *AdaptiveRate) Close() error {
+	var err error
+	ar.closeOnce.Do(func() {
+		close(ar.stop)
+		<-ar.done
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = ar.flush(ctx)
+	})
+	return err
+}
+
+// ObserveOutcome records the latency and status code of a response served under a policy.
+// Responses of other policies are ignored.
+func (ar *AdaptiveRate) ObserveOutcome(policy string, latency time.Duration, status int) {
+	if policy != ar.config.Policy {
+		return
+	}
+	ar.observe(time.Now(), latency, status)
+}
+
+// observe records one response in the window containing now
+func (ar *AdaptiveRate) observe(now time.Time, latency time.Duration, status int) {
+	window := ar.windowOf(now)
+	millis := float64(latency) / float64(time.Millisecond)
+	index := sort.SearchFloat64s(ar.bounds, millis) // First bound >= latency
+
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+
+	samples, ok := ar.pending[window]
+	if !ok {
+		samples = &adaptiveSamples{buckets: make([]int64, len(ar.bounds)+1)}
+		ar.pending[window] = samples
+	}
+	samples.count++
+	if status >= 500 {
+		samples.errors++
+	}
+	samples.buckets[index]++
+}
+
+// windowOf returns the number of the window containing t
+func (ar *AdaptiveRate) windowOf(t time.Time) int64 {
+	return t.UnixNano() / int64(ar.config.Window)
+}
+
+// run sends samples to Redis and evaluates finished windows a few times per window
+func (ar *AdaptiveRate) run() {
+	defer close(ar.done)
+
+	ticker := time.NewTicker(ar.config.Window / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ar.stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := ar.sync(ctx, time.Now()); err != nil {
+			log.Printf("Adaptive rate for policy %s: %v", ar.config.Policy, err)
+		}
+		cancel()
+	}
+}
+
+// sync sends the pending samples and evaluates the previous window once every instance has
+// had a quarter window to send its samples for it
+func (ar *AdaptiveRate) sync(ctx context.Context, now time.Time) error {
+	if err := ar.flush(ctx); err != nil {
+		return err
+	}
+
+	previous := ar.windowOf(now.Add(-ar.config.Window/4)) - 1
+	_, err := ar.evaluate(ctx, previous)
+	return err
+}
+
+// flush adds the pending samples to the shared window histograms
+func (ar *AdaptiveRate) flush(ctx context.Context) error {
+	ar.mu.Lock()
+	pending := ar.pending
+	ar.pending = make(map[int64]*adaptiveSamples)
+	ar.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	pipe := ar.bucket.client.TxPipeline()
+	for window, samples := range pending {
+		key := ar.windowKey(window)
+		pipe.HIncrBy(ctx, key, "count", samples.count)
+		if samples.errors > 0 {
+			pipe.HIncrBy(ctx, key, "errors", samples.errors)
+		}
+		for i, n := range samples.buckets {
+			if n > 0 {
+				pipe.HIncrBy(ctx, key, "b"+strconv.Itoa(i), n)
+			}
+		}
+		pipe.PExpire(ctx, key, 10*ar.config.Window)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		// Put the samples back so they are sent with the next flush
+		ar.mu.Lock()
+		for window, samples := range pending {
+			if current, ok := ar.pending[window]; ok {
+				samples.count += current.count
+				samples.errors += current.errors
+				for i := range samples.buckets {
+					samples.buckets[i] += current.buckets[i]
+				}
+			}
+			ar.pending[window] = samples
+		}
+		ar.mu.Unlock()
+		return fmt.Errorf("failed to record samples: %w", err)
+	}
+
+	return nil
+}
+
+// evaluate applies one AIMD step for a finished window, unless another instance already has.
+// It returns the state after the step.
+func (ar *AdaptiveRate) evaluate(ctx context.Context, window int64) (*AdaptiveState, error) {
+	bounds := make([]string, len(ar.bounds))
+	for i, bound := range ar.bounds {
+		bounds[i] = strconv.FormatFloat(bound, 'f', -1, 64)
+	}
+	targetMillis := float64(ar.config.TargetLatency) / float64(time.Millisecond)
+
+	result, err := runScript(ctx, ar.bucket.client, ar.script, "adaptive_adjust",
+		[]string{policiesKey, ar.stateKey(), ar.windowKey(window)},
+		ar.config.Policy,
+		window,
+		ar.config.MinRate,
+		ar.config.MaxRate,
+		ar.config.IncreaseStep,
+		ar.config.DecreaseFactor,
+		targetMillis,
+		ar.config.MaxErrorRate,
+		ar.config.MinSamples,
+		adaptivePercentile,
+		strings.Join(bounds, ","),
+	).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "policy not found") {
+			return nil, fmt.Errorf("adaptive policy %q: %w", ar.config.Policy, ErrPolicyNotFound)
+		}
+		return nil, fmt.Errorf("failed to adjust rate: %w", err)
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 8 {
+		return nil, fmt.Errorf("unexpected adjust script result: %v", result)
+	}
+
+	state := &AdaptiveState{
+		Policy:     ar.config.Policy,
+		LastAction: parseString(values[0]),
+		Rate:       parseFloat64(values[1]),
+		BaseRate:   parseFloat64(values[2]),
+		Window:     parseInt64(values[3]),
+		Samples:    parseInt64(values[4]),
+		P95Millis:  parseP95(values[5]),
+		ErrorRate:  parseFloat64(values[6]),
+	}
+	if parseInt64(values[7]) == 1 {
+		// The script rewrote the policy
+		ar.bucket.policies.invalidate()
+	}
+	metrics.AdaptiveRate.WithLabelValues(ar.config.Policy).Set(state.Rate)
+
+	return state, nil
+}
+
+// State returns the shared state of the adaptive policy
+func (ar *AdaptiveRate) State(ctx context.Context) (*AdaptiveState, error) {
+	values, err := ar.bucket.client.HGetAll(ctx, ar.stateKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get adaptive state: %w", err)
+	}
+
+	state := &AdaptiveState{Policy: ar.config.Policy, Window: -1, LastAction: values["action"]}
+	if len(values) == 0 {
+		// Nothing evaluated yet; the policy still has its configured rate
+		policy, err := ar.bucket.GetPolicy(ctx, ar.config.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("adaptive policy %q: %w", ar.config.Policy, err)
+		}
+		state.Rate = policy.RefillRate
+		state.BaseRate = policy.RefillRate
+		return state, nil
+	}
+
+	state.Rate = parseFloat64(values["rate"])
+	state.BaseRate = parseFloat64(values["base"])
+	state.Window = parseInt64(values["window"])
+	state.Samples = parseInt64(values["samples"])
+	state.P95Millis = parseP95(values["p95_ms"])
+	state.ErrorRate = parseFloat64(values["error_rate"])
+	return state, nil
+}
+
+// parseP95 parses a p95 latency from the adjust script, which is "inf" above the largest
+// histogram bound. JSON has no infinity, so that becomes nil.
+func parseP95(val interface{}) *float64 {
+	if parseString(val) == "inf" {
+		return nil
+	}
+	p95 := parseFloat64(val)
+	return &p95
+}
+
+// stateKey holds the shared rate and the outcome of the last evaluated window. Adaptive keys
+// share the policy hash tag because the adjust script also rewrites the policy.
+func (ar *AdaptiveRate) stateKey() string {
+	return "{token_bucket}:adaptive:" + ar.config.Policy
+}
+
+// windowKey holds the response histogram of one window
+func (ar *AdaptiveRate) windowKey(window int64) string {
+	return ar.stateKey() + ":" + strconv.FormatInt(window, 10)
+}
+
+// Lua script applying one AIMD step to a policy for a finished window. Each window is
+// evaluated once: the state remembers the last evaluated window.
+const adaptiveAdjustScript = `
+local policies_key = KEYS[1]
+local state_key = KEYS[2]
+local window_key = KEYS[3]
+local name = ARGV[1]
+local window = tonumber(ARGV[2])
+local min_rate = tonumber(ARGV[3])
+local max_rate = tonumber(ARGV[4])
+local step = tonumber(ARGV[5])
+local factor = tonumber(ARGV[6])
+local target = tonumber(ARGV[7])
+local max_error_rate = tonumber(ARGV[8])
+local min_samples = tonumber(ARGV[9])
+local percentile = tonumber(ARGV[10])
+
+local encoded = redis.call('HGET', policies_key, name)
+if not encoded then
+    return redis.error_reply('policy not found')
+end
+local policy = cjson.decode(encoded)
+local stored_rate = tonumber(policy.refill_rate)
+
+local function store_rate(new_rate)
+    redis.call('HSET', policies_key, name, string.format('{"name":%s,"capacity":%d,"refill_rate":%.17g}',
+        cjson.encode(name), tonumber(policy.capacity), new_rate))
+end
+
+local state = redis.call('HMGET', state_key, 'rate', 'window', 'action', 'samples', 'p95_ms', 'error_rate', 'base')
+local rate = tonumber(state[1])
+local base = tonumber(state[7])
+local last_window = tonumber(state[2]) or -1
+
+-- The policy carries the adaptive rate, so any other rate in it was stored from outside, e.g.
+-- by a policy file reload. The base rate the state started from puts the adaptive rate back;
+-- a new rate becomes the base and resets the state.
+if not rate or (stored_rate ~= rate and stored_rate ~= base) then
+    local action = 'hold'
+    if rate then
+        action = 'reset'
+    end
+    rate = math.max(min_rate, math.min(max_rate, stored_rate))
+    base = stored_rate
+    redis.call('DEL', state_key)
+    redis.call('HSET', state_key, 'rate', string.format('%.17g', rate), 'base', string.format('%.17g', base),
+        'window', last_window, 'action', action)
+    state = {nil, nil, action}
+end
+
+local changed = 0
+if rate ~= stored_rate then
+    store_rate(rate)
+    changed = 1
+end
+
+if window <= last_window then
+    return {state[3] or 'hold', string.format('%.17g', rate), string.format('%.17g', base), tostring(last_window),
+        state[4] or '0', state[5] or '0', state[6] or '0', changed}
+end
+
+local bounds = {}
+for bound in string.gmatch(ARGV[11], '[^,]+') do
+    bounds[#bounds + 1] = tonumber(bound)
+end
+
+local stats = redis.call('HGETALL', window_key)
+local counts = {}
+for i = 1, #stats, 2 do
+    counts[stats[i]] = tonumber(stats[i + 1])
+end
+local samples = counts['count'] or 0
+local errors = counts['errors'] or 0
+
+local action = 'hold'
+local p95 = 0
+local error_rate = 0
+if samples >= min_samples then
+    error_rate = errors / samples
+
+    -- The p95 is the smallest bound with at least 95% of the responses at or below it
+    p95 = 'inf'
+    local seen = 0
+    for i = 1, #bounds do
+        seen = seen + (counts['b' .. (i - 1)] or 0)
+        if seen >= percentile * samples then
+            p95 = bounds[i]
+            break
+        end
+    end
+
+    if p95 == 'inf' or p95 > target or error_rate > max_error_rate then
+        action = 'decrease'
+        rate = math.max(min_rate, rate * factor)
+    else
+        action = 'increase'
+        rate = math.min(max_rate, rate + step)
+    end
+end
+rate = math.max(min_rate, math.min(max_rate, rate))
+
+if rate ~= stored_rate then
+    store_rate(rate)
+    changed = 1
+end
+redis.call('HSET', state_key, 'rate', string.format('%.17g', rate), 'window', window, 'action', action,
+    'samples', samples, 'p95_ms', tostring(p95), 'error_rate', string.format('%.17g', error_rate))
+
+return {action, string.format('%.17g', rate), string.format('%.17g', base), tostring(window), tostring(samples),
+    tostring(p95), string.format('%.17g', error_rate), changed}
+`
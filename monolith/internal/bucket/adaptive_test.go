@@ -0,0 +1,249 @@
+package bucket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// createTestAdaptiveRate stores a fresh policy and returns an adaptive rate for it that only
+// moves when the test evaluates a window
+func createTestAdaptiveRate(t *testing.T, tb *RedisTokenBucket, policy string) *AdaptiveRate {
+	ctx := context.Background()
+	if err := tb.SetPolicy(ctx, &Policy{Name: policy, Capacity: 10, RefillRate: 5}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+
+	config := &AdaptiveConfig{
+		Policy:         policy,
+		MinRate:        1,
+		MaxRate:        8,
+		IncreaseStep:   1,
+		DecreaseFactor: 0.5,
+		TargetLatency:  100 * time.Millisecond,
+		MaxErrorRate:   0.05,
+		Window:         time.Hour, // Longer than the test, so the background loop stays idle
+		MinSamples:     10,
+	}
+	ar, err := NewAdaptiveRate(tb, config)
+	if err != nil {
+		t.Fatalf("NewAdaptiveRate failed: %v", err)
+	}
+	tb.client.Del(ctx, ar.stateKey())
+
+	return ar
+}
+
+// observeWindow records responses in a window and sends them to Redis
+func observeWindow(t *testing.T, ar *AdaptiveRate, window int64, fast int, slow int, failed int) {
+	at := time.Unix(0, window*int64(ar.config.Window))
+	for i := 0; i < fast; i++ {
+		ar.observe(at, 20*time.Millisecond, http.StatusOK)
+	}
+	for i := 0; i < slow; i++ {
+		ar.observe(at, 150*time.Millisecond, http.StatusOK)
+	}
+	for i := 0; i < failed; i++ {
+		ar.observe(at, 20*time.Millisecond, http.StatusBadGateway)
+	}
+	if err := ar.flush(context.Background()); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+}
+
+func TestAdaptiveRate_AIMD(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	ar := createTestAdaptiveRate(t, tb, "adaptive_aimd")
+	defer ar.Close()
+
+	ctx := context.Background()
+	window := ar.windowOf(time.Now())
+	for w := window; w < window+5; w++ {
+		tb.client.Del(ctx, ar.windowKey(w))
+	}
+
+	steps := []struct {
+		name               string
+		fast, slow, failed int
+		action             string
+		rate               float64
+	}{
+		{"healthy window increases additively", 20, 0, 0, AdaptiveIncrease, 6},
+		{"slow p95 decreases multiplicatively", 18, 2, 0, AdaptiveDecrease, 3},
+		{"errors decrease multiplicatively", 17, 0, 3, AdaptiveDecrease, 1.5},
+		{"too few samples hold", 5, 0, 0, AdaptiveHold, 1.5},
+		{"the minimum rate is a floor", 0, 20, 0, AdaptiveDecrease, 1},
+	}
+
+	for i, step := range steps {
+		observeWindow(t, ar, window+int64(i), step.fast, step.slow, step.failed)
+		state, err := ar.evaluate(ctx, window+int64(i))
+		if err != nil {
+			t.Fatalf("%s: evaluate failed: %v", step.name, err)
+		}
+		if state.LastAction != step.action || state.Rate != step.rate {
+			t.Errorf("%s: expected %s to %v, got %s to %v", step.name, step.action, step.rate, state.LastAction, state.Rate)
+		}
+
+		policy, err := tb.GetPolicy(ctx, "adaptive_aimd")
+		if err != nil || policy.RefillRate != step.rate || policy.Capacity != 10 {
+			t.Errorf("%s: expected the policy to carry rate %v, got %+v (%v)", step.name, step.rate, policy, err)
+		}
+	}
+
+	// A window is only evaluated once
+	state, err := ar.evaluate(ctx, window)
+	if err != nil || state.Rate != 1 || state.Window != window+4 {
+		t.Errorf("Expected an old window to leave the rate alone, got %+v (%v)", state, err)
+	}
+
+	// Buckets under the policy refill at the adjusted rate
+	tb.AssignPolicy(ctx, "adaptive_aimd_key", "adaptive_aimd")
+	result, err := tb.TakeTokens(ctx, "adaptive_aimd_key", 1)
+	if err != nil || result.RefillRate != 1 {
+		t.Errorf("Expected the bucket to use the adjusted refill rate, got %+v (%v)", result, err)
+	}
+}
+
+func TestAdaptiveRate_InstancesShareWindows(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	first := createTestAdaptiveRate(t, tb, "adaptive_shared")
+	defer first.Close()
+	second, err := NewAdaptiveRate(tb, first.config)
+	if err != nil {
+		t.Fatalf("NewAdaptiveRate failed: %v", err)
+	}
+	defer second.Close()
+
+	ctx := context.Background()
+	window := first.windowOf(time.Now())
+	tb.client.Del(ctx, first.windowKey(window))
+
+	// Neither instance is slow on its own terms, but together 10% of responses are slow
+	observeWindow(t, first, window, 19, 1, 0)
+	observeWindow(t, second, window, 17, 3, 0)
+
+	state, err := first.evaluate(ctx, window)
+	if err != nil || state.LastAction != AdaptiveDecrease || state.Samples != 40 {
+		t.Fatalf("Expected one decrease over 40 samples, got %+v (%v)", state, err)
+	}
+
+	// The second instance sees the step already taken
+	state, err = second.evaluate(ctx, window)
+	if err != nil || state.Rate != 2.5 {
+		t.Errorf("Expected the rate to be halved once, got %+v (%v)", state, err)
+	}
+
+	state, err = second.State(ctx)
+	if err != nil || state.Rate != 2.5 || state.Window != window {
+		t.Errorf("Expected the shared state to show the step, got %+v (%v)", state, err)
+	}
+}
+
+func TestAdaptiveRate_PolicyStoredAgain(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	ar := createTestAdaptiveRate(t, tb, "adaptive_reload")
+	defer ar.Close()
+
+	ctx := context.Background()
+	window := ar.windowOf(time.Now())
+	for w := window; w < window+2; w++ {
+		tb.client.Del(ctx, ar.windowKey(w))
+	}
+
+	observeWindow(t, ar, window, 20, 0, 0)
+	if state, err := ar.evaluate(ctx, window); err != nil || state.Rate != 6 || state.BaseRate != 5 {
+		t.Fatalf("Expected an increase from 5 to 6, got %+v (%v)", state, err)
+	}
+
+	// A reload of the same file puts the adaptive rate back
+	tb.SetPolicy(ctx, &Policy{Name: "adaptive_reload", Capacity: 10, RefillRate: 5})
+	state, err := ar.evaluate(ctx, window)
+	if err != nil || state.Rate != 6 {
+		t.Errorf("Expected the adaptive rate to survive an unchanged policy, got %+v (%v)", state, err)
+	}
+	if policy, err := tb.GetPolicy(ctx, "adaptive_reload"); err != nil || policy.RefillRate != 6 {
+		t.Errorf("Expected the policy to carry the adaptive rate again, got %+v (%v)", policy, err)
+	}
+
+	// A new configured rate resets the state to it
+	tb.SetPolicy(ctx, &Policy{Name: "adaptive_reload", Capacity: 10, RefillRate: 2})
+	state, err = ar.evaluate(ctx, window)
+	if err != nil || state.LastAction != AdaptiveReset || state.Rate != 2 || state.BaseRate != 2 || state.Samples != 0 {
+		t.Errorf("Expected a reset to the new rate, got %+v (%v)", state, err)
+	}
+
+	observeWindow(t, ar, window+1, 20, 0, 0)
+	if state, err := ar.evaluate(ctx, window+1); err != nil || state.Rate != 3 {
+		t.Errorf("Expected the next step to start from the new rate, got %+v (%v)", state, err)
+	}
+}
+
+func TestAdaptiveRate_P95AboveBounds(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	ar := createTestAdaptiveRate(t, tb, "adaptive_slow")
+	defer ar.Close()
+
+	ctx := context.Background()
+	window := ar.windowOf(time.Now())
+	tb.client.Del(ctx, ar.windowKey(window))
+
+	at := time.Unix(0, window*int64(ar.config.Window))
+	for i := 0; i < 10; i++ {
+		ar.observe(at, time.Minute, http.StatusOK)
+	}
+	if err := ar.flush(ctx); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	state, err := ar.evaluate(ctx, window)
+	if err != nil || state.LastAction != AdaptiveDecrease || state.P95Millis != nil {
+		t.Fatalf("Expected a decrease with an unknown p95, got %+v (%v)", state, err)
+	}
+	if _, err := json.Marshal(state); err != nil {
+		t.Errorf("Expected the state to encode as JSON: %v", err)
+	}
+
+	state, err = ar.State(ctx)
+	if err != nil || state.P95Millis != nil {
+		t.Errorf("Expected the stored state to have an unknown p95, got %+v (%v)", state, err)
+	}
+}
+
+func TestAdaptiveRate_Validation(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	valid := AdaptiveConfig{Policy: "adaptive_missing", MinRate: 1, MaxRate: 10, IncreaseStep: 1,
+		DecreaseFactor: 0.5, TargetLatency: time.Second, MaxErrorRate: 0.01}
+
+	invalid := []func(c *AdaptiveConfig){
+		func(c *AdaptiveConfig) { c.Policy = "" },
+		func(c *AdaptiveConfig) { c.MaxRate = 0.5 },
+		func(c *AdaptiveConfig) { c.DecreaseFactor = 1 },
+		func(c *AdaptiveConfig) { c.TargetLatency = 0 },
+		func(c *AdaptiveConfig) { c.MaxErrorRate = 2 },
+	}
+	for i, change := range invalid {
+		config := valid
+		change(&config)
+		if _, err := NewAdaptiveRate(tb, &config); err == nil {
+			t.Errorf("Case %d: expected an invalid config to fail", i+1)
+		}
+	}
+
+	tb.DeletePolicy(context.Background(), "adaptive_missing")
+	if _, err := NewAdaptiveRate(tb, &valid); err == nil {
+		t.Error("Expected a missing policy to fail")
+	}
+}
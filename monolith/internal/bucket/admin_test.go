@@ -0,0 +1,290 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// createTestAdmin returns a token bucket and a sliding window sharing one client on an empty
+// database, so scans only see the keys a test creates
+func createTestAdmin(t *testing.T) (*RedisTokenBucket, *RedisSlidingWindow) {
+	tb, err := NewRedisTokenBucket(&Config{
+		RedisAddr:  "localhost:6379",
+		RedisDB:    8, // Use different DB for admin tests
+		Capacity:   10,
+		RefillRate: 1.0,
+		TTL:        1 * time.Minute,
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	t.Cleanup(func() { tb.Close() })
+
+	sw, err := NewRedisSlidingWindowWithClient(tb.client, &SlidingWindowConfig{
+		WindowSize:  time.Minute,
+		MaxRequests: 10,
+		TTL:         time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create sliding window: %v", err)
+	}
+
+	if err := tb.client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("Failed to flush test DB: %v", err)
+	}
+
+	return tb, sw
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"", "anything", true},
+		{"*", "anything", true},
+		{"user:*", "user:42", true},
+		{"user:*", "org:42", false},
+		{"user:?", "user:7", true},
+		{"user:?", "user:42", false},
+		{"*:user:*", "{org:42}:user:7", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxbyy", false},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+	}
+
+	for _, test := range tests {
+		if got := matchPattern(test.pattern, test.key); got != test.match {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", test.pattern, test.key, got, test.match)
+		}
+	}
+}
+
+func TestLimiterKey(t *testing.T) {
+	keys := []string{"user:42", "{org:42}:user:7", "api_rate_limit:ip:10.0.0.1"}
+
+	for _, key := range keys {
+		if got := limiterKey(NamespaceTokenBucket, hashTagKey(NamespaceTokenBucket, key)); got != key {
+			t.Errorf("Expected %q to round trip, got %q", key, got)
+		}
+	}
+}
+
+func TestKeyAdmin_ListAndInspect(t *testing.T) {
+	tb, sw := createTestAdmin(t)
+	admin := tb.Admin()
+	ctx := context.Background()
+
+	for i := 0; i < 25; i++ {
+		tb.TakeTokens(ctx, fmt.Sprintf("user:%d", i), 1)
+	}
+	tb.TakeTokens(ctx, "org:1", 3)
+	sw.IsAllowedN(ctx, "user:0", 4)
+
+	// Page through the token buckets of users with a small page size
+	seen := make(map[string]bool)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("Listing did not finish")
+		}
+		page, err := admin.List(ctx, KeyFilter{Namespace: NamespaceTokenBucket, Pattern: "user:*"}, cursor, 5)
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		for _, info := range page.Keys {
+			if info.Namespace != NamespaceTokenBucket || info.Tokens == nil || *info.Tokens != 9 {
+				t.Errorf("Unexpected key state %+v", info)
+			}
+			seen[info.Key] = true
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(seen) != 25 || !seen["user:0"] || seen["org:1"] {
+		t.Errorf("Expected the 25 user buckets, got %d keys", len(seen))
+	}
+
+	info, err := admin.Inspect(ctx, NamespaceTokenBucket, "org:1")
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if *info.Tokens != 7 || *info.Capacity != 10 || info.TTL <= 0 || info.LastRefill.IsZero() {
+		t.Errorf("Unexpected bucket state %+v", info)
+	}
+
+	info, err = admin.Inspect(ctx, NamespaceSlidingWindow, "user:0")
+	if err != nil {
+		t.Fatalf("Inspect failed: %v", err)
+	}
+	if info.Entries == nil || *info.Entries != 4 {
+		t.Errorf("Expected 4 window entries, got %+v", info)
+	}
+
+	if _, err := admin.Inspect(ctx, NamespaceTokenBucket, "missing"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := admin.List(ctx, KeyFilter{Namespace: "bogus"}, "", 10); err == nil {
+		t.Error("Expected an unknown namespace to be rejected")
+	}
+}
+
+func TestKeyAdmin_DeleteByPattern(t *testing.T) {
+	tb, sw := createTestAdmin(t)
+	admin := tb.Admin()
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		tb.TakeTokens(ctx, fmt.Sprintf("tenant:a:%d", i), 10)
+		tb.TakeTokens(ctx, fmt.Sprintf("tenant:b:%d", i), 10)
+	}
+	sw.IsAllowed(ctx, "tenant:a:0")
+
+	deleted, err := admin.Delete(ctx, KeyFilter{Pattern: "tenant:a:*"})
+	if err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if deleted != 11 {
+		t.Errorf("Expected 10 buckets and 1 window deleted, got %d", deleted)
+	}
+
+	// Deleted buckets start full again; others are untouched
+	if result, _ := tb.TakeTokens(ctx, "tenant:a:3", 10); !result.Allowed {
+		t.Error("Expected the deleted bucket to be full")
+	}
+	if result, _ := tb.TakeTokens(ctx, "tenant:b:3", 10); result.Allowed {
+		t.Error("Expected the other tenant's bucket to stay empty")
+	}
+}
+
+func TestKeyAdmin_ExportImport(t *testing.T) {
+	tb, sw := createTestAdmin(t)
+	admin := tb.Admin()
+	ctx := context.Background()
+
+	tb.TakeTokens(ctx, "migrate:1", 6)
+	tb.TakeTokens(ctx, "{org:7}:user:1", 2)
+	sw.IsAllowedN(ctx, "migrate:1", 3)
+
+	exports, err := admin.Export(ctx, KeyFilter{})
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	if len(exports) != 3 {
+		t.Fatalf("Expected 3 exported keys, got %d", len(exports))
+	}
+
+	// Simulate moving to a fresh Redis
+	if err := tb.client.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	imported, err := admin.Import(ctx, exports)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if imported != 3 {
+		t.Errorf("Expected 3 imported keys, got %d", imported)
+	}
+
+	info, err := admin.Inspect(ctx, NamespaceTokenBucket, "{org:7}:user:1")
+	if err != nil || *info.Tokens != 8 || info.TTL <= 0 {
+		t.Errorf("Expected the hash-tagged bucket to be restored with its TTL, got %+v (%v)", info, err)
+	}
+	if result, _ := tb.TakeTokens(ctx, "migrate:1", 5); result.Allowed {
+		t.Error("Expected the imported bucket to keep its used tokens")
+	}
+	if state, _ := sw.GetWindowState(ctx, "migrate:1"); state.CurrentCount != 3 {
+		t.Errorf("Expected 3 imported window entries, got %d", state.CurrentCount)
+	}
+
+	if _, err := admin.Import(ctx, []*KeyExport{{Namespace: "bogus", Key: "x"}}); err == nil {
+		t.Error("Expected an unknown namespace to be rejected")
+	}
+}
+
+func TestKeyAdmin_ImportValidatesState(t *testing.T) {
+	tb, _ := createTestAdmin(t)
+	admin := tb.Admin()
+	ctx := context.Background()
+
+	bucketState := func(tokens, capacity, refillRate string) *KeyExport {
+		return &KeyExport{Namespace: NamespaceTokenBucket, Key: "import:invalid", TTL: 60000, Fields: map[string]string{
+			"tokens": tokens, "last_refill": "1700000000.5", "capacity": capacity, "refill_rate": refillRate,
+		}}
+	}
+	missingField := bucketState("5", "10", "1")
+	delete(missingField.Fields, "last_refill")
+
+	testCases := []struct {
+		name   string
+		export *KeyExport
+	}{
+		{"tokens above capacity", bucketState("11", "10", "1")},
+		{"zero refill rate", bucketState("5", "10", "0")},
+		{"zero capacity", bucketState("0", "0", "1")},
+		{"non-numeric tokens", bucketState("lots", "10", "1")},
+		{"NaN refill rate", bucketState("5", "10", "NaN")},
+		{"missing field", missingField},
+		{"entries on a bucket", &KeyExport{Namespace: NamespaceTokenBucket, Key: "import:invalid", TTL: -1,
+			Entries: []SlidingWindowLog{{Member: "a", Timestamp: 1}}}},
+		{"entry without timestamp", &KeyExport{Namespace: NamespaceSlidingWindow, Key: "import:invalid", TTL: -1,
+			Entries: []SlidingWindowLog{{Member: "a"}}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			valid := bucketState("5", "10", "1")
+			valid.Key = "import:valid"
+			if imported, err := admin.Import(ctx, []*KeyExport{valid, tc.export}); err == nil || imported != 0 {
+				t.Errorf("Expected the batch to be rejected, got %d imported (%v)", imported, err)
+			}
+		})
+	}
+
+	if exists := tb.client.Exists(ctx, tb.keyName("import:valid")).Val(); exists != 0 {
+		t.Error("Expected nothing to be written from a rejected import")
+	}
+	if imported, err := admin.Import(ctx, []*KeyExport{bucketState("10", "10", "0.5")}); err != nil || imported != 1 {
+		t.Errorf("Expected a full bucket to be imported, got %d (%v)", imported, err)
+	}
+	if imported, err := admin.Import(ctx, []*KeyExport{bucketState("-1", "10", "1")}); err != nil || imported != 1 {
+		t.Errorf("Expected a bucket in debt to be imported, got %d (%v)", imported, err)
+	}
+}
+
+func TestKeyAdmin_ExportImportDebt(t *testing.T) {
+	tb, _ := createTestAdmin(t)
+	admin := tb.Admin()
+	ctx := context.Background()
+
+	// Reserving more than is left puts the bucket into debt
+	tb.TakeTokens(ctx, "debt:1", 8)
+	if r, err := tb.Reserve(ctx, "debt:1", 10); err != nil || !r.OK() {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	exports, err := admin.Export(ctx, KeyFilter{Pattern: "debt:*"})
+	if err != nil || len(exports) != 1 {
+		t.Fatalf("Expected 1 exported key, got %d (%v)", len(exports), err)
+	}
+
+	if err := tb.client.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+
+	if imported, err := admin.Import(ctx, exports); err != nil || imported != 1 {
+		t.Fatalf("Expected the bucket in debt to be imported, got %d (%v)", imported, err)
+	}
+	info, err := admin.Inspect(ctx, NamespaceTokenBucket, "debt:1")
+	if err != nil || *info.Tokens >= 0 {
+		t.Errorf("Expected the imported bucket to stay in debt, got %+v (%v)", info, err)
+	}
+}
@@ -0,0 +1,151 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrConflictingPolicies is returned when items of a batch use the same key with different
+// policies, since a bucket can only have one capacity and refill rate
+var ErrConflictingPolicies = errors.New("items for the same key use different policies")
+
+// BatchLimiter is implemented by limiters that can consume from many keys in one round trip
+type BatchLimiter interface {
+	// TakeTokensBatch consumes tokens for every item. An atomic batch consumes for every item
+	// or for none of them; otherwise each item is decided on its own.
+	TakeTokensBatch(ctx context.Context, items []BatchItem, atomic bool) (*BatchResult, error)
+}
+
+// BatchItem is one consumption in a batch
+type BatchItem struct {
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+	Policy string  `json:"policy,omitempty"` // Named policy to use instead of the one assigned to the key
+}
+
+// BatchItemResult represents the outcome of one item in a batch
+type BatchItemResult struct {
+	Key             string  `json:"key"`
+	Tokens          float64 `json:"tokens"`
+	Allowed         bool    `json:"allowed"`
+	RemainingTokens float64 `json:"remaining_tokens"`
+	RetryAfter      float64 `json:"retry_after_seconds,omitempty"`
+	Capacity        int64   `json:"capacity"`
+	RefillRate      float64 `json:"refill_rate"`
+	Policy          string  `json:"policy,omitempty"`
+}
+
+// BatchResult represents the result of a batch consumption
+type BatchResult struct {
+	Allowed     bool              `json:"allowed"` // Every item was allowed
+	Atomic      bool              `json:"atomic"`
+	DeniedIndex int               `json:"denied_index"` // Index into Items of the first denied item, -1 if none
+	Items       []BatchItemResult `json:"items"`
+}
+
+var _ BatchLimiter = (*RedisTokenBucket)(nil)
+
+// TakeTokensBatch consumes tokens for a batch of keys with a single script call. Items are
+// evaluated in order, so several items for the same key draw from the same bucket. Each item
+// uses its named policy if given, otherwise the policy assigned to its key.
+//
+// Items for the same key must name the same policy, or none. When atomic is set, nothing is
+// deducted unless every item is allowed; Allowed on each item then reports whether it would
+// have passed. On Redis Cluster the keys of a batch must share a hash tag, as with
+// TakeTokensMulti; otherwise ErrCrossSlot is returned.
+func (tb *RedisTokenBucket) TakeTokensBatch(ctx context.Context, items []BatchItem, atomic bool) (*BatchResult, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("at least one item is required")
+	}
+
+	scriptKeys := make([]string, 0, len(items)+len(policyKeys))
+	args := make([]interface{}, 0, 2+5*len(items))
+	args = append(args, atomic, tb.config.TTL.Seconds())
+	policies := make(map[string]string, len(items))
+	for i, item := range items {
+		if item.Key == "" {
+			return nil, fmt.Errorf("item %d: key is required", i)
+		}
+		if item.Tokens <= 0 {
+			return nil, fmt.Errorf("item %d: tokens must be positive", i)
+		}
+		if policy, seen := policies[item.Key]; seen && policy != item.Policy {
+			return nil, fmt.Errorf("item %d: %w: key %q with policy %q and %q", i, ErrConflictingPolicies, item.Key, policy, item.Policy)
+		}
+		policies[item.Key] = item.Policy
+
+		mode, policyArg, capacity, refillRate, err := tb.batchPolicyArgs(ctx, item)
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+
+		scriptKeys = append(scriptKeys, tb.keyName(item.Key))
+		args = append(args, item.Tokens, mode, policyArg, capacity, refillRate)
+	}
+	if tb.cluster {
+		if err := checkSameSlot(scriptKeys); err != nil {
+			return nil, err
+		}
+	} else {
+		scriptKeys = append(scriptKeys, policyKeys...)
+	}
+
+	result, err := runScript(ctx, tb.client, tb.luaScripts["take_tokens_batch"], "take_tokens_batch", scriptKeys, args...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take tokens: %w", err)
+	}
+
+	values := result.([]interface{})
+	deniedIndex := int(parseInt64(values[0])) - 1 // The script numbers items from 1
+	if deniedIndex < -1 {
+		// A named policy does not exist
+		return nil, fmt.Errorf("item %d: %w", -deniedIndex-2, ErrPolicyNotFound)
+	}
+
+	batchResult := &BatchResult{
+		Allowed:     deniedIndex < 0,
+		Atomic:      atomic,
+		DeniedIndex: deniedIndex,
+		Items:       make([]BatchItemResult, 0, len(items)),
+	}
+
+	for i, value := range values[1:] {
+		item := value.([]interface{})
+		itemResult := BatchItemResult{
+			Key:             items[i].Key,
+			Tokens:          items[i].Tokens,
+			Allowed:         parseInt64(item[0]) == 1,
+			RemainingTokens: parseFloat64(item[1]),
+			Capacity:        parseInt64(item[3]),
+			RefillRate:      parseFloat64(item[4]),
+			Policy:          parseString(item[5]),
+		}
+		if !itemResult.Allowed {
+			itemResult.RetryAfter = parseFloat64(item[2])
+		}
+
+		batchResult.Items = append(batchResult.Items, itemResult)
+	}
+
+	return batchResult, nil
+}
+
+// batchPolicyArgs returns the policy arguments of a batch item. Items without a named policy
+// resolve it from their key like the other scripts; named policies are looked up by the script,
+// or here in cluster mode.
+func (tb *RedisTokenBucket) batchPolicyArgs(ctx context.Context, item BatchItem) (string, string, int64, float64, error) {
+	if item.Policy == "" {
+		policyArg, capacity, refillRate, err := tb.policyArgs(ctx, item.Key)
+		return "key", policyArg, capacity, refillRate, err
+	}
+	if !tb.cluster {
+		return "policy", item.Policy, 0, 0, nil
+	}
+
+	policy, err := tb.cachedPolicy(ctx, item.Policy)
+	if err != nil {
+		return "", "", 0, 0, err
+	}
+	return "policy", policy.Name, policy.Capacity, policy.RefillRate, nil
+}
@@ -0,0 +1,168 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestTakeTokensBatch_ItemsAreIndependent(t *testing.T) {
+	tb := createTestBucket(t, 5, 0.001) // Practically no refill during the test
+	defer tb.Close()
+
+	ctx := context.Background()
+	for _, key := range []string{"batch:a", "batch:b"} {
+		tb.ResetBucket(ctx, key)
+	}
+
+	result, err := tb.TakeTokensBatch(ctx, []BatchItem{
+		{Key: "batch:a", Tokens: 3},
+		{Key: "batch:a", Tokens: 3}, // Draws from what the first item left
+		{Key: "batch:b", Tokens: 2},
+	}, false)
+	if err != nil {
+		t.Fatalf("TakeTokensBatch failed: %v", err)
+	}
+
+	if result.Allowed || result.DeniedIndex != 1 {
+		t.Errorf("Expected the second item to be the first denial, got %+v", result)
+	}
+	expected := []struct {
+		allowed   bool
+		remaining float64
+	}{{true, 2}, {false, 2}, {true, 3}}
+	for i, item := range result.Items {
+		if item.Allowed != expected[i].allowed || math.Abs(item.RemainingTokens-expected[i].remaining) > 0.01 {
+			t.Errorf("Item %d: expected allowed=%v with %.0f left, got %+v", i, expected[i].allowed, expected[i].remaining, item)
+		}
+	}
+	if result.Items[1].RetryAfter <= 0 {
+		t.Error("Expected RetryAfter on the denied item")
+	}
+
+	// Allowed items were charged despite the denial
+	state, err := tb.GetBucketState(ctx, "batch:b")
+	if err != nil || math.Abs(state.CurrentTokens-3) > 0.01 {
+		t.Errorf("Expected batch:b to keep 3 tokens, got %+v (%v)", state, err)
+	}
+}
+
+func TestTakeTokensBatch_AtomicDeductsNothingOnDenial(t *testing.T) {
+	tb := createTestBucket(t, 5, 0.001)
+	defer tb.Close()
+
+	ctx := context.Background()
+	for _, key := range []string{"batch:a", "batch:b"} {
+		tb.ResetBucket(ctx, key)
+	}
+
+	items := []BatchItem{{Key: "batch:a", Tokens: 2}, {Key: "batch:b", Tokens: 6}}
+	result, err := tb.TakeTokensBatch(ctx, items, true)
+	if err != nil {
+		t.Fatalf("TakeTokensBatch failed: %v", err)
+	}
+	if result.Allowed || !result.Atomic || result.DeniedIndex != 1 {
+		t.Fatalf("Expected the atomic batch to be denied at item 1, got %+v", result)
+	}
+	if !result.Items[0].Allowed || math.Abs(result.Items[0].RemainingTokens-5) > 0.01 {
+		t.Errorf("Expected item 0 to pass on its own without being charged, got %+v", result.Items[0])
+	}
+
+	state, err := tb.GetBucketState(ctx, "batch:a")
+	if err != nil || math.Abs(state.CurrentTokens-5) > 0.01 {
+		t.Errorf("Expected batch:a to stay full, got %+v (%v)", state, err)
+	}
+
+	items[1].Tokens = 5
+	result, err = tb.TakeTokensBatch(ctx, items, true)
+	if err != nil || !result.Allowed || result.DeniedIndex != -1 {
+		t.Fatalf("Expected the atomic batch to pass, got %+v (%v)", result, err)
+	}
+	if math.Abs(result.Items[0].RemainingTokens-3) > 0.01 || math.Abs(result.Items[1].RemainingTokens) > 0.01 {
+		t.Errorf("Expected both items to be charged, got %+v", result.Items)
+	}
+}
+
+func TestTakeTokensBatch_NamedPolicy(t *testing.T) {
+	tb := createTestBucket(t, 5, 0.001)
+	defer tb.Close()
+
+	ctx := context.Background()
+	if err := tb.SetPolicy(ctx, &Policy{Name: "batch_premium", Capacity: 50, RefillRate: 0.001}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	defer tb.DeletePolicy(ctx, "batch_premium")
+	tb.client.Del(ctx, tb.keyName("batch:premium"))
+
+	result, err := tb.TakeTokensBatch(ctx, []BatchItem{{Key: "batch:premium", Tokens: 20, Policy: "batch_premium"}}, false)
+	if err != nil {
+		t.Fatalf("TakeTokensBatch failed: %v", err)
+	}
+	item := result.Items[0]
+	if !item.Allowed || item.Capacity != 50 || item.Policy != "batch_premium" || math.Abs(item.RemainingTokens-30) > 0.01 {
+		t.Errorf("Expected 20 of 50 tokens taken under batch_premium, got %+v", item)
+	}
+
+	_, err = tb.TakeTokensBatch(ctx, []BatchItem{{Key: "batch:a", Tokens: 1}, {Key: "batch:b", Tokens: 1, Policy: "batch_missing"}}, false)
+	if !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("Expected ErrPolicyNotFound, got %v", err)
+	}
+
+	if _, err := tb.TakeTokensBatch(ctx, []BatchItem{{Key: "batch:a", Tokens: 0}}, false); err == nil {
+		t.Error("Expected zero tokens to be rejected")
+	}
+}
+
+func TestTakeTokensBatch_ConflictingPolicies(t *testing.T) {
+	tb := createTestBucket(t, 5, 0.001)
+	defer tb.Close()
+
+	ctx := context.Background()
+	if err := tb.SetPolicy(ctx, &Policy{Name: "batch_premium", Capacity: 50, RefillRate: 0.001}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	defer tb.DeletePolicy(ctx, "batch_premium")
+	tb.client.Del(ctx, tb.keyName("batch:conflict"))
+
+	_, err := tb.TakeTokensBatch(ctx, []BatchItem{
+		{Key: "batch:conflict", Tokens: 1},
+		{Key: "batch:conflict", Tokens: 1, Policy: "batch_premium"},
+	}, false)
+	if !errors.Is(err, ErrConflictingPolicies) {
+		t.Errorf("Expected ErrConflictingPolicies, got %v", err)
+	}
+	if exists := tb.client.Exists(ctx, tb.keyName("batch:conflict")).Val(); exists != 0 {
+		t.Error("Expected a rejected batch to leave the bucket untouched")
+	}
+
+	// The same policy twice is fine
+	result, err := tb.TakeTokensBatch(ctx, []BatchItem{
+		{Key: "batch:conflict", Tokens: 1, Policy: "batch_premium"},
+		{Key: "batch:conflict", Tokens: 1, Policy: "batch_premium"},
+	}, false)
+	if err != nil || !result.Allowed || result.Items[1].Capacity != 50 {
+		t.Errorf("Expected both items under batch_premium, got %+v (%v)", result, err)
+	}
+}
+
+func TestTakeTokensBatch_ClusterRequiresSharedHashTag(t *testing.T) {
+	tb := createTestBucket(t, 5, 0.001)
+	defer tb.Close()
+
+	// Check the keys as a cluster client would
+	tb.cluster = true
+
+	ctx := context.Background()
+	_, err := tb.TakeTokensBatch(ctx, []BatchItem{{Key: "batch:a", Tokens: 1}, {Key: "batch:b", Tokens: 1}}, false)
+	if !errors.Is(err, ErrCrossSlot) {
+		t.Errorf("Expected ErrCrossSlot, got %v", err)
+	}
+
+	tb.ResetBucket(ctx, "{batch:org}:a")
+	tb.ResetBucket(ctx, "{batch:org}:b")
+	result, err := tb.TakeTokensBatch(ctx, []BatchItem{{Key: "{batch:org}:a", Tokens: 1}, {Key: "{batch:org}:b", Tokens: 1}}, true)
+	if err != nil || !result.Allowed {
+		t.Errorf("Expected keys with a shared hash tag to be consumed, got %+v (%v)", result, err)
+	}
+}
@@ -11,12 +11,14 @@ import (
 
 // Config holds the configuration for the Redis token bucket
 type Config struct {
-	RedisAddr     string
-	RedisPassword string
-	RedisDB       int
-	Capacity      int64         // Maximum tokens in bucket
-	RefillRate    float64       // Tokens per second
-	TTL           time.Duration // Time to live for bucket keys
+	RedisAddr       string
+	RedisAddrs      []string // Cluster or Sentinel addresses; overrides RedisAddr when set
+	RedisMasterName string   // Sentinel master name
+	RedisPassword   string
+	RedisDB         int
+	Capacity        int64         // Maximum tokens in bucket
+	RefillRate      float64       // Tokens per second
+	TTL             time.Duration // Time to live for bucket keys
 }
 
 // DefaultConfig returns a sensible default configuration
@@ -33,7 +35,10 @@ func DefaultConfig() *Config {
 
 // RedisTokenBucket implements a token bucket rate limiter using Redis
 type RedisTokenBucket struct {
-	client     *redis.Client
+	client     redis.UniversalClient
+	ownsClient bool // Close only closes clients created by the constructor
+	cluster    bool // Policies are resolved client-side because their keys live in another slot
+	policies   *policyCache
 	config     *Config
 	luaScripts map[string]*redis.Script
 }
@@ -46,6 +51,7 @@ type BucketState struct {
 	RefillRate     float64   `json:"refill_rate"`
 	LastRefillTime time.Time `json:"last_refill_time"`
 	TTL            int64     `json:"ttl_seconds"`
+	Policy         string    `json:"policy,omitempty"`
 }
 
 // TokenResult represents the result of a token consumption attempt
@@ -53,6 +59,9 @@ type TokenResult struct {
 	Allowed         bool    `json:"allowed"`
 	RemainingTokens float64 `json:"remaining_tokens"`
 	RetryAfter      float64 `json:"retry_after_seconds,omitempty"`
+	Capacity        int64   `json:"capacity"`
+	RefillRate      float64 `json:"refill_rate"`
+	Policy          string  `json:"policy,omitempty"`
 }
 
 // NewRedisTokenBucket creates a new Redis-backed token bucket
@@ -62,22 +71,36 @@ func NewRedisTokenBucket(config *Config) (*RedisTokenBucket, error) {
 	}
 
 	// Create Redis client
-	client := redis.NewClient(&redis.Options{
-		Addr:     config.RedisAddr,
-		Password: config.RedisPassword,
-		DB:       config.RedisDB,
-	})
+	client := newUniversalClient(config.RedisAddr, config.RedisAddrs, config.RedisMasterName,
+		config.RedisPassword, config.RedisDB)
 
-	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	tb, err := NewRedisTokenBucketWithClient(client, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	tb.ownsClient = true
+
+	return tb, nil
+}
+
+// NewRedisTokenBucketWithClient creates a token bucket on an existing Redis client, so it can
+// share a connection pool with the rest of the application. The Redis address fields of the
+// config are ignored and Close leaves the client open.
+func NewRedisTokenBucketWithClient(client redis.UniversalClient, config *Config) (*RedisTokenBucket, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
 
-	if err := client.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	// Test connection
+	if err := pingClient(client); err != nil {
+		return nil, err
 	}
 
 	tb := &RedisTokenBucket{
 		client:     client,
+		cluster:    isCluster(client),
+		policies:   &policyCache{},
 		config:     config,
 		luaScripts: make(map[string]*redis.Script),
 	}
@@ -85,42 +108,64 @@ func NewRedisTokenBucket(config *Config) (*RedisTokenBucket, error) {
 	// Initialize Lua scripts
 	tb.initLuaScripts()
 
+	if !tb.cluster {
+		if err := tb.indexPolicyPrefixes(); err != nil {
+			return nil, err
+		}
+	}
+
 	return tb, nil
 }
 
-// Close closes the Redis connection
+// Close closes the Redis connection if the bucket created it
 func (tb *RedisTokenBucket) Close() error {
+	if !tb.ownsClient {
+		return nil
+	}
 	return tb.client.Close()
 }
 
 // keyName generates a Redis key for the given bucket key
 func (tb *RedisTokenBucket) keyName(key string) string {
-	return fmt.Sprintf("token_bucket:%s", key)
+	return hashTagKey("token_bucket", key)
+}
+
+// scriptKeys returns the KEYS passed to the token bucket scripts for the given bucket key.
+// In cluster mode the policy tables live in another slot and are left out.
+func (tb *RedisTokenBucket) scriptKeys(key string) []string {
+	if tb.cluster {
+		return []string{tb.keyName(key)}
+	}
+	return append([]string{tb.keyName(key)}, policyKeys...)
 }
 
 // GetBucketState returns the current state of a token bucket
 func (tb *RedisTokenBucket) GetBucketState(ctx context.Context, key string) (*BucketState, error) {
-	redisKey := tb.keyName(key)
+	policyArg, capacity, refillRate, err := tb.policyArgs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 
 	// Run the get bucket state Lua script
-	result, err := tb.luaScripts["get_state"].Run(ctx, tb.client, []string{redisKey},
-		tb.config.Capacity, tb.config.RefillRate, tb.config.TTL.Seconds()).Result()
+	result, err := runScript(ctx, tb.client, tb.luaScripts["get_state"], "get_state", tb.scriptKeys(key),
+		policyArg, capacity, refillRate, tb.config.TTL.Seconds()).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get bucket state: %w", err)
 	}
 
 	values := result.([]interface{})
 	currentTokens := parseFloat64(values[0])
-	lastRefillTime := time.Unix(parseInt64(values[1]), 0)
+	lastRefillTime := time.Unix(0, int64(parseFloat64(values[1])*float64(time.Second)))
 	ttl := parseInt64(values[2])
 
 	return &BucketState{
 		Key:            key,
 		CurrentTokens:  currentTokens,
-		Capacity:       tb.config.Capacity,
-		RefillRate:     tb.config.RefillRate,
+		Capacity:       parseInt64(values[3]),
+		RefillRate:     parseFloat64(values[4]),
 		LastRefillTime: lastRefillTime,
 		TTL:            ttl,
+		Policy:         parseString(values[5]),
 	}, nil
 }
 
@@ -130,11 +175,14 @@ func (tb *RedisTokenBucket) TakeTokens(ctx context.Context, key string, tokens f
 		return nil, fmt.Errorf("tokens must be positive")
 	}
 
-	redisKey := tb.keyName(key)
+	policyArg, capacity, refillRate, err := tb.policyArgs(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 
 	// Run the take tokens Lua script
-	result, err := tb.luaScripts["take_tokens"].Run(ctx, tb.client, []string{redisKey},
-		tokens, tb.config.Capacity, tb.config.RefillRate, tb.config.TTL.Seconds()).Result()
+	result, err := runScript(ctx, tb.client, tb.luaScripts["take_tokens"], "take_tokens", tb.scriptKeys(key),
+		policyArg, tokens, capacity, refillRate, tb.config.TTL.Seconds()).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to take tokens: %w", err)
 	}
@@ -147,6 +195,9 @@ func (tb *RedisTokenBucket) TakeTokens(ctx context.Context, key string, tokens f
 	tokenResult := &TokenResult{
 		Allowed:         allowed,
 		RemainingTokens: remainingTokens,
+		Capacity:        parseInt64(values[3]),
+		RefillRate:      parseFloat64(values[4]),
+		Policy:          parseString(values[5]),
 	}
 
 	if !allowed && retryAfter > 0 {
@@ -158,10 +209,13 @@ func (tb *RedisTokenBucket) TakeTokens(ctx context.Context, key string, tokens f
 
 // ResetBucket resets a bucket to full capacity
 func (tb *RedisTokenBucket) ResetBucket(ctx context.Context, key string) error {
-	redisKey := tb.keyName(key)
+	policyArg, capacity, refillRate, err := tb.policyArgs(ctx, key)
+	if err != nil {
+		return err
+	}
 
-	_, err := tb.luaScripts["reset_bucket"].Run(ctx, tb.client, []string{redisKey},
-		tb.config.Capacity, tb.config.RefillRate, tb.config.TTL.Seconds()).Result()
+	_, err = runScript(ctx, tb.client, tb.luaScripts["reset_bucket"], "reset_bucket", tb.scriptKeys(key),
+		policyArg, capacity, refillRate, tb.config.TTL.Seconds()).Result()
 	if err != nil {
 		return fmt.Errorf("failed to reset bucket: %w", err)
 	}
@@ -190,6 +244,13 @@ func parseInt64(val interface{}) int64 {
 	}
 }
 
+func parseString(val interface{}) string {
+	if s, ok := val.(string); ok {
+		return s
+	}
+	return ""
+}
+
 func parseFloat64(val interface{}) float64 {
 	switch v := val.(type) {
 	case string:
@@ -0,0 +1,133 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"monolith/internal/metrics"
+)
+
+// newUniversalClient creates a Redis client for a single node, a Sentinel-managed master or a
+// cluster. Addrs overrides addr when set; a master name selects Sentinel, and more than one
+// address without a master name selects cluster mode.
+func newUniversalClient(addr string, addrs []string, masterName string, password string, db int) redis.UniversalClient {
+	if len(addrs) == 0 {
+		addrs = []string{addr}
+	}
+
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      addrs,
+		MasterName: masterName,
+		Password:   password,
+		DB:         db, // Ignored by cluster clients
+	})
+}
+
+// unavailablePrefixes start the Redis errors of a server that cannot serve commands right now
+var unavailablePrefixes = []string{"LOADING ", "READONLY ", "CLUSTERDOWN ", "TRYAGAIN ", "MASTERDOWN "}
+
+// IsUnavailable reports whether an error means Redis could not be reached or did not answer in
+// time, as opposed to a request it answered with an error
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, redis.ErrClosed) {
+		return true
+	}
+	// The pool timeout is not exported
+	if strings.Contains(err.Error(), "redis: connection pool timeout") {
+		return true
+	}
+
+	var redisErr redis.Error
+	if errors.As(err, &redisErr) {
+		for _, prefix := range unavailablePrefixes {
+			if strings.HasPrefix(redisErr.Error(), prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pingClient checks that Redis is reachable
+func pingClient(client redis.UniversalClient) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	return nil
+}
+
+// isCluster reports whether the client talks to a Redis Cluster, where every key used by a
+// script must hash to the same slot
+func isCluster(client redis.UniversalClient) bool {
+	_, ok := client.(*redis.ClusterClient)
+	return ok
+}
+
+// ErrCrossSlot is returned on Redis Cluster when the keys of a multi-key operation do not share
+// a hash tag, so a script cannot reach all of them
+var ErrCrossSlot = errors.New("keys must share a hash tag on Redis Cluster")
+
+// hashSlotKey returns the part of a Redis key that Redis Cluster hashes: the content of the
+// first non-empty hash tag, or the whole key
+func hashSlotKey(redisKey string) string {
+	if start := strings.Index(redisKey, "{"); start >= 0 {
+		if end := strings.Index(redisKey[start+1:], "}"); end > 0 {
+			return redisKey[start+1 : start+1+end]
+		}
+	}
+	return redisKey
+}
+
+// checkSameSlot returns ErrCrossSlot if the Redis keys do not all share a hash tag
+func checkSameSlot(redisKeys []string) error {
+	for _, redisKey := range redisKeys[1:] {
+		if hashSlotKey(redisKey) != hashSlotKey(redisKeys[0]) {
+			return fmt.Errorf("%w: %q and %q", ErrCrossSlot, redisKeys[0], redisKey)
+		}
+	}
+	return nil
+}
+
+// hashTagKey builds a Redis key from a prefix and a limiter key. The limiter key is wrapped in
+// a hash tag so that all keys derived from it land in the same cluster slot. Keys that already
+// contain a hash tag (e.g. "{org:42}:user:7") are used as is, which lets callers place related
+// buckets in one slot for multi-key operations.
+func hashTagKey(prefix string, key string) string {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			return prefix + ":" + key
+		}
+	}
+
+	return prefix + ":{" + key + "}"
+}
+
+// runScript runs a Lua script and records its latency and errors under the given name
+func runScript(ctx context.Context, client redis.Scripter, script *redis.Script, name string, keys []string, args ...interface{}) *redis.Cmd {
+	start := time.Now()
+	cmd := script.Run(ctx, client, keys, args...)
+	metrics.ScriptDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		metrics.RedisErrors.WithLabelValues(name).Inc()
+	}
+
+	return cmd
+}
@@ -0,0 +1,220 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestHashTagKey(t *testing.T) {
+	testCases := []struct {
+		key  string
+		want string
+	}{
+		{"user123", "token_bucket:{user123}"},
+		{"org:42:user:7", "token_bucket:{org:42:user:7}"},
+		{"{org:42}:user:7", "token_bucket:{org:42}:user:7"},
+		{"{org:42}", "token_bucket:{org:42}"},
+		{"empty{}tag", "token_bucket:{empty{}tag}"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			if got := hashTagKey("token_bucket", tc.key); got != tc.want {
+				t.Errorf("hashTagKey(%q) = %q, want %q", tc.key, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckSameSlot(t *testing.T) {
+	if err := checkSameSlot([]string{"token_bucket:{org:42}", "token_bucket:{org:42}:user:7"}); err != nil {
+		t.Errorf("Expected keys with a shared hash tag to pass, got %v", err)
+	}
+	if err := checkSameSlot([]string{"token_bucket:{org:42}", "token_bucket:{org:43}"}); !errors.Is(err, ErrCrossSlot) {
+		t.Errorf("Expected ErrCrossSlot, got %v", err)
+	}
+}
+
+func TestNewUniversalClient_Mode(t *testing.T) {
+	testCases := []struct {
+		name        string
+		addrs       []string
+		masterName  string
+		wantCluster bool
+	}{
+		{"Single node", nil, "", false},
+		{"Sentinel", []string{"sentinel-1:26379", "sentinel-2:26379"}, "mymaster", false},
+		{"Cluster", []string{"node-1:6379", "node-2:6379", "node-3:6379"}, "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := newUniversalClient("localhost:6379", tc.addrs, tc.masterName, "", 0)
+			defer client.Close()
+
+			if got := isCluster(client); got != tc.wantCluster {
+				t.Errorf("Expected cluster=%v, got %v", tc.wantCluster, got)
+			}
+		})
+	}
+}
+
+func TestNewRedisTokenBucketWithClient_SharedClient(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	config := &Config{Capacity: 5, RefillRate: 1.0, TTL: time.Minute}
+
+	tb, err := NewRedisTokenBucketWithClient(client, config)
+	if err != nil {
+		t.Fatalf("NewRedisTokenBucketWithClient failed: %v", err)
+	}
+	sw, err := NewRedisSlidingWindowWithClient(client, &SlidingWindowConfig{
+		WindowSize:  time.Second,
+		MaxRequests: 5,
+		TTL:         time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewRedisSlidingWindowWithClient failed: %v", err)
+	}
+
+	ctx := context.Background()
+
+	result, err := tb.TakeTokens(ctx, "shared_client", 1)
+	if err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if !result.Allowed || result.RemainingTokens != 4 {
+		t.Errorf("Expected 4 remaining tokens, got allowed=%v remaining=%.1f", result.Allowed, result.RemainingTokens)
+	}
+
+	// Buckets are stored under a hash-tagged key
+	exists, err := client.Exists(ctx, "token_bucket:{shared_client}").Result()
+	if err != nil {
+		t.Fatalf("EXISTS failed: %v", err)
+	}
+	if exists != 1 {
+		t.Error("Expected bucket to be stored at token_bucket:{shared_client}")
+	}
+
+	// Closing the limiters leaves the shared client usable
+	if err := tb.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Errorf("Expected shared client to stay open, got %v", err)
+	}
+}
+
+func TestNewRedisTokenBucketWithClient_Unreachable(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1", DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+
+	if _, err := NewRedisTokenBucketWithClient(client, nil); err == nil {
+		t.Error("Expected error for unreachable Redis")
+	}
+}
+
+func TestIsUnavailable(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "localhost:1", DialTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	dialErr := client.Ping(context.Background()).Err()
+
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"Refused connection", fmt.Errorf("failed to take tokens: %w", dialErr), true},
+		{"Timeout", context.DeadlineExceeded, true},
+		{"Dropped connection", io.EOF, true},
+		{"Closed client", redis.ErrClosed, true},
+		{"Invalid cost", errors.New("cost must be a positive whole number, got 2.5"), false},
+		{"No error", nil, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := IsUnavailable(tc.err); got != tc.want {
+				t.Errorf("IsUnavailable(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucket_ClusterPolicyResolution(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+
+	// Resolve policies client-side as a cluster client would
+	tb.cluster = true
+
+	ctx := context.Background()
+
+	if err := tb.SetPolicy(ctx, &Policy{Name: "free", Capacity: 20, RefillRate: 10}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if err := tb.SetPolicy(ctx, &Policy{Name: "enterprise", Capacity: 1000, RefillRate: 500}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "org:*", "free"); err != nil {
+		t.Fatalf("AssignPolicy failed: %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "org:42:*", "enterprise"); err != nil {
+		t.Fatalf("AssignPolicy failed: %v", err)
+	}
+
+	testCases := []struct {
+		key          string
+		wantPolicy   string
+		wantCapacity int64
+	}{
+		{"anonymous", "", 10},
+		{"org:1", "free", 20},
+		{"org:42:user:1", "enterprise", 1000},
+	}
+
+	for _, tc := range testCases {
+		result, err := tb.TakeTokens(ctx, tc.key, 1)
+		if err != nil {
+			t.Fatalf("TakeTokens failed for %s: %v", tc.key, err)
+		}
+		if result.Policy != tc.wantPolicy || result.Capacity != tc.wantCapacity {
+			t.Errorf("Expected %q with capacity %d for %s, got %q with %d",
+				tc.wantPolicy, tc.wantCapacity, tc.key, result.Policy, result.Capacity)
+		}
+	}
+
+	// Local changes are visible immediately
+	if err := tb.UnassignPolicy(ctx, "org:42:*"); err != nil {
+		t.Fatalf("UnassignPolicy failed: %v", err)
+	}
+	state, err := tb.GetBucketState(ctx, "org:42:user:2")
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.Policy != "free" {
+		t.Errorf("Expected free policy after unassigning enterprise, got %q", state.Policy)
+	}
+
+	// Multi-key consumption resolves every level
+	multi, err := tb.TakeTokensMulti(ctx, []string{"{org:7}", "{org:7}:user:1"}, 1)
+	if err != nil {
+		t.Fatalf("TakeTokensMulti failed: %v", err)
+	}
+	if !multi.Allowed || multi.Levels[0].Capacity != 10 || multi.Levels[1].Capacity != 10 {
+		t.Errorf("Expected both levels to use the default capacity, got %+v", multi.Levels)
+	}
+}
@@ -0,0 +1,45 @@
+package bucket
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the in-memory limiters what time it is, so tests can control time
+// instead of sleeping. The Redis limiters always use the Redis or system clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is the Clock backed by time.Now
+type RealClock struct{}
+
+// Now returns the current system time
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock that only moves when it is advanced
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock creates a manual clock set to the given time
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+// Now returns the clock's current time
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
@@ -0,0 +1,388 @@
+package bucket
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// conformanceTokenBucket is the token bucket API shared by the Redis and in-memory backends
+type conformanceTokenBucket interface {
+	Limiter
+	TakeTokens(ctx context.Context, key string, tokens float64) (*TokenResult, error)
+	GetBucketState(ctx context.Context, key string) (*BucketState, error)
+	ResetBucket(ctx context.Context, key string) error
+}
+
+// conformanceSlidingWindow is the sliding window API shared by the Redis and in-memory backends
+type conformanceSlidingWindow interface {
+	Limiter
+	IsAllowed(ctx context.Context, key string) (*SlidingWindowResult, error)
+	IsAllowedN(ctx context.Context, key string, cost int64) (*SlidingWindowResult, error)
+	GetWindowState(ctx context.Context, key string) (*SlidingWindowResult, error)
+	ClearWindow(ctx context.Context, key string) error
+}
+
+// tokenBucketBackend creates a token bucket and returns it with a function that lets time pass
+type tokenBucketBackend func(t *testing.T, capacity int64, refillRate float64) (conformanceTokenBucket, func(time.Duration))
+
+// slidingWindowBackend creates a sliding window and returns it with a function that lets time pass
+type slidingWindowBackend func(t *testing.T, windowSize time.Duration, maxRequests int64) (conformanceSlidingWindow, func(time.Duration))
+
+var tokenBucketBackends = map[string]tokenBucketBackend{
+	"redis": func(t *testing.T, capacity int64, refillRate float64) (conformanceTokenBucket, func(time.Duration)) {
+		setupTestRedis(t).Close()
+		return createTestBucket(t, capacity, refillRate), time.Sleep
+	},
+	"memory": func(t *testing.T, capacity int64, refillRate float64) (conformanceTokenBucket, func(time.Duration)) {
+		clock := NewManualClock(time.Unix(1700000000, 0))
+		mb, err := NewMemoryTokenBucketWithClock(&Config{Capacity: capacity, RefillRate: refillRate, TTL: time.Minute}, clock)
+		if err != nil {
+			t.Fatalf("NewMemoryTokenBucketWithClock failed: %v", err)
+		}
+		return mb, clock.Advance
+	},
+}
+
+var slidingWindowBackends = map[string]slidingWindowBackend{
+	"redis": func(t *testing.T, windowSize time.Duration, maxRequests int64) (conformanceSlidingWindow, func(time.Duration)) {
+		return createTestSlidingWindow(t, windowSize, maxRequests), time.Sleep
+	},
+	"memory": func(t *testing.T, windowSize time.Duration, maxRequests int64) (conformanceSlidingWindow, func(time.Duration)) {
+		clock := NewManualClock(time.Unix(1700000000, 0))
+		mw, err := NewMemorySlidingWindowWithClock(&SlidingWindowConfig{WindowSize: windowSize, MaxRequests: maxRequests, TTL: time.Minute}, clock)
+		if err != nil {
+			t.Fatalf("NewMemorySlidingWindowWithClock failed: %v", err)
+		}
+		return mw, clock.Advance
+	},
+}
+
+// takeN takes one token n times and returns how many were allowed
+func takeN(t *testing.T, tb conformanceTokenBucket, key string, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		result, err := tb.TakeTokens(context.Background(), key, 1)
+		if err != nil {
+			t.Fatalf("TakeTokens failed: %v", err)
+		}
+		if result.Allowed {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestConformance_TokenBucket(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string)
+	}{
+		{
+			name: "burst up to capacity",
+			run: func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string) {
+				if allowed := takeN(t, tb, key, 5); allowed != 5 {
+					t.Errorf("Expected 5 requests allowed, got %d", allowed)
+				}
+
+				result, err := tb.TakeTokens(context.Background(), key, 1)
+				if err != nil {
+					t.Fatalf("TakeTokens failed: %v", err)
+				}
+				if result.Allowed {
+					t.Error("Expected request beyond capacity to be denied")
+				}
+				if result.RetryAfter <= 0 || result.RetryAfter > 0.11 {
+					t.Errorf("Expected RetryAfter of about 0.1s, got %.3f", result.RetryAfter)
+				}
+			},
+		},
+		{
+			name: "refills over time",
+			run: func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string) {
+				takeN(t, tb, key, 5)
+				sleep(250 * time.Millisecond)
+
+				// 250ms at 10 tokens/sec refills two and a half tokens
+				if allowed := takeN(t, tb, key, 3); allowed != 2 {
+					t.Errorf("Expected 2 requests allowed after 250ms, got %d", allowed)
+				}
+			},
+		},
+		{
+			name: "multi-token retry after",
+			run: func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string) {
+				takeN(t, tb, key, 5)
+
+				result, err := tb.TakeTokens(context.Background(), key, 3)
+				if err != nil {
+					t.Fatalf("TakeTokens failed: %v", err)
+				}
+				if result.Allowed {
+					t.Error("Expected 3 tokens to be denied from an empty bucket")
+				}
+				if result.RetryAfter < 0.25 || result.RetryAfter > 0.31 {
+					t.Errorf("Expected RetryAfter of about 0.3s, got %.3f", result.RetryAfter)
+				}
+			},
+		},
+		{
+			name: "never exceeds capacity",
+			run: func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string) {
+				takeN(t, tb, key, 1)
+				sleep(600 * time.Millisecond)
+
+				state, err := tb.GetBucketState(context.Background(), key)
+				if err != nil {
+					t.Fatalf("GetBucketState failed: %v", err)
+				}
+				if state.CurrentTokens != 5 {
+					t.Errorf("Expected bucket to be capped at 5 tokens, got %.2f", state.CurrentTokens)
+				}
+			},
+		},
+		{
+			name: "reset refills the bucket",
+			run: func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string) {
+				takeN(t, tb, key, 5)
+
+				if err := tb.ResetBucket(context.Background(), key); err != nil {
+					t.Fatalf("ResetBucket failed: %v", err)
+				}
+				if allowed := takeN(t, tb, key, 5); allowed != 5 {
+					t.Errorf("Expected 5 requests allowed after reset, got %d", allowed)
+				}
+			},
+		},
+		{
+			name: "peek does not consume",
+			run: func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string) {
+				for i := 0; i < 3; i++ {
+					result, err := tb.Peek(context.Background(), key)
+					if err != nil {
+						t.Fatalf("Peek failed: %v", err)
+					}
+					if result.Remaining != 5 || result.Limit != 5 || !result.Allowed {
+						t.Errorf("Expected a full bucket, got %+v", result)
+					}
+				}
+			},
+		},
+		{
+			name: "keys are independent",
+			run: func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string) {
+				other := key + "_other"
+				tb.ResetBucket(context.Background(), other)
+
+				takeN(t, tb, key, 5)
+				if allowed := takeN(t, tb, other, 5); allowed != 5 {
+					t.Errorf("Expected 5 requests allowed on a different key, got %d", allowed)
+				}
+			},
+		},
+		{
+			name: "rejects invalid token counts",
+			run: func(t *testing.T, tb conformanceTokenBucket, sleep func(time.Duration), key string) {
+				for _, tokens := range []float64{0, -1} {
+					if _, err := tb.TakeTokens(context.Background(), key, tokens); err == nil {
+						t.Errorf("Expected error for %v tokens", tokens)
+					}
+				}
+			},
+		},
+	}
+
+	for backend, create := range tokenBucketBackends {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				tb, sleep := create(t, 5, 10.0)
+				defer tb.Close()
+
+				key := "conformance_token_bucket"
+				tb.ResetBucket(context.Background(), key)
+
+				tt.run(t, tb, sleep, key)
+			})
+		}
+	}
+}
+
+func TestConformance_SlidingWindow(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, sw conformanceSlidingWindow, sleep func(time.Duration), key string)
+	}{
+		{
+			name: "allows up to the maximum",
+			run: func(t *testing.T, sw conformanceSlidingWindow, sleep func(time.Duration), key string) {
+				ctx := context.Background()
+
+				for i := 0; i < 3; i++ {
+					result, err := sw.IsAllowed(ctx, key)
+					if err != nil {
+						t.Fatalf("IsAllowed failed: %v", err)
+					}
+					if !result.Allowed || result.CurrentCount != int64(i+1) {
+						t.Errorf("Expected request %d to be allowed with count %d, got %+v", i+1, i+1, result)
+					}
+				}
+
+				result, err := sw.IsAllowed(ctx, key)
+				if err != nil {
+					t.Fatalf("IsAllowed failed: %v", err)
+				}
+				if result.Allowed {
+					t.Error("Expected request beyond the maximum to be denied")
+				}
+				if result.RetryAfter <= 0 || result.RetryAfter > 0.5 {
+					t.Errorf("Expected RetryAfter within the window, got %.3f", result.RetryAfter)
+				}
+			},
+		},
+		{
+			name: "requests expire with the window",
+			run: func(t *testing.T, sw conformanceSlidingWindow, sleep func(time.Duration), key string) {
+				ctx := context.Background()
+
+				for i := 0; i < 3; i++ {
+					sw.IsAllowed(ctx, key)
+				}
+				sleep(600 * time.Millisecond)
+
+				result, err := sw.IsAllowed(ctx, key)
+				if err != nil {
+					t.Fatalf("IsAllowed failed: %v", err)
+				}
+				if !result.Allowed || result.CurrentCount != 1 {
+					t.Errorf("Expected a fresh window after expiry, got %+v", result)
+				}
+			},
+		},
+		{
+			name: "window slides",
+			run: func(t *testing.T, sw conformanceSlidingWindow, sleep func(time.Duration), key string) {
+				ctx := context.Background()
+
+				sw.IsAllowed(ctx, key)
+				sleep(300 * time.Millisecond)
+				sw.IsAllowed(ctx, key)
+				sw.IsAllowed(ctx, key)
+				sleep(250 * time.Millisecond)
+
+				// Only the first request has left the window
+				state, err := sw.GetWindowState(ctx, key)
+				if err != nil {
+					t.Fatalf("GetWindowState failed: %v", err)
+				}
+				if state.CurrentCount != 2 || !state.Allowed {
+					t.Errorf("Expected 2 requests left in the window, got %+v", state)
+				}
+			},
+		},
+		{
+			name: "state does not record a request",
+			run: func(t *testing.T, sw conformanceSlidingWindow, sleep func(time.Duration), key string) {
+				ctx := context.Background()
+
+				sw.IsAllowed(ctx, key)
+				for i := 0; i < 3; i++ {
+					state, err := sw.GetWindowState(ctx, key)
+					if err != nil {
+						t.Fatalf("GetWindowState failed: %v", err)
+					}
+					if state.CurrentCount != 1 {
+						t.Errorf("Expected count 1, got %d", state.CurrentCount)
+					}
+					if state.WindowEnd-state.WindowStart != 500 {
+						t.Errorf("Expected a 500ms window, got %dms", state.WindowEnd-state.WindowStart)
+					}
+				}
+
+				result, err := sw.Peek(ctx, key)
+				if err != nil {
+					t.Fatalf("Peek failed: %v", err)
+				}
+				if result.Remaining != 2 || result.Limit != 3 {
+					t.Errorf("Expected 2 of 3 remaining, got %+v", result)
+				}
+			},
+		},
+		{
+			name: "clear empties the window",
+			run: func(t *testing.T, sw conformanceSlidingWindow, sleep func(time.Duration), key string) {
+				ctx := context.Background()
+
+				for i := 0; i < 3; i++ {
+					sw.IsAllowed(ctx, key)
+				}
+				if err := sw.ClearWindow(ctx, key); err != nil {
+					t.Fatalf("ClearWindow failed: %v", err)
+				}
+
+				state, err := sw.GetWindowState(ctx, key)
+				if err != nil {
+					t.Fatalf("GetWindowState failed: %v", err)
+				}
+				if state.CurrentCount != 0 {
+					t.Errorf("Expected an empty window after clear, got %d", state.CurrentCount)
+				}
+			},
+		},
+		{
+			name: "weighted requests take several slots",
+			run: func(t *testing.T, sw conformanceSlidingWindow, sleep func(time.Duration), key string) {
+				ctx := context.Background()
+
+				sw.IsAllowed(ctx, key)
+				sleep(100 * time.Millisecond)
+
+				result, err := sw.IsAllowedN(ctx, key, 2)
+				if err != nil {
+					t.Fatalf("IsAllowedN failed: %v", err)
+				}
+				if !result.Allowed || result.CurrentCount != 3 {
+					t.Errorf("Expected 2 slots to fit with count 3, got %+v", result)
+				}
+
+				// Two slots only free up once the weighted request expires, not the first one
+				result, err = sw.IsAllowedN(ctx, key, 2)
+				if err != nil {
+					t.Fatalf("IsAllowedN failed: %v", err)
+				}
+				if result.Allowed {
+					t.Error("Expected 2 more slots to be denied")
+				}
+				if result.RetryAfter < 0.45 || result.RetryAfter > 0.5 {
+					t.Errorf("Expected RetryAfter of about 0.5s, got %.3f", result.RetryAfter)
+				}
+			},
+		},
+		{
+			name: "rejects invalid costs",
+			run: func(t *testing.T, sw conformanceSlidingWindow, sleep func(time.Duration), key string) {
+				for _, cost := range []int64{0, -1, 4} {
+					if _, err := sw.IsAllowedN(context.Background(), key, cost); err == nil {
+						t.Errorf("Expected error for a cost of %d", cost)
+					}
+				}
+				if _, err := sw.Allow(context.Background(), key, 1.5); err == nil {
+					t.Error("Expected error for a fractional cost")
+				}
+			},
+		},
+	}
+
+	for backend, create := range slidingWindowBackends {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				sw, sleep := create(t, 500*time.Millisecond, 3)
+				defer sw.Close()
+
+				key := "conformance_sliding_window"
+				sw.ClearWindow(context.Background(), key)
+
+				tt.run(t, sw, sleep, key)
+			})
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// WindowCounterConfig holds configuration for the counter based window rate limiters
+// (fixed window and sliding window counter)
+type WindowCounterConfig struct {
+	RedisAddr       string
+	RedisAddrs      []string // Cluster or Sentinel addresses; overrides RedisAddr when set
+	RedisMasterName string   // Sentinel master name
+	RedisPassword   string
+	RedisDB         int
+	WindowSize      time.Duration // Length of each window; keys expire with the windows they track
+	MaxRequests     int64         // Maximum requests allowed per window
+}
+
+// DefaultWindowCounterConfig returns a sensible default configuration
+func DefaultWindowCounterConfig() *WindowCounterConfig {
+	return &WindowCounterConfig{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       0,
+		WindowSize:    1 * time.Minute, // 1 minute window
+		MaxRequests:   100,             // 100 requests per minute
+	}
+}
+
+// RedisFixedWindow implements a fixed window counter rate limiter using Redis.
+// Each key holds a single integer, so memory use is constant regardless of the limit.
+type RedisFixedWindow struct {
+	client     redis.UniversalClient
+	ownsClient bool // Close only closes clients created by the constructor
+	config     *WindowCounterConfig
+	luaScript  *redis.Script
+}
+
+var _ Limiter = (*RedisFixedWindow)(nil)
+
+// NewRedisFixedWindow creates a new Redis-backed fixed window rate limiter
+func NewRedisFixedWindow(config *WindowCounterConfig) (*RedisFixedWindow, error) {
+	if config == nil {
+		config = DefaultWindowCounterConfig()
+	}
+
+	// Create Redis client
+	client := newUniversalClient(config.RedisAddr, config.RedisAddrs, config.RedisMasterName,
+		config.RedisPassword, config.RedisDB)
+
+	fw, err := NewRedisFixedWindowWithClient(client, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	fw.ownsClient = true
+
+	return fw, nil
+}
+
+// NewRedisFixedWindowWithClient creates a fixed window on an existing Redis client. The Redis address
+// fields of the config are ignored and Close leaves the client open.
+func NewRedisFixedWindowWithClient(client redis.UniversalClient, config *WindowCounterConfig) (*RedisFixedWindow, error) {
+	if config == nil {
+		config = DefaultWindowCounterConfig()
+	}
+
+	// Test connection
+	if err := pingClient(client); err != nil {
+		return nil, err
+	}
+
+	return &RedisFixedWindow{
+		client:    client,
+		config:    config,
+		luaScript: redis.NewScript(fixedWindowScript),
+	}, nil
+}
+
+// Close closes the Redis connection if the fixed window created it
+func (fw *RedisFixedWindow) Close() error {
+	if !fw.ownsClient {
+		return nil
+	}
+	return fw.client.Close()
+}
+
+// keyName generates a Redis key for the given window key
+func (fw *RedisFixedWindow) keyName(key string) string {
+	return fmt.Sprintf("fixed_window:%s", key)
+}
+
+// Allow implements Limiter by adding n to the counter of the current window
+func (fw *RedisFixedWindow) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	cost, err := wholeCost(n)
+	if err != nil {
+		return nil, err
+	}
+	return fw.run(ctx, key, cost, true)
+}
+
+// Peek implements Limiter by reading the counter of the current window
+func (fw *RedisFixedWindow) Peek(ctx context.Context, key string) (*Result, error) {
+	return fw.run(ctx, key, 1, false)
+}
+
+// Reset implements Limiter by deleting the counter, which starts a new window
+func (fw *RedisFixedWindow) Reset(ctx context.Context, key string) error {
+	return fw.client.Del(ctx, fw.keyName(key)).Err()
+}
+
+// run executes the fixed window script, consuming cost only when apply is set
+func (fw *RedisFixedWindow) run(ctx context.Context, key string, cost int64, apply bool) (*Result, error) {
+	applyFlag := 0
+	if apply {
+		applyFlag = 1
+	}
+
+	result, err := runScript(ctx, fw.client, fw.luaScript, "fixed_window", []string{fw.keyName(key)},
+		cost,
+		fw.config.MaxRequests,
+		fw.config.WindowSize.Milliseconds(),
+		applyFlag).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check fixed window: %w", err)
+	}
+
+	values := result.([]interface{})
+	allowed := parseInt64(values[0]) == 1
+	count := parseInt64(values[1])
+	resetMs := parseInt64(values[2])
+
+	remaining := fw.config.MaxRequests - count
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	windowResult := &Result{
+		Allowed:   allowed,
+		Remaining: float64(remaining),
+		Limit:     fw.config.MaxRequests,
+		ResetAt:   time.Now().Add(time.Duration(resetMs) * time.Millisecond),
+		Window:    fw.config.WindowSize.Seconds(),
+	}
+
+	if !allowed {
+		windowResult.RetryAfter = float64(resetMs) / 1000.0
+	}
+
+	return windowResult, nil
+}
+
+// Lua script for fixed window counting. The window starts with the first request
+// (INCRBY) and ends when the key expires (PEXPIRE), so no timestamps are stored.
+const fixedWindowScript = `
+local key = KEYS[1]
+local cost = tonumber(ARGV[1])
+local max_requests = tonumber(ARGV[2])
+local window_ms = tonumber(ARGV[3])
+local apply = tonumber(ARGV[4])
+
+local current = tonumber(redis.call('GET', key) or '0')
+
+local allowed = 0
+if current + cost <= max_requests then
+    allowed = 1
+    if apply == 1 then
+        current = redis.call('INCRBY', key, cost)
+    end
+end
+
+-- Start the window on the first increment (or repair a key without TTL)
+local reset_ms = redis.call('PTTL', key)
+if reset_ms < 0 then
+    if current > 0 then
+        redis.call('PEXPIRE', key, window_ms)
+    end
+    reset_ms = window_ms
+end
+
+return {allowed, current, reset_ms}
+`
@@ -0,0 +1,230 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// setupHierarchy assigns separate policies to the global, tenant and user levels
+func setupHierarchy(t *testing.T, tb *RedisTokenBucket) {
+	ctx := context.Background()
+
+	policies := []*Policy{
+		{Name: "global", Capacity: 100, RefillRate: 0.01},
+		{Name: "tenant", Capacity: 5, RefillRate: 0.01},
+		{Name: "user", Capacity: 3, RefillRate: 0.01},
+	}
+	for _, policy := range policies {
+		if err := tb.SetPolicy(ctx, policy); err != nil {
+			t.Fatalf("SetPolicy failed: %v", err)
+		}
+	}
+
+	assignments := map[string]string{"global": "global", "org:*": "tenant", "user:*": "user"}
+	for pattern, name := range assignments {
+		if err := tb.AssignPolicy(ctx, pattern, name); err != nil {
+			t.Fatalf("AssignPolicy failed: %v", err)
+		}
+	}
+}
+
+func TestTakeTokensMulti_AllLevelsAllow(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+	setupHierarchy(t, tb)
+
+	ctx := context.Background()
+	keys := []string{"global", "org:42", "user:7"}
+
+	result, err := tb.TakeTokensMulti(ctx, keys, 2)
+	if err != nil {
+		t.Fatalf("TakeTokensMulti failed: %v", err)
+	}
+	if !result.Allowed || result.DeniedLevel != -1 || result.DeniedKey != "" {
+		t.Fatalf("Expected request to be allowed, got allowed=%v level=%d key=%q",
+			result.Allowed, result.DeniedLevel, result.DeniedKey)
+	}
+
+	expected := []struct {
+		policy    string
+		remaining float64
+	}{
+		{"global", 98},
+		{"tenant", 3},
+		{"user", 1},
+	}
+	for i, level := range result.Levels {
+		if level.Key != keys[i] {
+			t.Errorf("Expected level %d to be %s, got %s", i, keys[i], level.Key)
+		}
+		if level.Policy != expected[i].policy {
+			t.Errorf("Expected policy %s for %s, got %s", expected[i].policy, level.Key, level.Policy)
+		}
+		if level.RemainingTokens < expected[i].remaining || level.RemainingTokens > expected[i].remaining+0.1 {
+			t.Errorf("Expected %.0f remaining for %s, got %.2f", expected[i].remaining, level.Key, level.RemainingTokens)
+		}
+	}
+}
+
+func TestTakeTokensMulti_DeniedLevelDeductsNothing(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+	setupHierarchy(t, tb)
+
+	ctx := context.Background()
+
+	// Exhaust the user bucket on its own
+	if _, err := tb.TakeTokens(ctx, "user:7", 3); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+
+	result, err := tb.TakeTokensMulti(ctx, []string{"global", "org:42", "user:7"}, 1)
+	if err != nil {
+		t.Fatalf("TakeTokensMulti failed: %v", err)
+	}
+	if result.Allowed {
+		t.Fatal("Expected request to be denied by the user level")
+	}
+	if result.DeniedLevel != 2 || result.DeniedKey != "user:7" {
+		t.Errorf("Expected denial at level 2 (user:7), got level %d (%s)", result.DeniedLevel, result.DeniedKey)
+	}
+	if result.RetryAfter <= 0 {
+		t.Error("Expected RetryAfter to be set")
+	}
+
+	// The levels above were not charged
+	for _, key := range []string{"global", "org:42"} {
+		state, err := tb.GetBucketState(ctx, key)
+		if err != nil {
+			t.Fatalf("GetBucketState failed: %v", err)
+		}
+		if state.CurrentTokens != float64(state.Capacity) {
+			t.Errorf("Expected %s to stay full, got %.2f of %d", key, state.CurrentTokens, state.Capacity)
+		}
+	}
+}
+
+func TestTakeTokensMulti_ReportsFirstDeniedLevel(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+	setupHierarchy(t, tb)
+
+	ctx := context.Background()
+
+	// Four tokens fit the tenant but not the user
+	result, err := tb.TakeTokensMulti(ctx, []string{"global", "org:42", "user:7"}, 4)
+	if err != nil {
+		t.Fatalf("TakeTokensMulti failed: %v", err)
+	}
+	if result.Allowed || result.DeniedKey != "user:7" {
+		t.Errorf("Expected denial by user:7, got allowed=%v key=%q", result.Allowed, result.DeniedKey)
+	}
+
+	// Six tokens fit neither; the broader tenant level is reported
+	result, err = tb.TakeTokensMulti(ctx, []string{"global", "org:42", "user:7"}, 6)
+	if err != nil {
+		t.Fatalf("TakeTokensMulti failed: %v", err)
+	}
+	if result.DeniedLevel != 1 || result.DeniedKey != "org:42" {
+		t.Errorf("Expected denial at level 1 (org:42), got level %d (%s)", result.DeniedLevel, result.DeniedKey)
+	}
+	if !result.Levels[0].Allowed || result.Levels[1].Allowed || result.Levels[2].Allowed {
+		t.Errorf("Expected only the global level to allow, got %+v", result.Levels)
+	}
+}
+
+func TestTakeTokensMulti_ConcurrentUsersShareTenant(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+	setupHierarchy(t, tb)
+
+	ctx := context.Background()
+
+	const numGoroutines = 50
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successCount := 0
+
+	// 50 different users of one tenant compete for its 5 tokens
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+
+			keys := []string{"global", "org:42", fmt.Sprintf("user:%d", index)}
+			result, err := tb.TakeTokensMulti(ctx, keys, 1)
+			if err != nil {
+				t.Errorf("TakeTokensMulti failed in goroutine %d: %v", index, err)
+				return
+			}
+
+			mu.Lock()
+			if result.Allowed {
+				successCount++
+			}
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	if successCount != 5 {
+		t.Errorf("Expected exactly 5 successful requests (tenant capacity), got %d", successCount)
+	}
+
+	// Only the allowed requests were charged to the global level
+	state, err := tb.GetBucketState(ctx, "global")
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.CurrentTokens < 95 || state.CurrentTokens > 95.5 {
+		t.Errorf("Expected 95 global tokens, got %.2f", state.CurrentTokens)
+	}
+}
+
+func TestTakeTokensMulti_InvalidInput(t *testing.T) {
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+
+	ctx := context.Background()
+
+	if _, err := tb.TakeTokensMulti(ctx, nil, 1); err == nil {
+		t.Error("Expected error for empty key list")
+	}
+	if _, err := tb.TakeTokensMulti(ctx, []string{"global"}, 0); err == nil {
+		t.Error("Expected error for non-positive tokens")
+	}
+}
+
+func TestTakeTokensMulti_RejectsDuplicateKeys(t *testing.T) {
+	tb := createTestBucket(t, 10, 0.01)
+	defer tb.Close()
+
+	ctx := context.Background()
+	tb.ResetBucket(ctx, "dup:org:1")
+
+	// Each level is checked against the bucket before the call, so a repeated key would be
+	// allowed 10 tokens twice over
+	if _, err := tb.TakeTokensMulti(ctx, []string{"dup:org:1", "dup:user:1", "dup:org:1"}, 10); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("Expected ErrDuplicateKey, got %v", err)
+	}
+	if result, err := tb.Peek(ctx, "dup:org:1"); err != nil || result.Remaining != 10 {
+		t.Errorf("Expected the bucket to be untouched, got %+v (%v)", result, err)
+	}
+}
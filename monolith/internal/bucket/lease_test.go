@@ -0,0 +1,234 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createTestLeasingBucket(tb interface{}, capacity int64, refillRate float64, config *LeaseConfig) *LeasingBucket {
+	lb, err := NewLeasingBucket(createTestBucket(tb, capacity, refillRate), config)
+	if err != nil {
+		switch v := tb.(type) {
+		case *testing.T:
+			v.Fatalf("NewLeasingBucket failed: %v", err)
+		case *testing.B:
+			v.Fatalf("NewLeasingBucket failed: %v", err)
+		}
+	}
+
+	return lb
+}
+
+// redisTokens returns the tokens currently held in Redis for the given key
+func redisTokens(t *testing.T, lb *LeasingBucket, key string) float64 {
+	state, err := lb.bucket.GetBucketState(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	return state.CurrentTokens
+}
+
+func TestLeasingBucket_ServesFromLease(t *testing.T) {
+	lb := createTestLeasingBucket(t, 100, 0.01, &LeaseConfig{LeaseSize: 10, MaxLeaseAge: time.Minute})
+	defer lb.Close()
+
+	ctx := context.Background()
+	key := "lease_local"
+	lb.Reset(ctx, key)
+
+	// The first request leases a block of 10 tokens
+	for i := 0; i < 10; i++ {
+		result, err := lb.TakeTokens(ctx, key, 1)
+		if err != nil {
+			t.Fatalf("TakeTokens failed: %v", err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	// All ten requests were served from a single lease
+	if tokens := redisTokens(t, lb, key); tokens < 90 || tokens > 90.1 {
+		t.Errorf("Expected 90 tokens left in Redis after one lease, got %.2f", tokens)
+	}
+
+	// The eleventh request needs a new lease
+	if _, err := lb.TakeTokens(ctx, key, 1); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if tokens := redisTokens(t, lb, key); tokens < 80 || tokens > 80.1 {
+		t.Errorf("Expected 80 tokens left in Redis after two leases, got %.2f", tokens)
+	}
+}
+
+func TestLeasingBucket_FallsBackNearLimit(t *testing.T) {
+	lb := createTestLeasingBucket(t, 5, 0.01, &LeaseConfig{LeaseSize: 10, MaxLeaseAge: time.Minute})
+	defer lb.Close()
+
+	ctx := context.Background()
+	key := "lease_fallback"
+	lb.Reset(ctx, key)
+
+	// A full lease never fits, but single tokens still do
+	for i := 0; i < 5; i++ {
+		result, err := lb.TakeTokens(ctx, key, 1)
+		if err != nil {
+			t.Fatalf("TakeTokens failed: %v", err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	result, err := lb.TakeTokens(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request beyond capacity to be denied")
+	}
+	if result.RetryAfter <= 0 {
+		t.Error("Expected RetryAfter to be set")
+	}
+}
+
+func TestLeasingBucket_ReturnsExpiredLeases(t *testing.T) {
+	lb := createTestLeasingBucket(t, 100, 0.01, &LeaseConfig{LeaseSize: 10, MaxLeaseAge: 100 * time.Millisecond})
+	defer lb.Close()
+
+	ctx := context.Background()
+	key := "lease_expiry"
+	lb.Reset(ctx, key)
+
+	if _, err := lb.TakeTokens(ctx, key, 1); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if tokens := redisTokens(t, lb, key); tokens > 90.1 {
+		t.Errorf("Expected a lease of 10 tokens, got %.2f tokens in Redis", tokens)
+	}
+
+	// The nine unused tokens go back once the lease expires
+	time.Sleep(300 * time.Millisecond)
+
+	if tokens := redisTokens(t, lb, key); tokens < 99 || tokens > 99.1 {
+		t.Errorf("Expected 99 tokens in Redis after the lease expired, got %.2f", tokens)
+	}
+}
+
+func TestLeasingBucket_ReturnsLeasesOnClose(t *testing.T) {
+	lb := createTestLeasingBucket(t, 100, 0.01, &LeaseConfig{LeaseSize: 10, MaxLeaseAge: time.Minute})
+
+	ctx := context.Background()
+	key := "lease_close"
+	lb.Reset(ctx, key)
+
+	if _, err := lb.TakeTokens(ctx, key, 3); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+
+	if err := lb.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	check := createTestBucket(t, 100, 0.01)
+	defer check.Close()
+
+	state, err := check.GetBucketState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.CurrentTokens < 97 || state.CurrentTokens > 97.1 {
+		t.Errorf("Expected 97 tokens in Redis after Close, got %.2f", state.CurrentTokens)
+	}
+}
+
+func TestLeasingBucket_GlobalLimitAcrossInstances(t *testing.T) {
+	const capacity = 50
+	const numInstances = 3
+	const numRequests = 300
+
+	// Slow refill so no tokens are replenished during the test
+	instances := make([]*LeasingBucket, numInstances)
+	for i := range instances {
+		instances[i] = createTestLeasingBucket(t, capacity, 0.01, &LeaseConfig{LeaseSize: 7, MaxLeaseAge: time.Minute})
+	}
+
+	ctx := context.Background()
+	key := "lease_global"
+	instances[0].Reset(ctx, key)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successCount := 0
+
+	for i := 0; i < numRequests; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+
+			result, err := instances[index%numInstances].TakeTokens(ctx, key, 1)
+			if err != nil {
+				t.Errorf("TakeTokens failed in goroutine %d: %v", index, err)
+				return
+			}
+
+			mu.Lock()
+			if result.Allowed {
+				successCount++
+			}
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Leased tokens are taken from Redis before they are served, so the limit holds exactly;
+	// the only slack is tokens still sitting unused in the outstanding leases
+	outstanding := 0.0
+	for _, lb := range instances {
+		lb.mu.Lock()
+		for _, l := range lb.leases {
+			outstanding += l.tokens
+		}
+		lb.mu.Unlock()
+	}
+
+	if successCount > capacity {
+		t.Errorf("Global limit exceeded: %d requests allowed with capacity %d", successCount, capacity)
+	}
+	if float64(successCount)+outstanding < capacity-0.1 {
+		t.Errorf("Expected allowed requests plus outstanding leases to cover the capacity, got %d + %.1f",
+			successCount, outstanding)
+	}
+
+	for _, lb := range instances {
+		if err := lb.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}
+
+	t.Logf("Leasing global limit test: %d allowed, %.1f tokens outstanding before Close", successCount, outstanding)
+}
+
+func BenchmarkLeasingBucket_TakeTokens(b *testing.B) {
+	lb := createTestLeasingBucket(b, 1000000, 1000000, &LeaseConfig{LeaseSize: 100, MaxLeaseAge: time.Second})
+	defer lb.Close()
+
+	ctx := context.Background()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := fmt.Sprintf("benchmark_lease_%d", i%100) // 100 different keys
+			_, err := lb.TakeTokens(ctx, key, 1)
+			if err != nil {
+				b.Errorf("TakeTokens failed: %v", err)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// MemoryTokenBucket implements a token bucket in process memory. Limits apply per instance,
+// so it is meant for tests and as a fallback while Redis is unavailable. The Redis fields of
+// the config are ignored.
+type MemoryTokenBucket struct {
+	mu        sync.Mutex
+	clock     Clock
+	config    *Config
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+// memoryBucket holds the state of one in-memory bucket
+type memoryBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+var _ Limiter = (*MemoryTokenBucket)(nil)
+
+// NewMemoryTokenBucket creates a new in-memory token bucket
+func NewMemoryTokenBucket(config *Config) (*MemoryTokenBucket, error) {
+	return NewMemoryTokenBucketWithClock(config, RealClock{})
+}
+
+// NewMemoryTokenBucketWithClock creates a new in-memory token bucket that reads the time from clock
+func NewMemoryTokenBucketWithClock(config *Config, clock Clock) (*MemoryTokenBucket, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+
+	if config.Capacity <= 0 || config.RefillRate <= 0 {
+		return nil, fmt.Errorf("capacity and refill rate must be positive")
+	}
+
+	return &MemoryTokenBucket{
+		clock:     clock,
+		config:    config,
+		buckets:   make(map[string]*memoryBucket),
+		lastSweep: clock.Now(),
+	}, nil
+}
+
+// Close releases the in-memory state
+func (mb *MemoryTokenBucket) Close() error {
+	mb.mu.Lock()
+	mb.buckets = make(map[string]*memoryBucket)
+	mb.mu.Unlock()
+	return nil
+}
+
+// refill returns the bucket for the given key with its tokens brought up to date.
+// Must be called with mb.mu held.
+func (mb *MemoryTokenBucket) refill(key string, now time.Time) *memoryBucket {
+	b, ok := mb.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(mb.config.Capacity), lastRefill: now}
+		mb.buckets[key] = b
+	}
+
+	elapsed := math.Max(0, now.Sub(b.lastRefill).Seconds())
+	b.tokens = math.Min(float64(mb.config.Capacity), b.tokens+elapsed*mb.config.RefillRate)
+	b.lastRefill = now
+
+	return b
+}
+
+// sweep forgets buckets that have refilled to capacity, which is the same as not having
+// a bucket at all. Runs at most once per TTL. Must be called with mb.mu held.
+func (mb *MemoryTokenBucket) sweep(now time.Time) {
+	interval := mb.config.TTL
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	if now.Sub(mb.lastSweep) < interval {
+		return
+	}
+	mb.lastSweep = now
+
+	for key, b := range mb.buckets {
+		elapsed := now.Sub(b.lastRefill).Seconds()
+		if b.tokens+elapsed*mb.config.RefillRate >= float64(mb.config.Capacity) {
+			delete(mb.buckets, key)
+		}
+	}
+}
+
+// TakeTokens attempts to consume the specified number of tokens
+func (mb *MemoryTokenBucket) TakeTokens(ctx context.Context, key string, tokens float64) (*TokenResult, error) {
+	if tokens <= 0 {
+		return nil, fmt.Errorf("tokens must be positive")
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	now := mb.clock.Now()
+	mb.sweep(now)
+	b := mb.refill(key, now)
+
+	result := &TokenResult{
+		Capacity:   mb.config.Capacity,
+		RefillRate: mb.config.RefillRate,
+	}
+
+	if b.tokens >= tokens {
+		b.tokens -= tokens
+		result.Allowed = true
+	} else {
+		result.RetryAfter = (tokens - b.tokens) / mb.config.RefillRate
+	}
+	result.RemainingTokens = b.tokens
+
+	return result, nil
+}
+
+// GetBucketState returns the current state of a token bucket
+func (mb *MemoryTokenBucket) GetBucketState(ctx context.Context, key string) (*BucketState, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	now := mb.clock.Now()
+	b := mb.refill(key, now)
+
+	return &BucketState{
+		Key:            key,
+		CurrentTokens:  b.tokens,
+		Capacity:       mb.config.Capacity,
+		RefillRate:     mb.config.RefillRate,
+		LastRefillTime: b.lastRefill,
+		TTL:            int64(mb.config.TTL.Seconds()),
+	}, nil
+}
+
+// Allow implements Limiter by taking n tokens from the bucket
+func (mb *MemoryTokenBucket) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	result, err := mb.TakeTokens(ctx, key, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Result(mb.clock.Now()), nil
+}
+
+// Peek implements Limiter by reading the current bucket state
+func (mb *MemoryTokenBucket) Peek(ctx context.Context, key string) (*Result, error) {
+	state, err := mb.GetBucketState(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Result(), nil
+}
+
+// ResetBucket resets a bucket to full capacity
+func (mb *MemoryTokenBucket) ResetBucket(ctx context.Context, key string) error {
+	mb.mu.Lock()
+	delete(mb.buckets, key)
+	mb.mu.Unlock()
+	return nil
+}
+
+// Reset implements Limiter by refilling the bucket to capacity
+func (mb *MemoryTokenBucket) Reset(ctx context.Context, key string) error {
+	return mb.ResetBucket(ctx, key)
+}
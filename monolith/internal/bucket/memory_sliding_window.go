@@ -0,0 +1,188 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemorySlidingWindow implements a sliding window log in process memory with the same
+// semantics as RedisSlidingWindow. Limits apply per instance. The Redis fields of the
+// config are ignored.
+type MemorySlidingWindow struct {
+	mu        sync.Mutex
+	clock     Clock
+	config    *SlidingWindowConfig
+	windows   map[string][]int64 // Request timestamps in milliseconds, oldest first
+	lastSweep time.Time
+}
+
+var _ Limiter = (*MemorySlidingWindow)(nil)
+
+// NewMemorySlidingWindow creates a new in-memory sliding window rate limiter
+func NewMemorySlidingWindow(config *SlidingWindowConfig) (*MemorySlidingWindow, error) {
+	return NewMemorySlidingWindowWithClock(config, RealClock{})
+}
+
+// NewMemorySlidingWindowWithClock creates a new in-memory sliding window that reads the time from clock
+func NewMemorySlidingWindowWithClock(config *SlidingWindowConfig, clock Clock) (*MemorySlidingWindow, error) {
+	if config == nil {
+		config = DefaultSlidingWindowConfig()
+	}
+
+	if config.WindowSize <= 0 || config.MaxRequests <= 0 {
+		return nil, fmt.Errorf("window size and max requests must be positive")
+	}
+
+	return &MemorySlidingWindow{
+		clock:     clock,
+		config:    config,
+		windows:   make(map[string][]int64),
+		lastSweep: clock.Now(),
+	}, nil
+}
+
+// Close releases the in-memory state
+func (mw *MemorySlidingWindow) Close() error {
+	mw.mu.Lock()
+	mw.windows = make(map[string][]int64)
+	mw.mu.Unlock()
+	return nil
+}
+
+// expire drops the entries of a window that are at or before windowStart and returns the rest.
+// Must be called with mw.mu held.
+func (mw *MemorySlidingWindow) expire(key string, windowStart int64) []int64 {
+	entries := mw.windows[key]
+
+	i := 0
+	for i < len(entries) && entries[i] <= windowStart {
+		i++
+	}
+	entries = entries[i:]
+
+	if len(entries) == 0 {
+		delete(mw.windows, key)
+	} else {
+		mw.windows[key] = entries
+	}
+
+	return entries
+}
+
+// sweep forgets windows whose entries have all expired. Runs at most once per window size.
+// Must be called with mw.mu held.
+func (mw *MemorySlidingWindow) sweep(now time.Time) {
+	if now.Sub(mw.lastSweep) < mw.config.WindowSize {
+		return
+	}
+	mw.lastSweep = now
+
+	windowStart := now.Add(-mw.config.WindowSize).UnixMilli()
+	for key := range mw.windows {
+		mw.expire(key, windowStart)
+	}
+}
+
+// IsAllowed checks if a request is allowed within the sliding window
+func (mw *MemorySlidingWindow) IsAllowed(ctx context.Context, key string) (*SlidingWindowResult, error) {
+	return mw.IsAllowedN(ctx, key, 1)
+}
+
+// IsAllowedN checks if a request costing cost slots is allowed within the sliding window.
+// The request is recorded only if all of its slots fit.
+func (mw *MemorySlidingWindow) IsAllowedN(ctx context.Context, key string, cost int64) (*SlidingWindowResult, error) {
+	if cost <= 0 || cost > mw.config.MaxRequests {
+		return nil, fmt.Errorf("cost must be between 1 and %d, got %d", mw.config.MaxRequests, cost)
+	}
+
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	now := mw.clock.Now()
+	mw.sweep(now)
+
+	windowStart := now.Add(-mw.config.WindowSize).UnixMilli()
+	windowEnd := now.UnixMilli()
+	entries := mw.expire(key, windowStart)
+
+	result := &SlidingWindowResult{
+		WindowStart: windowStart,
+		WindowEnd:   windowEnd,
+	}
+
+	count := int64(len(entries))
+	if count+cost <= mw.config.MaxRequests {
+		for i := int64(0); i < cost; i++ {
+			entries = append(entries, windowEnd)
+		}
+		mw.windows[key] = entries
+		result.Allowed = true
+		result.CurrentCount = count + cost
+	} else {
+		// Time until enough of the oldest entries leave the window
+		result.CurrentCount = count
+		oldest := entries[count+cost-mw.config.MaxRequests-1]
+		if retryAfter := oldest + (windowEnd - windowStart) - windowEnd; retryAfter > 0 {
+			result.RetryAfter = float64(retryAfter) / 1000.0 // Convert to seconds
+		}
+	}
+
+	return result, nil
+}
+
+// GetWindowState returns the current state of the sliding window
+func (mw *MemorySlidingWindow) GetWindowState(ctx context.Context, key string) (*SlidingWindowResult, error) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	now := mw.clock.Now()
+	windowStart := now.Add(-mw.config.WindowSize).UnixMilli()
+	currentCount := int64(len(mw.expire(key, windowStart)))
+
+	return &SlidingWindowResult{
+		Allowed:      currentCount < mw.config.MaxRequests,
+		CurrentCount: currentCount,
+		WindowStart:  windowStart,
+		WindowEnd:    now.UnixMilli(),
+	}, nil
+}
+
+// ClearWindow clears all entries for a given key
+func (mw *MemorySlidingWindow) ClearWindow(ctx context.Context, key string) error {
+	mw.mu.Lock()
+	delete(mw.windows, key)
+	mw.mu.Unlock()
+	return nil
+}
+
+// Allow implements Limiter by recording a request of n slots in the sliding window
+func (mw *MemorySlidingWindow) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	cost, err := wholeCost(n)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := mw.IsAllowedN(ctx, key, cost)
+	if err != nil {
+		return nil, err
+	}
+
+	return slidingWindowToResult(mw.config, result), nil
+}
+
+// Peek implements Limiter by counting the requests currently in the window
+func (mw *MemorySlidingWindow) Peek(ctx context.Context, key string) (*Result, error) {
+	result, err := mw.GetWindowState(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return slidingWindowToResult(mw.config, result), nil
+}
+
+// Reset implements Limiter by clearing the window
+func (mw *MemorySlidingWindow) Reset(ctx context.Context, key string) error {
+	return mw.ClearWindow(ctx, key)
+}
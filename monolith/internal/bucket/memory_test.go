@@ -0,0 +1,99 @@
+package bucket
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenBucket_TakeAndRefill(t *testing.T) {
+	mb, err := NewMemoryTokenBucket(&Config{Capacity: 5, RefillRate: 10.0, TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewMemoryTokenBucket failed: %v", err)
+	}
+	defer mb.Close()
+
+	ctx := context.Background()
+	key := "memory_basic"
+
+	for i := 0; i < 5; i++ {
+		result, err := mb.TakeTokens(ctx, key, 1)
+		if err != nil {
+			t.Fatalf("TakeTokens failed: %v", err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	result, err := mb.TakeTokens(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if result.Allowed || result.RetryAfter <= 0 {
+		t.Errorf("Expected denial with RetryAfter, got allowed=%v retry=%.3f", result.Allowed, result.RetryAfter)
+	}
+
+	// 10 tokens/sec refills one token in 100ms
+	time.Sleep(150 * time.Millisecond)
+	result, err = mb.TakeTokens(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after refill")
+	}
+
+	if err := mb.Reset(ctx, key); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	state, err := mb.GetBucketState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.CurrentTokens != 5 {
+		t.Errorf("Expected full bucket after reset, got %.2f", state.CurrentTokens)
+	}
+}
+
+func TestMemoryTokenBucket_ConcurrencyTest(t *testing.T) {
+	mb, err := NewMemoryTokenBucket(&Config{Capacity: 50, RefillRate: 0.1, TTL: time.Minute})
+	if err != nil {
+		t.Fatalf("NewMemoryTokenBucket failed: %v", err)
+	}
+	defer mb.Close()
+
+	ctx := context.Background()
+
+	const numGoroutines = 100
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successCount := 0
+
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result, err := mb.TakeTokens(ctx, "memory_concurrency", 1)
+			if err != nil {
+				t.Errorf("TakeTokens failed: %v", err)
+				return
+			}
+
+			mu.Lock()
+			if result.Allowed {
+				successCount++
+			}
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+
+	if successCount != 50 {
+		t.Errorf("Expected exactly 50 successful requests, got %d", successCount)
+	}
+}
@@ -0,0 +1,255 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPolicy_Validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{"Valid", Policy{Name: "free", Capacity: 20, RefillRate: 10}, false},
+		{"Missing name", Policy{Capacity: 20, RefillRate: 10}, true},
+		{"Zero capacity", Policy{Name: "free", Capacity: 0, RefillRate: 10}, true},
+		{"Negative refill", Policy{Name: "free", Capacity: 20, RefillRate: -1}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Validate()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicy_ExactAndPrefixAssignment(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0) // Default: 10 tokens, 1 token/sec
+	defer tb.Close()
+
+	ctx := context.Background()
+
+	if err := tb.SetPolicy(ctx, &Policy{Name: "free", Capacity: 20, RefillRate: 10}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if err := tb.SetPolicy(ctx, &Policy{Name: "enterprise", Capacity: 1000, RefillRate: 500}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "org:*", "free"); err != nil {
+		t.Fatalf("AssignPolicy failed: %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "org:42:*", "enterprise"); err != nil {
+		t.Fatalf("AssignPolicy failed: %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "org:42:user:7", "free"); err != nil {
+		t.Fatalf("AssignPolicy failed: %v", err)
+	}
+
+	testCases := []struct {
+		key          string
+		wantPolicy   string
+		wantCapacity int64
+	}{
+		{"anonymous", "", 10},
+		{"org:1", "free", 20},
+		{"org:42:user:1", "enterprise", 1000},
+		{"org:42:user:7", "free", 20},
+	}
+
+	for _, tc := range testCases {
+		result, err := tb.TakeTokens(ctx, tc.key, 1)
+		if err != nil {
+			t.Fatalf("TakeTokens failed for %s: %v", tc.key, err)
+		}
+		if result.Policy != tc.wantPolicy {
+			t.Errorf("Expected policy %q for %s, got %q", tc.wantPolicy, tc.key, result.Policy)
+		}
+		if result.Capacity != tc.wantCapacity {
+			t.Errorf("Expected capacity %d for %s, got %d", tc.wantCapacity, tc.key, result.Capacity)
+		}
+		if result.RemainingTokens != float64(tc.wantCapacity-1) {
+			t.Errorf("Expected %d remaining tokens for %s, got %.1f", tc.wantCapacity-1, tc.key, result.RemainingTokens)
+		}
+	}
+}
+
+func TestPolicy_UpdateTakesEffect(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "tenant:update"
+
+	if err := tb.SetPolicy(ctx, &Policy{Name: "tier", Capacity: 5, RefillRate: 1}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "tenant:*", "tier"); err != nil {
+		t.Fatalf("AssignPolicy failed: %v", err)
+	}
+
+	// Exhaust the bucket under the small policy
+	result, err := tb.TakeTokens(ctx, key, 5)
+	if err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if !result.Allowed {
+		t.Fatal("Expected consumption within policy capacity to be allowed")
+	}
+
+	// Raise the limit; a reset should now fill the bucket to the new capacity
+	if err := tb.SetPolicy(ctx, &Policy{Name: "tier", Capacity: 50, RefillRate: 1}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if err := tb.ResetBucket(ctx, key); err != nil {
+		t.Fatalf("ResetBucket failed: %v", err)
+	}
+
+	state, err := tb.GetBucketState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.Capacity != 50 || state.Policy != "tier" {
+		t.Errorf("Expected capacity 50 from policy tier, got %d from %q", state.Capacity, state.Policy)
+	}
+	if state.CurrentTokens != 50 {
+		t.Errorf("Expected 50 tokens after reset, got %.1f", state.CurrentTokens)
+	}
+}
+
+func TestPolicy_DeleteRemovesAssignments(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+
+	ctx := context.Background()
+
+	if err := tb.SetPolicy(ctx, &Policy{Name: "temp", Capacity: 3, RefillRate: 1}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "temp:*", "temp"); err != nil {
+		t.Fatalf("AssignPolicy failed: %v", err)
+	}
+
+	if err := tb.DeletePolicy(ctx, "temp"); err != nil {
+		t.Fatalf("DeletePolicy failed: %v", err)
+	}
+
+	assignments, err := tb.ListAssignments(ctx)
+	if err != nil {
+		t.Fatalf("ListAssignments failed: %v", err)
+	}
+	if _, ok := assignments["temp:*"]; ok {
+		t.Error("Expected assignment to be removed together with its policy")
+	}
+
+	if _, err := tb.GetPolicy(ctx, "temp"); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("Expected ErrPolicyNotFound, got %v", err)
+	}
+	if err := tb.DeletePolicy(ctx, "temp"); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("Expected ErrPolicyNotFound on second delete, got %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "temp:*", "temp"); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("Expected ErrPolicyNotFound when assigning a missing policy, got %v", err)
+	}
+
+	// Buckets fall back to the default configuration
+	result, err := tb.TakeTokens(ctx, "temp:1", 1)
+	if err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if result.Capacity != 10 || result.Policy != "" {
+		t.Errorf("Expected default capacity 10 without policy, got %d from %q", result.Capacity, result.Policy)
+	}
+}
+
+func TestPolicy_PrefixIndex(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+
+	ctx := context.Background()
+
+	if err := tb.SetPolicy(ctx, &Policy{Name: "indexed", Capacity: 20, RefillRate: 1}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	if err := tb.AssignPolicy(ctx, "idx:*", "indexed"); err != nil {
+		t.Fatalf("AssignPolicy failed: %v", err)
+	}
+	if score, err := client.ZScore(ctx, policyPrefixesKey, "idx:").Result(); err != nil || score != 4 {
+		t.Errorf("Expected the prefix indexed by its length, got %v (%v)", score, err)
+	}
+
+	if err := tb.UnassignPolicy(ctx, "idx:*"); err != nil {
+		t.Fatalf("UnassignPolicy failed: %v", err)
+	}
+	if err := client.ZScore(ctx, policyPrefixesKey, "idx:").Err(); err == nil {
+		t.Error("Expected the prefix to leave the index with its assignment")
+	}
+
+	// Assignments made before the index existed are indexed when a bucket starts
+	client.HSet(ctx, policyAssignmentsKey, "legacy:*", "indexed")
+	restarted := createTestBucket(t, 10, 1.0)
+	defer restarted.Close()
+
+	result, err := restarted.TakeTokens(ctx, "legacy:1", 1)
+	if err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if result.Policy != "indexed" || result.Capacity != 20 {
+		t.Errorf("Expected the legacy prefix to resolve, got %q with capacity %d", result.Policy, result.Capacity)
+	}
+
+	if err := tb.DeletePolicy(ctx, "indexed"); err != nil {
+		t.Fatalf("DeletePolicy failed: %v", err)
+	}
+	if n, err := client.ZCard(ctx, policyPrefixesKey).Result(); err != nil || n != 0 {
+		t.Errorf("Expected deleting the policy to empty the index, got %d prefixes (%v)", n, err)
+	}
+}
+
+func TestPolicyCache_ReloadsWithoutBlocking(t *testing.T) {
+	client := setupTestRedis(t)
+	defer client.Close()
+
+	tb := createTestBucket(t, 10, 1.0)
+	defer tb.Close()
+
+	ctx := context.Background()
+	if err := tb.SetPolicy(ctx, &Policy{Name: "stored", Capacity: 20, RefillRate: 1}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+
+	// Another caller is reloading an expired snapshot: it is still served
+	stale := &policySnapshot{policies: map[string]*Policy{"stale": {Name: "stale", Capacity: 1, RefillRate: 1}}}
+	tb.policies.mu.Lock()
+	tb.policies.snapshot = stale
+	tb.policies.loadedAt = time.Now().Add(-time.Hour)
+	tb.policies.loading = true
+	tb.policies.mu.Unlock()
+
+	if _, err := tb.cachedPolicy(ctx, "stale"); err != nil {
+		t.Errorf("Expected the expired snapshot during a reload, got %v", err)
+	}
+
+	// After a local change the snapshot is never served, even during a reload
+	tb.policies.invalidate()
+	if _, err := tb.cachedPolicy(ctx, "stored"); err != nil {
+		t.Errorf("Expected a reload after invalidate, got %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// QuotaPeriod is the calendar period a quota resets on
+type QuotaPeriod string
+
+const (
+	// QuotaHourly resets at the start of every hour
+	QuotaHourly QuotaPeriod = "hour"
+	// QuotaDaily resets at midnight
+	QuotaDaily QuotaPeriod = "day"
+	// QuotaWeekly resets at midnight on the configured first day of the week
+	QuotaWeekly QuotaPeriod = "week"
+	// QuotaMonthly resets at midnight on the 1st of the month
+	QuotaMonthly QuotaPeriod = "month"
+)
+
+// ParseQuotaPeriod parses "hour", "day", "week" or "month"
+func ParseQuotaPeriod(s string) (QuotaPeriod, error) {
+	switch period := QuotaPeriod(s); period {
+	case QuotaHourly, QuotaDaily, QuotaWeekly, QuotaMonthly:
+		return period, nil
+	default:
+		return "", fmt.Errorf("unknown quota period %q", s)
+	}
+}
+
+// QuotaReader is implemented by limiters that can report calendar quota usage
+type QuotaReader interface {
+	// Usage returns the quota used in the current period without consuming anything
+	Usage(ctx context.Context, key string) (*QuotaResult, error)
+}
+
+// QuotaConfig holds configuration for calendar-aligned quotas
+type QuotaConfig struct {
+	RedisAddr       string
+	RedisAddrs      []string // Cluster or Sentinel addresses; overrides RedisAddr when set
+	RedisMasterName string   // Sentinel master name
+	RedisPassword   string
+	RedisDB         int
+	Limit           int64          // Units allowed per period
+	Period          QuotaPeriod    // Calendar period the quota resets on
+	Location        *time.Location // Time zone of the period boundaries (default UTC)
+	WeekStart       time.Weekday   // First day of a weekly period (default Sunday)
+
+	// LocationFunc returns the time zone for a key, e.g. the customer's; nil falls back to Location
+	LocationFunc func(key string) *time.Location
+}
+
+// DefaultQuotaConfig returns a sensible default configuration
+func DefaultQuotaConfig() *QuotaConfig {
+	return &QuotaConfig{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       0,
+		Limit:         10000,        // 10,000 calls
+		Period:        QuotaMonthly, // per calendar month
+		Location:      time.UTC,
+	}
+}
+
+// RedisQuota limits usage per calendar period (hour, day, week or month) in a given time
+// zone. Unlike the token bucket and sliding window, the whole quota becomes available again
+// at the period boundary. Boundaries are computed on the host clock, so skew between
+// instances only matters within seconds of a reset.
+type RedisQuota struct {
+	client     redis.UniversalClient
+	ownsClient bool // Close only closes clients created by the constructor
+	config     *QuotaConfig
+	clock      Clock
+	luaScript  *redis.Script
+}
+
+var (
+	_ Limiter     = (*RedisQuota)(nil)
+	_ QuotaReader = (*RedisQuota)(nil)
+	_ Refunder    = (*RedisQuota)(nil)
+)
+
+// QuotaResult represents the usage of a quota in its current period
+type QuotaResult struct {
+	Allowed     bool      `json:"allowed"`
+	Used        int64     `json:"used"`
+	Limit       int64     `json:"limit"`
+	Remaining   int64     `json:"remaining"`
+	Period      string    `json:"period"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"` // When the quota resets
+	RetryAfter  float64   `json:"retry_after_seconds,omitempty"`
+}
+
+// NewRedisQuota creates a new Redis-backed calendar quota
+func NewRedisQuota(config *QuotaConfig) (*RedisQuota, error) {
+	if config == nil {
+		config = DefaultQuotaConfig()
+	}
+
+	// Create Redis client
+	client := newUniversalClient(config.RedisAddr, config.RedisAddrs, config.RedisMasterName,
+		config.RedisPassword, config.RedisDB)
+
+	q, err := NewRedisQuotaWithClient(client, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	q.ownsClient = true
+
+	return q, nil
+}
+
+// NewRedisQuotaWithClient creates a calendar quota on an existing Redis client. The Redis
+// address fields of the config are ignored and Close leaves the client open.
+func NewRedisQuotaWithClient(client redis.UniversalClient, config *QuotaConfig) (*RedisQuota, error) {
+	if config == nil {
+		config = DefaultQuotaConfig()
+	}
+
+	if config.Limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	if _, err := ParseQuotaPeriod(string(config.Period)); err != nil {
+		return nil, err
+	}
+
+	// Test connection
+	if err := pingClient(client); err != nil {
+		return nil, err
+	}
+
+	return &RedisQuota{
+		client:    client,
+		config:    config,
+		clock:     RealClock{},
+		luaScript: redis.NewScript(quotaScript),
+	}, nil
+}
+
+// Close closes the Redis connection if the quota created it
+func (q *RedisQuota) Close() error {
+	if !q.ownsClient {
+		return nil
+	}
+	return q.client.Close()
+}
+
+// location returns the time zone whose calendar the given key follows
+func (q *RedisQuota) location(key string) *time.Location {
+	if q.config.LocationFunc != nil {
+		if loc := q.config.LocationFunc(key); loc != nil {
+			return loc
+		}
+	}
+	if q.config.Location != nil {
+		return q.config.Location
+	}
+	return time.UTC
+}
+
+// ParseQuotaLocations parses per-key time zones such as
+// "tenant:acme=America/New_York,tenant:eu-*=Europe/Berlin" into a LocationFunc. A trailing "*"
+// matches a key prefix. Like policy assignments, an exact key wins over prefixes and longer
+// prefixes win over shorter ones. An empty list returns nil.
+func ParseQuotaLocations(s string) (func(key string) *time.Location, error) {
+	exact := make(map[string]*time.Location)
+	prefixes := make(map[string]*time.Location)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, zone, ok := strings.Cut(field, "=")
+		key, zone = strings.TrimSpace(key), strings.TrimSpace(zone)
+		if !ok || key == "" || key == "*" {
+			return nil, fmt.Errorf("quota time zone %q: want <key>=<zone> or <prefix>*=<zone>", field)
+		}
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("quota time zone %q: %w", field, err)
+		}
+		if prefix, ok := strings.CutSuffix(key, "*"); ok {
+			prefixes[prefix] = loc
+		} else {
+			exact[key] = loc
+		}
+	}
+	if len(exact) == 0 && len(prefixes) == 0 {
+		return nil, nil
+	}
+
+	return func(key string) *time.Location {
+		if loc, ok := exact[key]; ok {
+			return loc
+		}
+		for i := len(key) - 1; i > 0; i-- {
+			if loc, ok := prefixes[key[:i]]; ok {
+				return loc
+			}
+		}
+		return nil
+	}, nil
+}
+
+// PeriodBounds returns the start and end of the period containing now in the given time zone
+func PeriodBounds(now time.Time, period QuotaPeriod, loc *time.Location, weekStart time.Weekday) (time.Time, time.Time) {
+	now = now.In(loc)
+	year, month, day := now.Date()
+
+	// time.Date and AddDate keep boundaries at local midnight across DST changes
+	switch period {
+	case QuotaHourly:
+		start := time.Date(year, month, day, now.Hour(), 0, 0, 0, loc)
+		return start, start.Add(time.Hour)
+	case QuotaWeekly:
+		back := (int(now.Weekday()) - int(weekStart) + 7) % 7
+		start := time.Date(year, month, day-back, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 7)
+	case QuotaMonthly:
+		start := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(year, month, day, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// keyName generates the Redis key of the counter for the period starting at start
+func (q *RedisQuota) keyName(key string, start time.Time) string {
+	return hashTagKey("quota", key) + ":" + strconv.FormatInt(start.Unix(), 10)
+}
+
+// run adds cost to the counter of the current period if it fits and returns the usage.
+// A negative cost gives units back and a cost of 0 only reads the counter.
+func (q *RedisQuota) run(ctx context.Context, key string, cost int64) (*QuotaResult, error) {
+	now := q.clock.Now()
+	start, end := PeriodBounds(now, q.config.Period, q.location(key), q.config.WeekStart)
+
+	// Let the counter outlive its period by a day so instances with skewed clocks agree on it
+	expireAt := end.Add(24 * time.Hour)
+
+	result, err := runScript(ctx, q.client, q.luaScript, "quota", []string{q.keyName(key, start)},
+		cost, q.config.Limit, expireAt.UnixMilli()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to update quota: %w", err)
+	}
+
+	values := result.([]interface{})
+	quotaResult := &QuotaResult{
+		Allowed:     parseInt64(values[0]) == 1,
+		Used:        parseInt64(values[1]),
+		Limit:       q.config.Limit,
+		Period:      string(q.config.Period),
+		PeriodStart: start,
+		PeriodEnd:   end,
+	}
+
+	quotaResult.Remaining = quotaResult.Limit - quotaResult.Used
+	if quotaResult.Remaining < 0 {
+		quotaResult.Remaining = 0
+	}
+	if cost == 0 {
+		// A read is allowed as long as anything is left
+		quotaResult.Allowed = quotaResult.Remaining > 0
+	}
+	if !quotaResult.Allowed {
+		quotaResult.RetryAfter = end.Sub(now).Seconds()
+	}
+
+	return quotaResult, nil
+}
+
+// Consume uses n units of the current period's quota. Nothing is used if the request
+// does not fit in what is left.
+func (q *RedisQuota) Consume(ctx context.Context, key string, n int64) (*QuotaResult, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("units must be positive")
+	}
+	return q.run(ctx, key, n)
+}
+
+// Usage returns the quota used in the current period without consuming anything
+func (q *RedisQuota) Usage(ctx context.Context, key string) (*QuotaResult, error) {
+	return q.run(ctx, key, 0)
+}
+
+// Refund gives n units back to the current period, e.g. when the request they paid for failed
+func (q *RedisQuota) Refund(ctx context.Context, key string, n float64) error {
+	cost, err := wholeCost(n)
+	if err != nil {
+		return err
+	}
+	_, err = q.run(ctx, key, -cost)
+	return err
+}
+
+// Allow implements Limiter by consuming n units of the quota
+func (q *RedisQuota) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	cost, err := wholeCost(n)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := q.Consume(ctx, key, cost)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.toResult(), nil
+}
+
+// Peek implements Limiter by reading the usage of the current period
+func (q *RedisQuota) Peek(ctx context.Context, key string) (*Result, error) {
+	result, err := q.Usage(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.toResult(), nil
+}
+
+// Reset implements Limiter by clearing the usage of the current period
+func (q *RedisQuota) Reset(ctx context.Context, key string) error {
+	start, _ := PeriodBounds(q.clock.Now(), q.config.Period, q.location(key), q.config.WeekStart)
+	return q.client.Del(ctx, q.keyName(key, start)).Err()
+}
+
+// toResult converts a quota result into the common Result type
+func (r *QuotaResult) toResult() *Result {
+	return &Result{
+		Allowed:    r.Allowed,
+		Remaining:  float64(r.Remaining),
+		Limit:      r.Limit,
+		ResetAt:    r.PeriodEnd,
+		Window:     r.PeriodEnd.Sub(r.PeriodStart).Seconds(),
+		RetryAfter: r.RetryAfter,
+	}
+}
+
+// Lua script for calendar quotas. The counter key already names the period, so a new
+// period simply starts a new counter.
+const quotaScript = `
+local key = KEYS[1]
+local cost = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+local expire_at = tonumber(ARGV[3])
+
+local used = tonumber(redis.call('GET', key) or '0')
+
+if cost < 0 then
+    -- Refunds never take usage below zero
+    local refund = math.min(-cost, used)
+    if refund > 0 then
+        used = redis.call('DECRBY', key, refund)
+    end
+    return {1, used}
+end
+
+if cost == 0 then
+    return {1, used}
+end
+
+if used + cost > limit then
+    return {0, used}
+end
+
+used = redis.call('INCRBY', key, cost)
+redis.call('PEXPIREAT', key, expire_at)
+
+return {1, used}
+`
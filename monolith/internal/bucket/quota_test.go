@@ -0,0 +1,305 @@
+package bucket
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func createTestQuota(tb interface{}, config *QuotaConfig, clock Clock) *RedisQuota {
+	config.RedisAddr = "localhost:6379"
+	config.RedisDB = 7 // Use different DB for quota tests
+
+	q, err := NewRedisQuota(config)
+	if err != nil {
+		switch v := tb.(type) {
+		case *testing.T:
+			v.Skipf("Redis not available: %v", err)
+		case *testing.B:
+			v.Skipf("Redis not available: %v", err)
+		}
+	}
+	q.clock = clock
+
+	// Counters of other periods survive Reset, so start from an empty database
+	q.client.FlushDB(context.Background())
+
+	return q
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("Time zone %s not available: %v", name, err)
+	}
+	return loc
+}
+
+func TestPeriodBounds(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	kolkata := mustLoadLocation(t, "Asia/Kolkata")
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		period    QuotaPeriod
+		loc       *time.Location
+		weekStart time.Weekday
+		wantStart time.Time
+		wantEnd   time.Time
+	}{
+		{
+			name:      "month in a customer time zone",
+			now:       time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC), // Still February in New York
+			period:    QuotaMonthly,
+			loc:       newYork,
+			wantStart: time.Date(2026, 2, 1, 0, 0, 0, 0, newYork),
+			wantEnd:   time.Date(2026, 3, 1, 0, 0, 0, 0, newYork),
+		},
+		{
+			name:      "day across a DST change",
+			now:       time.Date(2026, 3, 8, 12, 0, 0, 0, newYork),
+			period:    QuotaDaily,
+			loc:       newYork,
+			wantStart: time.Date(2026, 3, 8, 0, 0, 0, 0, newYork),
+			wantEnd:   time.Date(2026, 3, 9, 0, 0, 0, 0, newYork), // Only 23 hours long
+		},
+		{
+			name:      "week starting on Monday",
+			now:       time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC), // A Sunday
+			period:    QuotaWeekly,
+			loc:       time.UTC,
+			weekStart: time.Monday,
+			wantStart: time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC),
+			wantEnd:   time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:      "hour in a half-hour offset zone",
+			now:       time.Date(2026, 10, 16, 10, 15, 0, 0, time.UTC), // 15:45 in Kolkata
+			period:    QuotaHourly,
+			loc:       kolkata,
+			wantStart: time.Date(2026, 10, 16, 15, 0, 0, 0, kolkata),
+			wantEnd:   time.Date(2026, 10, 16, 16, 0, 0, 0, kolkata),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := PeriodBounds(tt.now, tt.period, tt.loc, tt.weekStart)
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("Expected [%v, %v), got [%v, %v)", tt.wantStart, tt.wantEnd, start, end)
+			}
+		})
+	}
+}
+
+func TestQuota_ResetsOnPeriodBoundary(t *testing.T) {
+	clock := NewManualClock(time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC))
+	q := createTestQuota(t, &QuotaConfig{Limit: 3, Period: QuotaMonthly}, clock)
+	defer q.Close()
+
+	ctx := context.Background()
+	key := "quota_monthly"
+	q.Reset(ctx, key)
+
+	result, err := q.Consume(ctx, key, 2)
+	if err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	if !result.Allowed || result.Used != 2 || result.Remaining != 1 {
+		t.Errorf("Expected 2 used and 1 remaining, got %+v", result)
+	}
+
+	// A request that does not fit uses nothing and waits for the 1st
+	result, err = q.Consume(ctx, key, 2)
+	if err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	if result.Allowed || result.Used != 2 {
+		t.Errorf("Expected denial with usage unchanged, got %+v", result)
+	}
+	if result.RetryAfter != 3600 {
+		t.Errorf("Expected RetryAfter of one hour until the reset, got %.0f", result.RetryAfter)
+	}
+
+	clock.Advance(2 * time.Hour)
+
+	result, err = q.Consume(ctx, key, 3)
+	if err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+	if !result.Allowed || result.Used != 3 {
+		t.Errorf("Expected the full quota in the new month, got %+v", result)
+	}
+	if want := time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC); !result.PeriodEnd.Equal(want) {
+		t.Errorf("Expected the quota to reset at %v, got %v", want, result.PeriodEnd)
+	}
+}
+
+func TestQuota_PerKeyTimeZone(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+
+	// 20:00 UTC on the 31st is already the 1st in Tokyo
+	clock := NewManualClock(time.Date(2026, 10, 31, 20, 0, 0, 0, time.UTC))
+	q := createTestQuota(t, &QuotaConfig{
+		Limit:  1,
+		Period: QuotaMonthly,
+		LocationFunc: func(key string) *time.Location {
+			if key == "quota_tokyo" {
+				return tokyo
+			}
+			return nil
+		},
+	}, clock)
+	defer q.Close()
+
+	ctx := context.Background()
+	for _, key := range []string{"quota_tokyo", "quota_utc"} {
+		q.Reset(ctx, key)
+		if _, err := q.Consume(ctx, key, 1); err != nil {
+			t.Fatalf("Consume failed: %v", err)
+		}
+	}
+
+	// Five hours later both keys are in November; only the UTC customer got a new quota
+	clock.Advance(5 * time.Hour)
+
+	tests := []struct {
+		key     string
+		allowed bool
+	}{
+		{key: "quota_tokyo", allowed: false},
+		{key: "quota_utc", allowed: true},
+	}
+
+	for _, tt := range tests {
+		result, err := q.Consume(ctx, tt.key, 1)
+		if err != nil {
+			t.Fatalf("Consume failed: %v", err)
+		}
+		if result.Allowed != tt.allowed {
+			t.Errorf("%s: expected allowed=%v, got %+v", tt.key, tt.allowed, result)
+		}
+	}
+}
+
+func TestParseQuotaLocations(t *testing.T) {
+	locations, err := ParseQuotaLocations("tenant:acme=Asia/Tokyo, tenant:*=Europe/Berlin,tenant:eu-*=Europe/Paris")
+	if err != nil {
+		t.Fatalf("ParseQuotaLocations failed: %v", err)
+	}
+
+	tests := []struct {
+		key      string
+		expected string
+	}{
+		{"tenant:acme", "Asia/Tokyo"},
+		{"tenant:acme2", "Europe/Berlin"},
+		{"tenant:eu-west", "Europe/Paris"},
+		{"ip:192.0.2.7", ""},
+	}
+	for _, tt := range tests {
+		name := ""
+		if loc := locations(tt.key); loc != nil {
+			name = loc.String()
+		}
+		if name != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.key, tt.expected, name)
+		}
+	}
+
+	if locations, err := ParseQuotaLocations(""); err != nil || locations != nil {
+		t.Errorf("Expected no LocationFunc for an empty list, got %v", err)
+	}
+	for _, invalid := range []string{"tenant:acme", "tenant:acme=Mars/Olympus", "*=UTC"} {
+		if _, err := ParseQuotaLocations(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestQuota_UsageAndRefund(t *testing.T) {
+	q := createTestQuota(t, &QuotaConfig{Limit: 10, Period: QuotaDaily}, RealClock{})
+	defer q.Close()
+
+	ctx := context.Background()
+	key := "quota_usage"
+	q.Reset(ctx, key)
+
+	if _, err := q.Consume(ctx, key, 4); err != nil {
+		t.Fatalf("Consume failed: %v", err)
+	}
+
+	// Reading the usage does not consume anything
+	for i := 0; i < 2; i++ {
+		usage, err := q.Usage(ctx, key)
+		if err != nil {
+			t.Fatalf("Usage failed: %v", err)
+		}
+		if usage.Used != 4 || usage.Remaining != 6 || !usage.Allowed {
+			t.Errorf("Expected 4 used and 6 remaining, got %+v", usage)
+		}
+	}
+
+	// Refunds never take usage below zero
+	if err := q.Refund(ctx, key, 10); err != nil {
+		t.Fatalf("Refund failed: %v", err)
+	}
+	usage, err := q.Usage(ctx, key)
+	if err != nil {
+		t.Fatalf("Usage failed: %v", err)
+	}
+	if usage.Used != 0 {
+		t.Errorf("Expected usage of 0 after refund, got %d", usage.Used)
+	}
+
+	if _, err := q.Consume(ctx, key, 0); err == nil {
+		t.Error("Expected error for 0 units")
+	}
+}
+
+func TestCompositeLimiter_RequiresAllLimiters(t *testing.T) {
+	tb := createTestBucket(t, 5, 0.01)
+	q := createTestQuota(t, &QuotaConfig{Limit: 3, Period: QuotaMonthly}, RealClock{})
+	limiter := NewCompositeLimiter(tb, q)
+	defer limiter.Close()
+
+	ctx := context.Background()
+	key := "composite_quota"
+	limiter.Reset(ctx, key)
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow(ctx, key, 1)
+		if err != nil {
+			t.Fatalf("Allow failed: %v", err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	// The quota refuses the fourth request and the token it took is refunded
+	result, err := limiter.Allow(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("Allow failed: %v", err)
+	}
+	if result.Allowed || result.Limit != 3 {
+		t.Errorf("Expected the quota to deny, got %+v", result)
+	}
+
+	state, err := tb.GetBucketState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.CurrentTokens < 2 || state.CurrentTokens > 2.1 {
+		t.Errorf("Expected 2 tokens left after the refund, got %.2f", state.CurrentTokens)
+	}
+
+	usage, err := limiter.Usage(ctx, key)
+	if err != nil {
+		t.Fatalf("Usage failed: %v", err)
+	}
+	if usage.Used != 3 {
+		t.Errorf("Expected quota usage of 3, got %d", usage.Used)
+	}
+}
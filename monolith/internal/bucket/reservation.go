@@ -0,0 +1,116 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Reservation holds tokens taken from a bucket ahead of time, modeled on rate.Reservation.
+// The tokens are deducted in Redis when the reservation is made, so reservations are shared
+// by every instance; Cancel gives them back if the work they paid for does not happen.
+type Reservation struct {
+	tb        *RedisTokenBucket
+	key       string
+	tokens    float64
+	ok        bool
+	timeToAct time.Time
+	result    *TokenResult
+
+	mu       sync.Mutex
+	canceled bool
+}
+
+// Reserve takes n tokens from the bucket and returns a reservation telling the caller how
+// long to wait before using them. The tokens are reserved however long the wait is, putting
+// the bucket into debt if needed; only a request larger than the bucket capacity is refused,
+// in which case OK reports false.
+func (tb *RedisTokenBucket) Reserve(ctx context.Context, key string, n float64) (*Reservation, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("tokens must be positive")
+	}
+
+	result, wait, err := tb.reserveTokens(ctx, key, n, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reservation{
+		tb:        tb,
+		key:       key,
+		tokens:    n,
+		ok:        result.Allowed,
+		timeToAct: time.Now().Add(time.Duration(wait * float64(time.Second))),
+		result:    result,
+	}, nil
+}
+
+// OK reports whether the tokens were reserved
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns how long to wait before the reserved tokens may be used
+func (r *Reservation) Delay() time.Duration {
+	if !r.ok {
+		return 0
+	}
+	if delay := time.Until(r.timeToAct); delay > 0 {
+		return delay
+	}
+	return 0
+}
+
+// Tokens returns the number of tokens held by the reservation
+func (r *Reservation) Tokens() float64 {
+	return r.tokens
+}
+
+// Result returns the bucket state at the time the reservation was made
+func (r *Reservation) Result() *TokenResult {
+	return r.result
+}
+
+// Cancel returns the reserved tokens to the bucket, capped at its capacity. It uses its own
+// timeout rather than a request context, so it still works after the client disconnected.
+// Calling Cancel more than once, or on a reservation that is not OK, does nothing.
+func (r *Reservation) Cancel() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.ok || r.canceled {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := r.tb.RefundTokens(ctx, r.key, r.tokens); err != nil {
+		return err
+	}
+	r.canceled = true
+
+	return nil
+}
+
+// RefundTokens returns tokens to a bucket, capped at its capacity, and returns the tokens
+// now in the bucket
+func (tb *RedisTokenBucket) RefundTokens(ctx context.Context, key string, tokens float64) (float64, error) {
+	if tokens <= 0 {
+		return 0, fmt.Errorf("tokens must be positive")
+	}
+
+	policyArg, capacity, refillRate, err := tb.policyArgs(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := runScript(ctx, tb.client, tb.luaScripts["refund_tokens"], "refund_tokens", tb.scriptKeys(key),
+		policyArg, tokens, capacity, refillRate, tb.config.TTL.Seconds()).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to refund tokens: %w", err)
+	}
+
+	return parseFloat64(result), nil
+}
@@ -0,0 +1,169 @@
+package bucket
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReserve_ImmediateWhenAvailable(t *testing.T) {
+	tb := createTestBucket(t, 10, 1.0) // 10 tokens, 1 token/sec
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "reserve_immediate"
+	tb.ResetBucket(ctx, key)
+
+	r, err := tb.Reserve(ctx, key, 4)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if !r.OK() {
+		t.Fatal("Expected reservation to be OK")
+	}
+	if r.Delay() != 0 {
+		t.Errorf("Expected no delay with tokens available, got %v", r.Delay())
+	}
+	if r.Result().RemainingTokens != 6 {
+		t.Errorf("Expected 6 remaining tokens, got %.1f", r.Result().RemainingTokens)
+	}
+}
+
+func TestReserve_DelayWhenInDebt(t *testing.T) {
+	tb := createTestBucket(t, 5, 10.0) // 5 tokens, 10 tokens/sec
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "reserve_debt"
+	tb.ResetBucket(ctx, key)
+
+	tests := []struct {
+		tokens    float64
+		wantDelay time.Duration
+	}{
+		{tokens: 5, wantDelay: 0},
+		{tokens: 3, wantDelay: 300 * time.Millisecond},
+		{tokens: 2, wantDelay: 500 * time.Millisecond}, // Queued behind the previous reservation
+	}
+
+	for i, tt := range tests {
+		r, err := tb.Reserve(ctx, key, tt.tokens)
+		if err != nil {
+			t.Fatalf("Reserve failed: %v", err)
+		}
+		if !r.OK() {
+			t.Fatalf("Expected reservation %d to be OK", i+1)
+		}
+		if diff := r.Delay() - tt.wantDelay; diff < -50*time.Millisecond || diff > 50*time.Millisecond {
+			t.Errorf("Reservation %d: expected delay of about %v, got %v", i+1, tt.wantDelay, r.Delay())
+		}
+	}
+}
+
+func TestReserve_LargerThanCapacity(t *testing.T) {
+	tb := createTestBucket(t, 5, 10.0)
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "reserve_too_large"
+	tb.ResetBucket(ctx, key)
+
+	r, err := tb.Reserve(ctx, key, 6)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if r.OK() {
+		t.Error("Expected a reservation above capacity not to be OK")
+	}
+	if err := r.Cancel(); err != nil {
+		t.Errorf("Cancel on a failed reservation should do nothing, got %v", err)
+	}
+
+	state, err := tb.GetBucketState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.CurrentTokens != 5 {
+		t.Errorf("Expected the bucket to be untouched, got %.1f tokens", state.CurrentTokens)
+	}
+
+	if _, err := tb.Reserve(ctx, key, 0); err == nil {
+		t.Error("Expected error for 0 tokens")
+	}
+}
+
+func TestReservation_Cancel(t *testing.T) {
+	tb := createTestBucket(t, 10, 0.01) // Slow refill so only refunds change the bucket
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "reserve_cancel"
+	tb.ResetBucket(ctx, key)
+
+	r, err := tb.Reserve(ctx, key, 4)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+
+	// Cancelling twice only refunds once
+	for i := 0; i < 2; i++ {
+		if err := r.Cancel(); err != nil {
+			t.Fatalf("Cancel failed: %v", err)
+		}
+	}
+
+	// Other requests took tokens in the meantime; the refund still goes back
+	r, err = tb.Reserve(ctx, key, 4)
+	if err != nil {
+		t.Fatalf("Reserve failed: %v", err)
+	}
+	if _, err := tb.TakeTokens(ctx, key, 3); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if err := r.Cancel(); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+
+	state, err := tb.GetBucketState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.CurrentTokens < 7 || state.CurrentTokens > 7.1 {
+		t.Errorf("Expected 7 tokens after cancelling, got %.2f", state.CurrentTokens)
+	}
+}
+
+func TestRefundTokens_CappedAtCapacity(t *testing.T) {
+	tb := createTestBucket(t, 10, 0.01)
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "refund_capped"
+	tb.ResetBucket(ctx, key)
+
+	if _, err := tb.TakeTokens(ctx, key, 3); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+
+	tests := []struct {
+		refund float64
+		want   float64
+	}{
+		{refund: 1, want: 8},
+		{refund: 5, want: 10}, // Capped at capacity
+	}
+
+	for _, tt := range tests {
+		tokens, err := tb.RefundTokens(ctx, key, tt.refund)
+		if err != nil {
+			t.Fatalf("RefundTokens failed: %v", err)
+		}
+		if tokens < tt.want || tokens > tt.want+0.1 {
+			t.Errorf("Expected %.0f tokens after refunding %.0f, got %.2f", tt.want, tt.refund, tokens)
+		}
+	}
+
+	if _, err := tb.RefundTokens(ctx, key, -1); err == nil {
+		t.Error("Expected error for a negative refund")
+	}
+}
@@ -2,13 +2,49 @@ package bucket
 
 import "github.com/go-redis/redis/v8"
 
+// Lua helper shared by the token bucket scripts that resolves the policy for a
+// bucket key. An exact key assignment wins over prefix assignments ("prefix*"),
+// and longer prefixes win over shorter ones. Falls back to the given defaults.
+// The prefixes are looked up in the prefix index, scored by length, so a miss costs one
+// ZREVRANGEBYSCORE over the assigned prefixes that are short enough instead of a HGET per
+// character of the key.
+// On Redis Cluster the policy tables are not passed; the client has already resolved the
+// policy and passes its name and limits in place of the bucket key and defaults.
+const resolvePolicyScript = `
+local function resolve_policy(policies_key, assignments_key, prefixes_key, bucket_key, default_capacity, default_refill_rate)
+    if not policies_key then
+        return bucket_key, default_capacity, default_refill_rate
+    end
+
+    local name = redis.call('HGET', assignments_key, bucket_key)
+    if not name then
+        local prefixes = redis.call('ZREVRANGEBYSCORE', prefixes_key, #bucket_key - 1, 0)
+        for _, prefix in ipairs(prefixes) do
+            if string.sub(bucket_key, 1, #prefix) == prefix then
+                name = redis.call('HGET', assignments_key, prefix .. '*')
+                break
+            end
+        end
+    end
+
+    if name then
+        local encoded = redis.call('HGET', policies_key, name)
+        if encoded then
+            local policy = cjson.decode(encoded)
+            return name, tonumber(policy.capacity), tonumber(policy.refill_rate)
+        end
+    end
+
+    return '', default_capacity, default_refill_rate
+end
+`
+
 // Lua script for atomic token consumption
-const takeTokensScript = `
+const takeTokensScript = resolvePolicyScript + `
 local key = KEYS[1]
-local requested_tokens = tonumber(ARGV[1])
-local capacity = tonumber(ARGV[2])
-local refill_rate = tonumber(ARGV[3])
-local ttl = tonumber(ARGV[4])
+local requested_tokens = tonumber(ARGV[2])
+local policy, capacity, refill_rate = resolve_policy(KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[3]), tonumber(ARGV[4]))
+local ttl = tonumber(ARGV[5])
 
 local now = redis.call('TIME')
 local current_time = tonumber(now[1]) + tonumber(now[2]) / 1000000
@@ -48,15 +84,15 @@ redis.call('HMSET', key,
 -- Set TTL
 redis.call('EXPIRE', key, ttl)
 
-return {allowed, new_tokens, retry_after}
+-- Fractions are returned as strings so Redis does not truncate them to integers
+return {allowed, tostring(new_tokens), tostring(retry_after), capacity, tostring(refill_rate), policy}
 `
 
 // Lua script for getting bucket state
-const getBucketStateScript = `
+const getBucketStateScript = resolvePolicyScript + `
 local key = KEYS[1]
-local capacity = tonumber(ARGV[1])
-local refill_rate = tonumber(ARGV[2])
-local ttl = tonumber(ARGV[3])
+local policy, capacity, refill_rate = resolve_policy(KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3]))
+local ttl = tonumber(ARGV[4])
 
 local now = redis.call('TIME')
 local current_time = tonumber(now[1]) + tonumber(now[2]) / 1000000
@@ -89,15 +125,14 @@ if bucket_ttl == -1 then
     redis.call('EXPIRE', key, ttl)
 end
 
-return {new_tokens, current_time, bucket_ttl}
+return {tostring(new_tokens), tostring(current_time), bucket_ttl, capacity, tostring(refill_rate), policy}
 `
 
 // Lua script for resetting a bucket
-const resetBucketScript = `
+const resetBucketScript = resolvePolicyScript + `
 local key = KEYS[1]
-local capacity = tonumber(ARGV[1])
-local refill_rate = tonumber(ARGV[2])
-local ttl = tonumber(ARGV[3])
+local policy, capacity, refill_rate = resolve_policy(KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3]))
+local ttl = tonumber(ARGV[4])
 
 local now = redis.call('TIME')
 local current_time = tonumber(now[1]) + tonumber(now[2]) / 1000000
@@ -115,9 +150,341 @@ redis.call('EXPIRE', key, ttl)
 return {capacity, current_time}
 `
 
+// Lua script for reserving tokens ahead of time. Unlike take_tokens it lets the bucket go
+// into debt (negative tokens) when the caller is willing to wait for the refill.
+const reserveTokensScript = resolvePolicyScript + `
+local key = KEYS[1]
+local requested_tokens = tonumber(ARGV[2])
+local policy, capacity, refill_rate = resolve_policy(KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[3]), tonumber(ARGV[4]))
+local ttl = tonumber(ARGV[5])
+local max_wait = tonumber(ARGV[6])
+
+local now = redis.call('TIME')
+local current_time = tonumber(now[1]) + tonumber(now[2]) / 1000000
+
+-- Get current bucket state
+local bucket_data = redis.call('HMGET', key, 'tokens', 'last_refill')
+local current_tokens = tonumber(bucket_data[1]) or capacity
+local last_refill = tonumber(bucket_data[2]) or current_time
+
+-- Calculate tokens to add based on time elapsed
+local time_elapsed = math.max(0, current_time - last_refill)
+local new_tokens = math.min(capacity, current_tokens + time_elapsed * refill_rate)
+
+local reserved = 0
+local wait = 0
+
+if requested_tokens > capacity then
+    -- The bucket can never hold this many tokens
+    wait = -1
+else
+    wait = math.max(0, requested_tokens - new_tokens) / refill_rate
+    if max_wait < 0 or wait <= max_wait then
+        new_tokens = new_tokens - requested_tokens
+        reserved = 1
+    end
+end
+
+redis.call('HMSET', key,
+    'tokens', new_tokens,
+    'last_refill', current_time,
+    'capacity', capacity,
+    'refill_rate', refill_rate
+)
+
+-- Keep the key at least until any debt has been paid back
+local refill_time = math.ceil((capacity - new_tokens) / refill_rate)
+redis.call('EXPIRE', key, math.max(ttl, refill_time))
+
+return {reserved, tostring(new_tokens), tostring(wait), capacity, tostring(refill_rate), policy}
+`
+
+// Lua script for returning tokens to a bucket, capped at its capacity
+const refundTokensScript = resolvePolicyScript + `
+local key = KEYS[1]
+local refund_tokens = tonumber(ARGV[2])
+local policy, capacity, refill_rate = resolve_policy(KEYS[2], KEYS[3], KEYS[4], ARGV[1], tonumber(ARGV[3]), tonumber(ARGV[4]))
+local ttl = tonumber(ARGV[5])
+
+local now = redis.call('TIME')
+local current_time = tonumber(now[1]) + tonumber(now[2]) / 1000000
+
+-- Get current bucket state
+local bucket_data = redis.call('HMGET', key, 'tokens', 'last_refill')
+local current_tokens = tonumber(bucket_data[1]) or capacity
+local last_refill = tonumber(bucket_data[2]) or current_time
+
+-- Refill first, then add the refunded tokens without exceeding capacity
+local time_elapsed = math.max(0, current_time - last_refill)
+local new_tokens = math.min(capacity, current_tokens + time_elapsed * refill_rate + refund_tokens)
+
+redis.call('HMSET', key,
+    'tokens', new_tokens,
+    'last_refill', current_time,
+    'capacity', capacity,
+    'refill_rate', refill_rate
+)
+
+local refill_time = math.ceil((capacity - new_tokens) / refill_rate)
+redis.call('EXPIRE', key, math.max(ttl, refill_time))
+
+return tostring(new_tokens)
+`
+
+// Lua script for consuming tokens from several buckets at once, e.g. global, tenant and user.
+// Every level is refilled and checked first; tokens are only deducted if all levels allow the
+// request, so a denial at any level leaves every bucket untouched.
+const takeTokensMultiScript = resolvePolicyScript + `
+local requested_tokens = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+
+-- KEYS holds one bucket per level, followed by the policy tables unless running on a cluster.
+-- ARGV holds a (policy argument, default capacity, default refill rate) triple per level.
+local num_levels = (#ARGV - 2) / 3
+local policies_key = KEYS[num_levels + 1]
+local assignments_key = KEYS[num_levels + 2]
+local prefixes_key = KEYS[num_levels + 3]
+
+local now = redis.call('TIME')
+local current_time = tonumber(now[1]) + tonumber(now[2]) / 1000000
+
+local levels = {}
+local denied_level = 0
+
+-- First pass: refill and check every level
+for i = 1, num_levels do
+    local key = KEYS[i]
+    local arg = 3 * i
+    local policy, capacity, refill_rate = resolve_policy(policies_key, assignments_key, prefixes_key, ARGV[arg], tonumber(ARGV[arg + 1]), tonumber(ARGV[arg + 2]))
+
+    local bucket_data = redis.call('HMGET', key, 'tokens', 'last_refill')
+    local current_tokens = tonumber(bucket_data[1]) or capacity
+    local last_refill = tonumber(bucket_data[2]) or current_time
+
+    local time_elapsed = math.max(0, current_time - last_refill)
+    local new_tokens = math.min(capacity, current_tokens + time_elapsed * refill_rate)
+
+    local allowed = 0
+    local retry_after = 0
+    if new_tokens >= requested_tokens then
+        allowed = 1
+    else
+        retry_after = (requested_tokens - new_tokens) / refill_rate
+        if denied_level == 0 then
+            denied_level = i
+        end
+    end
+
+    levels[#levels + 1] = {key, policy, capacity, refill_rate, new_tokens, allowed, retry_after}
+end
+
+-- Second pass: deduct from every level only if all of them allowed the request
+local reply = {denied_level}
+for _, level in ipairs(levels) do
+    local key, policy, capacity, refill_rate, new_tokens, allowed, retry_after = unpack(level)
+    if denied_level == 0 then
+        new_tokens = new_tokens - requested_tokens
+    end
+
+    redis.call('HMSET', key,
+        'tokens', new_tokens,
+        'last_refill', current_time,
+        'capacity', capacity,
+        'refill_rate', refill_rate
+    )
+    redis.call('EXPIRE', key, ttl)
+
+    reply[#reply + 1] = {allowed, tostring(new_tokens), tostring(retry_after), capacity, tostring(refill_rate), policy}
+end
+
+return reply
+`
+
+// Lua script for consuming tokens for a batch of keys. Items are refilled and checked in
+// order against a running balance per bucket. A non-atomic batch deducts every allowed item;
+// an atomic batch only deducts if all items are allowed.
+const takeTokensBatchScript = resolvePolicyScript + `
+local atomic = ARGV[1] == '1'
+local ttl = tonumber(ARGV[2])
+
+-- KEYS holds one bucket per item, followed by the policy tables unless running on a cluster.
+-- ARGV holds (tokens, policy mode, policy argument, default capacity, default refill rate)
+-- per item. Mode "policy" names the policy; mode "key" resolves it from the bucket key.
+local num_items = (#ARGV - 2) / 5
+local policies_key = KEYS[num_items + 1]
+local assignments_key = KEYS[num_items + 2]
+local prefixes_key = KEYS[num_items + 3]
+
+local now = redis.call('TIME')
+local current_time = tonumber(now[1]) + tonumber(now[2]) / 1000000
+
+local buckets = {}
+local order = {}
+local items = {}
+local denied_item = 0
+
+for i = 1, num_items do
+    local key = KEYS[i]
+    local arg = 5 * i - 2
+    local requested_tokens = tonumber(ARGV[arg])
+
+    local policy, capacity, refill_rate
+    if ARGV[arg + 1] == 'policy' and policies_key then
+        local encoded = redis.call('HGET', policies_key, ARGV[arg + 2])
+        if not encoded then
+            return {-i}
+        end
+        local decoded = cjson.decode(encoded)
+        policy, capacity, refill_rate = ARGV[arg + 2], tonumber(decoded.capacity), tonumber(decoded.refill_rate)
+    else
+        policy, capacity, refill_rate = resolve_policy(policies_key, assignments_key, prefixes_key, ARGV[arg + 2], tonumber(ARGV[arg + 3]), tonumber(ARGV[arg + 4]))
+    end
+
+    local bucket = buckets[key]
+    if not bucket then
+        local bucket_data = redis.call('HMGET', key, 'tokens', 'last_refill')
+        local current_tokens = tonumber(bucket_data[1]) or capacity
+        local last_refill = tonumber(bucket_data[2]) or current_time
+        local time_elapsed = math.max(0, current_time - last_refill)
+        local refilled = math.min(capacity, current_tokens + time_elapsed * refill_rate)
+
+        bucket = {refilled = refilled, tokens = refilled}
+        buckets[key] = bucket
+        order[#order + 1] = key
+    end
+    bucket.capacity = capacity
+    bucket.refill_rate = refill_rate
+
+    local allowed = 0
+    local retry_after = 0
+    if bucket.tokens >= requested_tokens then
+        bucket.tokens = bucket.tokens - requested_tokens
+        allowed = 1
+    else
+        retry_after = (requested_tokens - bucket.tokens) / refill_rate
+        if denied_item == 0 then
+            denied_item = i
+        end
+    end
+
+    items[i] = {key, allowed, bucket.tokens, retry_after, capacity, refill_rate, policy}
+end
+
+-- An atomic batch with a denied item gives back everything it took
+local rollback = atomic and denied_item > 0
+
+for _, key in ipairs(order) do
+    local bucket = buckets[key]
+    if rollback then
+        bucket.tokens = bucket.refilled
+    end
+
+    redis.call('HMSET', key,
+        'tokens', bucket.tokens,
+        'last_refill', current_time,
+        'capacity', bucket.capacity,
+        'refill_rate', bucket.refill_rate
+    )
+    redis.call('EXPIRE', key, ttl)
+end
+
+local reply = {denied_item}
+for _, item in ipairs(items) do
+    local key, allowed, remaining, retry_after, capacity, refill_rate, policy = unpack(item)
+    if rollback then
+        remaining = buckets[key].tokens
+    end
+    reply[#reply + 1] = {allowed, tostring(remaining), tostring(retry_after), capacity, tostring(refill_rate), policy}
+end
+
+return reply
+`
+
+// Lua helper shared by the policy scripts that removes an assignment and, for a prefix, its
+// entry in the prefix index
+const unassignHelperScript = `
+local function unassign(assignments_key, prefixes_key, pattern)
+    local removed = redis.call('HDEL', assignments_key, pattern)
+    if string.sub(pattern, -1) == '*' then
+        redis.call('ZREM', prefixes_key, string.sub(pattern, 1, -2))
+    end
+    return removed
+end
+`
+
+// Lua script for deleting a policy together with every assignment that references it
+const deletePolicyScript = unassignHelperScript + `
+local policies_key = KEYS[1]
+local assignments_key = KEYS[2]
+local prefixes_key = KEYS[3]
+local name = ARGV[1]
+
+local deleted = redis.call('HDEL', policies_key, name)
+
+local assignments = redis.call('HGETALL', assignments_key)
+for i = 1, #assignments, 2 do
+    if assignments[i + 1] == name then
+        unassign(assignments_key, prefixes_key, assignments[i])
+    end
+end
+
+return deleted
+`
+
+// Lua script for assigning a policy to a key or prefix. Checking that the policy exists and
+// assigning it happen atomically, so a concurrent delete cannot leave a dangling assignment.
+const assignPolicyScript = `
+local policies_key = KEYS[1]
+local assignments_key = KEYS[2]
+local prefixes_key = KEYS[3]
+local pattern = ARGV[1]
+local name = ARGV[2]
+
+if redis.call('HEXISTS', policies_key, name) == 0 then
+    return 0
+end
+
+redis.call('HSET', assignments_key, pattern, name)
+if string.sub(pattern, -1) == '*' then
+    redis.call('ZADD', prefixes_key, #pattern - 1, string.sub(pattern, 1, -2))
+end
+
+return 1
+`
+
+// Lua script for removing the assignment of a key or prefix
+const unassignPolicyScript = unassignHelperScript + `
+return unassign(KEYS[1], KEYS[2], ARGV[1])
+`
+
+// Lua script for rebuilding the prefix index from the assignments, for assignments made
+// before the index existed
+const indexPolicyPrefixesScript = `
+local assignments_key = KEYS[1]
+local prefixes_key = KEYS[2]
+
+redis.call('DEL', prefixes_key)
+local patterns = redis.call('HKEYS', assignments_key)
+for _, pattern in ipairs(patterns) do
+    if string.sub(pattern, -1) == '*' then
+        redis.call('ZADD', prefixes_key, #pattern - 1, string.sub(pattern, 1, -2))
+    end
+end
+
+return redis.call('ZCARD', prefixes_key)
+`
+
 // initLuaScripts initializes all Lua scripts
 func (tb *RedisTokenBucket) initLuaScripts() {
 	tb.luaScripts["take_tokens"] = redis.NewScript(takeTokensScript)
 	tb.luaScripts["get_state"] = redis.NewScript(getBucketStateScript)
 	tb.luaScripts["reset_bucket"] = redis.NewScript(resetBucketScript)
+	tb.luaScripts["delete_policy"] = redis.NewScript(deletePolicyScript)
+	tb.luaScripts["assign_policy"] = redis.NewScript(assignPolicyScript)
+	tb.luaScripts["unassign_policy"] = redis.NewScript(unassignPolicyScript)
+	tb.luaScripts["index_policy_prefixes"] = redis.NewScript(indexPolicyPrefixesScript)
+	tb.luaScripts["reserve_tokens"] = redis.NewScript(reserveTokensScript)
+	tb.luaScripts["refund_tokens"] = redis.NewScript(refundTokensScript)
+	tb.luaScripts["take_tokens_multi"] = redis.NewScript(takeTokensMultiScript)
+	tb.luaScripts["take_tokens_batch"] = redis.NewScript(takeTokensBatchScript)
 }
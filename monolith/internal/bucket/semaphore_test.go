@@ -0,0 +1,213 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createTestSemaphore(tb interface{}, limit int64, leaseTTL time.Duration) *RedisSemaphore {
+	config := &SemaphoreConfig{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       6, // Use different DB for semaphore tests
+		Limit:         limit,
+		LeaseTTL:      leaseTTL,
+	}
+
+	sem, err := NewRedisSemaphore(config)
+	if err != nil {
+		switch v := tb.(type) {
+		case *testing.T:
+			v.Skipf("Redis not available: %v", err)
+		case *testing.B:
+			v.Skipf("Redis not available: %v", err)
+		}
+	}
+
+	return sem
+}
+
+func TestSemaphore_AcquireAndRelease(t *testing.T) {
+	sem := createTestSemaphore(t, 3, time.Minute)
+	defer sem.Close()
+
+	ctx := context.Background()
+	key := "semaphore_basic"
+	sem.Reset(ctx, key)
+
+	leases := make([]*SemaphoreLease, 0, 3)
+	for i := 0; i < 3; i++ {
+		result, err := sem.Acquire(ctx, key)
+		if err != nil {
+			t.Fatalf("Acquire failed: %v", err)
+		}
+		if !result.Acquired || result.InFlight != int64(i+1) {
+			t.Fatalf("Expected slot %d to be acquired, got %+v", i+1, result)
+		}
+		leases = append(leases, result.Lease)
+	}
+
+	result, err := sem.Acquire(ctx, key)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if result.Acquired {
+		t.Error("Expected acquire beyond the limit to fail")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 60 {
+		t.Errorf("Expected RetryAfter up to the lease TTL, got %.3f", result.RetryAfter)
+	}
+
+	// Releasing a slot lets the next holder in; releasing it again does nothing
+	for i := 0; i < 2; i++ {
+		if err := sem.Release(ctx, leases[0]); err != nil {
+			t.Fatalf("Release failed: %v", err)
+		}
+	}
+	if inFlight, err := sem.InFlight(ctx, key); err != nil || inFlight != 2 {
+		t.Errorf("Expected 2 in flight after release, got %d (%v)", inFlight, err)
+	}
+
+	result, err = sem.Acquire(ctx, key)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if !result.Acquired {
+		t.Error("Expected acquire to succeed after release")
+	}
+}
+
+func TestSemaphore_ExpiredLeasesAreReclaimed(t *testing.T) {
+	sem := createTestSemaphore(t, 1, 200*time.Millisecond)
+	defer sem.Close()
+
+	ctx := context.Background()
+	key := "semaphore_expiry"
+	sem.Reset(ctx, key)
+
+	// A holder that crashes never releases its slot
+	result, err := sem.Acquire(ctx, key)
+	if err != nil || !result.Acquired {
+		t.Fatalf("Expected the first acquire to succeed: %v", err)
+	}
+	crashed := result.Lease
+
+	if result, err := sem.Acquire(ctx, key); err != nil || result.Acquired {
+		t.Fatalf("Expected the slot to be taken: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	result, err = sem.Acquire(ctx, key)
+	if err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if !result.Acquired {
+		t.Error("Expected the expired lease to be reclaimed")
+	}
+
+	// The crashed holder cannot renew a lease that was reclaimed
+	if err := sem.Renew(ctx, crashed); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected ErrLeaseLost, got %v", err)
+	}
+}
+
+func TestSemaphore_RenewKeepsLease(t *testing.T) {
+	sem := createTestSemaphore(t, 1, 200*time.Millisecond)
+	defer sem.Close()
+
+	ctx := context.Background()
+	key := "semaphore_renew"
+	sem.Reset(ctx, key)
+
+	result, err := sem.Acquire(ctx, key)
+	if err != nil || !result.Acquired {
+		t.Fatalf("Expected acquire to succeed: %v", err)
+	}
+	lease := result.Lease
+
+	// Renewing more often than the TTL keeps the slot past its original expiry
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		before := lease.ExpiresAt
+		if err := sem.Renew(ctx, lease); err != nil {
+			t.Fatalf("Renew failed: %v", err)
+		}
+		if !lease.ExpiresAt.After(before) {
+			t.Errorf("Expected renew to move the expiry forward, got %v after %v", lease.ExpiresAt, before)
+		}
+	}
+
+	if result, err := sem.Acquire(ctx, key); err != nil || result.Acquired {
+		t.Errorf("Expected the renewed lease to still hold the slot: %v", err)
+	}
+}
+
+func TestSemaphore_ConcurrencyAcrossInstances(t *testing.T) {
+	const limit = 5
+	const numInstances = 3
+	const numGoroutines = 100
+
+	instances := make([]*RedisSemaphore, numInstances)
+	for i := range instances {
+		instances[i] = createTestSemaphore(t, limit, time.Minute)
+		defer instances[i].Close()
+	}
+
+	ctx := context.Background()
+	key := "semaphore_concurrency"
+	instances[0].Reset(ctx, key)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	acquired := 0
+
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+
+			result, err := instances[index%numInstances].Acquire(ctx, key)
+			if err != nil {
+				t.Errorf("Acquire failed in goroutine %d: %v", index, err)
+				return
+			}
+
+			mu.Lock()
+			if result.Acquired {
+				acquired++
+			}
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	if acquired != limit {
+		t.Errorf("Expected exactly %d slots acquired, got %d", limit, acquired)
+	}
+}
+
+func BenchmarkSemaphore_AcquireRelease(b *testing.B) {
+	sem := createTestSemaphore(b, 1000000, time.Minute)
+	defer sem.Close()
+
+	ctx := context.Background()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			result, err := sem.Acquire(ctx, "benchmark_semaphore")
+			if err != nil {
+				b.Errorf("Acquire failed: %v", err)
+				continue
+			}
+			if result.Acquired {
+				sem.Release(ctx, result.Lease)
+			}
+		}
+	})
+}
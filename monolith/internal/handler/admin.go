@@ -0,0 +1,227 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"monolith/internal/bucket"
+)
+
+// adminTimeout bounds admin operations, which may scan the whole keyspace
+const adminTimeout = 30 * time.Second
+
+// ImportBucketsRequest represents the body for importing exported keys
+type ImportBucketsRequest struct {
+	Keys []*bucket.KeyExport `json:"keys"`
+}
+
+// AdminAuth returns middleware that requires "Authorization: Bearer <token>" on the admin
+// endpoints. With an empty token the admin API is disabled.
+func (h *Handler) AdminAuth(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				h.writeErrorResponse(w, http.StatusForbidden, "admin_disabled",
+					"The admin API is disabled because no admin token is configured")
+				return
+			}
+
+			provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				h.writeErrorResponse(w, http.StatusUnauthorized, "unauthorized",
+					"A valid admin bearer token is required")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// keyAdmin returns the limiter's key administrator, writing an error response if it has none
+func (h *Handler) keyAdmin(w http.ResponseWriter) (*bucket.KeyAdmin, bool) {
+	provider, ok := h.bucket.(bucket.AdminProvider)
+	if !ok {
+		h.writeErrorResponse(w, http.StatusNotImplemented, "admin_unsupported",
+			"The configured limiter does not support key administration")
+		return nil, false
+	}
+	return provider.Admin(), true
+}
+
+// keyFilter reads the namespace and pattern query parameters
+func keyFilter(r *http.Request) bucket.KeyFilter {
+	return bucket.KeyFilter{
+		Namespace: r.URL.Query().Get("namespace"),
+		Pattern:   r.URL.Query().Get("pattern"),
+	}
+}
+
+// ListBuckets handles GET /api/admin/buckets - returns one page of keys and their state
+func (h *Handler) ListBuckets(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	admin, ok := h.keyAdmin(w)
+	if !ok {
+		return
+	}
+
+	count := int64(100)
+	if countStr := r.URL.Query().Get("count"); countStr != "" {
+		parsed, err := strconv.ParseInt(countStr, 10, 64)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			h.writeErrorResponse(w, http.StatusBadRequest, "invalid_count", "Count must be between 1 and 1000")
+			return
+		}
+		count = parsed
+	}
+
+	page, err := admin.List(ctx, keyFilter(r), r.URL.Query().Get("cursor"), count)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "list_failed",
+			fmt.Sprintf("Failed to list keys: %v", err))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"keys":        page.Keys,
+		"next_cursor": page.NextCursor,
+	})
+}
+
+// InspectBucket handles GET /api/admin/buckets/inspect - returns the state of one key
+func (h *Handler) InspectBucket(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	admin, ok := h.keyAdmin(w)
+	if !ok {
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "missing_key", "Key parameter is required")
+		return
+	}
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		namespace = bucket.NamespaceTokenBucket
+	}
+
+	info, err := admin.Inspect(ctx, namespace, key)
+	if errors.Is(err, bucket.ErrKeyNotFound) {
+		h.writeErrorResponse(w, http.StatusNotFound, "key_not_found",
+			fmt.Sprintf("No %s state for key %q", namespace, key))
+		return
+	}
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "inspect_failed",
+			fmt.Sprintf("Failed to inspect key: %v", err))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"key":     info,
+	})
+}
+
+// ResetBuckets handles POST /api/admin/buckets/reset - deletes every key matching a pattern,
+// e.g. {"namespace":"token_bucket","pattern":"user:*"}. Use "*" to match every key.
+func (h *Handler) ResetBuckets(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	admin, ok := h.keyAdmin(w)
+	if !ok {
+		return
+	}
+
+	var filter bucket.KeyFilter
+	if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_json",
+			"Request body must be JSON with a namespace and pattern")
+		return
+	}
+	if filter.Pattern == "" {
+		// An empty pattern matches everything; make callers say so explicitly
+		h.writeErrorResponse(w, http.StatusBadRequest, "missing_pattern", "Pattern is required")
+		return
+	}
+
+	deleted, err := admin.Delete(ctx, filter)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "reset_failed",
+			fmt.Sprintf("Failed to reset keys: %v", err))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"deleted": deleted,
+	})
+}
+
+// ExportBuckets handles GET /api/admin/buckets/export - returns the state of every matching key
+func (h *Handler) ExportBuckets(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	admin, ok := h.keyAdmin(w)
+	if !ok {
+		return
+	}
+
+	exports, err := admin.Export(ctx, keyFilter(r))
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "export_failed",
+			fmt.Sprintf("Failed to export keys: %v", err))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"keys":    exports,
+	})
+}
+
+// ImportBuckets handles POST /api/admin/buckets/import - writes keys from an export
+func (h *Handler) ImportBuckets(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	admin, ok := h.keyAdmin(w)
+	if !ok {
+		return
+	}
+
+	var req ImportBucketsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_json",
+			"Request body must be the JSON returned by the export endpoint")
+		return
+	}
+
+	imported, err := admin.Import(ctx, req.Keys)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "import_failed",
+			fmt.Sprintf("Failed to import keys: %v", err))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"imported": imported,
+	})
+}
@@ -0,0 +1,205 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"monolith/internal/bucket"
+)
+
+// AssignPolicyRequest represents the body for assigning a policy to a key or key prefix
+type AssignPolicyRequest struct {
+	Pattern string `json:"pattern"`
+	Policy  string `json:"policy"`
+}
+
+// policyStore returns the limiter's policy store, writing an error response if it has none
+func (h *Handler) policyStore(w http.ResponseWriter) (bucket.PolicyStore, bool) {
+	store, ok := h.bucket.(bucket.PolicyStore)
+	if !ok {
+		h.writeErrorResponse(w, http.StatusNotImplemented, "policies_unsupported",
+			"The configured limiter does not support policies")
+		return nil, false
+	}
+	return store, true
+}
+
+// ListPolicies handles GET /api/policies - returns all policies and their assignments
+func (h *Handler) ListPolicies(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	store, ok := h.policyStore(w)
+	if !ok {
+		return
+	}
+
+	policies, err := store.ListPolicies(ctx)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "policy_error",
+			fmt.Sprintf("Failed to list policies: %v", err))
+		return
+	}
+
+	assignments, err := store.ListAssignments(ctx)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "policy_error",
+			fmt.Sprintf("Failed to list policy assignments: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":     true,
+		"policies":    policies,
+		"assignments": assignments,
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, response)
+}
+
+// SetPolicy handles POST/PUT /api/policies - creates or updates a policy
+func (h *Handler) SetPolicy(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	store, ok := h.policyStore(w)
+	if !ok {
+		return
+	}
+
+	var policy bucket.Policy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_json", "Request body must be a JSON policy")
+		return
+	}
+
+	if err := policy.Validate(); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_policy", err.Error())
+		return
+	}
+
+	if err := store.SetPolicy(ctx, &policy); err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "policy_error",
+			fmt.Sprintf("Failed to set policy: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Policy '%s' has been saved", policy.Name),
+		"policy":  policy,
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, response)
+}
+
+// DeletePolicy handles DELETE /api/policies?name=<name> - deletes a policy and its assignments
+func (h *Handler) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	store, ok := h.policyStore(w)
+	if !ok {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "missing_name", "Name parameter is required")
+		return
+	}
+
+	err := store.DeletePolicy(ctx, name)
+	if errors.Is(err, bucket.ErrPolicyNotFound) {
+		h.writeErrorResponse(w, http.StatusNotFound, "policy_not_found",
+			fmt.Sprintf("Policy '%s' does not exist", name))
+		return
+	}
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "policy_error",
+			fmt.Sprintf("Failed to delete policy: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Policy '%s' has been deleted", name),
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, response)
+}
+
+// AssignPolicy handles POST /api/policies/assign - assigns a policy to a key or key prefix
+func (h *Handler) AssignPolicy(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	store, ok := h.policyStore(w)
+	if !ok {
+		return
+	}
+
+	var req AssignPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_json", "Request body must be JSON")
+		return
+	}
+
+	if req.Pattern == "" || req.Policy == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_assignment", "Pattern and policy are required")
+		return
+	}
+
+	err := store.AssignPolicy(ctx, req.Pattern, req.Policy)
+	if errors.Is(err, bucket.ErrPolicyNotFound) {
+		h.writeErrorResponse(w, http.StatusNotFound, "policy_not_found",
+			fmt.Sprintf("Policy '%s' does not exist", req.Policy))
+		return
+	}
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "policy_error",
+			fmt.Sprintf("Failed to assign policy: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Policy '%s' assigned to '%s'", req.Policy, req.Pattern),
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, response)
+}
+
+// UnassignPolicy handles DELETE /api/policies/assign?pattern=<pattern> - removes an assignment
+func (h *Handler) UnassignPolicy(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	store, ok := h.policyStore(w)
+	if !ok {
+		return
+	}
+
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "missing_pattern", "Pattern parameter is required")
+		return
+	}
+
+	if err := store.UnassignPolicy(ctx, pattern); err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "policy_error",
+			fmt.Sprintf("Failed to unassign policy: %v", err))
+		return
+	}
+
+	response := map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Policy assignment for '%s' has been removed", pattern),
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"monolith/internal/bucket"
+)
+
+// QuotaUsageResponse represents the response for a quota usage query
+type QuotaUsageResponse struct {
+	*bucket.QuotaResult
+	Key     string `json:"key"`
+	Success bool   `json:"success"`
+}
+
+// QuotaUsage handles GET /api/quota - returns the quota used in the current calendar period
+func (h *Handler) QuotaUsage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	reader, ok := h.bucket.(bucket.QuotaReader)
+	if !ok {
+		h.writeErrorResponse(w, http.StatusNotImplemented, "quota_unsupported",
+			"The configured limiter does not have a calendar quota")
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "missing_key", "Key parameter is required")
+		return
+	}
+
+	usage, err := reader.Usage(ctx, key)
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "quota_error",
+			fmt.Sprintf("Failed to get quota usage: %v", err))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, QuotaUsageResponse{
+		QuotaResult: usage,
+		Key:         key,
+		Success:     true,
+	})
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Rate limiter metrics. Labels only take values from bounded sets: route templates, policy
+// names, script names and failure modes. Client keys never become labels.
+var (
+	factory = promauto.With(Registry)
+
+	// Decisions counts rate limit decisions by route, policy and outcome
+	Decisions = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_decisions_total",
+		Help: "Rate limit decisions by route template, policy and outcome (allowed, denied, blocked, failed_open, error, exempt).",
+	}, []string{"route", "policy", "decision"})
+
+	// ScriptDuration observes the latency of the Redis Lua scripts
+	ScriptDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ratelimit_redis_script_duration_seconds",
+		Help:    "Latency of Redis Lua script calls by script.",
+		Buckets: ScriptBuckets,
+	}, []string{"script"})
+
+	// RedisErrors counts failed Redis script calls
+	RedisErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_redis_errors_total",
+		Help: "Redis script calls that returned an error, by script.",
+	}, []string{"script"})
+
+	// FallbackActive is the number of rate limiters currently running in their failure mode
+	FallbackActive = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ratelimit_fallback_active",
+		Help: "Rate limiters currently bypassing Redis, by failure mode.",
+	}, []string{"mode"})
+
+	// FallbackActivations counts switches from Redis to the failure mode
+	FallbackActivations = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_fallback_activations_total",
+		Help: "Times a rate limiter switched from Redis to its failure mode, by failure mode.",
+	}, []string{"mode"})
+
+	// AdaptiveRate is the refill rate of adaptive policies after their last evaluation
+	AdaptiveRate = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ratelimit_adaptive_refill_rate",
+		Help: "Refill rate in tokens per second of adaptive policies, by policy.",
+	}, []string{"policy"})
+)
+
+// Decision outcomes
+const (
+	DecisionAllowed    = "allowed"
+	DecisionDenied     = "denied"
+	DecisionBlocked    = "blocked"
+	DecisionFailedOpen = "failed_open"
+	DecisionError      = "error"
+	DecisionExempt     = "exempt"
+)
+
+// RouteLabel returns the route template of the request (e.g. "/api/users/{id}"), so every
+// user ID does not become its own series. Requests that matched no route share one label.
+func RouteLabel(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+// PolicyLabel returns the policy label for a decision; buckets without a policy use "default"
+func PolicyLabel(policy string) string {
+	if policy == "" {
+		return "default"
+	}
+	return policy
+}
+
+// ObserveDecision counts one rate limit decision for a request
+func ObserveDecision(r *http.Request, policy string, decision string) {
+	Decisions.WithLabelValues(RouteLabel(r), PolicyLabel(policy), decision).Inc()
+}
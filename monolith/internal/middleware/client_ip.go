@@ -0,0 +1,244 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipv6GroupBits is the prefix length IPv6 clients are grouped by. A single subscriber usually
+// gets a whole /64, so keying on the full address would hand out a bucket per address.
+const ipv6GroupBits = 64
+
+// credentialDigestLength is the number of hex characters of the SHA-256 of a credential kept
+// in its client key
+const credentialDigestLength = 32
+
+// Forwarding headers a trusted proxy can name the client in
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded" // RFC 7239
+	HeaderXRealIP       = "X-Real-IP"
+)
+
+// Proxies describes the reverse proxies in front of the server. Only the one header the
+// proxies set is read: proxies append to or overwrite their own header but pass every other
+// forwarding header from the client through untouched.
+type Proxies struct {
+	Trusted []netip.Prefix // Networks of the proxies; none means forwarding headers are ignored
+	Header  string         // HeaderXForwardedFor (the default), HeaderForwarded or HeaderXRealIP
+}
+
+// ParseProxyHeader returns the canonical name of a forwarding header; empty means
+// X-Forwarded-For
+func ParseProxyHeader(s string) (string, error) {
+	for _, header := range []string{HeaderXForwardedFor, HeaderForwarded, HeaderXRealIP} {
+		if strings.EqualFold(s, header) {
+			return header, nil
+		}
+	}
+	if s == "" {
+		return HeaderXForwardedFor, nil
+	}
+	return "", fmt.Errorf("unknown forwarding header %q (want X-Forwarded-For, Forwarded or X-Real-IP)", s)
+}
+
+// ParseTrustedProxies parses a comma-separated list of proxy networks such as
+// "10.0.0.0/8,192.0.2.1". An empty list trusts no proxy.
+func ParseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		prefix, err := parsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", field, err)
+		}
+		proxies = append(proxies, prefix)
+	}
+	return proxies, nil
+}
+
+// parsePrefix parses a CIDR or a single address, which becomes a prefix of its full length
+func parsePrefix(s string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(s)
+		if addrErr != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return prefix.Masked(), nil
+}
+
+// trusted reports whether an address belongs to one of the trusted proxies
+func trusted(addr netip.Addr, proxies []netip.Prefix) bool {
+	for _, proxy := range proxies {
+		if proxy.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of a request. The forwarding header is only
+// believed when the connection comes from a trusted proxy. Its chain is then walked from the
+// right, skipping trusted proxies, and the first untrusted address is the client. It returns
+// false if the connection address cannot be parsed.
+func clientIP(r *http.Request, proxies Proxies) (netip.Addr, bool) {
+	remote, ok := parseNode(r.RemoteAddr)
+	if !ok || !trusted(remote, proxies.Trusted) {
+		return remote, ok
+	}
+
+	var hops []string
+	switch proxies.Header {
+	case HeaderForwarded:
+		hops = forwardedFor(r.Header)
+	case HeaderXRealIP:
+		// The proxy overwrites it, so there is a single value
+		if value := r.Header.Get(HeaderXRealIP); value != "" {
+			hops = []string{strings.TrimSpace(value)}
+		}
+	default:
+		hops = xForwardedFor(r.Header)
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseNode(hops[i])
+		if !ok {
+			// "unknown", an obfuscated identifier or garbage: nothing further left can be
+			// trusted, so the last hop we could read is the client
+			break
+		}
+		client = addr
+		if !trusted(addr, proxies.Trusted) {
+			break
+		}
+	}
+	return client, true
+}
+
+// forwardedFor returns the for= nodes of all Forwarded headers.
+// Elements without for= are kept as empty nodes, so they end the walk through the chain.
+func forwardedFor(h http.Header) []string {
+	var nodes []string
+	for _, value := range h.Values("Forwarded") {
+		for _, element := range splitQuoted(value, ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					node = strings.Trim(strings.TrimSpace(value), `"`)
+				}
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// xForwardedFor returns the addresses of all X-Forwarded-For headers
+func xForwardedFor(h http.Header) []string {
+	var nodes []string
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(value, ",") {
+			nodes = append(nodes, strings.TrimSpace(node))
+		}
+	}
+	return nodes
+}
+
+// splitQuoted splits s at sep outside of double-quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseNode parses an address with or without a port, such as "192.0.2.1", "192.0.2.1:80",
+// "2001:db8::1" or "[2001:db8::1]:80". IPv4-mapped IPv6 addresses become IPv4.
+func parseNode(node string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(strings.Trim(node, "[]"))
+	if err != nil {
+		addrPort, portErr := netip.ParseAddrPort(node)
+		if portErr != nil {
+			return netip.Addr{}, false
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+// ipGroup returns the address a client is keyed by: IPv4 addresses as they are and IPv6
+// addresses as their /64 network, e.g. "2001:db8:1:2::/64"
+func ipGroup(addr netip.Addr) string {
+	if addr.Is4() {
+		return addr.String()
+	}
+	return netip.PrefixFrom(addr, ipv6GroupBits).Masked().String()
+}
+
+// hashCredential returns a digest of a credential to key its bucket by, so credentials never
+// appear in Redis key names
+func hashCredential(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])[:credentialDigestLength]
+}
+
+// bearerToken strips the "Bearer " scheme from an Authorization header value
+func bearerToken(authorization string) string {
+	if token, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return authorization
+}
+
+// clientKey extracts a unique identifier for the client
+func clientKey(r *http.Request, proxies Proxies) string {
+	// Priority order for client identification:
+	// 1. API Key (Authorization or X-API-Key header), hashed
+	// 2. Client address resolved through the trusted proxies
+	// 3. RemoteAddr as it is, if it is not an address
+
+	// The same key sent either way lands in the same bucket
+	if apiKey := bearerToken(r.Header.Get("Authorization")); apiKey != "" {
+		return "api_key:" + hashCredential(apiKey)
+	}
+	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+		return "api_key:" + hashCredential(apiKey)
+	}
+
+	if addr, ok := clientIP(r, proxies); ok {
+		return "ip:" + ipGroup(addr)
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// remoteIP returns the address of the connection with the port stripped
+func remoteIP(r *http.Request) string {
+	remoteIP := r.RemoteAddr
+	if colonIdx := strings.LastIndex(remoteIP, ":"); colonIdx != -1 {
+		remoteIP = remoteIP[:colonIdx]
+	}
+	return remoteIP
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientKey(t *testing.T) {
+	trustedProxies, err := ParseTrustedProxies("10.0.0.0/8, 2001:db8:ffff::/48")
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		header     string // Forwarding header of the proxies; empty for X-Forwarded-For
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"direct client", "", "192.0.2.7:1234", nil, "ip:192.0.2.7"},
+		{"spoofed headers from an untrusted client", "", "192.0.2.7:1234",
+			map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2", "Forwarded": "for=198.51.100.3"},
+			"ip:192.0.2.7"},
+		{"rightmost untrusted hop", "", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.9, 10.1.1.1"}, "ip:203.0.113.9"},
+		{"only trusted hops", "", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "10.3.3.3, 10.2.2.2"}, "ip:10.3.3.3"},
+		{"unknown hop ends the chain", "", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "198.51.100.1, unknown, 10.2.2.2"}, "ip:10.2.2.2"},
+		// A proxy appending to X-Forwarded-For passes the client's own headers through
+		{"client-supplied forwarded ignored", "", "10.0.0.1:1234",
+			map[string]string{"Forwarded": "for=198.51.100.1", "X-Real-IP": "198.51.100.2", "X-Forwarded-For": "203.0.113.9"},
+			"ip:203.0.113.9"},
+		{"no header from the proxy", "", "10.0.0.1:1234",
+			map[string]string{"Forwarded": "for=198.51.100.1", "X-Real-IP": "198.51.100.2"}, "ip:10.0.0.1"},
+		{"forwarded", HeaderForwarded, "10.0.0.1:1234",
+			map[string]string{"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8:cafe::17]:4711"`, "X-Forwarded-For": "203.0.113.9"},
+			"ip:2001:db8:cafe::/64"},
+		{"forwarded through a trusted ipv6 proxy", HeaderForwarded, "[2001:db8:ffff::1]:443",
+			map[string]string{"Forwarded": `for=198.51.100.1:8080;by=_edge, For="[2001:db8:ffff::2]"`}, "ip:198.51.100.1"},
+		{"real ip", HeaderXRealIP, "10.0.0.1:1234",
+			map[string]string{"X-Real-IP": "203.0.113.9", "X-Forwarded-For": "198.51.100.1"}, "ip:203.0.113.9"},
+		{"ipv6 grouped by /64", "", "[2001:db8:1:2:aaaa:bbbb:cccc:dddd]:1234", nil, "ip:2001:db8:1:2::/64"},
+		{"ipv4-mapped address", "", "[::ffff:192.0.2.7]:1234", nil, "ip:192.0.2.7"},
+		{"bearer token hashed", "", "192.0.2.7:1234",
+			map[string]string{"Authorization": "Bearer secret-token"}, "api_key:" + hashCredential("secret-token")},
+		{"api key hashed like the bearer token", "", "192.0.2.7:1234",
+			map[string]string{"X-API-Key": "secret-token"}, "api_key:" + hashCredential("secret-token")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			req.RemoteAddr = test.remoteAddr
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			if got := clientKey(req, Proxies{Trusted: trustedProxies, Header: test.header}); got != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestClientKey_NeverContainsCredential(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+
+	key := clientKey(req, Proxies{})
+	if len(key) != len("api_key:")+credentialDigestLength || key == "api_key:secret-token" {
+		t.Errorf("Expected a digest of the token, got %s", key)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies("")
+	if err != nil || len(proxies) != 0 {
+		t.Errorf("Expected no proxies, got %v (%v)", proxies, err)
+	}
+
+	proxies, err = ParseTrustedProxies("192.0.2.1,10.1.2.3/8")
+	if err != nil || len(proxies) != 2 || proxies[0].String() != "192.0.2.1/32" || proxies[1].String() != "10.0.0.0/8" {
+		t.Errorf("Expected an address and a masked network, got %v (%v)", proxies, err)
+	}
+
+	if _, err := ParseTrustedProxies("10.0.0.0/8,proxy.internal"); err == nil {
+		t.Error("Expected a host name to be rejected")
+	}
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	for input, expected := range map[string]string{"": HeaderXForwardedFor, "forwarded": HeaderForwarded, "X-REAL-IP": HeaderXRealIP} {
+		if header, err := ParseProxyHeader(input); err != nil || header != expected {
+			t.Errorf("Expected %q to parse as %s, got %q (%v)", input, expected, header, err)
+		}
+	}
+	if _, err := ParseProxyHeader("CF-Connecting-IP"); err == nil {
+		t.Error("Expected an unknown header to be rejected")
+	}
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"monolith/internal/bucket"
+)
+
+// ConcurrencyLimitConfig holds configuration for the concurrency limiting middleware
+type ConcurrencyLimitConfig struct {
+	// KeyFunc returns the key whose in-flight requests are limited, e.g. a tenant ID.
+	// Defaults to the client identifier used by the rate limiter.
+	KeyFunc func(r *http.Request) string
+	// Proxies are the trusted proxies whose forwarding header the default KeyFunc believes
+	Proxies Proxies
+	// RenewInterval is how often the lease of a running request is renewed (default LeaseTTL/3)
+	RenewInterval time.Duration
+}
+
+// ConcurrencyLimitMiddleware caps the number of requests in flight per key on top of a RedisSemaphore
+type ConcurrencyLimitMiddleware struct {
+	sem    *bucket.RedisSemaphore
+	config *ConcurrencyLimitConfig
+}
+
+// NewConcurrencyLimitMiddleware creates a new concurrency limiting middleware
+func NewConcurrencyLimitMiddleware(sem *bucket.RedisSemaphore, config *ConcurrencyLimitConfig) *ConcurrencyLimitMiddleware {
+	if config == nil {
+		config = &ConcurrencyLimitConfig{}
+	}
+	if config.KeyFunc == nil {
+		proxies := config.Proxies
+		config.KeyFunc = func(r *http.Request) string {
+			return clientKey(r, proxies)
+		}
+	}
+	if config.RenewInterval <= 0 {
+		config.RenewInterval = sem.Config().LeaseTTL / 3
+	}
+
+	return &ConcurrencyLimitMiddleware{
+		sem:    sem,
+		config: config,
+	}
+}
+
+// Handler returns the HTTP middleware handler function. The slot is held while the wrapped
+// handler runs and released when it returns.
+func (clm *ConcurrencyLimitMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := fmt.Sprintf("api_concurrency:%s", clm.config.KeyFunc(r))
+
+		result, err := clm.sem.Acquire(r.Context(), key)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		if err != nil {
+			log.Printf("Concurrency limit error for %s: %v", key, err)
+			http.Error(w, "Concurrency limiting temporarily unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("X-Concurrency-Limit", strconv.FormatInt(result.Limit, 10))
+
+		if !result.Acquired {
+			// RetryAfter is when the oldest lease expires; slots usually free up sooner
+			w.Header().Set("Retry-After", strconv.FormatFloat(math.Ceil(result.RetryAfter), 'f', 0, 64))
+			log.Printf("Concurrency limit exceeded for %s (%d in flight)", key, result.InFlight)
+			http.Error(w, fmt.Sprintf("Too many concurrent requests. At most %d are allowed at a time.",
+				result.Limit), http.StatusTooManyRequests)
+			return
+		}
+
+		stop := clm.keepAlive(result.Lease)
+		defer func() {
+			stop()
+
+			// The request context may already be cancelled, but the slot must still be released
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := clm.sem.Release(ctx, result.Lease); err != nil {
+				log.Printf("Failed to release concurrency slot for %s, it expires at %v: %v",
+					key, result.Lease.ExpiresAt, err)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// keepAlive renews the lease until the returned function is called, so requests that run
+// longer than the lease TTL keep their slot
+func (clm *ConcurrencyLimitMiddleware) keepAlive(lease *bucket.SemaphoreLease) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(clm.config.RenewInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				err := clm.sem.Renew(ctx, lease)
+				cancel()
+				if errors.Is(err, bucket.ErrLeaseLost) {
+					log.Printf("Concurrency slot for %s expired while the request was running", lease.Key)
+					return
+				}
+				if err != nil {
+					log.Printf("Failed to renew concurrency slot for %s: %v", lease.Key, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"monolith/internal/bucket"
+)
+
+func createTestSemaphore(t *testing.T, limit int64, leaseTTL time.Duration) *bucket.RedisSemaphore {
+	sem, err := bucket.NewRedisSemaphore(&bucket.SemaphoreConfig{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       6, // Use semaphore test DB
+		Limit:         limit,
+		LeaseTTL:      leaseTTL,
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+
+	return sem
+}
+
+// tenantKey limits in-flight requests per tenant header
+func tenantKey(r *http.Request) string {
+	return "tenant:" + r.Header.Get("X-Tenant")
+}
+
+func TestConcurrencyLimitMiddleware_CapsInFlightRequests(t *testing.T) {
+	sem := createTestSemaphore(t, 2, time.Minute)
+	defer sem.Close()
+
+	ctx := context.Background()
+	key := "api_concurrency:tenant:acme"
+	sem.Reset(ctx, key)
+
+	// Requests of the acme tenant block until released
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant") == "acme" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	h := NewConcurrencyLimitMiddleware(sem, &ConcurrencyLimitConfig{KeyFunc: tenantKey}).Handler(slow)
+
+	request := func(tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/export", nil)
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// Two exports hold both slots
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := request("acme"); w.Code != http.StatusOK {
+				t.Errorf("Expected the running export to succeed, got %d", w.Code)
+			}
+		}()
+	}
+	<-started
+	<-started
+
+	w := request("acme")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 with both slots taken, got %d", w.Code)
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 {
+		t.Errorf("Expected a Retry-After of at least a second on 429, got %q", w.Header().Get("Retry-After"))
+	}
+
+	// Other tenants are not affected
+	if w := request("other"); w.Code != http.StatusOK {
+		t.Errorf("Expected another tenant to pass, got %d", w.Code)
+	}
+
+	// Finishing the exports releases their slots
+	close(release)
+	wg.Wait()
+
+	if inFlight, err := sem.InFlight(ctx, key); err != nil || inFlight != 0 {
+		t.Errorf("Expected no requests in flight after completion, got %d (%v)", inFlight, err)
+	}
+}
+
+func TestConcurrencyLimitMiddleware_RenewsLongRequests(t *testing.T) {
+	sem := createTestSemaphore(t, 1, 150*time.Millisecond)
+	defer sem.Close()
+
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(400 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	h := NewConcurrencyLimitMiddleware(sem, &ConcurrencyLimitConfig{KeyFunc: tenantKey}).Handler(slow)
+
+	key := "api_concurrency:tenant:renew"
+	sem.Reset(context.Background(), key)
+
+	req := httptest.NewRequest("POST", "/api/export", nil)
+	req.Header.Set("X-Tenant", "renew")
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	// Well past the lease TTL, the running request still holds its slot
+	time.Sleep(300 * time.Millisecond)
+	inFlight, err := sem.InFlight(context.Background(), key)
+	if err != nil {
+		t.Fatalf("InFlight failed: %v", err)
+	}
+	if inFlight != 1 {
+		t.Errorf("Expected the running request to keep its slot, got %d in flight", inFlight)
+	}
+
+	// A lease expiring in less than a second still asks for a whole second
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req.Clone(context.Background()))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After 1, got %d with %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	<-done
+}
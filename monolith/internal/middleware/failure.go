@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"monolith/internal/bucket"
+	"monolith/internal/metrics"
+)
+
+// FailureMode controls how the rate limit middleware behaves when the limiter is unavailable
+type FailureMode int
+
+const (
+	// FailClosed rejects requests while the limiter is unavailable
+	FailClosed FailureMode = iota
+	// FailOpen lets every request through while the limiter is unavailable
+	FailOpen
+	// FailLocal limits requests with a per-instance in-memory token bucket while the limiter is unavailable
+	FailLocal
+)
+
+// String returns the name of the failure mode
+func (m FailureMode) String() string {
+	switch m {
+	case FailClosed:
+		return "fail-closed"
+	case FailOpen:
+		return "fail-open"
+	case FailLocal:
+		return "fail-local"
+	default:
+		return fmt.Sprintf("FailureMode(%d)", int(m))
+	}
+}
+
+// ParseFailureMode parses "closed", "open" or "local" (optionally prefixed with "fail-")
+func ParseFailureMode(s string) (FailureMode, error) {
+	switch s {
+	case "", "closed", "fail-closed":
+		return FailClosed, nil
+	case "open", "fail-open":
+		return FailOpen, nil
+	case "local", "fail-local":
+		return FailLocal, nil
+	default:
+		return FailClosed, fmt.Errorf("unknown failure mode %q", s)
+	}
+}
+
+// limiterHealth tracks whether the limiter is usable. After a failure the limiter is skipped
+// until the next probe, when a single request is sent to it to check for recovery.
+type limiterHealth struct {
+	mu        sync.Mutex
+	healthy   bool
+	probing   bool
+	nextProbe time.Time
+	interval  time.Duration
+	mode      FailureMode // Failure mode in use while unhealthy
+}
+
+// newLimiterHealth creates a health tracker that starts out healthy
+func newLimiterHealth(interval time.Duration) *limiterHealth {
+	return &limiterHealth{
+		healthy:  true,
+		interval: interval,
+	}
+}
+
+// shouldTry reports whether a request should be sent to the limiter
+func (h *limiterHealth) shouldTry() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.healthy {
+		return true
+	}
+
+	// Let exactly one request probe the limiter once the interval has passed
+	if !h.probing && !time.Now().Before(h.nextProbe) {
+		h.probing = true
+		return true
+	}
+
+	return false
+}
+
+// markHealthy records a successful limiter call
+func (h *limiterHealth) markHealthy() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.healthy {
+		log.Printf("Rate limiter recovered, switching back from degraded mode")
+		metrics.FallbackActive.WithLabelValues(h.mode.String()).Dec()
+	}
+	h.healthy = true
+	h.probing = false
+}
+
+// markFailed records a failed limiter call and schedules the next probe
+func (h *limiterHealth) markFailed(err error, mode FailureMode) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.healthy {
+		log.Printf("Rate limiter unavailable, switching to %s: %v", mode, err)
+		metrics.FallbackActive.WithLabelValues(mode.String()).Inc()
+		metrics.FallbackActivations.WithLabelValues(mode.String()).Inc()
+		h.mode = mode
+	}
+	h.healthy = false
+	h.probing = false
+	h.nextProbe = time.Now().Add(h.interval)
+}
+
+// releaseProbe lets another request probe the limiter when a probe ended without an answer
+func (h *limiterHealth) releaseProbe() {
+	h.mu.Lock()
+	h.probing = false
+	h.mu.Unlock()
+}
+
+// isHealthy reports whether the limiter is currently considered usable
+func (h *limiterHealth) isHealthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy
+}
+
+// DefaultPolicyLimiter is implemented by limiters that can report the capacity and refill
+// rate of buckets without a policy, so the FailLocal fallback can be sized like them
+type DefaultPolicyLimiter interface {
+	DefaultPolicy() *bucket.Policy
+}
+
+var _ DefaultPolicyLimiter = (*bucket.RedisTokenBucket)(nil)
+
+// fallbackSize is the capacity and refill rate of the policy a fallback bucket stands in for
+type fallbackSize struct {
+	capacity   int64
+	refillRate float64
+}
+
+// fallbackLimiter is the in-memory limiter used in FailLocal mode. It keeps a token bucket per
+// policy size, and each policy's limit is split evenly between the expected number of instances.
+type fallbackLimiter struct {
+	instances int
+
+	mu      sync.Mutex
+	buckets map[fallbackSize]*bucket.MemoryTokenBucket
+}
+
+// newFallbackLimiter creates the in-memory limiter used in FailLocal mode
+func newFallbackLimiter(instances int) *fallbackLimiter {
+	if instances < 1 {
+		instances = 1
+	}
+
+	return &fallbackLimiter{
+		instances: instances,
+		buckets:   make(map[fallbackSize]*bucket.MemoryTokenBucket),
+	}
+}
+
+// allow takes cost tokens from the local bucket of a key, sized as this instance's share of
+// the given policy size
+func (f *fallbackLimiter) allow(ctx context.Context, key string, cost float64, size fallbackSize) (*bucket.Result, error) {
+	f.mu.Lock()
+	limiter, ok := f.buckets[size]
+	if !ok {
+		capacity := size.capacity / int64(f.instances)
+		if capacity < 1 {
+			capacity = 1
+		}
+
+		var err error
+		limiter, err = bucket.NewMemoryTokenBucket(&bucket.Config{
+			Capacity:   capacity,
+			RefillRate: size.refillRate / float64(f.instances),
+			TTL:        5 * time.Minute,
+		})
+		if err != nil {
+			f.mu.Unlock()
+			return nil, fmt.Errorf("failed to create fallback bucket: %w", err)
+		}
+		f.buckets[size] = limiter
+	}
+	f.mu.Unlock()
+
+	return limiter.Allow(ctx, key, cost)
+}
+
+// fallbackSize returns the size of the policy a request is limited by: the named policy of
+// the policy file, otherwise the limiter's default bucket. RequestsPerMinute and BurstSize are
+// only used for limiters that cannot report their size.
+func (rlm *RateLimitMiddleware) fallbackSize(policy string) fallbackSize {
+	if policy != "" && rlm.config.Policies != nil {
+		if p := rlm.config.Policies.Current().Policy(policy); p != nil {
+			return fallbackSize{capacity: p.Capacity, refillRate: p.RefillRate}
+		}
+	}
+	if limiter, ok := rlm.limiter.(DefaultPolicyLimiter); ok {
+		p := limiter.DefaultPolicy()
+		return fallbackSize{capacity: p.Capacity, refillRate: p.RefillRate}
+	}
+	return fallbackSize{
+		capacity:   int64(rlm.config.BurstSize),
+		refillRate: float64(rlm.config.RequestsPerMinute) / 60.0,
+	}
+}
+
+// degraded handles a request while the limiter is unavailable. A nil result with a nil error
+// means the request is let through without rate limiting.
+func (rlm *RateLimitMiddleware) degraded(ctx context.Context, bucketKey string, policy string, cost float64, cause error) (*bucket.Result, error) {
+	switch rlm.config.FailureMode {
+	case FailOpen:
+		return nil, nil
+	case FailLocal:
+		result, err := rlm.fallback.allow(ctx, bucketKey, cost, rlm.fallbackSize(policy))
+		if err != nil {
+			return nil, err
+		}
+		result.Policy = policy
+		return result, nil
+	default:
+		return nil, cause
+	}
+}
@@ -2,14 +2,17 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"monolith/internal/bucket"
+	"monolith/internal/headers"
+	"monolith/internal/metrics"
 )
 
 // RateLimitConfig holds configuration for the rate limiting middleware
@@ -17,8 +20,51 @@ type RateLimitConfig struct {
 	RequestsPerMinute int           // Number of requests allowed per minute
 	BurstSize         int           // Burst capacity
 	RefillRate        time.Duration // How often to add tokens
+	MaxWait           time.Duration // Delay requests up to this long before rejecting (0 rejects immediately)
+	HeaderMode        headers.Mode  // Which rate limit headers to send (default both IETF and X-RateLimit-*)
+
+	// Proxies are the trusted proxies in front of the server and the forwarding header they
+	// set. Without any, clients are identified by the connection address.
+	Proxies Proxies
+
+	FailureMode         FailureMode   // What to do while the limiter is unavailable (default FailClosed)
+	ExpectedInstances   int           // Instances sharing the limit; the FailLocal fallback gets 1/N of each policy
+	HealthCheckInterval time.Duration // How often to retry the limiter while it is unavailable (default 5s)
+
+	// Policies, when set, picks the policy, client identity and exemptions of every request
+	// from a policy file (see PolicyWatcher)
+	Policies PolicySource
+
+	// Outcomes, when set, receives the latency and status code of every allowed request,
+	// e.g. a bucket.AdaptiveRate adjusting the policy it was served under
+	Outcomes OutcomeObserver
+
+	// Quota, when set, is charged after the rate limit under the client key alone, so a
+	// client's quota (e.g. a bucket.RedisQuota) is shared by every policy and route. When it
+	// denies, the tokens taken from the bucket are refunded.
+	Quota bucket.Limiter
+
+	// Penalties, when set, blocks clients that keep sending requests after being limited.
+	// Blocked clients get BlockedStatus: 429 (the default) or 403.
+	Penalties     PenaltyBox
+	BlockedStatus int
 }
 
+// OutcomeObserver receives the outcome of requests the middleware let through
+type OutcomeObserver interface {
+	ObserveOutcome(policy string, latency time.Duration, status int)
+}
+
+var _ OutcomeObserver = (*bucket.AdaptiveRate)(nil)
+
+// PenaltyBox tracks rate limit violations and blocks of clients
+type PenaltyBox interface {
+	Check(ctx context.Context, key string) (*bucket.Block, error)
+	RecordViolation(ctx context.Context, key string) (*bucket.Block, error)
+}
+
+var _ PenaltyBox = (*bucket.RedisPenaltyBox)(nil)
+
 // DefaultRateLimitConfig returns a sensible default configuration
 func DefaultRateLimitConfig() *RateLimitConfig {
 	return &RateLimitConfig{
@@ -28,58 +74,96 @@ func DefaultRateLimitConfig() *RateLimitConfig {
 	}
 }
 
-// RateLimitMiddleware creates a rate limiting middleware using the token bucket
+// RateLimitMiddleware creates a rate limiting middleware on top of any Limiter
 type RateLimitMiddleware struct {
-	tokenBucket *bucket.RedisTokenBucket
-	config      *RateLimitConfig
+	limiter  bucket.Limiter
+	config   *RateLimitConfig
+	health   *limiterHealth
+	fallback *fallbackLimiter // In-memory limiter for FailLocal mode
 }
 
 // NewRateLimitMiddleware creates a new rate limiting middleware
-func NewRateLimitMiddleware(tb *bucket.RedisTokenBucket, config *RateLimitConfig) *RateLimitMiddleware {
+func NewRateLimitMiddleware(limiter bucket.Limiter, config *RateLimitConfig) *RateLimitMiddleware {
 	if config == nil {
 		config = DefaultRateLimitConfig()
 	}
 
+	interval := config.HealthCheckInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
 	return &RateLimitMiddleware{
-		tokenBucket: tb,
-		config:      config,
+		limiter:  limiter,
+		config:   config,
+		health:   newLimiterHealth(interval),
+		fallback: newFallbackLimiter(config.ExpectedInstances),
 	}
 }
 
+// Healthy reports whether the underlying limiter is currently in use, as opposed to the
+// configured failure mode
+func (rlm *RateLimitMiddleware) Healthy() bool {
+	return rlm.health.isHealthy()
+}
+
 // Handler returns the HTTP middleware handler function
 func (rlm *RateLimitMiddleware) Handler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract client identifier (IP address or API key)
-		clientKey := rlm.getClientKey(r)
+		// Extract client identifier (IP address or API key) and the bucket to charge
+		clientKey, bucketKey, policy, cost, exempt := rlm.bucketKey(r)
+		if exempt {
+			metrics.ObserveDecision(r, "", metrics.DecisionExempt)
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		// Use token bucket key for rate limiting
-		bucketKey := fmt.Sprintf("api_rate_limit:%s", clientKey)
+		// Blocked clients are turned away without touching their bucket
+		if block := rlm.checkBlock(r.Context(), clientKey); block != nil {
+			rlm.writeBlocked(w, r, clientKey, block)
+			return
+		}
 
-		// Try to consume 1 token for this request
-		ctx := context.Background()
-		result, err := rlm.tokenBucket.TakeTokens(ctx, bucketKey, 1)
+		// Try to consume the route's cost for this request, waiting for it if shaping is enabled
+		result, err := rlm.take(r.Context(), clientKey, bucketKey, policy, cost)
+		if errors.Is(err, context.Canceled) {
+			// The client went away while its request was being delayed
+			log.Printf("Rate limit wait cancelled for %s", clientKey)
+			return
+		}
 		if err != nil {
 			log.Printf("Rate limit error for %s: %v", clientKey, err)
+			metrics.ObserveDecision(r, "", metrics.DecisionError)
 			http.Error(w, "Rate limiting temporarily unavailable", http.StatusInternalServerError)
 			return
 		}
+		if result == nil {
+			// Failing open: the limiter is unavailable and the request is not limited
+			metrics.ObserveDecision(r, "", metrics.DecisionFailedOpen)
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		// Fix retry_after overflow issue - cap at reasonable maximum
+		// Long waits, e.g. for a daily quota, are passed on as they are; only values that are
+		// not a time at all fall back to a minute
 		retryAfter := result.RetryAfter
-		if retryAfter > 3600 || retryAfter < 0 { // Cap at 1 hour max, handle negative values
-			retryAfter = 60 // Default to 1 minute
+		if retryAfter < 0 || math.IsNaN(retryAfter) || math.IsInf(retryAfter, 0) {
+			retryAfter = 60
 		}
 
-		// Debug logging
-		log.Printf("Rate limit check for %s: allowed=%v, remaining=%.2f, retryAfter=%.2f (fixed=%.2f)",
-			clientKey, result.Allowed, result.RemainingTokens, result.RetryAfter, retryAfter)
-
 		// Check if request is allowed
 		if !result.Allowed {
+			// Enough violations turn the rejection into a block
+			if block := rlm.recordViolation(r.Context(), clientKey); block != nil {
+				rlm.writeBlocked(w, r, clientKey, block)
+				return
+			}
+
+			metrics.ObserveDecision(r, result.Policy, metrics.DecisionDenied)
+
 			// Add rate limit headers
-			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rlm.config.RequestsPerMinute))
-			w.Header().Set("X-RateLimit-Remaining", "0")
-			w.Header().Set("Retry-After", strconv.FormatFloat(retryAfter, 'f', 0, 64))
+			headers.Set(w.Header(), rlm.config.HeaderMode, result)
+			w.Header().Set("Retry-After", strconv.FormatFloat(math.Ceil(retryAfter), 'f', 0, 64))
 
 			// Log rate limit hit
 			log.Printf("Rate limit exceeded for client %s (IP: %s, User-Agent: %s) - retry after %.2f seconds",
@@ -91,51 +175,157 @@ func (rlm *RateLimitMiddleware) Handler(next http.Handler) http.Handler {
 			return
 		}
 
+		metrics.ObserveDecision(r, result.Policy, metrics.DecisionAllowed)
+
 		// Add informational rate limit headers
-		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rlm.config.RequestsPerMinute))
-		w.Header().Set("X-RateLimit-Remaining", strconv.FormatFloat(result.RemainingTokens, 'f', 0, 64))
+		headers.Set(w.Header(), rlm.config.HeaderMode, result)
 
 		// Request is allowed, proceed to next handler
-		next.ServeHTTP(w, r)
+		if rlm.config.Outcomes == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		ww := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(ww, r)
+		rlm.config.Outcomes.ObserveOutcome(result.Policy, time.Since(start), ww.statusCode)
 	})
 }
 
-// getClientKey extracts a unique identifier for the client
-func (rlm *RateLimitMiddleware) getClientKey(r *http.Request) string {
-	// Priority order for client identification:
-	// 1. API Key (if provided in Authorization header)
-	// 2. X-Forwarded-For (if behind proxy)
-	// 3. X-Real-IP (if behind proxy)
-	// 4. RemoteAddr (direct connection)
+// checkBlock returns the active block of a client. Penalty errors are logged and ignored;
+// the rate limit still applies.
+func (rlm *RateLimitMiddleware) checkBlock(ctx context.Context, clientKey string) *bucket.Block {
+	if rlm.config.Penalties == nil {
+		return nil
+	}
+	block, err := rlm.config.Penalties.Check(ctx, clientKey)
+	if err != nil {
+		log.Printf("Penalty check error for %s: %v", clientKey, err)
+		return nil
+	}
+	return block
+}
 
-	// Check for API key in Authorization header
-	if apiKey := r.Header.Get("Authorization"); apiKey != "" {
-		return fmt.Sprintf("api_key:%s", apiKey)
+// recordViolation counts a rejected request and returns the block it caused, if any
+func (rlm *RateLimitMiddleware) recordViolation(ctx context.Context, clientKey string) *bucket.Block {
+	if rlm.config.Penalties == nil {
+		return nil
 	}
+	block, err := rlm.config.Penalties.RecordViolation(ctx, clientKey)
+	if err != nil {
+		log.Printf("Penalty violation error for %s: %v", clientKey, err)
+		return nil
+	}
+	return block
+}
 
-	// Check for X-API-Key header
-	if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
-		return fmt.Sprintf("api_key:%s", apiKey)
+// writeBlocked rejects a request of a blocked client, with the block expiry in the headers
+func (rlm *RateLimitMiddleware) writeBlocked(w http.ResponseWriter, r *http.Request, clientKey string, block *bucket.Block) {
+	metrics.ObserveDecision(r, "", metrics.DecisionBlocked)
+
+	status := rlm.config.BlockedStatus
+	if status == 0 {
+		status = http.StatusTooManyRequests
 	}
 
-	// Check for forwarded IP (when behind load balancer/proxy)
-	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
-		// Take only the first IP in case of multiple proxies
-		firstIP := strings.Split(forwardedFor, ",")[0]
-		return fmt.Sprintf("ip:%s", strings.TrimSpace(firstIP))
+	expires := block.ExpiresAt.UTC().Format(time.RFC3339)
+	w.Header().Set("Retry-After", strconv.FormatInt(block.RetryAfter(time.Now()), 10))
+	w.Header().Set("X-RateLimit-Blocked-Until", expires)
+
+	log.Printf("Blocked client %s (level %d) until %s", clientKey, block.Level, expires)
+	http.Error(w, fmt.Sprintf("Blocked for repeatedly exceeding the rate limit until %s.", expires), status)
+}
+
+// take consumes cost tokens for the bucket key and the client's quota. When MaxWait is set
+// and the limiter supports it, the request is delayed until a token is available instead of
+// rejected. While the limiter is unreachable or timing out the configured failure mode decides
+// instead; other limiter errors are returned.
+func (rlm *RateLimitMiddleware) take(ctx context.Context, clientKey, bucketKey string, policy string, cost float64) (*bucket.Result, error) {
+	if !rlm.health.shouldTry() {
+		return rlm.degraded(ctx, bucketKey, policy, cost, errors.New("rate limiter unavailable"))
 	}
 
-	// Check for real IP header
-	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
-		return fmt.Sprintf("ip:%s", realIP)
+	result, err := rlm.allow(ctx, clientKey, bucketKey, cost)
+	if err != nil {
+		if errors.Is(err, context.Canceled) || !bucket.IsUnavailable(err) {
+			// The client went away, or the limiter answered with an error such as an invalid
+			// cost; neither says the limiter is down, so the request fails without a fallback
+			rlm.health.releaseProbe()
+			return nil, err
+		}
+		rlm.health.markFailed(err, rlm.config.FailureMode)
+		return rlm.degraded(ctx, bucketKey, policy, cost, err)
+	}
+
+	rlm.health.markHealthy()
+	return result, nil
+}
+
+// allow takes cost tokens from the bucket, waiting for them if shaping is enabled, and then
+// charges the client's quota. The result is the quota's denial, otherwise the result with
+// the least remaining.
+func (rlm *RateLimitMiddleware) allow(ctx context.Context, clientKey, bucketKey string, cost float64) (*bucket.Result, error) {
+	var result *bucket.Result
+	var err error
+	if waiter, ok := rlm.limiter.(bucket.Waiter); ok && rlm.config.MaxWait > 0 {
+		result, err = waiter.Wait(ctx, bucketKey, cost, rlm.config.MaxWait)
+	} else {
+		result, err = rlm.limiter.Allow(ctx, bucketKey, cost)
+	}
+	if err != nil || !result.Allowed || rlm.config.Quota == nil {
+		return result, err
 	}
 
-	// Fall back to remote address, strip port if present
-	remoteIP := r.RemoteAddr
-	if colonIdx := strings.LastIndex(remoteIP, ":"); colonIdx != -1 {
-		remoteIP = remoteIP[:colonIdx]
+	quota, err := rlm.config.Quota.Allow(ctx, clientKey, cost)
+	if err != nil || !quota.Allowed {
+		rlm.refund(bucketKey, cost)
+		return quota, err
 	}
-	return fmt.Sprintf("ip:%s", remoteIP)
+	if quota.Remaining < result.Remaining {
+		return quota, nil
+	}
+	return result, nil
+}
+
+// refund gives tokens back to the bucket after the quota refused the request
+func (rlm *RateLimitMiddleware) refund(bucketKey string, cost float64) {
+	refunder, ok := rlm.limiter.(bucket.Refunder)
+	if !ok {
+		return
+	}
+
+	// The request context may be gone, but the tokens must still go back
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := refunder.Refund(ctx, bucketKey, cost); err != nil {
+		log.Printf("Failed to refund %v tokens for %s: %v", cost, bucketKey, err)
+	}
+}
+
+// bucketKey returns the client key, bucket key, policy and cost of a request, and whether
+// the policy file exempts it from rate limiting by route or allowlist
+func (rlm *RateLimitMiddleware) bucketKey(r *http.Request) (string, string, string, float64, bool) {
+	if rlm.config.Policies == nil {
+		clientKey := rlm.getClientKey(r)
+		return clientKey, fmt.Sprintf("api_rate_limit:%s", clientKey), "", 1, false
+	}
+
+	// Use one snapshot for the whole request, even if the file is reloaded meanwhile
+	set := rlm.config.Policies.Current()
+	policy, cost, exempt := set.Limit(routeTemplate(r), r.Method)
+	if exempt || set.Allowlisted(r, rlm.config.Proxies) {
+		return "", "", "", 0, true
+	}
+
+	clientKey := set.ClientKey(r, rlm.config.Proxies)
+	return clientKey, set.BucketKey(policy, clientKey), policy, cost, false
+}
+
+// getClientKey extracts a unique identifier for the client
+func (rlm *RateLimitMiddleware) getClientKey(r *http.Request) string {
+	return clientKey(r, rlm.config.Proxies)
 }
 
 // LoggingMiddleware logs all HTTP requests (compatible with mux.MiddlewareFunc)
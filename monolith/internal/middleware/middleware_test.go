@@ -0,0 +1,573 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"monolith/internal/bucket"
+	"monolith/internal/headers"
+	"monolith/internal/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+func createTestBucket(t *testing.T, capacity int64, refillRate float64) *bucket.RedisTokenBucket {
+	tb, err := bucket.NewRedisTokenBucket(&bucket.Config{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       1, // Use test DB
+		Capacity:      capacity,
+		RefillRate:    refillRate,
+		TTL:           1 * time.Minute,
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+
+	return tb
+}
+
+// okHandler is the downstream handler used by the middleware tests
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func serve(h http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/api/test", nil)
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitMiddleware_RejectsWhenExhausted(t *testing.T) {
+	tb := createTestBucket(t, 2, 0.1)
+	defer tb.Close()
+
+	tb.ResetBucket(context.Background(), "api_rate_limit:ip:10.0.0.1")
+	h := NewRateLimitMiddleware(tb, &RateLimitConfig{RequestsPerMinute: 6}).Handler(okHandler)
+
+	for i := 0; i < 2; i++ {
+		if w := serve(h, "10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Errorf("Expected request %d to pass, got %d", i+1, w.Code)
+		}
+	}
+
+	w := serve(h, "10.0.0.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header on 429")
+	}
+}
+
+func TestRateLimitMiddleware_LongRetryAfter(t *testing.T) {
+	// One token every 10000 seconds, far beyond an hour
+	limiter, err := bucket.NewMemoryTokenBucket(&bucket.Config{Capacity: 1, RefillRate: 0.0001})
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer limiter.Close()
+
+	h := NewRateLimitMiddleware(limiter, &RateLimitConfig{RequestsPerMinute: 1}).Handler(okHandler)
+	serve(h, "10.0.0.9:1234")
+
+	w := serve(h, "10.0.0.9:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", w.Code)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "10000" {
+		t.Errorf("Expected the full wait of 10000 seconds, got %q", retryAfter)
+	}
+}
+
+func TestRateLimitMiddleware_Headers(t *testing.T) {
+	limiter, err := bucket.NewMemoryTokenBucket(&bucket.Config{Capacity: 5, RefillRate: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer limiter.Close()
+
+	// The headers carry the bucket's capacity, not RequestsPerMinute
+	h := NewRateLimitMiddleware(limiter, &RateLimitConfig{RequestsPerMinute: 6}).Handler(okHandler)
+	w := serve(h, "10.0.0.9:1234")
+	expected := map[string]string{
+		"RateLimit-Policy":      `"default";q=5;w=10`,
+		"RateLimit":             `"default";r=4;t=2`,
+		"X-RateLimit-Limit":     "5",
+		"X-RateLimit-Remaining": "4",
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("Expected %s: %q, got %q", name, value, got)
+		}
+	}
+	if w.Header().Get("X-RateLimit-Reset") == "" {
+		t.Error("Expected X-RateLimit-Reset header")
+	}
+
+	h = NewRateLimitMiddleware(limiter, &RateLimitConfig{HeaderMode: headers.IETF}).Handler(okHandler)
+	w = serve(h, "10.0.0.9:1234")
+	if w.Header().Get("RateLimit") != `"default";r=3;t=4` || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Errorf("Expected only the IETF headers, got %v", w.Header())
+	}
+}
+
+func TestRateLimitMiddleware_ShapesWithinMaxWait(t *testing.T) {
+	tb := createTestBucket(t, 1, 10.0) // 1 token, 10 tokens/sec
+	defer tb.Close()
+
+	tb.ResetBucket(context.Background(), "api_rate_limit:ip:10.0.0.2")
+	h := NewRateLimitMiddleware(tb, &RateLimitConfig{
+		RequestsPerMinute: 600,
+		MaxWait:           500 * time.Millisecond,
+	}).Handler(okHandler)
+
+	// The second request is delayed by ~100ms instead of rejected
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if w := serve(h, "10.0.0.2:1234"); w.Code != http.StatusOK {
+			t.Errorf("Expected request %d to pass, got %d", i+1, w.Code)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the second request to be delayed, took %v", elapsed)
+	}
+}
+
+func TestRateLimitMiddleware_RejectsBeyondMaxWait(t *testing.T) {
+	tb := createTestBucket(t, 1, 0.1) // 1 token, one every 10s
+	defer tb.Close()
+
+	tb.ResetBucket(context.Background(), "api_rate_limit:ip:10.0.0.3")
+	h := NewRateLimitMiddleware(tb, &RateLimitConfig{
+		RequestsPerMinute: 6,
+		MaxWait:           200 * time.Millisecond,
+	}).Handler(okHandler)
+
+	if w := serve(h, "10.0.0.3:1234"); w.Code != http.StatusOK {
+		t.Errorf("Expected first request to pass, got %d", w.Code)
+	}
+
+	start := time.Now()
+	w := serve(h, "10.0.0.3:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected immediate rejection when the wait exceeds MaxWait, took %v", elapsed)
+	}
+}
+
+// flakyLimiter is a Limiter that fails while down is set and counts the calls it receives
+type flakyLimiter struct {
+	mu    sync.Mutex
+	down  bool
+	err   error // Returned while down; a refused connection by default
+	calls int
+}
+
+func (f *flakyLimiter) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+func (f *flakyLimiter) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+func (f *flakyLimiter) Allow(ctx context.Context, key string, n float64) (*bucket.Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	if f.down && f.err != nil {
+		return nil, f.err
+	}
+	if f.down {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	return &bucket.Result{Allowed: true, Remaining: 99, Limit: 100}, nil
+}
+
+func (f *flakyLimiter) Peek(ctx context.Context, key string) (*bucket.Result, error) {
+	return f.Allow(ctx, key, 0)
+}
+
+func (f *flakyLimiter) Reset(ctx context.Context, key string) error { return nil }
+
+func (f *flakyLimiter) Close() error { return nil }
+
+func TestRateLimitMiddleware_FailureModes(t *testing.T) {
+	testCases := []struct {
+		name         string
+		mode         FailureMode
+		wantStatuses []int
+	}{
+		{"Fail closed", FailClosed, []int{500, 500, 500}},
+		{"Fail open", FailOpen, []int{200, 200, 200}},
+		// 4 burst split over 2 instances leaves 2 local tokens
+		{"Fail local", FailLocal, []int{200, 200, 429}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter := &flakyLimiter{down: true}
+			h := NewRateLimitMiddleware(limiter, &RateLimitConfig{
+				RequestsPerMinute: 1,
+				BurstSize:         4,
+				FailureMode:       tc.mode,
+				ExpectedInstances: 2,
+			}).Handler(okHandler)
+
+			for i, want := range tc.wantStatuses {
+				if w := serve(h, "10.0.1.1:1234"); w.Code != want {
+					t.Errorf("Request %d: expected status %d, got %d", i+1, want, w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware_LimiterErrors(t *testing.T) {
+	// An error the limiter answers with is not an outage; it must not switch to the failure mode
+	limiter := &flakyLimiter{down: true, err: errors.New("cost must be a positive whole number, got 2.5")}
+	rlm := NewRateLimitMiddleware(limiter, &RateLimitConfig{
+		RequestsPerMinute: 1,
+		BurstSize:         4,
+		FailureMode:       FailOpen,
+	})
+	h := rlm.Handler(okHandler)
+
+	for i := 0; i < 3; i++ {
+		if w := serve(h, "10.0.1.4:1234"); w.Code != http.StatusInternalServerError {
+			t.Errorf("Request %d: expected status 500, got %d", i+1, w.Code)
+		}
+	}
+	if !rlm.Healthy() {
+		t.Error("Expected the limiter to stay healthy")
+	}
+	if calls := limiter.callCount(); calls != 3 {
+		t.Errorf("Expected every request to reach the limiter, got %d calls", calls)
+	}
+}
+
+// sizedLimiter is a flaky limiter that reports the size of its buckets
+type sizedLimiter struct {
+	flakyLimiter
+	policy bucket.Policy
+}
+
+func (s *sizedLimiter) DefaultPolicy() *bucket.Policy { return &s.policy }
+
+// staticPolicies serves one policy set
+type staticPolicies struct{ set *PolicySet }
+
+func (s staticPolicies) Current() *PolicySet { return s.set }
+
+func TestRateLimitMiddleware_FailLocalUsesPolicySize(t *testing.T) {
+	// The limiter's buckets hold 6 tokens, split over 2 instances; RequestsPerMinute and
+	// BurstSize do not apply
+	limiter := &sizedLimiter{flakyLimiter: flakyLimiter{down: true}, policy: bucket.Policy{Capacity: 6, RefillRate: 0.01}}
+	h := NewRateLimitMiddleware(limiter, &RateLimitConfig{
+		RequestsPerMinute: 1,
+		BurstSize:         1,
+		FailureMode:       FailLocal,
+		ExpectedInstances: 2,
+	}).Handler(okHandler)
+
+	for i, want := range []int{200, 200, 200, 429} {
+		if w := serve(h, "10.0.1.3:1234"); w.Code != want {
+			t.Errorf("Request %d: expected status %d, got %d", i+1, want, w.Code)
+		}
+	}
+
+	// With a policy file, each route gets the size of its policy
+	set, err := LoadPolicyFile(writePolicyFile(t, "policy.yaml", testPolicyYAML))
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+	router := mux.NewRouter()
+	router.Use(NewRateLimitMiddleware(&flakyLimiter{down: true}, &RateLimitConfig{
+		RequestsPerMinute: 1,
+		BurstSize:         1,
+		FailureMode:       FailLocal,
+		Policies:          staticPolicies{set},
+	}).Handler)
+	router.Handle("/api/search/{index}", okHandler)
+	router.Handle("/api/orders", okHandler)
+
+	allowed := func(path string) int {
+		count := 0
+		for i := 0; i < 10; i++ {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			if w.Code == http.StatusOK {
+				count++
+			}
+		}
+		return count
+	}
+	if got := allowed("/api/search/products"); got != 5 {
+		t.Errorf("Expected the search policy to allow 5 requests locally, got %d", got)
+	}
+	if got := allowed("/api/orders"); got != 2 {
+		t.Errorf("Expected the standard policy to allow 2 requests locally, got %d", got)
+	}
+}
+
+func TestRateLimitMiddleware_QuotaPerClient(t *testing.T) {
+	ctx := context.Background()
+	tb := createTestBucket(t, 10, 0.01)
+	defer tb.Close()
+	quota, err := bucket.NewRedisQuota(&bucket.QuotaConfig{
+		RedisAddr: "localhost:6379",
+		RedisDB:   1, // Use test DB
+		Limit:     3,
+		Period:    bucket.QuotaDaily,
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	defer quota.Close()
+
+	set, err := LoadPolicyFile(writePolicyFile(t, "policy.yaml", testPolicyYAML))
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+	searchKey := set.BucketKey("search", "tenant:quota")
+	standardKey := set.BucketKey("standard", "tenant:quota")
+	tb.ResetBucket(ctx, searchKey)
+	tb.ResetBucket(ctx, standardKey)
+	quota.Reset(ctx, "tenant:quota")
+
+	router := mux.NewRouter()
+	router.Use(NewRateLimitMiddleware(tb, &RateLimitConfig{
+		Policies: staticPolicies{set},
+		Quota:    quota,
+	}).Handler)
+	router.Handle("/api/search/{index}", okHandler)
+	router.Handle("/api/orders", okHandler)
+
+	// The two routes use different policies and buckets, but one quota
+	for i, path := range []string{"/api/search/products", "/api/search/products", "/api/orders", "/api/orders"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Tenant-ID", "quota")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		want := http.StatusOK
+		if i == 3 {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("Request %d to %s: expected status %d, got %d", i+1, path, want, w.Code)
+		}
+	}
+
+	if usage, err := quota.Usage(ctx, "tenant:quota"); err != nil || usage.Used != 3 {
+		t.Errorf("Expected 3 units used under the client key, got %+v (%v)", usage, err)
+	}
+	// The token taken for the request the quota denied is given back
+	if result, err := tb.Peek(ctx, standardKey); err != nil || result.Remaining < 9 {
+		t.Errorf("Expected the denied request's token to be refunded, got %+v (%v)", result, err)
+	}
+}
+
+func TestRateLimitMiddleware_RecoversAfterOutage(t *testing.T) {
+	limiter := &flakyLimiter{down: true}
+	rlm := NewRateLimitMiddleware(limiter, &RateLimitConfig{
+		RequestsPerMinute:   60,
+		BurstSize:           10,
+		FailureMode:         FailOpen,
+		HealthCheckInterval: 100 * time.Millisecond,
+	})
+	h := rlm.Handler(okHandler)
+
+	// The first failure switches to degraded mode
+	serve(h, "10.0.1.2:1234")
+	if rlm.Healthy() {
+		t.Fatal("Expected limiter to be marked unhealthy after an error")
+	}
+
+	// While degraded, the limiter is not called for every request
+	for i := 0; i < 10; i++ {
+		serve(h, "10.0.1.2:1234")
+	}
+	if calls := limiter.callCount(); calls != 1 {
+		t.Errorf("Expected only the first request to reach the limiter, got %d calls", calls)
+	}
+
+	// Once it recovers, the next probe switches back
+	limiter.setDown(false)
+	time.Sleep(150 * time.Millisecond)
+
+	w := serve(h, "10.0.1.2:1234")
+	if !rlm.Healthy() {
+		t.Error("Expected limiter to be marked healthy after a successful probe")
+	}
+	if w.Header().Get("X-RateLimit-Remaining") != "99" {
+		t.Errorf("Expected headers from the recovered limiter, got remaining=%q", w.Header().Get("X-RateLimit-Remaining"))
+	}
+}
+
+func TestRateLimitMiddleware_Metrics(t *testing.T) {
+	limiter, err := bucket.NewMemoryTokenBucket(&bucket.Config{Capacity: 2, RefillRate: 0.001})
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer limiter.Close()
+
+	router := mux.NewRouter()
+	router.Use(NewRateLimitMiddleware(limiter, &RateLimitConfig{RequestsPerMinute: 1}).Handler)
+	router.Handle("/api/metrics-test/{id}", okHandler)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/metrics-test/%d", i), nil)
+		req.RemoteAddr = "10.0.2.1:1234"
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		`ratelimit_decisions_total{decision="allowed",policy="default",route="/api/metrics-test/{id}"} 2`,
+		`ratelimit_decisions_total{decision="denied",policy="default",route="/api/metrics-test/{id}"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected %q in the metrics output", line)
+		}
+	}
+
+	// Neither client addresses nor concrete paths may become labels
+	if strings.Contains(body, "10.0.2.1") || strings.Contains(body, "/api/metrics-test/1") {
+		t.Error("Expected no client keys or raw paths in the metrics output")
+	}
+}
+
+func TestRateLimitMiddleware_Penalties(t *testing.T) {
+	penalties, err := bucket.NewRedisPenaltyBox(&bucket.PenaltyConfig{
+		RedisAddr:       "localhost:6379",
+		RedisDB:         1, // Use test DB
+		Threshold:       2,
+		ViolationWindow: time.Minute,
+		BlockDurations:  []time.Duration{time.Minute, 10 * time.Minute},
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	defer penalties.Close()
+
+	limiter, err := bucket.NewMemoryTokenBucket(&bucket.Config{Capacity: 1, RefillRate: 0.001})
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer limiter.Close()
+
+	ctx := context.Background()
+	penalties.Lift(ctx, "ip:10.0.4.1")
+	defer penalties.Lift(ctx, "ip:10.0.4.1")
+
+	h := NewRateLimitMiddleware(limiter, &RateLimitConfig{
+		RequestsPerMinute: 1,
+		Penalties:         penalties,
+		BlockedStatus:     http.StatusForbidden,
+	}).Handler(okHandler)
+
+	// One allowed request, one plain rejection, then the second violation blocks the client
+	expected := []int{http.StatusOK, http.StatusTooManyRequests, http.StatusForbidden, http.StatusForbidden}
+	var w *httptest.ResponseRecorder
+	for i, status := range expected {
+		w = serve(h, "10.0.4.1:1234")
+		if w.Code != status {
+			t.Fatalf("Request %d: expected %d, got %d", i+1, status, w.Code)
+		}
+	}
+
+	until, err := time.Parse(time.RFC3339, w.Header().Get("X-RateLimit-Blocked-Until"))
+	if err != nil || time.Until(until) < 50*time.Second {
+		t.Errorf("Expected the block expiry about a minute ahead, got %q", w.Header().Get("X-RateLimit-Blocked-Until"))
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "60" && retryAfter != "59" {
+		t.Errorf("Expected Retry-After of about 60 seconds, got %q", retryAfter)
+	}
+
+	// Other clients are not affected
+	if w := serve(h, "10.0.4.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("Expected another client to pass, got %d", w.Code)
+	}
+}
+
+// outcomeRecorder is an OutcomeObserver that keeps what it observes
+type outcomeRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+}
+
+func (o *outcomeRecorder) ObserveOutcome(policy string, latency time.Duration, status int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.statuses = append(o.statuses, status)
+}
+
+func TestRateLimitMiddleware_FeedsOutcomes(t *testing.T) {
+	limiter, err := bucket.NewMemoryTokenBucket(&bucket.Config{Capacity: 2, RefillRate: 0.001})
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer limiter.Close()
+
+	outcomes := &outcomeRecorder{}
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	h := NewRateLimitMiddleware(limiter, &RateLimitConfig{RequestsPerMinute: 1, Outcomes: outcomes}).Handler(failing)
+
+	// Two requests reach the handler; the third is rejected by the limiter and not observed
+	for i := 0; i < 3; i++ {
+		serve(h, "10.0.3.1:1234")
+	}
+
+	if len(outcomes.statuses) != 2 || outcomes.statuses[0] != http.StatusServiceUnavailable {
+		t.Errorf("Expected the two served responses to be observed, got %v", outcomes.statuses)
+	}
+}
+
+func TestParseFailureMode(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    FailureMode
+		wantErr bool
+	}{
+		{"", FailClosed, false},
+		{"closed", FailClosed, false},
+		{"fail-open", FailOpen, false},
+		{"local", FailLocal, false},
+		{"sideways", FailClosed, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := ParseFailureMode(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseFailureMode(%q) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+		}
+		if got != tc.want {
+			t.Errorf("ParseFailureMode(%q) = %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+
+	"monolith/internal/bucket"
+)
+
+// policyKeyPrefix starts the bucket keys of requests limited by a policy from the policy file.
+// The full key is "api_rate_limit:<policy>:<client>" and the policy is assigned to the
+// "api_rate_limit:<policy>:*" prefix in the policy store.
+const policyKeyPrefix = "api_rate_limit:"
+
+// policyNamePattern keeps policy names usable inside bucket keys
+var policyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// PolicyFile is the YAML or JSON file that configures the rate limit middleware
+type PolicyFile struct {
+	Version       string         `json:"version,omitempty" yaml:"version"`               // Shown by the policy endpoint; defaults to a checksum
+	DefaultPolicy string         `json:"default_policy,omitempty" yaml:"default_policy"` // Policy of routes without a rule; empty uses the bucket defaults
+	Policies      []FilePolicy   `json:"policies" yaml:"policies"`
+	Routes        []RouteRule    `json:"routes,omitempty" yaml:"routes"`
+	Identity      []IdentityRule `json:"identity,omitempty" yaml:"identity"` // Tried in order; empty uses the built-in client identification
+	Exempt        Exemptions     `json:"exempt,omitempty" yaml:"exempt"`
+}
+
+// FilePolicy is a named token bucket policy
+type FilePolicy struct {
+	Name       string  `json:"name" yaml:"name"`
+	Capacity   int64   `json:"capacity" yaml:"capacity"`       // Maximum tokens in bucket
+	RefillRate float64 `json:"refill_rate" yaml:"refill_rate"` // Tokens per second
+}
+
+// RouteRule sets the policy and cost of a route, or exempts it. Path is a mux route template
+// such as "/api/users/{id}", or a prefix ending in "*".
+type RouteRule struct {
+	Path    string   `json:"path" yaml:"path"`
+	Methods []string `json:"methods,omitempty" yaml:"methods"` // Empty matches every method
+	Policy  string   `json:"policy,omitempty" yaml:"policy"`   // Empty uses the default policy
+	Cost    *float64 `json:"cost,omitempty" yaml:"cost"`       // Tokens per request; defaults to 1
+	Exempt  bool     `json:"exempt,omitempty" yaml:"exempt"`   // Never rate limit matching requests
+}
+
+// Identity sources
+const (
+	IdentityHeader       = "header"        // Value of the named header
+	IdentityForwardedFor = "forwarded_for" // Client address from the forwarding header of the trusted proxies
+	IdentityRealIP       = "real_ip"       // X-Real-IP, if it is the forwarding header of the trusted proxies
+	IdentityRemoteAddr   = "remote_addr"   // Address of the connection
+)
+
+// IdentityRule names one place to find the client identity. The first rule that yields a
+// value wins and the client key becomes "<prefix>:<value>". Addresses are IPv6 /64 networks
+// or IPv4 addresses.
+type IdentityRule struct {
+	Source string `json:"source" yaml:"source"`
+	Header string `json:"header,omitempty" yaml:"header"` // Header name for the header source
+	Prefix string `json:"prefix,omitempty" yaml:"prefix"` // Defaults to "api_key" for headers and "ip" otherwise
+	Plain  bool   `json:"plain,omitempty" yaml:"plain"`   // Key by the header value itself instead of its digest; only for values that are not secret
+}
+
+// credentialHeaders are never used as plain identities
+var credentialHeaders = []string{"Authorization", "X-API-Key", "Cookie", "Proxy-Authorization"}
+
+// Exemptions lists requests that are never rate limited
+type Exemptions struct {
+	Routes  []string `json:"routes,omitempty" yaml:"routes"`     // Route templates or prefixes ending in "*"
+	CIDRs   []string `json:"cidrs,omitempty" yaml:"cidrs"`       // Client networks such as "10.0.0.0/8", or single addresses
+	APIKeys []string `json:"api_keys,omitempty" yaml:"api_keys"` // "sha256:<hex>" digests, so the policy endpoint never shows a key
+}
+
+// apiKeyDigestPrefix starts the API key digests in the allowlist
+const apiKeyDigestPrefix = "sha256:"
+
+// allowlist is the parsed form of the network and API key exemptions
+type allowlist struct {
+	networks []netip.Prefix
+	apiKeys  map[string]bool // Hex SHA-256 digests
+}
+
+// compile parses the network and API key exemptions
+func (e *Exemptions) compile() (*allowlist, error) {
+	list := &allowlist{apiKeys: make(map[string]bool, len(e.APIKeys))}
+
+	for _, cidr := range e.CIDRs {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("exempt CIDR %q: %w", cidr, err)
+		}
+		list.networks = append(list.networks, prefix)
+	}
+
+	for _, key := range e.APIKeys {
+		digest, ok := strings.CutPrefix(key, apiKeyDigestPrefix)
+		if decoded, err := hex.DecodeString(digest); !ok || err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("exempt API key %q must be \"sha256:\" followed by the hex SHA-256 of the key", key)
+		}
+		list.apiKeys[strings.ToLower(digest)] = true
+	}
+
+	return list, nil
+}
+
+// PolicySet is a validated policy file. It is immutable, so requests can keep using the set
+// they started with while a reload swaps in a new one.
+type PolicySet struct {
+	File     *PolicyFile `json:"file"`
+	Version  string      `json:"version"`
+	Checksum string      `json:"checksum"`
+	Path     string      `json:"path"`
+	LoadedAt time.Time   `json:"loaded_at"`
+
+	allowlist *allowlist
+}
+
+// PolicySource provides the policy set currently in effect
+type PolicySource interface {
+	Current() *PolicySet
+}
+
+// LoadPolicyFile reads and validates a policy file. Files ending in .json are parsed as JSON,
+// anything else as YAML. Unknown fields are rejected so typos do not go unnoticed.
+func LoadPolicyFile(path string) (*PolicySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+
+	var file PolicyFile
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", path, err)
+	}
+
+	if err := file.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	allowlist, err := file.Exempt.compile()
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	version := file.Version
+	if version == "" {
+		version = "sha256:" + checksum[:12]
+	}
+
+	return &PolicySet{
+		File:     &file,
+		Version:  version,
+		Checksum: checksum,
+		Path:     path,
+		LoadedAt: time.Now(),
+
+		allowlist: allowlist,
+	}, nil
+}
+
+// clientKeyPrefixes returns the prefixes client keys can start with. Keys of requests without
+// a policy are "api_rate_limit:<client>", so a policy of the same name would take them over.
+func (f *PolicyFile) clientKeyPrefixes() map[string]bool {
+	prefixes := map[string]bool{"ip": true, "api_key": true}
+	for _, rule := range f.Identity {
+		if rule.Prefix != "" {
+			prefixes[rule.Prefix] = true
+		}
+	}
+	return prefixes
+}
+
+// Validate checks that the file is complete and consistent
+func (f *PolicyFile) Validate() error {
+	names := make(map[string]bool, len(f.Policies))
+	prefixes := f.clientKeyPrefixes()
+	for _, p := range f.Policies {
+		if !policyNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("policy name %q must only contain letters, digits, '-' and '_'", p.Name)
+		}
+		if prefixes[p.Name] {
+			return fmt.Errorf("policy name %q is also a client key prefix", p.Name)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("policy %q is defined twice", p.Name)
+		}
+		names[p.Name] = true
+
+		policy := bucket.Policy{Name: p.Name, Capacity: p.Capacity, RefillRate: p.RefillRate}
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("policy %q: %w", p.Name, err)
+		}
+	}
+
+	if f.DefaultPolicy != "" && !names[f.DefaultPolicy] {
+		return fmt.Errorf("default policy %q is not defined", f.DefaultPolicy)
+	}
+
+	for i, route := range f.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("route %d: path %q must start with '/'", i+1, route.Path)
+		}
+		if route.Policy != "" && !names[route.Policy] {
+			return fmt.Errorf("route %s: policy %q is not defined", route.Path, route.Policy)
+		}
+		if route.Cost != nil && !(*route.Cost > 0 && !math.IsInf(*route.Cost, 0)) {
+			return fmt.Errorf("route %s: cost must be a positive number, got %v", route.Path, *route.Cost)
+		}
+		if route.Exempt && (route.Policy != "" || route.Cost != nil) {
+			return fmt.Errorf("route %s: an exempt route cannot set a policy or cost", route.Path)
+		}
+		if !route.Exempt && route.Policy == "" && route.Cost == nil {
+			return fmt.Errorf("route %s: set a policy, a cost or exempt", route.Path)
+		}
+		for _, method := range route.Methods {
+			if method == "" || strings.ToUpper(method) != method {
+				return fmt.Errorf("route %s: method %q must be upper case", route.Path, method)
+			}
+		}
+	}
+
+	for i, rule := range f.Identity {
+		if rule.Plain && rule.Source != IdentityHeader {
+			return fmt.Errorf("identity rule %d: plain only applies to header values", i+1)
+		}
+		for _, header := range credentialHeaders {
+			if rule.Plain && strings.EqualFold(rule.Header, header) {
+				return fmt.Errorf("identity rule %d: %s carries credentials and must be hashed", i+1, header)
+			}
+		}
+		switch rule.Source {
+		case IdentityHeader:
+			if rule.Header == "" {
+				return fmt.Errorf("identity rule %d: header source needs a header name", i+1)
+			}
+		case IdentityForwardedFor, IdentityRealIP, IdentityRemoteAddr:
+		default:
+			return fmt.Errorf("identity rule %d: unknown source %q", i+1, rule.Source)
+		}
+	}
+
+	for _, route := range f.Exempt.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("exempt route %q must start with '/'", route)
+		}
+	}
+
+	if _, err := f.Exempt.compile(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ValidateWholeCosts checks that every route cost is a whole number, for limiters that only
+// count whole requests
+func (f *PolicyFile) ValidateWholeCosts() error {
+	for _, route := range f.Routes {
+		if route.Cost != nil && *route.Cost != math.Trunc(*route.Cost) {
+			return fmt.Errorf("route %s: cost must be a whole number for this limiter, got %v", route.Path, *route.Cost)
+		}
+	}
+	return nil
+}
+
+// matchRoute reports whether a route matches a rule path: the same template, or a prefix
+// ending in "*"
+func matchRoute(pattern string, route string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(route, prefix)
+	}
+	return pattern == route
+}
+
+// routeTemplate returns the mux route template of a request, or its path outside a router
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return r.URL.Path
+}
+
+// matches reports whether a rule applies to a route and method
+func (rule *RouteRule) matches(route string, method string) bool {
+	if !matchRoute(rule.Path, route) {
+		return false
+	}
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, m := range rule.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Exempt reports whether requests to the route are never rate limited
+func (ps *PolicySet) Exempt(route string) bool {
+	for _, pattern := range ps.File.Exempt.Routes {
+		if matchRoute(pattern, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy returns the policy of the given name, or nil if the file has none
+func (ps *PolicySet) Policy(name string) *FilePolicy {
+	for i := range ps.File.Policies {
+		if ps.File.Policies[i].Name == name {
+			return &ps.File.Policies[i]
+		}
+	}
+	return nil
+}
+
+// Limit returns the policy and cost of a request to a route: those of the first matching
+// route rule, falling back to the default policy and a cost of 1. Exempt is set for exempt
+// routes and rules.
+func (ps *PolicySet) Limit(route string, method string) (policy string, cost float64, exempt bool) {
+	if ps.Exempt(route) {
+		return "", 0, true
+	}
+
+	for i := range ps.File.Routes {
+		rule := &ps.File.Routes[i]
+		if !rule.matches(route, method) {
+			continue
+		}
+		if rule.Exempt {
+			return "", 0, true
+		}
+
+		policy, cost = rule.Policy, 1
+		if policy == "" {
+			policy = ps.File.DefaultPolicy
+		}
+		if rule.Cost != nil {
+			cost = *rule.Cost
+		}
+		return policy, cost, false
+	}
+
+	return ps.File.DefaultPolicy, 1, false
+}
+
+// Allowlisted reports whether the client is exempt by network or API key. The network is
+// matched against the client address resolved through the trusted proxies; API keys are read
+// from X-API-Key, Authorization (with or without "Bearer ") and the headers of the identity rules.
+func (ps *PolicySet) Allowlisted(r *http.Request, proxies Proxies) bool {
+	list := ps.allowlist
+	if list == nil {
+		return false
+	}
+
+	if len(list.networks) > 0 {
+		if addr, ok := clientIP(r, proxies); ok && trusted(addr, list.networks) {
+			return true
+		}
+	}
+
+	if len(list.apiKeys) > 0 {
+		candidates := []string{r.Header.Get("X-API-Key"), r.Header.Get("Authorization")}
+		if token, ok := strings.CutPrefix(candidates[1], "Bearer "); ok {
+			candidates = append(candidates, token)
+		}
+		for _, rule := range ps.File.Identity {
+			if rule.Source == IdentityHeader {
+				candidates = append(candidates, r.Header.Get(rule.Header))
+			}
+		}
+
+		for _, key := range candidates {
+			if key == "" {
+				continue
+			}
+			sum := sha256.Sum256([]byte(key))
+			if list.apiKeys[hex.EncodeToString(sum[:])] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ClientKey identifies the client of a request with the identity rules
+func (ps *PolicySet) ClientKey(r *http.Request, proxies Proxies) string {
+	if len(ps.File.Identity) == 0 {
+		return clientKey(r, proxies)
+	}
+
+	for _, rule := range ps.File.Identity {
+		var value string
+		prefix := "ip"
+		switch rule.Source {
+		case IdentityHeader:
+			value = r.Header.Get(rule.Header)
+			if strings.EqualFold(rule.Header, "Authorization") {
+				// Same bucket as the built-in identification of the key
+				value = bearerToken(value)
+			}
+			if value != "" && !rule.Plain {
+				value = hashCredential(value)
+			}
+			prefix = "api_key"
+		case IdentityForwardedFor:
+			if addr, ok := clientIP(r, proxies); ok {
+				value = ipGroup(addr)
+			}
+		case IdentityRealIP:
+			if proxies.Header != HeaderXRealIP {
+				break
+			}
+			if addr, ok := clientIP(r, proxies); ok {
+				value = ipGroup(addr)
+			}
+		case IdentityRemoteAddr:
+			if addr, ok := parseNode(r.RemoteAddr); ok {
+				value = ipGroup(addr)
+			}
+		}
+
+		if value == "" {
+			continue
+		}
+		if rule.Prefix != "" {
+			prefix = rule.Prefix
+		}
+		return prefix + ":" + value
+	}
+
+	// No rule matched; the connection address always exists
+	if addr, ok := parseNode(r.RemoteAddr); ok {
+		return "ip:" + ipGroup(addr)
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// BucketKey returns the bucket key for a client under a policy
+func (ps *PolicySet) BucketKey(policy string, client string) string {
+	if policy == "" {
+		return policyKeyPrefix + client
+	}
+	return policyKeyPrefix + policy + ":" + client
+}
+
+// Apply stores the policies and assigns each to its bucket key prefix. Assignments of policies
+// that were removed from the file are dropped afterwards, so requests are never left without
+// a policy while the file changes. Only assignments a policy file makes are dropped; those
+// made through the admin API are kept.
+func (ps *PolicySet) Apply(ctx context.Context, store bucket.PolicyStore) error {
+	wanted := make(map[string]string, len(ps.File.Policies))
+	for _, p := range ps.File.Policies {
+		policy := &bucket.Policy{Name: p.Name, Capacity: p.Capacity, RefillRate: p.RefillRate}
+		if err := store.SetPolicy(ctx, policy); err != nil {
+			return fmt.Errorf("failed to store policy %q: %w", p.Name, err)
+		}
+
+		pattern := ps.BucketKey(p.Name, "*")
+		if err := store.AssignPolicy(ctx, pattern, p.Name); err != nil {
+			return fmt.Errorf("failed to assign policy %q: %w", p.Name, err)
+		}
+		wanted[pattern] = p.Name
+	}
+
+	assignments, err := store.ListAssignments(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list policy assignments: %w", err)
+	}
+	for pattern, name := range assignments {
+		if ps.fileAssignment(pattern, name) && wanted[pattern] == "" {
+			if err := store.UnassignPolicy(ctx, pattern); err != nil {
+				return fmt.Errorf("failed to remove assignment %q: %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// fileAssignment reports whether an assignment has the form Apply gives them: a policy
+// assigned to the "api_rate_limit:<policy>:*" prefix of its own name
+func (ps *PolicySet) fileAssignment(pattern string, name string) bool {
+	return policyNamePattern.MatchString(name) && pattern == ps.BucketKey(name, "*")
+}
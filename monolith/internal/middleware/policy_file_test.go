@@ -0,0 +1,432 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"monolith/internal/bucket"
+
+	"github.com/gorilla/mux"
+)
+
+const testPolicyYAML = `
+version: "2026-10-01"
+default_policy: standard
+policies:
+  - name: standard
+    capacity: 2
+    refill_rate: 0.01
+  - name: search
+    capacity: 5
+    refill_rate: 0.01
+routes:
+  - path: /api/search/*
+    policy: search
+identity:
+  - source: header
+    header: X-Tenant-ID
+    prefix: tenant
+    plain: true
+  - source: remote_addr
+exempt:
+  routes: [/health]
+`
+
+func writePolicyFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write policy file: %v", err)
+	}
+	return path
+}
+
+func TestLoadPolicyFile_YAMLAndJSON(t *testing.T) {
+	set, err := LoadPolicyFile(writePolicyFile(t, "policy.yaml", testPolicyYAML))
+	if err != nil {
+		t.Fatalf("Failed to load YAML: %v", err)
+	}
+	if set.Version != "2026-10-01" || len(set.File.Policies) != 2 || set.File.Policies[1].RefillRate != 0.01 {
+		t.Errorf("Unexpected policy set %+v", set.File)
+	}
+
+	set, err = LoadPolicyFile(writePolicyFile(t, "policy.json",
+		`{"policies":[{"name":"standard","capacity":10,"refill_rate":1}],"default_policy":"standard"}`))
+	if err != nil {
+		t.Fatalf("Failed to load JSON: %v", err)
+	}
+	if !strings.HasPrefix(set.Version, "sha256:") {
+		t.Errorf("Expected a checksum version without an explicit version, got %q", set.Version)
+	}
+}
+
+func TestLoadPolicyFile_Validation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown field", "policies: []\nburst: 5\n", "burst"},
+		{"bad policy name", "policies:\n  - {name: 'a:b', capacity: 1, refill_rate: 1}\n", "policy name"},
+		{"duplicate policy", "policies:\n  - {name: a, capacity: 1, refill_rate: 1}\n  - {name: a, capacity: 2, refill_rate: 1}\n", "twice"},
+		{"zero capacity", "policies:\n  - {name: a, capacity: 0, refill_rate: 1}\n", "capacity"},
+		{"undefined default", "default_policy: missing\npolicies: []\n", "default policy"},
+		{"route without policy", "policies: []\nroutes:\n  - {path: /api, policy: missing}\n", "not defined"},
+		{"relative route", "policies:\n  - {name: a, capacity: 1, refill_rate: 1}\nroutes:\n  - {path: api, policy: a}\n", "must start"},
+		{"header rule without name", "policies: []\nidentity:\n  - {source: header}\n", "header name"},
+		{"unknown identity source", "policies: []\nidentity:\n  - {source: cookie}\n", "unknown source"},
+		{"plain address", "policies: []\nidentity:\n  - {source: remote_addr, plain: true}\n", "plain only applies"},
+		{"plain credential", "policies: []\nidentity:\n  - {source: header, header: authorization, plain: true}\n", "must be hashed"},
+		{"policy named like client keys", "policies:\n  - {name: ip, capacity: 1, refill_rate: 1}\n", "client key prefix"},
+		{"policy named like an identity prefix", "policies:\n  - {name: tenant, capacity: 1, refill_rate: 1}\nidentity:\n  - {source: header, header: X-Tenant-ID, prefix: tenant, plain: true}\n", "client key prefix"},
+		{"empty route rule", "policies: []\nroutes:\n  - {path: /api}\n", "set a policy"},
+		{"exempt route with cost", "policies: []\nroutes:\n  - {path: /api, exempt: true, cost: 2}\n", "exempt route cannot"},
+		{"negative cost", "policies: []\nroutes:\n  - {path: /api, cost: -1}\n", "positive"},
+		{"zero cost", "policies: []\nroutes:\n  - {path: /api, cost: 0}\n", "positive"},
+		{"NaN cost", "policies: []\nroutes:\n  - {path: /api, cost: .nan}\n", "positive"},
+		{"lower case method", "policies: []\nroutes:\n  - {path: /api, cost: 2, methods: [post]}\n", "upper case"},
+		{"bad CIDR", "policies: []\nexempt:\n  cidrs: [10.0.0.0/33]\n", "CIDR"},
+		{"plain API key", "policies: []\nexempt:\n  api_keys: [secret]\n", "sha256"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadPolicyFile(writePolicyFile(t, "policy.yaml", test.content))
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Expected an error containing %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPolicyWatcher_WholeCosts(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	ctx := context.Background()
+	path := writePolicyFile(t, "policy.yaml",
+		strings.Replace(testPolicyYAML, "routes:\n", "routes:\n  - {path: /api/reports, cost: 2.5}\n", 1))
+	window, err := bucket.NewMemorySlidingWindow(&bucket.SlidingWindowConfig{WindowSize: time.Minute, MaxRequests: 10})
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	defer window.Close()
+
+	// A token bucket takes fractional costs, a sliding window only whole requests
+	if _, err := NewPolicyWatcher(ctx, path, tb, tb); err != nil {
+		t.Errorf("Expected a fractional cost to be accepted for a token bucket, got %v", err)
+	}
+	if _, err := NewPolicyWatcher(ctx, path, tb, tb, window); err == nil || !strings.Contains(err.Error(), "whole number") {
+		t.Errorf("Expected a fractional cost to be rejected for a sliding window, got %v", err)
+	}
+}
+
+func TestPolicySet_ClientKey(t *testing.T) {
+	set, err := LoadPolicyFile(writePolicyFile(t, "policy.yaml", `
+policies: [{name: standard, capacity: 2, refill_rate: 1}]
+identity:
+  - {source: header, header: Authorization}
+  - {source: header, header: X-Tenant-ID, prefix: tenant, plain: true}
+  - {source: real_ip}
+  - {source: forwarded_for}
+exempt:
+  cidrs: [198.51.100.0/24]
+`))
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+	trustedProxies, _ := ParseTrustedProxies("10.0.0.0/8")
+	proxies := Proxies{Trusted: trustedProxies}
+
+	request := func(remoteAddr string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest("GET", "/api/test", nil)
+		req.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+
+	tests := []struct {
+		req      *http.Request
+		expected string
+	}{
+		{request("192.0.2.7:1234", map[string]string{"Authorization": "Bearer secret", "X-Tenant-ID": "acme"}), "api_key:" + hashCredential("secret")},
+		{request("192.0.2.7:1234", map[string]string{"X-Tenant-ID": "acme"}), "tenant:acme"},
+		{request("192.0.2.7:1234", map[string]string{"X-Real-IP": "203.0.113.9", "X-Forwarded-For": "203.0.113.8"}), "ip:192.0.2.7"},
+		{request("10.0.0.1:1234", map[string]string{"X-Real-IP": "203.0.113.9"}), "ip:10.0.0.1"}, // Not the proxies' header
+		{request("10.0.0.1:1234", map[string]string{"X-Forwarded-For": "2001:db8:1:2::7, 10.0.0.2"}), "ip:2001:db8:1:2::/64"},
+	}
+	for i, test := range tests {
+		if got := set.ClientKey(test.req, proxies); got != test.expected {
+			t.Errorf("Request %d: expected %s, got %s", i+1, test.expected, got)
+		}
+	}
+
+	realIPProxies := Proxies{Trusted: trustedProxies, Header: HeaderXRealIP}
+	if got := set.ClientKey(request("10.0.0.1:1234", map[string]string{"X-Real-IP": "203.0.113.9"}), realIPProxies); got != "ip:203.0.113.9" {
+		t.Errorf("Expected X-Real-IP from the proxies, got %s", got)
+	}
+
+	// Allowlisted networks match the client behind a trusted proxy, not a spoofed header
+	if !set.Allowlisted(request("10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.4"}), proxies) {
+		t.Error("Expected the client behind the trusted proxy to be allowlisted")
+	}
+	if set.Allowlisted(request("192.0.2.7:1234", map[string]string{"X-Forwarded-For": "198.51.100.4"}), proxies) {
+		t.Error("Expected a spoofed X-Forwarded-For not to be allowlisted")
+	}
+}
+
+func TestRateLimitMiddleware_PolicyFile(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	ctx := context.Background()
+	path := writePolicyFile(t, "policy.yaml", testPolicyYAML)
+	watcher, err := NewPolicyWatcher(ctx, path, tb)
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+	for _, key := range []string{"api_rate_limit:standard:tenant:acme", "api_rate_limit:search:tenant:acme"} {
+		tb.ResetBucket(ctx, key)
+	}
+
+	router := mux.NewRouter()
+	router.Use(NewRateLimitMiddleware(tb, &RateLimitConfig{RequestsPerMinute: 1, Policies: watcher}).Handler)
+	router.Handle("/api/search/{index}", okHandler)
+	router.Handle("/api/orders", okHandler)
+	router.Handle("/health", okHandler)
+
+	request := func(path string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Tenant-ID", "acme")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The search route gets its own bucket of 5, everything else the standard bucket of 2
+	for i := 0; i < 5; i++ {
+		if code := request("/api/search/products"); code != http.StatusOK {
+			t.Fatalf("Search request %d: expected 200, got %d", i+1, code)
+		}
+	}
+	if code := request("/api/search/products"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the search policy to allow 5 requests, got %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := request("/api/orders"); code != http.StatusOK {
+			t.Fatalf("Order request %d: expected 200, got %d", i+1, code)
+		}
+	}
+	if code := request("/api/orders"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the standard policy to allow 2 requests, got %d", code)
+	}
+
+	// Exempt routes are never limited
+	for i := 0; i < 10; i++ {
+		if code := request("/health"); code != http.StatusOK {
+			t.Fatalf("Expected /health to be exempt, got %d", code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	watcher.ServeHTTP(w, httptest.NewRequest("GET", "/api/ratelimit/policy", nil))
+	if !strings.Contains(w.Body.String(), `"version":"2026-10-01"`) {
+		t.Errorf("Expected the policy endpoint to show the version, got %s", w.Body.String())
+	}
+}
+
+func TestRateLimitMiddleware_RouteRulesAndAllowlists(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	partnerKey := sha256.Sum256([]byte("partner-key"))
+	path := writePolicyFile(t, "policy.yaml", fmt.Sprintf(`
+default_policy: standard
+policies:
+  - {name: standard, capacity: 4, refill_rate: 0.01}
+routes:
+  - {path: /health, exempt: true}
+  - {path: /api/users, methods: [POST], cost: 2}
+exempt:
+  cidrs: [10.20.0.0/16, "2001:db8::1"]
+  api_keys: ["sha256:%x"]
+`, partnerKey))
+
+	ctx := context.Background()
+	watcher, err := NewPolicyWatcher(ctx, path, tb)
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+	tb.ResetBucket(ctx, "api_rate_limit:standard:ip:192.0.2.7")
+
+	router := mux.NewRouter()
+	router.Use(NewRateLimitMiddleware(tb, &RateLimitConfig{Policies: watcher}).Handler)
+	router.Handle("/api/users", okHandler).Methods("GET", "POST")
+	router.Handle("/health", okHandler)
+
+	request := func(method string, path string, remoteAddr string, apiKey string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Health checks never take tokens
+	for i := 0; i < 10; i++ {
+		if code := request("GET", "/health", "192.0.2.7:1234", ""); code != http.StatusOK {
+			t.Fatalf("Expected /health to be exempt, got %d", code)
+		}
+	}
+
+	// POST costs 2 of the 4 tokens, GET the default of 1
+	for i, method := range []string{"POST", "GET", "GET"} {
+		if code := request(method, "/api/users", "192.0.2.7:1234", ""); code != http.StatusOK {
+			t.Fatalf("Request %d (%s): expected 200, got %d", i+1, method, code)
+		}
+	}
+	if code := request("POST", "/api/users", "192.0.2.7:1234", ""); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the bucket to be exhausted, got %d", code)
+	}
+
+	// Allowlisted networks and API keys bypass the limit
+	allowed := []struct {
+		remoteAddr string
+		apiKey     string
+	}{
+		{"10.20.3.4:1234", ""},
+		{"[2001:db8::1]:1234", ""},
+		{"192.0.2.7:1234", "partner-key"},
+	}
+	for _, client := range allowed {
+		for i := 0; i < 5; i++ {
+			if code := request("POST", "/api/users", client.remoteAddr, client.apiKey); code != http.StatusOK {
+				t.Fatalf("Expected %+v to be allowlisted, got %d", client, code)
+			}
+		}
+	}
+}
+
+func TestPolicyWatcher_Reload(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	ctx := context.Background()
+	path := writePolicyFile(t, "policy.yaml", testPolicyYAML)
+	watcher, err := NewPolicyWatcher(ctx, path, tb)
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+
+	// An invalid file is ignored and the previous version stays active
+	os.WriteFile(path, []byte("policies:\n  - {name: standard, capacity: -1, refill_rate: 1}\n"), 0o644)
+	if changed, err := watcher.Reload(ctx); err == nil || changed {
+		t.Errorf("Expected an invalid file to be rejected, got changed=%v err=%v", changed, err)
+	}
+	if version := watcher.Current().Version; version != "2026-10-01" {
+		t.Errorf("Expected the previous version to stay active, got %q", version)
+	}
+
+	// Requests keep flowing while the file changes underneath them
+	router := mux.NewRouter()
+	router.Use(NewRateLimitMiddleware(tb, &RateLimitConfig{RequestsPerMinute: 1, Policies: watcher}).Handler)
+	router.Handle("/api/orders", okHandler)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go watcher.Watch(watchCtx, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest("GET", "/api/orders", nil))
+				if w.Code != http.StatusOK && w.Code != http.StatusTooManyRequests {
+					t.Errorf("Expected 200 or 429 during reload, got %d", w.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	updated := strings.Replace(testPolicyYAML, `version: "2026-10-01"`, `version: "2026-10-02"`, 1)
+	os.WriteFile(path, []byte(updated), 0o644)
+	// Make sure the modification time moves even on coarse-grained file systems
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for watcher.Current().Version != "2026-10-02" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	if version := watcher.Current().Version; version != "2026-10-02" {
+		t.Errorf("Expected the changed file to be picked up, got version %q", version)
+	}
+}
+
+func TestPolicyWatcher_ReloadKeepsAdminAssignments(t *testing.T) {
+	tb := createTestBucket(t, 100, 100)
+	defer tb.Close()
+
+	ctx := context.Background()
+	path := writePolicyFile(t, "policy.yaml", testPolicyYAML)
+	watcher, err := NewPolicyWatcher(ctx, path, tb)
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+
+	// An operator gives one tenant a bigger bucket through the admin API
+	adminPattern := "api_rate_limit:standard:tenant:acme"
+	if err := tb.AssignPolicy(ctx, adminPattern, "search"); err != nil {
+		t.Fatalf("Failed to assign policy: %v", err)
+	}
+	defer tb.UnassignPolicy(ctx, adminPattern)
+
+	// The search policy is removed from the file
+	updated := strings.Replace(testPolicyYAML, `version: "2026-10-01"`, `version: "2026-10-02"`, 1)
+	updated = strings.Replace(updated, "  - path: /api/search/*\n    policy: search\n", "", 1)
+	updated = strings.Replace(updated, "  - name: search\n    capacity: 5\n    refill_rate: 0.01\n", "", 1)
+	os.WriteFile(path, []byte(updated), 0o644)
+	if changed, err := watcher.Reload(ctx); err != nil || !changed {
+		t.Fatalf("Expected the file to be reloaded, got changed=%v err=%v", changed, err)
+	}
+
+	assignments, err := tb.ListAssignments(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list assignments: %v", err)
+	}
+	if assignments[adminPattern] != "search" {
+		t.Errorf("Expected the admin assignment to survive the reload, got %v", assignments)
+	}
+	if _, ok := assignments["api_rate_limit:search:*"]; ok {
+		t.Error("Expected the assignment of the removed policy to be dropped")
+	}
+	if assignments["api_rate_limit:standard:*"] != "standard" {
+		t.Errorf("Expected the standard policy to stay assigned, got %v", assignments)
+	}
+}
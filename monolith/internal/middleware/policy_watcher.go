@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"monolith/internal/bucket"
+)
+
+// PolicyWatcher keeps the policy file in effect and reloads it when it changes. A file that
+// fails to load or validate is logged and ignored; the previous policy set stays active.
+type PolicyWatcher struct {
+	path       string
+	store      bucket.PolicyStore
+	wholeCosts bool // The route costs are charged to a limiter that needs whole numbers
+	current    atomic.Pointer[PolicySet]
+	mu         sync.Mutex // Serializes reloads
+	lastMod    time.Time  // Modification time of the file at the last reload
+}
+
+var _ PolicySource = (*PolicyWatcher)(nil)
+
+// NewPolicyWatcher loads the policy file and stores its policies in the policy store. It fails
+// if the initial file is invalid. The route costs are charged to the given limiters; if any of
+// them only takes whole numbers, files with fractional costs are rejected.
+func NewPolicyWatcher(ctx context.Context, path string, store bucket.PolicyStore, limiters ...bucket.Limiter) (*PolicyWatcher, error) {
+	pw := &PolicyWatcher{
+		path:  path,
+		store: store,
+	}
+	for _, limiter := range limiters {
+		if bucket.NeedsWholeCost(limiter) {
+			pw.wholeCosts = true
+		}
+	}
+
+	if _, err := pw.Reload(ctx); err != nil {
+		return nil, err
+	}
+
+	return pw, nil
+}
+
+// Current returns the policy set in effect
+func (pw *PolicyWatcher) Current() *PolicySet {
+	return pw.current.Load()
+}
+
+// Reload loads the policy file and switches to it if it changed. It reports whether a new
+// policy set took effect. Requests in flight finish with the set they started with.
+func (pw *PolicyWatcher) Reload(ctx context.Context) (bool, error) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	// A file that fails to load is retried on SIGHUP or its next change, not on every check
+	pw.lastMod = pw.modTime()
+
+	set, err := LoadPolicyFile(pw.path)
+	if err != nil {
+		return false, err
+	}
+	if pw.wholeCosts {
+		if err := set.File.ValidateWholeCosts(); err != nil {
+			return false, fmt.Errorf("invalid policy file %s: %w", pw.path, err)
+		}
+	}
+
+	if current := pw.current.Load(); current != nil && current.Checksum == set.Checksum {
+		return false, nil
+	}
+
+	// Store the new policies before any request can use their bucket keys
+	if err := set.Apply(ctx, pw.store); err != nil {
+		return false, err
+	}
+	pw.current.Store(set)
+
+	return true, nil
+}
+
+// Watch reloads the policy file on SIGHUP and whenever its modification time changes, checking
+// every interval, until ctx is cancelled
+func (pw *PolicyWatcher) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading rate limit policy file %s", pw.path)
+		case <-ticker.C:
+			if !pw.changed() {
+				continue
+			}
+		}
+
+		pw.reloadAndLog(ctx)
+	}
+}
+
+// changed reports whether the policy file was modified since the last reload
+func (pw *PolicyWatcher) changed() bool {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return !pw.modTime().Equal(pw.lastMod)
+}
+
+// modTime returns the modification time of the policy file, or the zero time if it is missing
+func (pw *PolicyWatcher) modTime() time.Time {
+	info, err := os.Stat(pw.path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadAndLog reloads the policy file and logs the outcome
+func (pw *PolicyWatcher) reloadAndLog(ctx context.Context) {
+	reloadCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	changed, err := pw.Reload(reloadCtx)
+	switch {
+	case err != nil:
+		log.Printf("Keeping rate limit policy version %s: %v", pw.Current().Version, err)
+	case changed:
+		log.Printf("Loaded rate limit policy version %s", pw.Current().Version)
+	}
+}
+
+// ServeHTTP serves the policy set in effect as JSON. It is read-only.
+func (pw *PolicyWatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	set := pw.Current()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", `"`+set.Checksum+`"`)
+	json.NewEncoder(w).Encode(set)
+}
@@ -0,0 +1,107 @@
+package rls
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"gopkg.in/yaml.v3"
+
+	"monolith/internal/bucket"
+)
+
+// Config maps Envoy descriptors to token bucket policies
+type Config struct {
+	Policies []PolicyConfig `yaml:"policies"` // Stored on every startup, replacing stored policies of the same name; may be empty if the policies already exist
+	Rules    []Rule         `yaml:"rules"`    // Tried in order; the first match wins
+}
+
+// PolicyConfig is a named token bucket policy
+type PolicyConfig struct {
+	Name       string  `yaml:"name"`
+	Capacity   int64   `yaml:"capacity"`    // Maximum tokens in bucket
+	RefillRate float64 `yaml:"refill_rate"` // Tokens per second
+}
+
+// Rule applies a policy to descriptors in a domain. A descriptor matches when it has exactly
+// the rule's entries, with the same keys in the same order. An entry without a value matches
+// any value, and every distinct value gets its own bucket.
+type Rule struct {
+	Domain     string         `yaml:"domain"` // Empty matches every domain
+	Descriptor []EntryMatcher `yaml:"descriptor"`
+	Policy     string         `yaml:"policy"`
+}
+
+// EntryMatcher matches one descriptor entry
+type EntryMatcher struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"` // Empty matches any value
+}
+
+// LoadConfig reads a YAML descriptor mapping. Unknown fields are rejected.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rate limit service config: %w", err)
+	}
+
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse rate limit service config %s: %w", path, err)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid rate limit service config %s: %w", path, err)
+	}
+
+	return &config, nil
+}
+
+// Validate checks the policies and that every rule names a policy and matches something
+func (c *Config) Validate() error {
+	for _, p := range c.Policies {
+		policy := bucket.Policy{Name: p.Name, Capacity: p.Capacity, RefillRate: p.RefillRate}
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("policy %q: %w", p.Name, err)
+		}
+	}
+
+	for i, rule := range c.Rules {
+		if rule.Policy == "" {
+			return fmt.Errorf("rule %d: policy is required", i+1)
+		}
+		if len(rule.Descriptor) == 0 {
+			return fmt.Errorf("rule %d: descriptor needs at least one entry", i+1)
+		}
+		for _, entry := range rule.Descriptor {
+			if entry.Key == "" {
+				return fmt.Errorf("rule %d: descriptor entry key is required", i+1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// match reports whether the rule applies to a descriptor
+func (r *Rule) match(domain string, d *ratelimitv3.RateLimitDescriptor) bool {
+	if r.Domain != "" && r.Domain != domain {
+		return false
+	}
+	entries := d.GetEntries()
+	if len(r.Descriptor) != len(entries) {
+		return false
+	}
+	for i, entry := range r.Descriptor {
+		if entry.Key != entries[i].GetKey() {
+			return false
+		}
+		if entry.Value != "" && entry.Value != entries[i].GetValue() {
+			return false
+		}
+	}
+	return true
+}
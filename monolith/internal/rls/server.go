@@ -0,0 +1,227 @@
+// Package rls implements the Envoy rate limit service (envoy.service.ratelimit.v3) on top of
+// the Redis token buckets, so edge proxies and Go services share the same buckets.
+//
+// The service is a grpc-go server using the stubs generated from the Envoy protos in
+// go-control-plane, so it speaks exactly what Envoy's rate limit filter sends.
+package rls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"monolith/internal/bucket"
+	"monolith/internal/metrics"
+)
+
+// keyPrefix starts the bucket keys of descriptors. The full key is
+// "rls:<policy>:<domain>:<key>=<value>:..." and the policy is assigned to "rls:<policy>:*".
+const keyPrefix = "rls:"
+
+// Limiter is the bucket backend of the service
+type Limiter interface {
+	bucket.PolicyStore
+	TakeTokens(ctx context.Context, key string, tokens float64) (*bucket.TokenResult, error)
+}
+
+var _ Limiter = (*bucket.RedisTokenBucket)(nil)
+
+// Server answers ShouldRateLimit calls from the descriptor rules
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	limiter Limiter
+	rules   []Rule
+}
+
+var _ rlsv3.RateLimitServiceServer = (*Server)(nil)
+
+// NewServer stores the configured policies and assigns each rule's policy to its bucket keys.
+// The config owns the policies it lists: a stored policy of the same name, e.g. one changed
+// through the policy API, is overwritten on every start. It fails if a rule names a policy
+// that does not exist.
+func NewServer(ctx context.Context, limiter Limiter, config *Config) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	for _, p := range config.Policies {
+		policy := &bucket.Policy{Name: p.Name, Capacity: p.Capacity, RefillRate: p.RefillRate}
+		if stored, err := limiter.GetPolicy(ctx, p.Name); err == nil &&
+			(stored.Capacity != policy.Capacity || stored.RefillRate != policy.RefillRate) {
+			log.Printf("Rate limit service config replaces stored policy %q (capacity %d, refill rate %g)",
+				p.Name, stored.Capacity, stored.RefillRate)
+		}
+		if err := limiter.SetPolicy(ctx, policy); err != nil {
+			return nil, fmt.Errorf("failed to store policy %q: %w", p.Name, err)
+		}
+	}
+
+	assigned := make(map[string]bool)
+	for _, rule := range config.Rules {
+		if assigned[rule.Policy] {
+			continue
+		}
+		if err := limiter.AssignPolicy(ctx, keyPrefix+rule.Policy+":*", rule.Policy); err != nil {
+			if errors.Is(err, bucket.ErrPolicyNotFound) {
+				return nil, fmt.Errorf("rule policy %q does not exist", rule.Policy)
+			}
+			return nil, fmt.Errorf("failed to assign policy %q: %w", rule.Policy, err)
+		}
+		assigned[rule.Policy] = true
+	}
+
+	return &Server{
+		limiter: limiter,
+		rules:   config.Rules,
+	}, nil
+}
+
+// Register adds the service to a gRPC server
+func (s *Server) Register(registrar grpc.ServiceRegistrar) {
+	rlsv3.RegisterRateLimitServiceServer(registrar, s)
+}
+
+// ShouldRateLimit takes hits from the bucket of every descriptor that matches a rule. The
+// request is over the limit if any descriptor is. Like the reference Envoy service, every
+// matching descriptor is charged even when another one is over its limit. Descriptors without
+// a rule are not limited.
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one descriptor is required")
+	}
+
+	resp := &rlsv3.RateLimitResponse{
+		OverallCode: rlsv3.RateLimitResponse_OK,
+		Statuses:    make([]*rlsv3.RateLimitResponse_DescriptorStatus, len(req.Descriptors)),
+	}
+
+	for i, descriptor := range req.Descriptors {
+		rule := s.ruleFor(req.Domain, descriptor)
+		if rule == nil {
+			resp.Statuses[i] = &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}
+			continue
+		}
+
+		result, err := s.limiter.TakeTokens(ctx, bucketKey(rule.Policy, req.Domain, descriptor), hits(req, descriptor))
+		if err != nil {
+			metrics.Decisions.WithLabelValues(rule.route(), rule.Policy, metrics.DecisionError).Inc()
+			log.Printf("Rate limit service error: %v", err)
+			return nil, status.Errorf(codes.Unavailable, "rate limit backend: %v", err)
+		}
+
+		descriptorStatus := descriptorStatus(rule.Policy, result)
+		decision := metrics.DecisionAllowed
+		if descriptorStatus.Code == rlsv3.RateLimitResponse_OVER_LIMIT {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			decision = metrics.DecisionDenied
+		}
+		metrics.Decisions.WithLabelValues(rule.route(), rule.Policy, decision).Inc()
+		resp.Statuses[i] = descriptorStatus
+	}
+
+	return resp, nil
+}
+
+// ruleFor returns the first rule matching a descriptor, or nil
+func (s *Server) ruleFor(domain string, d *ratelimitv3.RateLimitDescriptor) *Rule {
+	for i := range s.rules {
+		if s.rules[i].match(domain, d) {
+			return &s.rules[i]
+		}
+	}
+	return nil
+}
+
+// route returns the route label of the rule's decisions. It comes from the configuration,
+// never from the request, so clients cannot create label series.
+func (r *Rule) route() string {
+	if r.Domain == "" {
+		return "rls"
+	}
+	return "rls:" + r.Domain
+}
+
+// bucketKey returns the bucket of a descriptor under a policy
+func bucketKey(policy string, domain string, d *ratelimitv3.RateLimitDescriptor) string {
+	var sb strings.Builder
+	sb.WriteString(keyPrefix + policy + ":" + domain)
+	for _, e := range d.GetEntries() {
+		sb.WriteString(":" + e.GetKey() + "=" + e.GetValue())
+	}
+	return sb.String()
+}
+
+// hits returns the tokens a descriptor takes. A hits_addend of zero counts as one hit.
+func hits(req *rlsv3.RateLimitRequest, d *ratelimitv3.RateLimitDescriptor) float64 {
+	if addend := d.GetHitsAddend(); addend != nil && addend.GetValue() > 0 {
+		return float64(addend.GetValue())
+	}
+	if req.GetHitsAddend() > 0 {
+		return float64(req.GetHitsAddend())
+	}
+	return 1
+}
+
+// descriptorStatus converts a token bucket result into a descriptor status. The reset time is
+// when the bucket is full again, or when the denied hits fit if that is later.
+func descriptorStatus(policy string, result *bucket.TokenResult) *rlsv3.RateLimitResponse_DescriptorStatus {
+	descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code:           rlsv3.RateLimitResponse_OK,
+		CurrentLimit:   currentLimit(policy, result.RefillRate),
+		LimitRemaining: uint32(math.Max(0, math.Floor(result.RemainingTokens))),
+	}
+	if !result.Allowed {
+		descriptorStatus.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+	}
+
+	if result.RefillRate > 0 {
+		untilFull := (float64(result.Capacity) - result.RemainingTokens) / result.RefillRate
+		descriptorStatus.DurationUntilReset = durationpb.New(
+			time.Duration(math.Max(untilFull, result.RetryAfter) * float64(time.Second)))
+	}
+
+	return descriptorStatus
+}
+
+// currentLimit expresses a refill rate in the smallest unit that gives a whole number of
+// requests, e.g. 0.5 tokens/s becomes 30 per minute
+func currentLimit(policy string, refillRate float64) *rlsv3.RateLimitResponse_RateLimit {
+	units := []struct {
+		unit    rlsv3.RateLimitResponse_RateLimit_Unit
+		seconds float64
+	}{
+		{rlsv3.RateLimitResponse_RateLimit_SECOND, 1},
+		{rlsv3.RateLimitResponse_RateLimit_MINUTE, 60},
+		{rlsv3.RateLimitResponse_RateLimit_HOUR, 3600},
+		{rlsv3.RateLimitResponse_RateLimit_DAY, 86400},
+	}
+
+	for _, u := range units {
+		perUnit := refillRate * u.seconds
+		if perUnit >= 1 && math.Abs(perUnit-math.Round(perUnit)) < 1e-6 {
+			return &rlsv3.RateLimitResponse_RateLimit{Name: policy, RequestsPerUnit: uint32(math.Round(perUnit)), Unit: u.unit}
+		}
+	}
+
+	// No unit divides evenly; round per day
+	return &rlsv3.RateLimitResponse_RateLimit{
+		Name:            policy,
+		RequestsPerUnit: uint32(math.Max(1, math.Round(refillRate*86400))),
+		Unit:            rlsv3.RateLimitResponse_RateLimit_DAY,
+	}
+}
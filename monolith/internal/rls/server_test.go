@@ -0,0 +1,239 @@
+package rls
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"monolith/internal/bucket"
+)
+
+func createTestBucket(t *testing.T) *bucket.RedisTokenBucket {
+	tb, err := bucket.NewRedisTokenBucket(&bucket.Config{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       9, // Use test DB
+		Capacity:      100,
+		RefillRate:    100,
+		TTL:           1 * time.Minute,
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+
+	return tb
+}
+
+const testConfigYAML = `
+policies:
+  - name: edge_login
+    capacity: 3
+    refill_rate: 0.05
+  - name: edge_per_ip
+    capacity: 10
+    refill_rate: 1
+rules:
+  - domain: edge
+    descriptor:
+      - key: remote_address
+      - key: path
+        value: /login
+    policy: edge_login
+  - domain: edge
+    descriptor:
+      - key: remote_address
+    policy: edge_per_ip
+`
+
+func TestLoadConfig_Validation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown field", "rules: []\nlimits: []\n", "limits"},
+		{"rule without policy", "rules:\n  - descriptor: [{key: a}]\n", "policy is required"},
+		{"rule without entries", "rules:\n  - {policy: a}\n", "at least one entry"},
+		{"entry without key", "rules:\n  - {policy: a, descriptor: [{value: b}]}\n", "key is required"},
+		{"invalid policy", "policies:\n  - {name: a, capacity: 0, refill_rate: 1}\n", "capacity"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rls.yaml")
+			os.WriteFile(path, []byte(test.content), 0o644)
+			_, err := LoadConfig(path)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Expected an error containing %q, got %v", test.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestServer_ShouldRateLimit(t *testing.T) {
+	tb := createTestBucket(t)
+	defer tb.Close()
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "rls.yaml")
+	os.WriteFile(path, []byte(testConfigYAML), 0o644)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	server, err := NewServer(ctx, tb, config)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	tb.ResetBucket(ctx, "rls:edge_login:edge:remote_address=10.0.0.1:path=/login")
+	tb.ResetBucket(ctx, "rls:edge_per_ip:edge:remote_address=10.0.0.1")
+
+	// Call the service like Envoy would, with the client generated from the Envoy protos
+	client := startServer(t, server)
+
+	entry := func(key, value string) *ratelimitv3.RateLimitDescriptor_Entry {
+		return &ratelimitv3.RateLimitDescriptor_Entry{Key: key, Value: value}
+	}
+	login := &rlsv3.RateLimitRequest{
+		Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			{Entries: []*ratelimitv3.RateLimitDescriptor_Entry{entry("remote_address", "10.0.0.1"), entry("path", "/login")}},
+			{Entries: []*ratelimitv3.RateLimitDescriptor_Entry{entry("remote_address", "10.0.0.1")}},
+			{Entries: []*ratelimitv3.RateLimitDescriptor_Entry{entry("user_agent", "curl")}}, // No rule
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.ShouldRateLimit(ctx, login)
+		if err != nil {
+			t.Fatalf("Call %d failed: %v", i+1, err)
+		}
+		if resp.OverallCode != rlsv3.RateLimitResponse_OK {
+			t.Fatalf("Call %d: expected OK, got %v", i+1, resp)
+		}
+	}
+
+	resp, err := client.ShouldRateLimit(ctx, login)
+	if err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT || len(resp.Statuses) != 3 {
+		t.Fatalf("Expected the login limit to be exceeded, got %v", resp)
+	}
+
+	loginStatus := resp.Statuses[0]
+	if loginStatus.Code != rlsv3.RateLimitResponse_OVER_LIMIT || loginStatus.LimitRemaining != 0 || loginStatus.DurationUntilReset.AsDuration() <= 0 {
+		t.Errorf("Unexpected login status %v", loginStatus)
+	}
+	if limit := loginStatus.CurrentLimit; limit.GetName() != "edge_login" || limit.GetRequestsPerUnit() != 3 ||
+		limit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_MINUTE {
+		t.Errorf("Expected 3 per minute for edge_login, got %v", limit)
+	}
+	if status := resp.Statuses[1]; status.Code != rlsv3.RateLimitResponse_OK || status.LimitRemaining != 6 {
+		t.Errorf("Expected the per-IP bucket to be charged on every call, got %v", status)
+	}
+	if status := resp.Statuses[2]; status.Code != rlsv3.RateLimitResponse_OK || status.CurrentLimit != nil {
+		t.Errorf("Expected descriptors without a rule to be unlimited, got %v", status)
+	}
+
+	// A descriptor's hits_addend overrides the request's
+	tb.ResetBucket(ctx, "rls:edge_per_ip:edge:remote_address=10.0.0.2")
+	resp, err = client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Domain:     "edge",
+		HitsAddend: 2,
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{{
+			Entries:    []*ratelimitv3.RateLimitDescriptor_Entry{entry("remote_address", "10.0.0.2")},
+			HitsAddend: wrapperspb.UInt64(4),
+		}},
+	})
+	if err != nil || resp.Statuses[0].LimitRemaining != 6 {
+		t.Errorf("Expected 4 hits to leave 6 tokens, got %v (%v)", resp, err)
+	}
+
+	// The same buckets are visible to Go services using the bucket package
+	state, err := tb.TakeTokens(ctx, "rls:edge_per_ip:edge:remote_address=10.0.0.1", 1)
+	if err != nil || state.Policy != "edge_per_ip" || state.RemainingTokens >= 6 {
+		t.Errorf("Expected the Go side to share the per-IP bucket, got %+v (%v)", state, err)
+	}
+
+	_, err = client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{Domain: "edge"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected INVALID_ARGUMENT without descriptors, got %v", err)
+	}
+}
+
+// startServer serves the service on a local port and returns a generated client for it
+func startServer(t *testing.T, server *Server) rlsv3.RateLimitServiceClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	grpcServer := grpc.NewServer()
+	server.Register(grpcServer)
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func TestNewServer_UnknownPolicy(t *testing.T) {
+	tb := createTestBucket(t)
+	defer tb.Close()
+
+	config := &Config{Rules: []Rule{{Descriptor: []EntryMatcher{{Key: "a"}}, Policy: "missing_rls_policy"}}}
+	if _, err := NewServer(context.Background(), tb, config); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected an error for an unknown policy, got %v", err)
+	}
+}
+
+func TestNewServer_ReplacesStoredPolicies(t *testing.T) {
+	tb := createTestBucket(t)
+	defer tb.Close()
+
+	ctx := context.Background()
+	if err := tb.SetPolicy(ctx, &bucket.Policy{Name: "rls_replaced", Capacity: 1000, RefillRate: 100}); err != nil {
+		t.Fatalf("SetPolicy failed: %v", err)
+	}
+	defer tb.DeletePolicy(ctx, "rls_replaced")
+
+	config := &Config{
+		Policies: []PolicyConfig{{Name: "rls_replaced", Capacity: 5, RefillRate: 1}},
+		Rules:    []Rule{{Descriptor: []EntryMatcher{{Key: "a"}}, Policy: "rls_replaced"}},
+	}
+	if _, err := NewServer(ctx, tb, config); err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	policy, err := tb.GetPolicy(ctx, "rls_replaced")
+	if err != nil || policy.Capacity != 5 || policy.RefillRate != 1 {
+		t.Errorf("Expected the config to own the policy, got %+v (%v)", policy, err)
+	}
+}
+
+func TestRule_RouteComesFromConfig(t *testing.T) {
+	if route := (&Rule{Domain: "edge"}).route(); route != "rls:edge" {
+		t.Errorf("Expected rls:edge, got %s", route)
+	}
+	// Rules without a domain match any domain, so the request's domain must not leak into it
+	if route := (&Rule{}).route(); route != "rls" {
+		t.Errorf("Expected rls, got %s", route)
+	}
+}
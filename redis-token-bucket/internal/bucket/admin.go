@@ -0,0 +1,582 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Namespaces of the limiter keys that KeyAdmin manages
+const (
+	NamespaceTokenBucket   = "token_bucket"
+	NamespaceSlidingWindow = "sliding_window"
+)
+
+// adminNamespaces lists the managed namespaces in scan order
+var adminNamespaces = []string{NamespaceTokenBucket, NamespaceSlidingWindow}
+
+// ErrKeyNotFound is returned when inspecting a key that does not exist
+var ErrKeyNotFound = errors.New("key not found")
+
+// AdminProvider is implemented by limiters that can hand out a KeyAdmin for their Redis client
+type AdminProvider interface {
+	Admin() *KeyAdmin
+}
+
+// KeyFilter selects limiter keys. An empty namespace selects every namespace and an empty
+// pattern every key. Patterns match the limiter key (e.g. "user:*"), not the Redis key, and
+// support "*" for any run of characters and "?" for a single character.
+type KeyFilter struct {
+	Namespace string `json:"namespace,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+}
+
+// KeyInfo describes the stored state of one limiter key
+type KeyInfo struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	TTL       int64  `json:"ttl_ms"` // -1 if the key does not expire
+
+	// Token bucket state as of the last refill; tokens refill lazily on the next take
+	Tokens     *float64   `json:"tokens,omitempty"`
+	Capacity   *int64     `json:"capacity,omitempty"`
+	RefillRate *float64   `json:"refill_rate,omitempty"`
+	LastRefill *time.Time `json:"last_refill,omitempty"`
+
+	// Sliding window log entries, including expired ones the next request will trim
+	Entries *int64 `json:"entries,omitempty"`
+}
+
+// KeyPage is one page of a key listing
+type KeyPage struct {
+	Keys       []*KeyInfo `json:"keys"`
+	NextCursor string     `json:"next_cursor,omitempty"` // Empty once the scan is complete
+}
+
+// KeyExport is the JSON form of a limiter key used to move state between Redis deployments
+type KeyExport struct {
+	Namespace string             `json:"namespace"`
+	Key       string             `json:"key"`
+	TTL       int64              `json:"ttl_ms"`           // Remaining TTL; -1 if the key does not expire
+	Fields    map[string]string  `json:"fields,omitempty"` // Token bucket hash
+	Entries   []SlidingWindowLog `json:"entries,omitempty"`
+}
+
+// SlidingWindowLog is one entry of a sliding window log
+type SlidingWindowLog struct {
+	Member    string `json:"member"`
+	Timestamp int64  `json:"timestamp_ms"`
+}
+
+// KeyAdmin lists, inspects, deletes, exports and imports limiter keys. It walks the keyspace
+// with SCAN, so it never blocks Redis, and on Redis Cluster it scans every master in turn.
+type KeyAdmin struct {
+	client redis.UniversalClient
+}
+
+// NewKeyAdmin creates a key administrator on an existing Redis client
+func NewKeyAdmin(client redis.UniversalClient) *KeyAdmin {
+	return &KeyAdmin{client: client}
+}
+
+// Admin returns a key administrator that shares the token bucket's Redis client
+func (tb *RedisTokenBucket) Admin() *KeyAdmin {
+	return NewKeyAdmin(tb.client)
+}
+
+// Admin returns a key administrator that shares the sliding window's Redis client
+func (sw *RedisSlidingWindow) Admin() *KeyAdmin {
+	return NewKeyAdmin(sw.client)
+}
+
+// namespaces returns the namespaces selected by a filter
+func (f KeyFilter) namespaces() ([]string, error) {
+	if f.Namespace == "" {
+		return adminNamespaces, nil
+	}
+	for _, namespace := range adminNamespaces {
+		if namespace == f.Namespace {
+			return []string{namespace}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown namespace %q", f.Namespace)
+}
+
+// limiterKey turns a Redis key back into the limiter key it was built from by hashTagKey
+func limiterKey(namespace string, redisKey string) string {
+	key := strings.TrimPrefix(redisKey, namespace+":")
+	if strings.HasPrefix(key, "{") && strings.Index(key, "}") == len(key)-1 {
+		return key[1 : len(key)-1]
+	}
+	return key
+}
+
+// matchPattern reports whether s matches a glob pattern with "*" and "?" wildcards
+func matchPattern(pattern string, s string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	// Backtrack to the last "*" on a mismatch
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			mark++
+			i = mark
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// nodes returns the Redis nodes to scan: every master of a cluster in a stable order, or the
+// client itself
+func (a *KeyAdmin) nodes(ctx context.Context) ([]redis.Cmdable, error) {
+	cluster, ok := a.client.(*redis.ClusterClient)
+	if !ok {
+		return []redis.Cmdable{a.client}, nil
+	}
+
+	var mu sync.Mutex
+	var masters []*redis.Client
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		mu.Lock()
+		masters = append(masters, master)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cluster masters: %w", err)
+	}
+
+	// Cursors hold a node index, so the order must not change between pages
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+
+	nodes := make([]redis.Cmdable, len(masters))
+	for i, master := range masters {
+		nodes[i] = master
+	}
+	return nodes, nil
+}
+
+// adminCursor is the position of a scan across namespaces and nodes. It is encoded as
+// "namespace:node:cursor" with indexes into the namespace and node lists.
+type adminCursor struct {
+	namespace int
+	node      int
+	scan      uint64
+}
+
+// parseAdminCursor decodes a cursor returned by List; an empty cursor starts a new scan
+func parseAdminCursor(s string) (adminCursor, error) {
+	if s == "" {
+		return adminCursor{}, nil
+	}
+
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return adminCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+	namespace, err1 := strconv.Atoi(parts[0])
+	node, err2 := strconv.Atoi(parts[1])
+	scan, err3 := strconv.ParseUint(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || namespace < 0 || node < 0 {
+		return adminCursor{}, fmt.Errorf("invalid cursor %q", s)
+	}
+
+	return adminCursor{namespace: namespace, node: node, scan: scan}, nil
+}
+
+// String encodes the cursor
+func (c adminCursor) String() string {
+	return fmt.Sprintf("%d:%d:%d", c.namespace, c.node, c.scan)
+}
+
+// scannedKey is a Redis key found by a scan together with its namespace
+type scannedKey struct {
+	namespace string
+	redisKey  string
+}
+
+// scanPage runs one SCAN step from cursor and returns the matching Redis keys with their
+// namespace, and the cursor of the next step ("" when done). A page may be empty before the
+// scan is complete.
+func (a *KeyAdmin) scanPage(ctx context.Context, filter KeyFilter, nodes []redis.Cmdable,
+	cursor adminCursor, count int64) ([]scannedKey, string, error) {
+	namespaces, err := filter.namespaces()
+	if err != nil {
+		return nil, "", err
+	}
+	if cursor.namespace >= len(namespaces) || cursor.node >= len(nodes) {
+		return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	namespace := namespaces[cursor.namespace]
+	keys, next, err := nodes[cursor.node].Scan(ctx, cursor.scan, namespace+":*", count).Result()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to scan keys: %w", err)
+	}
+
+	matched := make([]scannedKey, 0, len(keys))
+	for _, redisKey := range keys {
+		if matchPattern(filter.Pattern, limiterKey(namespace, redisKey)) {
+			matched = append(matched, scannedKey{namespace, redisKey})
+		}
+	}
+
+	// Move on to the next node, then the next namespace, once a SCAN completes
+	cursor.scan = next
+	if next == 0 {
+		cursor.node++
+		if cursor.node == len(nodes) {
+			cursor.node = 0
+			cursor.namespace++
+		}
+		if cursor.namespace == len(namespaces) {
+			return matched, "", nil
+		}
+	}
+
+	return matched, cursor.String(), nil
+}
+
+// scanAll calls fn with every page of keys matching the filter
+func (a *KeyAdmin) scanAll(ctx context.Context, filter KeyFilter, fn func(keys []scannedKey) error) error {
+	nodes, err := a.nodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	var cursor adminCursor
+	for {
+		keys, next, err := a.scanPage(ctx, filter, nodes, cursor, 500)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor, _ = parseAdminCursor(next)
+	}
+}
+
+// List returns one page of keys matching the filter with their state. Pass the returned
+// NextCursor to get the next page. Like SCAN, count is a hint and a page may hold fewer keys
+// (or none) before the listing is complete.
+func (a *KeyAdmin) List(ctx context.Context, filter KeyFilter, cursor string, count int64) (*KeyPage, error) {
+	start, err := parseAdminCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := a.nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, next, err := a.scanPage(ctx, filter, nodes, start, count)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := a.describe(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPage{Keys: infos, NextCursor: next}, nil
+}
+
+// Inspect returns the state of a single limiter key
+func (a *KeyAdmin) Inspect(ctx context.Context, namespace string, key string) (*KeyInfo, error) {
+	if namespace == "" {
+		return nil, fmt.Errorf("namespace is required")
+	}
+	if _, err := (KeyFilter{Namespace: namespace}).namespaces(); err != nil {
+		return nil, err
+	}
+
+	infos, err := a.describe(ctx, []scannedKey{{namespace, hashTagKey(namespace, key)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, ErrKeyNotFound
+	}
+
+	return infos[0], nil
+}
+
+// describe reads the state of the given keys in one pipeline. Keys that expired since they
+// were scanned are left out.
+func (a *KeyAdmin) describe(ctx context.Context, keys []scannedKey) ([]*KeyInfo, error) {
+	ttls := make([]*redis.DurationCmd, len(keys))
+	states := make([]redis.Cmder, len(keys))
+
+	_, err := a.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			ttls[i] = pipe.PTTL(ctx, k.redisKey)
+			if k.namespace == NamespaceTokenBucket {
+				states[i] = pipe.HMGet(ctx, k.redisKey, "tokens", "capacity", "refill_rate", "last_refill")
+			} else {
+				states[i] = pipe.ZCard(ctx, k.redisKey)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read keys: %w", err)
+	}
+
+	infos := make([]*KeyInfo, 0, len(keys))
+	for i, k := range keys {
+		ttl := ttls[i].Val()
+		if ttl == -2 {
+			continue // Gone
+		}
+
+		info := &KeyInfo{
+			Namespace: k.namespace,
+			Key:       limiterKey(k.namespace, k.redisKey),
+			TTL:       -1,
+		}
+		if ttl >= 0 {
+			info.TTL = ttl.Milliseconds()
+		}
+
+		switch state := states[i].(type) {
+		case *redis.SliceCmd:
+			values := state.Val()
+			tokens, capacity, refillRate := parseFloat64(values[0]), parseInt64(values[1]), parseFloat64(values[2])
+			lastRefill := time.Unix(0, int64(parseFloat64(values[3])*float64(time.Second)))
+			info.Tokens, info.Capacity, info.RefillRate, info.LastRefill = &tokens, &capacity, &refillRate, &lastRefill
+		case *redis.IntCmd:
+			entries := state.Val()
+			info.Entries = &entries
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Delete removes every key matching the filter and returns how many were removed. A deleted
+// token bucket starts full and a deleted sliding window empty, so this resets them.
+func (a *KeyAdmin) Delete(ctx context.Context, filter KeyFilter) (int64, error) {
+	var deleted int64
+
+	err := a.scanAll(ctx, filter, func(keys []scannedKey) error {
+		cmds := make([]*redis.IntCmd, len(keys))
+		// One DEL per key, since keys in different cluster slots cannot share a command
+		_, err := a.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				cmds[i] = pipe.Del(ctx, k.redisKey)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete keys: %w", err)
+		}
+		for _, cmd := range cmds {
+			deleted += cmd.Val()
+		}
+		return nil
+	})
+
+	return deleted, err
+}
+
+// Export returns the state of every key matching the filter
+func (a *KeyAdmin) Export(ctx context.Context, filter KeyFilter) ([]*KeyExport, error) {
+	exports := []*KeyExport{}
+
+	err := a.scanAll(ctx, filter, func(keys []scannedKey) error {
+		ttls := make([]*redis.DurationCmd, len(keys))
+		states := make([]redis.Cmder, len(keys))
+
+		_, err := a.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, k := range keys {
+				ttls[i] = pipe.PTTL(ctx, k.redisKey)
+				if k.namespace == NamespaceTokenBucket {
+					states[i] = pipe.HGetAll(ctx, k.redisKey)
+				} else {
+					states[i] = pipe.ZRangeWithScores(ctx, k.redisKey, 0, -1)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to export keys: %w", err)
+		}
+
+		for i, k := range keys {
+			ttl := ttls[i].Val()
+			if ttl == -2 {
+				continue // Expired since the scan
+			}
+
+			export := &KeyExport{
+				Namespace: k.namespace,
+				Key:       limiterKey(k.namespace, k.redisKey),
+				TTL:       -1,
+			}
+			if ttl >= 0 {
+				export.TTL = ttl.Milliseconds()
+			}
+
+			switch state := states[i].(type) {
+			case *redis.StringStringMapCmd:
+				export.Fields = state.Val()
+			case *redis.ZSliceCmd:
+				for _, z := range state.Val() {
+					export.Entries = append(export.Entries, SlidingWindowLog{
+						Member:    fmt.Sprint(z.Member),
+						Timestamp: int64(z.Score),
+					})
+				}
+			}
+
+			exports = append(exports, export)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+// tokenBucketFields are the fields of a token bucket hash, all of which the take scripts write
+var tokenBucketFields = []string{"tokens", "last_refill", "capacity", "refill_rate"}
+
+// validate checks that an exported state can be used by the scripts: a token bucket needs
+// numeric fields, a positive capacity and refill rate and tokens up to the capacity, and a
+// sliding window needs named entries with positive timestamps. Empty states are skipped on
+// import and pass.
+func (e *KeyExport) validate() error {
+	if len(e.Fields) > 0 {
+		if e.Namespace != NamespaceTokenBucket {
+			return fmt.Errorf("fields are only valid for %s keys", NamespaceTokenBucket)
+		}
+		if len(e.Fields) != len(tokenBucketFields) {
+			return fmt.Errorf("token bucket fields must be exactly %s", strings.Join(tokenBucketFields, ", "))
+		}
+
+		values := make(map[string]float64, len(tokenBucketFields))
+		for _, field := range tokenBucketFields {
+			raw, ok := e.Fields[field]
+			if !ok {
+				return fmt.Errorf("missing field %q", field)
+			}
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+				return fmt.Errorf("field %q must be a number, got %q", field, raw)
+			}
+			values[field] = value
+		}
+
+		if values["capacity"] <= 0 || values["refill_rate"] <= 0 {
+			return fmt.Errorf("capacity and refill_rate must be positive")
+		}
+		// Tokens may be negative: Reserve and WaitTokens put buckets into debt, with no floor
+		if values["tokens"] > values["capacity"] {
+			return fmt.Errorf("tokens must not exceed the capacity %g, got %g", values["capacity"], values["tokens"])
+		}
+		if values["last_refill"] < 0 {
+			return fmt.Errorf("last_refill must not be negative")
+		}
+	}
+
+	if len(e.Entries) > 0 {
+		if e.Namespace != NamespaceSlidingWindow {
+			return fmt.Errorf("entries are only valid for %s keys", NamespaceSlidingWindow)
+		}
+		for i, entry := range e.Entries {
+			if entry.Member == "" || entry.Timestamp <= 0 {
+				return fmt.Errorf("entry %d must have a member and a positive timestamp", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Import writes exported keys, replacing any existing state of the same keys, and returns how
+// many were written. Keys whose TTL ran out are skipped.
+func (a *KeyAdmin) Import(ctx context.Context, exports []*KeyExport) (int, error) {
+	for _, export := range exports {
+		if _, err := (KeyFilter{Namespace: export.Namespace}).namespaces(); export.Namespace == "" || err != nil {
+			return 0, fmt.Errorf("key %q: unknown namespace %q", export.Key, export.Namespace)
+		}
+		if export.Key == "" {
+			return 0, fmt.Errorf("key is required")
+		}
+		if err := export.validate(); err != nil {
+			return 0, fmt.Errorf("key %q: %w", export.Key, err)
+		}
+	}
+
+	imported := 0
+	_, err := a.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, export := range exports {
+			if export.TTL == 0 || (len(export.Fields) == 0 && len(export.Entries) == 0) {
+				continue
+			}
+
+			redisKey := hashTagKey(export.Namespace, export.Key)
+			pipe.Del(ctx, redisKey)
+			if export.Namespace == NamespaceTokenBucket {
+				fields := make(map[string]interface{}, len(export.Fields))
+				for field, value := range export.Fields {
+					fields[field] = value
+				}
+				pipe.HSet(ctx, redisKey, fields)
+			} else {
+				members := make([]*redis.Z, len(export.Entries))
+				for i, entry := range export.Entries {
+					members[i] = &redis.Z{Score: float64(entry.Timestamp), Member: entry.Member}
+				}
+				pipe.ZAdd(ctx, redisKey, members...)
+			}
+			if export.TTL > 0 {
+				pipe.PExpire(ctx, redisKey, time.Duration(export.TTL)*time.Millisecond)
+			}
+			imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to import keys: %w", err)
+	}
+
+	return imported, nil
+}
@@ -2,6 +2,7 @@ package bucket
 
 import (
 	"context"
+	"math"
 	"sync"
 	"testing"
 	"time"
@@ -114,6 +115,39 @@ func TestTokenBucket_BoundaryCase_ZeroTokens(t *testing.T) {
 	}
 }
 
+func TestTokenBucket_FractionalTokens(t *testing.T) {
+	tb := createTestBucket(t, 2, 0.01) // 2 tokens, 1 token per 100s
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "fractional_test"
+
+	result, err := tb.TakeTokens(ctx, key, 1.5)
+	if err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+	if math.Abs(result.RemainingTokens-0.5) > 0.01 {
+		t.Errorf("Expected 0.5 tokens left, got %f", result.RemainingTokens)
+	}
+
+	state, err := tb.GetBucketState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if math.Abs(state.CurrentTokens-0.5) > 0.01 {
+		t.Errorf("Expected 0.5 tokens in the state, got %f", state.CurrentTokens)
+	}
+
+	// The missing half token takes 50s, not the 100s of a whole token
+	peek, err := tb.Peek(ctx, key)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if peek.Allowed || math.Abs(peek.RetryAfter-50) > 1 {
+		t.Errorf("Expected a denial retrying after 50s, got allowed=%v retry after %f", peek.Allowed, peek.RetryAfter)
+	}
+}
+
 func TestTokenBucket_BoundaryCase_BurstConsumption(t *testing.T) {
 	tb := createTestBucket(t, 10, 2.0) // 10 tokens, 2 tokens/sec
 	defer tb.Close()
@@ -332,8 +366,9 @@ func TestTokenBucket_Reset(t *testing.T) {
 	if err != nil {
 		t.Fatalf("GetBucketState failed: %v", err)
 	}
-	if state.CurrentTokens != 0 {
-		t.Errorf("Expected 0 tokens after consumption, got %.1f", state.CurrentTokens)
+	// Only the fraction refilled since the consumption is back
+	if state.CurrentTokens > 0.1 {
+		t.Errorf("Expected 0 tokens after consumption, got %f", state.CurrentTokens)
 	}
 
 	// Reset bucket
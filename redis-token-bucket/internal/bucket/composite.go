@@ -0,0 +1,134 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Refunder is implemented by limiters that can give back units consumed by Allow
+type Refunder interface {
+	// Refund returns n units to the given key
+	Refund(ctx context.Context, key string, n float64) error
+}
+
+var _ Refunder = (*RedisTokenBucket)(nil)
+
+// Refund implements Refunder by returning tokens to the bucket, capped at its capacity
+func (tb *RedisTokenBucket) Refund(ctx context.Context, key string, n float64) error {
+	_, err := tb.RefundTokens(ctx, key, n)
+	return err
+}
+
+// CompositeLimiter allows a request only if every one of its limiters allows it, e.g. a
+// short-term rate limit together with a monthly quota. Limiters are asked in order; when one
+// denies, the units already taken from the earlier ones are refunded if they support it.
+type CompositeLimiter struct {
+	limiters []Limiter
+}
+
+var (
+	_ Limiter     = (*CompositeLimiter)(nil)
+	_ QuotaReader = (*CompositeLimiter)(nil)
+)
+
+// NewCompositeLimiter creates a limiter that requires all of the given limiters to allow a request.
+// Put the cheapest and most often exhausted limiter first.
+func NewCompositeLimiter(limiters ...Limiter) *CompositeLimiter {
+	return &CompositeLimiter{limiters: limiters}
+}
+
+// Allow implements Limiter by consuming n units from every limiter. The result is the
+// denial if any limiter denied, otherwise the result with the least remaining.
+func (c *CompositeLimiter) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	var tightest *Result
+
+	for i, limiter := range c.limiters {
+		result, err := limiter.Allow(ctx, key, n)
+		if err != nil {
+			c.refund(key, n, i)
+			return nil, err
+		}
+		if !result.Allowed {
+			c.refund(key, n, i)
+			return result, nil
+		}
+		if tightest == nil || result.Remaining < tightest.Remaining {
+			tightest = result
+		}
+	}
+
+	return tightest, nil
+}
+
+// refund gives n units back to the first count limiters after a later one refused the request
+func (c *CompositeLimiter) refund(key string, n float64, count int) {
+	// The request context may be gone, but the units must still go back
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, limiter := range c.limiters[:count] {
+		refunder, ok := limiter.(Refunder)
+		if !ok {
+			continue
+		}
+		if err := refunder.Refund(ctx, key, n); err != nil {
+			log.Printf("Failed to refund %v units for %s: %v", n, key, err)
+		}
+	}
+}
+
+// Peek implements Limiter by reading every limiter. The result is the first one that would
+// deny, otherwise the one with the least remaining.
+func (c *CompositeLimiter) Peek(ctx context.Context, key string) (*Result, error) {
+	var tightest *Result
+
+	for _, limiter := range c.limiters {
+		result, err := limiter.Peek(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if !result.Allowed {
+			return result, nil
+		}
+		if tightest == nil || result.Remaining < tightest.Remaining {
+			tightest = result
+		}
+	}
+
+	return tightest, nil
+}
+
+// Reset implements Limiter by resetting every limiter
+func (c *CompositeLimiter) Reset(ctx context.Context, key string) error {
+	var errs []error
+	for _, limiter := range c.limiters {
+		if err := limiter.Reset(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close implements Limiter by closing every limiter
+func (c *CompositeLimiter) Close() error {
+	var errs []error
+	for _, limiter := range c.limiters {
+		if err := limiter.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Usage implements QuotaReader with the first limiter that reports quota usage
+func (c *CompositeLimiter) Usage(ctx context.Context, key string) (*QuotaResult, error) {
+	for _, limiter := range c.limiters {
+		if reader, ok := limiter.(QuotaReader); ok {
+			return reader.Usage(ctx, key)
+		}
+	}
+	return nil, fmt.Errorf("no limiter reports quota usage")
+}
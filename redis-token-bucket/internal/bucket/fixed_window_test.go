@@ -0,0 +1,299 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createTestFixedWindow(tb interface{}, windowSize time.Duration, maxRequests int64) *RedisFixedWindow {
+	config := &WindowCounterConfig{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       3, // Use different DB for fixed window tests
+		WindowSize:    windowSize,
+		MaxRequests:   maxRequests,
+	}
+
+	fw, err := NewRedisFixedWindow(config)
+	if err != nil {
+		switch v := tb.(type) {
+		case *testing.T:
+			v.Skipf("Redis not available: %v", err)
+		case *testing.B:
+			v.Skipf("Redis not available: %v", err)
+		}
+	}
+
+	return fw
+}
+
+func TestFixedWindow_BasicFunctionality(t *testing.T) {
+	fw := createTestFixedWindow(t, 1*time.Second, 5)
+	defer fw.Close()
+
+	ctx := context.Background()
+	key := "fixed_test"
+	fw.Reset(ctx, key)
+
+	// First 5 requests should be allowed
+	for i := 0; i < 5; i++ {
+		result, err := fw.Allow(ctx, key, 1)
+		if err != nil {
+			t.Fatalf("Allow failed on request %d: %v", i+1, err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != float64(4-i) {
+			t.Errorf("Expected %d remaining, got %.0f", 4-i, result.Remaining)
+		}
+	}
+
+	// 6th request should be denied with a retry time within the window
+	result, err := fw.Allow(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("Allow failed on 6th request: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected 6th request to be denied")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 1 {
+		t.Errorf("Expected RetryAfter within the window, got %.3f", result.RetryAfter)
+	}
+	if result.Limit != 5 {
+		t.Errorf("Expected limit 5, got %d", result.Limit)
+	}
+}
+
+func TestFixedWindow_Cost(t *testing.T) {
+	fw := createTestFixedWindow(t, 1*time.Second, 10)
+	defer fw.Close()
+
+	ctx := context.Background()
+	key := "fixed_cost_test"
+	fw.Reset(ctx, key)
+
+	result, err := fw.Allow(ctx, key, 7)
+	if err != nil {
+		t.Fatalf("Allow failed: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 3 {
+		t.Errorf("Expected cost 7 to be allowed with 3 remaining, got allowed=%v remaining=%.0f",
+			result.Allowed, result.Remaining)
+	}
+
+	// A cost larger than what is left is denied and not counted
+	result, err = fw.Allow(ctx, key, 4)
+	if err != nil {
+		t.Fatalf("Allow failed: %v", err)
+	}
+	if result.Allowed || result.Remaining != 3 {
+		t.Errorf("Expected cost 4 to be denied with 3 remaining, got allowed=%v remaining=%.0f",
+			result.Allowed, result.Remaining)
+	}
+
+	// Fractional costs are rejected
+	if _, err := fw.Allow(ctx, key, 1.5); err == nil {
+		t.Error("Expected fractional cost to be rejected")
+	}
+}
+
+func TestFixedWindow_WindowExpiry(t *testing.T) {
+	fw := createTestFixedWindow(t, 200*time.Millisecond, 3) // Very short window for testing
+	defer fw.Close()
+
+	ctx := context.Background()
+	key := "fixed_expiry_test"
+	fw.Reset(ctx, key)
+
+	// Fill up the window
+	for i := 0; i < 3; i++ {
+		if _, err := fw.Allow(ctx, key, 1); err != nil {
+			t.Fatalf("Allow failed: %v", err)
+		}
+	}
+
+	result, err := fw.Allow(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("Allow failed: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request to be denied when at capacity")
+	}
+
+	// Wait for window to expire
+	time.Sleep(250 * time.Millisecond)
+
+	result, err = fw.Allow(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("Allow failed after window expiry: %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after window expiry")
+	}
+	if result.Remaining != 2 {
+		t.Errorf("Expected 2 remaining after window expiry, got %.0f", result.Remaining)
+	}
+}
+
+func TestFixedWindow_PeekAndReset(t *testing.T) {
+	fw := createTestFixedWindow(t, 1*time.Second, 5)
+	defer fw.Close()
+
+	ctx := context.Background()
+	key := "fixed_peek_test"
+	fw.Reset(ctx, key)
+
+	for i := 0; i < 5; i++ {
+		if _, err := fw.Allow(ctx, key, 1); err != nil {
+			t.Fatalf("Allow failed: %v", err)
+		}
+	}
+
+	// Peeking does not consume
+	for i := 0; i < 2; i++ {
+		state, err := fw.Peek(ctx, key)
+		if err != nil {
+			t.Fatalf("Peek failed: %v", err)
+		}
+		if state.Allowed || state.Remaining != 0 {
+			t.Errorf("Expected full window, got allowed=%v remaining=%.0f", state.Allowed, state.Remaining)
+		}
+	}
+
+	if err := fw.Reset(ctx, key); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+
+	state, err := fw.Peek(ctx, key)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if !state.Allowed || state.Remaining != 5 {
+		t.Errorf("Expected empty window after reset, got allowed=%v remaining=%.0f", state.Allowed, state.Remaining)
+	}
+}
+
+func TestFixedWindow_ConstantMemory(t *testing.T) {
+	fw := createTestFixedWindow(t, 1*time.Minute, 100000)
+	defer fw.Close()
+
+	ctx := context.Background()
+	key := "fixed_memory_test"
+	fw.Reset(ctx, key)
+
+	for i := 0; i < 1000; i++ {
+		if _, err := fw.Allow(ctx, key, 1); err != nil {
+			t.Fatalf("Allow failed: %v", err)
+		}
+	}
+
+	// The whole window is a single integer with a TTL
+	value, err := fw.client.Get(ctx, fw.keyName(key)).Int64()
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	if value != 1000 {
+		t.Errorf("Expected counter 1000, got %d", value)
+	}
+
+	ttl, err := fw.client.PTTL(ctx, fw.keyName(key)).Result()
+	if err != nil {
+		t.Fatalf("PTTL failed: %v", err)
+	}
+	if ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected TTL within the window, got %v", ttl)
+	}
+}
+
+func TestFixedWindow_ConcurrencyTest(t *testing.T) {
+	fw := createTestFixedWindow(t, 1*time.Second, 50)
+	defer fw.Close()
+
+	ctx := context.Background()
+	key := "concurrency_fixed_test"
+	fw.Reset(ctx, key)
+
+	const numGoroutines = 100
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successCount := 0
+	failureCount := 0
+
+	// Launch goroutines
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+
+			result, err := fw.Allow(ctx, key, 1)
+			if err != nil {
+				t.Errorf("Allow failed in goroutine %d: %v", index, err)
+				return
+			}
+
+			mu.Lock()
+			if result.Allowed {
+				successCount++
+			} else {
+				failureCount++
+			}
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Should have exactly 50 successes (max requests)
+	if successCount != 50 {
+		t.Errorf("Expected exactly 50 successful requests, got %d", successCount)
+	}
+
+	if failureCount != 50 {
+		t.Errorf("Expected exactly 50 failed requests, got %d", failureCount)
+	}
+
+	t.Logf("Fixed window concurrency test: %d successes, %d failures", successCount, failureCount)
+}
+
+func BenchmarkFixedWindow_Allow(b *testing.B) {
+	fw := createTestFixedWindow(b, 1*time.Minute, 1000000000)
+	defer fw.Close()
+
+	ctx := context.Background()
+	key := "benchmark_fixed"
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := fw.Allow(ctx, key, 1)
+			if err != nil {
+				b.Errorf("Allow failed: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkFixedWindow_MultipleKeys(b *testing.B) {
+	fw := createTestFixedWindow(b, 1*time.Minute, 1000000000)
+	defer fw.Close()
+
+	ctx := context.Background()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := fmt.Sprintf("benchmark_fixed_%d", i%100) // 100 different keys
+			_, err := fw.Allow(ctx, key, 1)
+			if err != nil {
+				b.Errorf("Allow failed: %v", err)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,250 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// GCRAConfig holds configuration for the GCRA (generic cell rate algorithm) rate limiter
+type GCRAConfig struct {
+	RedisAddr       string
+	RedisAddrs      []string // Cluster or Sentinel addresses; overrides RedisAddr when set
+	RedisMasterName string   // Sentinel master name
+	RedisPassword   string
+	RedisDB         int
+	Rate            float64 // Sustained requests per second
+	Burst           int64   // Maximum requests allowed at once
+}
+
+// DefaultGCRAConfig returns a sensible default configuration
+func DefaultGCRAConfig() *GCRAConfig {
+	return &GCRAConfig{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       0,
+		Rate:          10.0, // 10 requests per second
+		Burst:         100,  // Bursts of up to 100 requests
+	}
+}
+
+// RedisGCRA implements the generic cell rate algorithm using Redis. Each key stores
+// only its theoretical arrival time (TAT), which expires once the key is idle again.
+type RedisGCRA struct {
+	client     redis.UniversalClient
+	ownsClient bool // Close only closes clients created by the constructor
+	config     *GCRAConfig
+	luaScript  *redis.Script
+}
+
+// GCRAResult represents the result of a GCRA check
+type GCRAResult struct {
+	Allowed    bool    `json:"allowed"`
+	Remaining  int64   `json:"remaining"`
+	RetryAfter float64 `json:"retry_after_seconds"` // -1 when the cost can never fit in the burst
+	ResetAfter float64 `json:"reset_after_seconds"` // Time until the key is back to a full burst
+}
+
+var _ Limiter = (*RedisGCRA)(nil)
+
+// NewRedisGCRA creates a new Redis-backed GCRA rate limiter
+func NewRedisGCRA(config *GCRAConfig) (*RedisGCRA, error) {
+	if config == nil {
+		config = DefaultGCRAConfig()
+	}
+
+	// Create Redis client
+	client := newUniversalClient(config.RedisAddr, config.RedisAddrs, config.RedisMasterName,
+		config.RedisPassword, config.RedisDB)
+
+	g, err := NewRedisGCRAWithClient(client, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	g.ownsClient = true
+
+	return g, nil
+}
+
+// NewRedisGCRAWithClient creates a GCRA limiter on an existing Redis client. The Redis address
+// fields of the config are ignored and Close leaves the client open.
+func NewRedisGCRAWithClient(client redis.UniversalClient, config *GCRAConfig) (*RedisGCRA, error) {
+	if config == nil {
+		config = DefaultGCRAConfig()
+	}
+
+	if config.Rate <= 0 || config.Burst <= 0 {
+		return nil, fmt.Errorf("rate and burst must be positive")
+	}
+
+	// Test connection
+	if err := pingClient(client); err != nil {
+		return nil, err
+	}
+
+	return &RedisGCRA{
+		client:    client,
+		config:    config,
+		luaScript: redis.NewScript(gcraScript),
+	}, nil
+}
+
+// Close closes the Redis connection if the GCRA limiter created it
+func (g *RedisGCRA) Close() error {
+	if !g.ownsClient {
+		return nil
+	}
+	return g.client.Close()
+}
+
+// keyName generates a Redis key for the given GCRA key
+func (g *RedisGCRA) keyName(key string) string {
+	return fmt.Sprintf("gcra:%s", key)
+}
+
+// emissionInterval returns the time between two requests at the sustained rate, in milliseconds
+func (g *RedisGCRA) emissionInterval() float64 {
+	return 1000.0 / g.config.Rate
+}
+
+// Check attempts to consume cost requests for the given key
+func (g *RedisGCRA) Check(ctx context.Context, key string, cost int64) (*GCRAResult, error) {
+	if cost <= 0 {
+		return nil, fmt.Errorf("cost must be positive")
+	}
+	return g.run(ctx, key, cost, true)
+}
+
+// State returns the GCRA state for the given key without consuming anything
+func (g *RedisGCRA) State(ctx context.Context, key string) (*GCRAResult, error) {
+	return g.run(ctx, key, 1, false)
+}
+
+// run executes the GCRA script, updating the TAT only when apply is set
+func (g *RedisGCRA) run(ctx context.Context, key string, cost int64, apply bool) (*GCRAResult, error) {
+	applyFlag := 0
+	if apply {
+		applyFlag = 1
+	}
+
+	result, err := runScript(ctx, g.client, g.luaScript, "gcra", []string{g.keyName(key)},
+		g.emissionInterval(),
+		g.config.Burst,
+		cost,
+		applyFlag).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check GCRA: %w", err)
+	}
+
+	values := result.([]interface{})
+	retryAfter := parseFloat64(values[2])
+	if retryAfter > 0 {
+		retryAfter /= 1000.0 // Convert to seconds
+	}
+
+	return &GCRAResult{
+		Allowed:    parseInt64(values[0]) == 1,
+		Remaining:  parseInt64(values[1]),
+		RetryAfter: retryAfter,
+		ResetAfter: parseFloat64(values[3]) / 1000.0, // Convert to seconds
+	}, nil
+}
+
+// Allow implements Limiter by checking n requests against the GCRA
+func (g *RedisGCRA) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	cost, err := wholeCost(n)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := g.Check(ctx, key, cost)
+	if err != nil {
+		return nil, err
+	}
+
+	return g.toResult(result), nil
+}
+
+// Peek implements Limiter by reading the GCRA state
+func (g *RedisGCRA) Peek(ctx context.Context, key string) (*Result, error) {
+	result, err := g.State(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return g.toResult(result), nil
+}
+
+// Reset implements Limiter by deleting the TAT, which restores the full burst
+func (g *RedisGCRA) Reset(ctx context.Context, key string) error {
+	return g.client.Del(ctx, g.keyName(key)).Err()
+}
+
+// toResult converts a GCRA result into the common Result type
+func (g *RedisGCRA) toResult(result *GCRAResult) *Result {
+	limiterResult := &Result{
+		Allowed:   result.Allowed,
+		Remaining: float64(result.Remaining),
+		Limit:     g.config.Burst,
+		ResetAt:   time.Now().Add(time.Duration(result.ResetAfter * float64(time.Second))),
+		Window:    float64(g.config.Burst) / g.config.Rate,
+	}
+
+	if !result.Allowed && result.RetryAfter > 0 {
+		limiterResult.RetryAfter = result.RetryAfter
+	}
+
+	return limiterResult
+}
+
+// Lua script for GCRA. All times are in milliseconds on the Redis server clock.
+// A request is allowed if the TAT after adding it stays within the burst tolerance.
+const gcraScript = `
+local key = KEYS[1]
+local emission_interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local apply = tonumber(ARGV[4])
+
+local now = redis.call('TIME')
+local now_ms = tonumber(now[1]) * 1000 + tonumber(now[2]) / 1000
+
+local tolerance = emission_interval * burst
+local increment = emission_interval * cost
+
+local tat = tonumber(redis.call('GET', key)) or now_ms
+if tat < now_ms then
+    tat = now_ms
+end
+
+local allowed = 0
+local retry_after = 0
+
+if increment > tolerance then
+    -- The cost can never fit in the burst
+    retry_after = -1
+else
+    local new_tat = tat + increment
+    local allow_at = new_tat - tolerance
+    if allow_at <= now_ms then
+        allowed = 1
+        if apply == 1 then
+            tat = new_tat
+            redis.call('SET', key, tostring(tat), 'PX', math.ceil(tat - now_ms))
+        end
+    else
+        retry_after = allow_at - now_ms
+    end
+end
+
+-- The small epsilon keeps float rounding from hiding a whole request
+local remaining = math.floor((tolerance - (tat - now_ms)) / emission_interval + 0.000001)
+if remaining < 0 then
+    remaining = 0
+end
+
+return {allowed, remaining, tostring(retry_after), tostring(tat - now_ms)}
+`
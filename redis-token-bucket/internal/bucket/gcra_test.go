@@ -0,0 +1,292 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func createTestGCRA(tb interface{}, rate float64, burst int64) *RedisGCRA {
+	config := &GCRAConfig{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       5, // Use different DB for GCRA tests
+		Rate:          rate,
+		Burst:         burst,
+	}
+
+	g, err := NewRedisGCRA(config)
+	if err != nil {
+		switch v := tb.(type) {
+		case *testing.T:
+			v.Skipf("Redis not available: %v", err)
+		case *testing.B:
+			v.Skipf("Redis not available: %v", err)
+		}
+	}
+
+	return g
+}
+
+func TestGCRA_Burst(t *testing.T) {
+	g := createTestGCRA(t, 10, 5) // 10 req/sec, burst of 5
+	defer g.Close()
+
+	ctx := context.Background()
+	key := "gcra_burst"
+	g.Reset(ctx, key)
+
+	// The full burst is allowed at once
+	for i := 0; i < 5; i++ {
+		result, err := g.Check(ctx, key, 1)
+		if err != nil {
+			t.Fatalf("Check failed on request %d: %v", i+1, err)
+		}
+		if !result.Allowed {
+			t.Errorf("Expected request %d to be allowed", i+1)
+		}
+		if result.Remaining != int64(4-i) {
+			t.Errorf("Expected %d remaining, got %d", 4-i, result.Remaining)
+		}
+	}
+
+	// The next request has to wait exactly one emission interval (100ms)
+	result, err := g.Check(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request beyond the burst to be denied")
+	}
+	if math.Abs(result.RetryAfter-0.1) > 0.02 {
+		t.Errorf("Expected RetryAfter of about 0.1s, got %.3f", result.RetryAfter)
+	}
+	if math.Abs(result.ResetAfter-0.5) > 0.02 {
+		t.Errorf("Expected ResetAfter of about 0.5s, got %.3f", result.ResetAfter)
+	}
+
+	// After the retry delay the request is allowed
+	time.Sleep(time.Duration(result.RetryAfter*float64(time.Second)) + 10*time.Millisecond)
+	result, err = g.Check(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected request to be allowed after RetryAfter")
+	}
+}
+
+func TestGCRA_Cost(t *testing.T) {
+	g := createTestGCRA(t, 1, 10) // 1 req/sec, burst of 10
+	defer g.Close()
+
+	ctx := context.Background()
+	key := "gcra_cost"
+	g.Reset(ctx, key)
+
+	result, err := g.Check(ctx, key, 7)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !result.Allowed || result.Remaining != 3 {
+		t.Errorf("Expected cost 7 to be allowed with 3 remaining, got allowed=%v remaining=%d",
+			result.Allowed, result.Remaining)
+	}
+
+	// Cost 5 needs two more emission intervals
+	result, err = g.Check(ctx, key, 5)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected cost 5 to be denied with 3 remaining")
+	}
+	if math.Abs(result.RetryAfter-2) > 0.05 {
+		t.Errorf("Expected RetryAfter of about 2s, got %.3f", result.RetryAfter)
+	}
+
+	// A cost larger than the burst can never be allowed
+	result, err = g.Check(ctx, key, 11)
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Allowed || result.RetryAfter != -1 {
+		t.Errorf("Expected cost above burst to be denied with RetryAfter -1, got allowed=%v retry=%.3f",
+			result.Allowed, result.RetryAfter)
+	}
+}
+
+func TestGCRA_MonotonicReset(t *testing.T) {
+	g := createTestGCRA(t, 10, 5)
+	defer g.Close()
+
+	ctx := context.Background()
+	key := "gcra_reset"
+	g.Reset(ctx, key)
+
+	// Every allowed request pushes the reset time out by one emission interval
+	var previous time.Time
+	for i := 0; i < 5; i++ {
+		result, err := g.Allow(ctx, key, 1)
+		if err != nil {
+			t.Fatalf("Allow failed: %v", err)
+		}
+		if !previous.IsZero() && result.ResetAt.Before(previous) {
+			t.Errorf("Expected reset time to be monotonic, %v is before %v", result.ResetAt, previous)
+		}
+		previous = result.ResetAt
+	}
+
+	// Denied requests do not move the reset time
+	result, err := g.Allow(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("Allow failed: %v", err)
+	}
+	if result.Allowed {
+		t.Fatal("Expected request beyond the burst to be denied")
+	}
+	if diff := result.ResetAt.Sub(previous); diff > 20*time.Millisecond || diff < -20*time.Millisecond {
+		t.Errorf("Expected denied request to keep the reset time, moved by %v", diff)
+	}
+}
+
+func TestGCRA_PeekAndSingleKey(t *testing.T) {
+	g := createTestGCRA(t, 10, 5)
+	defer g.Close()
+
+	ctx := context.Background()
+	key := "gcra_peek"
+	g.Reset(ctx, key)
+
+	state, err := g.Peek(ctx, key)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if !state.Allowed || state.Remaining != 5 || state.Limit != 5 {
+		t.Errorf("Expected a full burst of 5, got allowed=%v remaining=%.0f limit=%d",
+			state.Allowed, state.Remaining, state.Limit)
+	}
+
+	// Peeking does not create any state
+	exists, err := g.client.Exists(ctx, g.keyName(key)).Result()
+	if err != nil {
+		t.Fatalf("EXISTS failed: %v", err)
+	}
+	if exists != 0 {
+		t.Error("Expected Peek not to create a key")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := g.Allow(ctx, key, 1); err != nil {
+			t.Fatalf("Allow failed: %v", err)
+		}
+	}
+
+	// The whole state is a single string key that expires when the burst is restored
+	keyType, err := g.client.Type(ctx, g.keyName(key)).Result()
+	if err != nil {
+		t.Fatalf("TYPE failed: %v", err)
+	}
+	if keyType != "string" {
+		t.Errorf("Expected a string key, got %s", keyType)
+	}
+	ttl, err := g.client.PTTL(ctx, g.keyName(key)).Result()
+	if err != nil {
+		t.Fatalf("PTTL failed: %v", err)
+	}
+	if ttl <= 0 || ttl > 300*time.Millisecond {
+		t.Errorf("Expected TTL of about 300ms, got %v", ttl)
+	}
+}
+
+func TestGCRA_ConcurrencyTest(t *testing.T) {
+	g := createTestGCRA(t, 0.1, 50) // Slow rate so no requests are replenished during the test
+	defer g.Close()
+
+	ctx := context.Background()
+	key := "concurrency_gcra_test"
+	g.Reset(ctx, key)
+
+	const numGoroutines = 100
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successCount := 0
+	failureCount := 0
+
+	// Launch goroutines
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+
+			result, err := g.Check(ctx, key, 1)
+			if err != nil {
+				t.Errorf("Check failed in goroutine %d: %v", index, err)
+				return
+			}
+
+			mu.Lock()
+			if result.Allowed {
+				successCount++
+			} else {
+				failureCount++
+			}
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Should have exactly 50 successes (burst)
+	if successCount != 50 {
+		t.Errorf("Expected exactly 50 successful requests, got %d", successCount)
+	}
+
+	if failureCount != 50 {
+		t.Errorf("Expected exactly 50 failed requests, got %d", failureCount)
+	}
+
+	t.Logf("GCRA concurrency test: %d successes, %d failures", successCount, failureCount)
+}
+
+func BenchmarkGCRA_Check(b *testing.B) {
+	g := createTestGCRA(b, 1000000, 1000000)
+	defer g.Close()
+
+	ctx := context.Background()
+	key := "benchmark_gcra"
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := g.Check(ctx, key, 1)
+			if err != nil {
+				b.Errorf("Check failed: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkGCRA_MultipleKeys(b *testing.B) {
+	g := createTestGCRA(b, 1000000, 1000000)
+	defer g.Close()
+
+	ctx := context.Background()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := fmt.Sprintf("benchmark_gcra_%d", i%100) // 100 different keys
+			_, err := g.Check(ctx, key, 1)
+			if err != nil {
+				b.Errorf("Check failed: %v", err)
+			}
+			i++
+		}
+	})
+}
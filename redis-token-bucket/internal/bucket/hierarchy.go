@@ -0,0 +1,120 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrDuplicateKey is returned when a key appears more than once in a multi-key consumption,
+// since every level is checked against the bucket as it was before the call
+var ErrDuplicateKey = errors.New("keys must not repeat")
+
+// HierarchicalLimiter is implemented by limiters that can consume from several keys atomically
+type HierarchicalLimiter interface {
+	// TakeTokensMulti consumes tokens from every key or from none of them
+	TakeTokensMulti(ctx context.Context, keys []string, tokens float64) (*MultiTokenResult, error)
+}
+
+// LevelResult represents the state of one bucket in a multi-key consumption
+type LevelResult struct {
+	Key             string  `json:"key"`
+	Allowed         bool    `json:"allowed"`
+	RemainingTokens float64 `json:"remaining_tokens"`
+	RetryAfter      float64 `json:"retry_after_seconds,omitempty"`
+	Capacity        int64   `json:"capacity"`
+	RefillRate      float64 `json:"refill_rate"`
+	Policy          string  `json:"policy,omitempty"`
+}
+
+// MultiTokenResult represents the result of consuming tokens from several buckets at once
+type MultiTokenResult struct {
+	Allowed     bool          `json:"allowed"`
+	DeniedKey   string        `json:"denied_key,omitempty"`
+	DeniedLevel int           `json:"denied_level"`                  // Index into Levels of the first level that denied, -1 if allowed
+	RetryAfter  float64       `json:"retry_after_seconds,omitempty"` // Time until every level can allow the request
+	Levels      []LevelResult `json:"levels"`
+}
+
+var _ HierarchicalLimiter = (*RedisTokenBucket)(nil)
+
+// TakeTokensMulti attempts to consume the specified number of tokens from each of the given
+// buckets, ordered from the broadest level to the narrowest (e.g. "global", "org:42", "user:7").
+// Each bucket uses its own policy. The request is all-or-nothing: if any level does not have
+// enough tokens, nothing is deducted from any bucket and the first denying level is reported.
+func (tb *RedisTokenBucket) TakeTokensMulti(ctx context.Context, keys []string, tokens float64) (*MultiTokenResult, error) {
+	if tokens <= 0 {
+		return nil, fmt.Errorf("tokens must be positive")
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("at least one key is required")
+	}
+
+	// On Redis Cluster all keys must share a hash tag, e.g. "{org:42}" and "{org:42}:user:7"
+	scriptKeys := make([]string, 0, len(keys)+len(policyKeys))
+	args := []interface{}{tokens, tb.config.TTL.Seconds()}
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		if seen[key] {
+			return nil, fmt.Errorf("key %d: %w: %q", i, ErrDuplicateKey, key)
+		}
+		seen[key] = true
+
+		policyArg, capacity, refillRate, err := tb.policyArgs(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		scriptKeys = append(scriptKeys, tb.keyName(key))
+		args = append(args, policyArg, capacity, refillRate)
+	}
+	if tb.cluster {
+		if err := checkSameSlot(scriptKeys); err != nil {
+			return nil, err
+		}
+	} else {
+		scriptKeys = append(scriptKeys, policyKeys...)
+	}
+
+	// Run the multi-key take tokens Lua script
+	result, err := runScript(ctx, tb.client, tb.luaScripts["take_tokens_multi"], "take_tokens_multi", scriptKeys, args...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take tokens: %w", err)
+	}
+
+	values := result.([]interface{})
+	deniedLevel := int(parseInt64(values[0])) - 1 // The script numbers levels from 1
+
+	multiResult := &MultiTokenResult{
+		Allowed:     deniedLevel < 0,
+		DeniedLevel: deniedLevel,
+		Levels:      make([]LevelResult, 0, len(keys)),
+	}
+
+	for i, value := range values[1:] {
+		level := value.([]interface{})
+		levelResult := LevelResult{
+			Key:             keys[i],
+			Allowed:         parseInt64(level[0]) == 1,
+			RemainingTokens: parseFloat64(level[1]),
+			Capacity:        parseInt64(level[3]),
+			RefillRate:      parseFloat64(level[4]),
+			Policy:          parseString(level[5]),
+		}
+
+		if !levelResult.Allowed {
+			levelResult.RetryAfter = parseFloat64(level[2])
+			if levelResult.RetryAfter > multiResult.RetryAfter {
+				multiResult.RetryAfter = levelResult.RetryAfter
+			}
+		}
+
+		multiResult.Levels = append(multiResult.Levels, levelResult)
+	}
+
+	if !multiResult.Allowed {
+		multiResult.DeniedKey = keys[deniedLevel]
+	}
+
+	return multiResult, nil
+}
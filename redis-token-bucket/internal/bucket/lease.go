@@ -0,0 +1,278 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// LeaseConfig holds configuration for the local token leasing layer
+type LeaseConfig struct {
+	LeaseSize   float64       // Tokens leased from Redis per round trip
+	MaxLeaseAge time.Duration // Unused leased tokens are returned to Redis after this long
+}
+
+// DefaultLeaseConfig returns a sensible default configuration
+func DefaultLeaseConfig() *LeaseConfig {
+	return &LeaseConfig{
+		LeaseSize:   10,          // Lease 10 tokens at a time
+		MaxLeaseAge: time.Second, // Return unused tokens after 1 second
+	}
+}
+
+// LeasingBucket serves token requests from blocks of tokens leased from a RedisTokenBucket.
+// Leased tokens are already taken from Redis, so the global limit is never exceeded; at worst
+// other instances are denied tokens that sit unused in a lease until it expires. Unused
+// tokens are returned when a lease expires and on Close.
+type LeasingBucket struct {
+	bucket *RedisTokenBucket
+	config *LeaseConfig
+
+	mu     sync.Mutex
+	leases map[string]*tokenLease
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// tokenLease holds the tokens leased for one key
+type tokenLease struct {
+	mu        sync.Mutex
+	tokens    float64      // Leased tokens not yet handed out
+	expiresAt time.Time    // When the unused tokens are returned to Redis
+	last      *TokenResult // Last response from Redis, for capacity and policy reporting
+	removed   bool         // Set once the lease is dropped from the map
+}
+
+var _ Limiter = (*LeasingBucket)(nil)
+
+// NewLeasingBucket wraps a token bucket with a local leasing layer. The leasing bucket takes
+// ownership of tb and closes it on Close.
+func NewLeasingBucket(tb *RedisTokenBucket, config *LeaseConfig) (*LeasingBucket, error) {
+	if config == nil {
+		config = DefaultLeaseConfig()
+	}
+
+	if config.LeaseSize <= 0 || config.MaxLeaseAge <= 0 {
+		return nil, fmt.Errorf("lease size and max lease age must be positive")
+	}
+
+	lb := &LeasingBucket{
+		bucket: tb,
+		config: config,
+		leases: make(map[string]*tokenLease),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go lb.expireLeases()
+
+	return lb, nil
+}
+
+// Close returns all unused leased tokens to Redis and closes the underlying bucket
+func (lb *LeasingBucket) Close() error {
+	var err error
+	lb.closeOnce.Do(func() {
+		close(lb.stop)
+		<-lb.done
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		lb.mu.Lock()
+		for key, l := range lb.leases {
+			l.mu.Lock()
+			if releaseErr := lb.release(ctx, key, l); releaseErr != nil && err == nil {
+				err = releaseErr
+			}
+			l.removed = true
+			l.mu.Unlock()
+		}
+		lb.leases = make(map[string]*tokenLease)
+		lb.mu.Unlock()
+
+		if closeErr := lb.bucket.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+// lockLease returns the locked lease for the given key, creating it if needed
+func (lb *LeasingBucket) lockLease(key string) *tokenLease {
+	for {
+		lb.mu.Lock()
+		l, ok := lb.leases[key]
+		if !ok {
+			l = &tokenLease{}
+			lb.leases[key] = l
+		}
+		lb.mu.Unlock()
+
+		l.mu.Lock()
+		if !l.removed {
+			return l
+		}
+		// The lease expired and was dropped before we got it
+		l.mu.Unlock()
+	}
+}
+
+// TakeTokens attempts to consume the specified number of tokens, from the local lease when
+// possible. When the lease runs low a new block of LeaseSize tokens is taken from Redis; if
+// that block is not available, only the tokens needed for this request are taken.
+func (lb *LeasingBucket) TakeTokens(ctx context.Context, key string, tokens float64) (*TokenResult, error) {
+	if tokens <= 0 {
+		return nil, fmt.Errorf("tokens must be positive")
+	}
+
+	l := lb.lockLease(key)
+	defer l.mu.Unlock()
+
+	// Never serve from a lease that has outlived its staleness bound
+	if l.tokens > 0 && time.Now().After(l.expiresAt) {
+		if err := lb.release(ctx, key, l); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.tokens < tokens {
+		needed := tokens - l.tokens
+		amount := math.Max(needed, lb.config.LeaseSize)
+
+		result, err := lb.bucket.TakeTokens(ctx, key, amount)
+		if err == nil && !result.Allowed && amount > needed {
+			// A full block is not available; take just enough for this request
+			amount = needed
+			result, err = lb.bucket.TakeTokens(ctx, key, amount)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		l.last = result
+		if !result.Allowed {
+			return &TokenResult{
+				Allowed:         false,
+				RemainingTokens: result.RemainingTokens + l.tokens,
+				RetryAfter:      result.RetryAfter,
+				Capacity:        result.Capacity,
+				RefillRate:      result.RefillRate,
+				Policy:          result.Policy,
+			}, nil
+		}
+
+		l.tokens += amount
+		l.expiresAt = time.Now().Add(lb.config.MaxLeaseAge)
+	}
+
+	l.tokens -= tokens
+
+	// Remaining tokens are as of the last lease: what Redis had left plus our unused lease
+	return &TokenResult{
+		Allowed:         true,
+		RemainingTokens: l.last.RemainingTokens + l.tokens,
+		Capacity:        l.last.Capacity,
+		RefillRate:      l.last.RefillRate,
+		Policy:          l.last.Policy,
+	}, nil
+}
+
+// release returns the unused tokens of a locked lease to Redis
+func (lb *LeasingBucket) release(ctx context.Context, key string, l *tokenLease) error {
+	if l.tokens <= 0 {
+		return nil
+	}
+
+	if _, err := lb.bucket.RefundTokens(ctx, key, l.tokens); err != nil {
+		return fmt.Errorf("failed to return leased tokens: %w", err)
+	}
+	l.tokens = 0
+
+	return nil
+}
+
+// expireLeases periodically returns the tokens of expired leases and forgets idle keys
+func (lb *LeasingBucket) expireLeases() {
+	defer close(lb.done)
+
+	ticker := time.NewTicker(lb.config.MaxLeaseAge / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C:
+		}
+
+		lb.mu.Lock()
+		leases := make(map[string]*tokenLease, len(lb.leases))
+		for key, l := range lb.leases {
+			leases[key] = l
+		}
+		lb.mu.Unlock()
+
+		// Redis calls happen outside lb.mu so requests for other keys are not blocked
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		for key, l := range leases {
+			l.mu.Lock()
+			// On failure the tokens stay leased and are retried on the next tick
+			if time.Now().After(l.expiresAt) && lb.release(ctx, key, l) == nil {
+				lb.mu.Lock()
+				if lb.leases[key] == l {
+					delete(lb.leases, key)
+				}
+				lb.mu.Unlock()
+				l.removed = true
+			}
+			l.mu.Unlock()
+		}
+		cancel()
+	}
+}
+
+// Allow implements Limiter by taking n tokens through the lease
+func (lb *LeasingBucket) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	result, err := lb.TakeTokens(ctx, key, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Result(time.Now()), nil
+}
+
+// Peek implements Limiter by reading the bucket state and adding the unused local lease
+func (lb *LeasingBucket) Peek(ctx context.Context, key string) (*Result, error) {
+	result, err := lb.bucket.Peek(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	l := lb.lockLease(key)
+	leased := l.tokens
+	l.mu.Unlock()
+
+	if leased > 0 {
+		result.Remaining += leased
+		result.Allowed = result.Remaining >= 1
+		if result.Allowed {
+			result.RetryAfter = 0
+		}
+	}
+
+	return result, nil
+}
+
+// Reset implements Limiter by dropping the local lease and refilling the bucket
+func (lb *LeasingBucket) Reset(ctx context.Context, key string) error {
+	l := lb.lockLease(key)
+	l.tokens = 0
+	l.mu.Unlock()
+
+	return lb.bucket.Reset(ctx, key)
+}
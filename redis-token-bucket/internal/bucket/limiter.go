@@ -0,0 +1,191 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Limiter is the common interface implemented by every rate limiting algorithm
+type Limiter interface {
+	// Allow attempts to consume n units for the given key
+	Allow(ctx context.Context, key string, n float64) (*Result, error)
+	// Peek returns the current state for the given key without consuming anything
+	Peek(ctx context.Context, key string) (*Result, error)
+	// Reset restores the given key to its full limit
+	Reset(ctx context.Context, key string) error
+	// Close releases the underlying resources
+	Close() error
+}
+
+// Result represents the outcome of a limiter decision, independent of the algorithm
+type Result struct {
+	Allowed    bool      `json:"allowed"`
+	Remaining  float64   `json:"remaining"`
+	Limit      int64     `json:"limit"`
+	ResetAt    time.Time `json:"reset_at"`
+	Window     float64   `json:"window_seconds"` // Seconds over which Limit units are granted
+	RetryAfter float64   `json:"retry_after_seconds,omitempty"`
+	Policy     string    `json:"policy,omitempty"`
+}
+
+// Compile-time checks that both algorithms satisfy the Limiter interface
+var (
+	_ Limiter = (*RedisTokenBucket)(nil)
+	_ Limiter = (*RedisSlidingWindow)(nil)
+)
+
+// Allow implements Limiter by taking n tokens from the bucket
+func (tb *RedisTokenBucket) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	result, err := tb.TakeTokens(ctx, key, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Result(time.Now()), nil
+}
+
+// Peek implements Limiter by reading the current bucket state
+func (tb *RedisTokenBucket) Peek(ctx context.Context, key string) (*Result, error) {
+	state, err := tb.GetBucketState(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return state.Result(), nil
+}
+
+// Result converts a token consumption result into a Limiter result as of the given time
+func (r *TokenResult) Result(now time.Time) *Result {
+	return &Result{
+		Allowed:    r.Allowed,
+		Remaining:  r.RemainingTokens,
+		Limit:      r.Capacity,
+		ResetAt:    resetAtFrom(now, r.RemainingTokens, r.Capacity, r.RefillRate),
+		Window:     refillWindow(r.Capacity, r.RefillRate),
+		RetryAfter: r.RetryAfter,
+		Policy:     r.Policy,
+	}
+}
+
+// Result converts a bucket state into a Limiter result. A single token decides whether the
+// next request would be allowed.
+func (s *BucketState) Result() *Result {
+	result := &Result{
+		Allowed:   s.CurrentTokens >= 1,
+		Remaining: s.CurrentTokens,
+		Limit:     s.Capacity,
+		ResetAt:   resetAtFrom(s.LastRefillTime, s.CurrentTokens, s.Capacity, s.RefillRate),
+		Window:    refillWindow(s.Capacity, s.RefillRate),
+		Policy:    s.Policy,
+	}
+	if !result.Allowed {
+		result.RetryAfter = (1 - s.CurrentTokens) / s.RefillRate
+	}
+	return result
+}
+
+// Reset implements Limiter by refilling the bucket to capacity
+func (tb *RedisTokenBucket) Reset(ctx context.Context, key string) error {
+	return tb.ResetBucket(ctx, key)
+}
+
+// resetAt returns the time at which a bucket holding the given tokens is full again
+func resetAt(tokens float64, capacity int64, refillRate float64) time.Time {
+	return resetAtFrom(time.Now(), tokens, capacity, refillRate)
+}
+
+// resetAtFrom is resetAt measured from the given time instead of the system clock
+func resetAtFrom(now time.Time, tokens float64, capacity int64, refillRate float64) time.Time {
+	missing := float64(capacity) - tokens
+	if missing <= 0 || refillRate <= 0 {
+		return now
+	}
+	return now.Add(time.Duration(missing / refillRate * float64(time.Second)))
+}
+
+// refillWindow returns the seconds an empty bucket takes to refill to capacity, the window
+// over which a token bucket grants its capacity
+func refillWindow(capacity int64, refillRate float64) float64 {
+	if refillRate <= 0 {
+		return 0
+	}
+	return float64(capacity) / refillRate
+}
+
+// wholeCost converts a Limiter cost into the integer count used by the window counters
+func wholeCost(n float64) (int64, error) {
+	if n <= 0 || n != math.Trunc(n) {
+		return 0, fmt.Errorf("cost must be a positive whole number, got %v", n)
+	}
+	return int64(n), nil
+}
+
+// NeedsWholeCost reports whether a limiter only accepts costs that are whole numbers, as the
+// window counters and quotas do
+func NeedsWholeCost(limiter Limiter) bool {
+	switch l := limiter.(type) {
+	case *RedisSlidingWindow, *MemorySlidingWindow, *RedisSlidingWindowCounter, *RedisFixedWindow, *RedisGCRA, *RedisQuota:
+		return true
+	case *CompositeLimiter:
+		for _, inner := range l.limiters {
+			if NeedsWholeCost(inner) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Allow implements Limiter by recording a request of n slots in the sliding window
+func (sw *RedisSlidingWindow) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	cost, err := wholeCost(n)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := sw.IsAllowedN(ctx, key, cost)
+	if err != nil {
+		return nil, err
+	}
+
+	return sw.toResult(result), nil
+}
+
+// Peek implements Limiter by counting the requests currently in the window
+func (sw *RedisSlidingWindow) Peek(ctx context.Context, key string) (*Result, error) {
+	result, err := sw.GetWindowState(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return sw.toResult(result), nil
+}
+
+// Reset implements Limiter by clearing the window
+func (sw *RedisSlidingWindow) Reset(ctx context.Context, key string) error {
+	return sw.ClearWindow(ctx, key)
+}
+
+// toResult converts a sliding window result into the common Result type
+func (sw *RedisSlidingWindow) toResult(result *SlidingWindowResult) *Result {
+	return slidingWindowToResult(sw.config, result)
+}
+
+// slidingWindowToResult converts a sliding window result into the common Result type
+func slidingWindowToResult(config *SlidingWindowConfig, result *SlidingWindowResult) *Result {
+	remaining := config.MaxRequests - result.CurrentCount
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return &Result{
+		Allowed:    result.Allowed,
+		Remaining:  float64(remaining),
+		Limit:      config.MaxRequests,
+		ResetAt:    time.UnixMilli(result.WindowEnd).Add(config.WindowSize),
+		Window:     config.WindowSize.Seconds(),
+		RetryAfter: result.RetryAfter,
+	}
+}
@@ -0,0 +1,317 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrNotBlocked is returned when lifting a block that does not exist
+var ErrNotBlocked = errors.New("client is not blocked")
+
+// Redis key prefixes of the penalty box. The client key is the hash tag, so the keys of one
+// client live in the same slot.
+const (
+	penaltyBlockPrefix      = "penalty_block"
+	penaltyViolationsPrefix = "penalty_violations"
+	penaltyLevelPrefix      = "penalty_level"
+)
+
+// PenaltyConfig holds configuration for escalating blocks of repeat offenders
+type PenaltyConfig struct {
+	RedisAddr       string
+	RedisAddrs      []string // Cluster or Sentinel addresses; overrides RedisAddr when set
+	RedisMasterName string   // Sentinel master name
+	RedisPassword   string
+	RedisDB         int
+	Threshold       int64           // Violations within ViolationWindow that block the client
+	ViolationWindow time.Duration   // Window in which violations are counted
+	BlockDurations  []time.Duration // Block length per offence; the last one repeats
+	Memory          time.Duration   // How long an offence counts towards escalation after its block ends
+}
+
+// DefaultPenaltyConfig returns a sensible default configuration
+func DefaultPenaltyConfig() *PenaltyConfig {
+	return &PenaltyConfig{
+		RedisAddr:       "localhost:6379",
+		RedisPassword:   "",
+		RedisDB:         0,
+		Threshold:       10,          // 10 rejected requests
+		ViolationWindow: time.Minute, // within a minute
+		BlockDurations:  []time.Duration{time.Minute, 10 * time.Minute, time.Hour},
+		Memory:          24 * time.Hour, // Offences are forgiven after a quiet day
+	}
+}
+
+// Block is an active block of a client
+type Block struct {
+	Key       string    `json:"key"`
+	Level     int64     `json:"level"` // 1 for the first offence, 2 for the second, ...
+	BlockedAt time.Time `json:"blocked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// RetryAfter returns the seconds until the block expires, rounded up
+func (b *Block) RetryAfter(now time.Time) int64 {
+	seconds := b.ExpiresAt.Sub(now).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return int64(seconds + 0.999)
+}
+
+// RedisPenaltyBox counts rate limit violations per client and blocks clients that keep
+// sending requests after being limited. Every further offence blocks for longer. Blocks are
+// stored in Redis, so they apply on every instance and survive restarts.
+type RedisPenaltyBox struct {
+	client          redis.UniversalClient
+	ownsClient      bool // Close only closes clients created by the constructor
+	config          *PenaltyConfig
+	violationScript *redis.Script
+}
+
+// NewRedisPenaltyBox creates a new Redis-backed penalty box
+func NewRedisPenaltyBox(config *PenaltyConfig) (*RedisPenaltyBox, error) {
+	if config == nil {
+		config = DefaultPenaltyConfig()
+	}
+
+	// Create Redis client
+	client := newUniversalClient(config.RedisAddr, config.RedisAddrs, config.RedisMasterName,
+		config.RedisPassword, config.RedisDB)
+
+	pb, err := NewRedisPenaltyBoxWithClient(client, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	pb.ownsClient = true
+
+	return pb, nil
+}
+
+// NewRedisPenaltyBoxWithClient creates a penalty box on an existing Redis client. The Redis
+// address fields of the config are ignored and Close leaves the client open.
+func NewRedisPenaltyBoxWithClient(client redis.UniversalClient, config *PenaltyConfig) (*RedisPenaltyBox, error) {
+	if config == nil {
+		config = DefaultPenaltyConfig()
+	}
+
+	if config.Threshold <= 0 || config.ViolationWindow < time.Millisecond {
+		return nil, fmt.Errorf("threshold must be positive and violation window at least 1ms")
+	}
+	if len(config.BlockDurations) == 0 {
+		return nil, fmt.Errorf("at least one block duration is required")
+	}
+	for _, d := range config.BlockDurations {
+		if d < time.Millisecond {
+			return nil, fmt.Errorf("block durations must be at least 1ms")
+		}
+	}
+	if config.Memory < 0 {
+		return nil, fmt.Errorf("memory must not be negative")
+	}
+
+	// Test connection
+	if err := pingClient(client); err != nil {
+		return nil, err
+	}
+
+	return &RedisPenaltyBox{
+		client:          client,
+		config:          config,
+		violationScript: redis.NewScript(penaltyViolationScript),
+	}, nil
+}
+
+// Close closes the Redis connection if the penalty box created it
+func (pb *RedisPenaltyBox) Close() error {
+	if !pb.ownsClient {
+		return nil
+	}
+	return pb.client.Close()
+}
+
+// Check returns the active block of a client, or nil if it is not blocked. The block key
+// expires with the block, so Redis decides when a block is over and the clock of this host
+// does not matter.
+func (pb *RedisPenaltyBox) Check(ctx context.Context, key string) (*Block, error) {
+	values, err := pb.client.HMGet(ctx, hashTagKey(penaltyBlockPrefix, key), "level", "blocked_at", "expires_at").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check block: %w", err)
+	}
+	if values[2] == nil {
+		return nil, nil
+	}
+
+	return parseBlock(key, values[0], values[1], values[2]), nil
+}
+
+// RecordViolation counts a rate limit violation of a client. It returns the block if the
+// client is blocked, either by this violation or already.
+func (pb *RedisPenaltyBox) RecordViolation(ctx context.Context, key string) (*Block, error) {
+	durations := make([]string, len(pb.config.BlockDurations))
+	for i, d := range pb.config.BlockDurations {
+		durations[i] = strconv.FormatInt(d.Milliseconds(), 10)
+	}
+
+	result, err := runScript(ctx, pb.client, pb.violationScript, "penalty_violation",
+		[]string{
+			hashTagKey(penaltyViolationsPrefix, key),
+			hashTagKey(penaltyLevelPrefix, key),
+			hashTagKey(penaltyBlockPrefix, key),
+		},
+		pb.config.Threshold,
+		pb.config.ViolationWindow.Milliseconds(),
+		pb.config.Memory.Milliseconds(),
+		strings.Join(durations, ","),
+	).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to record violation: %w", err)
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 4 {
+		return nil, fmt.Errorf("unexpected violation script result: %v", result)
+	}
+	if parseInt64(values[0]) == 0 {
+		return nil, nil
+	}
+
+	return parseBlock(key, values[1], values[2], values[3]), nil
+}
+
+// Lift removes the block of a client and forgets its offences. It returns ErrNotBlocked if
+// the client has no block, even if it had offences to forget.
+func (pb *RedisPenaltyBox) Lift(ctx context.Context, key string) error {
+	var block *redis.IntCmd
+	_, err := pb.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		block = pipe.Del(ctx, hashTagKey(penaltyBlockPrefix, key))
+		pipe.Del(ctx, hashTagKey(penaltyViolationsPrefix, key), hashTagKey(penaltyLevelPrefix, key))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to lift block: %w", err)
+	}
+	if block.Val() == 0 {
+		return ErrNotBlocked
+	}
+	return nil
+}
+
+// ListBlocks returns the active blocks of clients matching a pattern ("*" and "?" wildcards;
+// empty matches every client), soonest expiry first. It scans the keyspace with SCAN.
+func (pb *RedisPenaltyBox) ListBlocks(ctx context.Context, pattern string) ([]*Block, error) {
+	nodes, err := NewKeyAdmin(pb.client).nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, node := range nodes {
+		var cursor uint64
+		for {
+			page, next, err := node.Scan(ctx, cursor, penaltyBlockPrefix+":*", 500).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan blocks: %w", err)
+			}
+			for _, redisKey := range page {
+				if matchPattern(pattern, limiterKey(penaltyBlockPrefix, redisKey)) {
+					keys = append(keys, redisKey)
+				}
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+
+	pipe := pb.client.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(keys))
+	for i, redisKey := range keys {
+		cmds[i] = pipe.HMGet(ctx, redisKey, "level", "blocked_at", "expires_at")
+	}
+	if len(keys) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to read blocks: %w", err)
+		}
+	}
+
+	blocks := make([]*Block, 0, len(keys))
+	for i, cmd := range cmds {
+		values := cmd.Val()
+		if len(values) != 3 || values[2] == nil {
+			// Expired between the scan and the read
+			continue
+		}
+		blocks = append(blocks, parseBlock(limiterKey(penaltyBlockPrefix, keys[i]), values[0], values[1], values[2]))
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].ExpiresAt.Before(blocks[j].ExpiresAt)
+	})
+
+	return blocks, nil
+}
+
+// parseBlock builds a block from its level and its millisecond timestamps
+func parseBlock(key string, level, blockedAt, expiresAt interface{}) *Block {
+	return &Block{
+		Key:       key,
+		Level:     parseInt64(level),
+		BlockedAt: time.UnixMilli(parseInt64(blockedAt)),
+		ExpiresAt: time.UnixMilli(parseInt64(expiresAt)),
+	}
+}
+
+// Lua script counting a violation and blocking the client once it reaches the threshold.
+// Violations of a blocked client are not counted. The escalation level outlives the block by
+// the configured memory, so offences within that time block for longer.
+const penaltyViolationScript = `
+local violations_key = KEYS[1]
+local level_key = KEYS[2]
+local block_key = KEYS[3]
+local threshold = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local memory = tonumber(ARGV[3])
+
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local block = redis.call('HMGET', block_key, 'level', 'blocked_at', 'expires_at')
+if block[3] and tonumber(block[3]) > now then
+    return {1, block[1], block[2], block[3]}
+end
+
+local count = redis.call('INCR', violations_key)
+if count == 1 then
+    redis.call('PEXPIRE', violations_key, window)
+end
+if count < threshold then
+    return {0, '0', '0', '0'}
+end
+
+local durations = {}
+for d in string.gmatch(ARGV[4], '[^,]+') do
+    durations[#durations + 1] = tonumber(d)
+end
+
+local level = redis.call('INCR', level_key)
+local duration = durations[math.min(level, #durations)]
+redis.call('PEXPIRE', level_key, duration + memory)
+redis.call('DEL', violations_key)
+
+local expires_at = now + duration
+
+redis.call('HSET', block_key, 'level', level, 'blocked_at', now, 'expires_at', expires_at)
+redis.call('PEXPIRE', block_key, duration)
+
+return {1, tostring(level), tostring(now), tostring(expires_at)}
+`
@@ -0,0 +1,133 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func createTestPenaltyBox(t *testing.T, config *PenaltyConfig) *RedisPenaltyBox {
+	config.RedisAddr = "localhost:6379"
+	config.RedisDB = 10 // Use different DB for penalty tests
+
+	pb, err := NewRedisPenaltyBox(config)
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+
+	return pb
+}
+
+func TestPenaltyBox_EscalatesBlocks(t *testing.T) {
+	pb := createTestPenaltyBox(t, &PenaltyConfig{
+		Threshold:       3,
+		ViolationWindow: time.Second,
+		BlockDurations:  []time.Duration{100 * time.Millisecond, 300 * time.Millisecond},
+		Memory:          time.Minute,
+	})
+	defer pb.Close()
+
+	ctx := context.Background()
+	key := "ip:10.9.0.1"
+	pb.Lift(ctx, key)
+
+	offend := func() *Block {
+		t.Helper()
+		var block *Block
+		for i := 0; i < 3; i++ {
+			var err error
+			if block, err = pb.RecordViolation(ctx, key); err != nil {
+				t.Fatalf("RecordViolation failed: %v", err)
+			}
+			if i < 2 && block != nil {
+				t.Fatalf("Expected violation %d to stay below the threshold, got %+v", i+1, block)
+			}
+		}
+		return block
+	}
+
+	block := offend()
+	if block == nil || block.Level != 1 || block.Key != key {
+		t.Fatalf("Expected a first level block, got %+v", block)
+	}
+	if d := block.ExpiresAt.Sub(block.BlockedAt); d != 100*time.Millisecond {
+		t.Errorf("Expected the first block to last 100ms, got %v", d)
+	}
+
+	// Violations while blocked do not escalate
+	again, err := pb.RecordViolation(ctx, key)
+	if err != nil || again == nil || again.Level != 1 || !again.ExpiresAt.Equal(block.ExpiresAt) {
+		t.Errorf("Expected the running block to be returned, got %+v (%v)", again, err)
+	}
+	if checked, err := pb.Check(ctx, key); err != nil || checked == nil || checked.Level != 1 {
+		t.Errorf("Expected Check to report the block, got %+v (%v)", checked, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if checked, err := pb.Check(ctx, key); err != nil || checked != nil {
+		t.Fatalf("Expected the block to expire, got %+v (%v)", checked, err)
+	}
+
+	// The next offence blocks for longer
+	block = offend()
+	if block == nil || block.Level != 2 || block.ExpiresAt.Sub(block.BlockedAt) != 300*time.Millisecond {
+		t.Fatalf("Expected a 300ms second level block, got %+v", block)
+	}
+	if retryAfter := block.RetryAfter(block.BlockedAt); retryAfter != 1 {
+		t.Errorf("Expected Retry-After to round up to 1s, got %d", retryAfter)
+	}
+}
+
+func TestPenaltyBox_ListAndLift(t *testing.T) {
+	pb := createTestPenaltyBox(t, &PenaltyConfig{
+		Threshold:       1,
+		ViolationWindow: time.Second,
+		BlockDurations:  []time.Duration{time.Minute},
+	})
+	defer pb.Close()
+
+	ctx := context.Background()
+	keys := []string{"api_key:list-a", "api_key:list-b", "ip:10.9.0.2"}
+	for _, key := range keys {
+		pb.Lift(ctx, key)
+		if block, err := pb.RecordViolation(ctx, key); err != nil || block == nil {
+			t.Fatalf("Expected %s to be blocked, got %+v (%v)", key, block, err)
+		}
+	}
+
+	blocks, err := pb.ListBlocks(ctx, "api_key:list-*")
+	if err != nil {
+		t.Fatalf("ListBlocks failed: %v", err)
+	}
+	if len(blocks) != 2 || blocks[0].Key != "api_key:list-a" && blocks[0].Key != "api_key:list-b" {
+		t.Errorf("Expected the two matching blocks, got %+v", blocks)
+	}
+
+	if err := pb.Lift(ctx, "api_key:list-a"); err != nil {
+		t.Fatalf("Lift failed: %v", err)
+	}
+	if block, err := pb.Check(ctx, "api_key:list-a"); err != nil || block != nil {
+		t.Errorf("Expected the lifted block to be gone, got %+v (%v)", block, err)
+	}
+	if err := pb.Lift(ctx, "api_key:list-a"); !errors.Is(err, ErrNotBlocked) {
+		t.Errorf("Expected ErrNotBlocked, got %v", err)
+	}
+
+	// An expired block leaves its level behind, which is not a block to lift
+	pb.RecordViolation(ctx, "api_key:list-a")
+	pb.client.Del(ctx, hashTagKey(penaltyBlockPrefix, "api_key:list-a"))
+	if err := pb.Lift(ctx, "api_key:list-a"); !errors.Is(err, ErrNotBlocked) {
+		t.Errorf("Expected ErrNotBlocked with only a level left, got %v", err)
+	}
+
+	// Lifting forgets earlier offences, so the next block starts at level 1 again
+	block, err := pb.RecordViolation(ctx, "api_key:list-a")
+	if err != nil || block == nil || block.Level != 1 {
+		t.Errorf("Expected a fresh first level block, got %+v (%v)", block, err)
+	}
+
+	for _, key := range keys {
+		pb.Lift(ctx, key)
+	}
+}
@@ -0,0 +1,329 @@
+package bucket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis keys holding the policy definitions, their key/prefix assignments and the index of
+// assigned prefixes. They share a hash tag so scripts that touch them work on Redis Cluster.
+const (
+	policiesKey          = "{token_bucket}:policies"
+	policyAssignmentsKey = "{token_bucket}:policy_assignments"
+	policyPrefixesKey    = "{token_bucket}:policy_prefixes" // Sorted set of prefixes without "*", scored by length
+)
+
+// policyKeys are the policy tables passed to the scripts that resolve policies
+var policyKeys = []string{policiesKey, policyAssignmentsKey, policyPrefixesKey}
+
+// clusterPolicyRefresh is how long cluster mode uses a policy snapshot before reloading it
+const clusterPolicyRefresh = 5 * time.Second
+
+// ErrPolicyNotFound is returned when a named policy does not exist
+var ErrPolicyNotFound = errors.New("policy not found")
+
+// Policy is a named rate limit that can be assigned to a bucket key or key prefix
+type Policy struct {
+	Name       string  `json:"name"`
+	Capacity   int64   `json:"capacity"`    // Maximum tokens in bucket
+	RefillRate float64 `json:"refill_rate"` // Tokens per second
+}
+
+// Validate checks that the policy can be stored and used by the take script
+func (p *Policy) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("policy name is required")
+	}
+	if p.Capacity <= 0 {
+		return fmt.Errorf("policy capacity must be positive")
+	}
+	if p.RefillRate <= 0 {
+		return fmt.Errorf("policy refill rate must be positive")
+	}
+	return nil
+}
+
+// PolicyStore manages named policies and their assignment to bucket keys.
+// A pattern is either an exact bucket key or a prefix ending in "*".
+type PolicyStore interface {
+	SetPolicy(ctx context.Context, policy *Policy) error
+	GetPolicy(ctx context.Context, name string) (*Policy, error)
+	ListPolicies(ctx context.Context) ([]*Policy, error)
+	DeletePolicy(ctx context.Context, name string) error
+	AssignPolicy(ctx context.Context, pattern string, name string) error
+	UnassignPolicy(ctx context.Context, pattern string) error
+	ListAssignments(ctx context.Context) (map[string]string, error)
+}
+
+var _ PolicyStore = (*RedisTokenBucket)(nil)
+
+// DefaultPolicy returns the capacity and refill rate of buckets without a policy
+func (tb *RedisTokenBucket) DefaultPolicy() *Policy {
+	return &Policy{Capacity: tb.config.Capacity, RefillRate: tb.config.RefillRate}
+}
+
+// SetPolicy creates or updates a named policy
+func (tb *RedisTokenBucket) SetPolicy(ctx context.Context, policy *Policy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("failed to encode policy: %w", err)
+	}
+
+	if err := tb.client.HSet(ctx, policiesKey, policy.Name, encoded).Err(); err != nil {
+		return fmt.Errorf("failed to set policy: %w", err)
+	}
+	tb.policies.invalidate()
+
+	return nil
+}
+
+// GetPolicy returns the named policy or ErrPolicyNotFound
+func (tb *RedisTokenBucket) GetPolicy(ctx context.Context, name string) (*Policy, error) {
+	encoded, err := tb.client.HGet(ctx, policiesKey, name).Result()
+	if err == redis.Nil {
+		return nil, ErrPolicyNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get policy: %w", err)
+	}
+
+	var policy Policy
+	if err := json.Unmarshal([]byte(encoded), &policy); err != nil {
+		return nil, fmt.Errorf("failed to decode policy %s: %w", name, err)
+	}
+
+	return &policy, nil
+}
+
+// ListPolicies returns all policies sorted by name
+func (tb *RedisTokenBucket) ListPolicies(ctx context.Context) ([]*Policy, error) {
+	entries, err := tb.client.HGetAll(ctx, policiesKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policies: %w", err)
+	}
+
+	policies := make([]*Policy, 0, len(entries))
+	for name, encoded := range entries {
+		var policy Policy
+		if err := json.Unmarshal([]byte(encoded), &policy); err != nil {
+			return nil, fmt.Errorf("failed to decode policy %s: %w", name, err)
+		}
+		policies = append(policies, &policy)
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	return policies, nil
+}
+
+// DeletePolicy removes a policy and every assignment that references it.
+// Buckets that used the policy fall back to the default configuration.
+func (tb *RedisTokenBucket) DeletePolicy(ctx context.Context, name string) error {
+	result, err := runScript(ctx, tb.client, tb.luaScripts["delete_policy"], "delete_policy",
+		policyKeys, name).Result()
+	if err != nil {
+		return fmt.Errorf("failed to delete policy: %w", err)
+	}
+
+	if parseInt64(result) == 0 {
+		return ErrPolicyNotFound
+	}
+	tb.policies.invalidate()
+
+	return nil
+}
+
+// AssignPolicy assigns an existing policy to a bucket key or a key prefix ending in "*"
+func (tb *RedisTokenBucket) AssignPolicy(ctx context.Context, pattern string, name string) error {
+	if pattern == "" {
+		return fmt.Errorf("pattern is required")
+	}
+
+	result, err := runScript(ctx, tb.client, tb.luaScripts["assign_policy"], "assign_policy",
+		policyKeys, pattern, name).Result()
+	if err != nil {
+		return fmt.Errorf("failed to assign policy: %w", err)
+	}
+	if parseInt64(result) == 0 {
+		return ErrPolicyNotFound
+	}
+	tb.policies.invalidate()
+
+	return nil
+}
+
+// UnassignPolicy removes the assignment for a bucket key or key prefix
+func (tb *RedisTokenBucket) UnassignPolicy(ctx context.Context, pattern string) error {
+	err := runScript(ctx, tb.client, tb.luaScripts["unassign_policy"], "unassign_policy",
+		[]string{policyAssignmentsKey, policyPrefixesKey}, pattern).Err()
+	if err != nil {
+		return fmt.Errorf("failed to unassign policy: %w", err)
+	}
+	tb.policies.invalidate()
+
+	return nil
+}
+
+// ListAssignments returns all pattern to policy name assignments
+func (tb *RedisTokenBucket) ListAssignments(ctx context.Context) (map[string]string, error) {
+	assignments, err := tb.client.HGetAll(ctx, policyAssignmentsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list policy assignments: %w", err)
+	}
+	return assignments, nil
+}
+
+// indexPolicyPrefixes rebuilds the prefix index the scripts resolve prefixes with
+func (tb *RedisTokenBucket) indexPolicyPrefixes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := runScript(ctx, tb.client, tb.luaScripts["index_policy_prefixes"], "index_policy_prefixes",
+		[]string{policyAssignmentsKey, policyPrefixesKey}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to index policy prefixes: %w", err)
+	}
+	return nil
+}
+
+// policyCache holds a snapshot of the policy tables for client-side resolution in cluster mode.
+// The lock only guards swapping snapshots; reloads run without it.
+type policyCache struct {
+	mu         sync.Mutex
+	snapshot   *policySnapshot
+	loadedAt   time.Time
+	loading    bool   // A reload is running
+	generation uint64 // Incremented by invalidate
+}
+
+// policySnapshot is an immutable copy of the policy tables
+type policySnapshot struct {
+	policies    map[string]*Policy
+	assignments map[string]string
+}
+
+// invalidate forces the next lookup to reload the policy tables
+func (c *policyCache) invalidate() {
+	c.mu.Lock()
+	c.loadedAt = time.Time{}
+	c.generation++
+	c.mu.Unlock()
+}
+
+// policyArgs returns the policy argument, capacity and refill rate passed to the token bucket
+// scripts. Normally the script resolves the policy itself from the bucket key; in cluster mode
+// the policy is resolved here and its name is passed instead.
+func (tb *RedisTokenBucket) policyArgs(ctx context.Context, key string) (string, int64, float64, error) {
+	if !tb.cluster {
+		return key, tb.config.Capacity, tb.config.RefillRate, nil
+	}
+
+	policy, err := tb.resolvePolicy(ctx, key)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if policy == nil {
+		return "", tb.config.Capacity, tb.config.RefillRate, nil
+	}
+
+	return policy.Name, policy.Capacity, policy.RefillRate, nil
+}
+
+// resolvePolicy finds the policy for a bucket key the same way the scripts do: an exact
+// assignment first, then the longest matching prefix. Returns nil if no policy applies.
+func (tb *RedisTokenBucket) resolvePolicy(ctx context.Context, key string) (*Policy, error) {
+	snapshot, err := tb.policySnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	name, ok := snapshot.assignments[key]
+	for i := len(key) - 1; !ok && i >= 0; i-- {
+		name, ok = snapshot.assignments[key[:i]+"*"]
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	return snapshot.policies[name], nil
+}
+
+// cachedPolicy returns a named policy from the cluster mode snapshot
+func (tb *RedisTokenBucket) cachedPolicy(ctx context.Context, name string) (*Policy, error) {
+	snapshot, err := tb.policySnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, ok := snapshot.policies[name]
+	if !ok {
+		return nil, ErrPolicyNotFound
+	}
+	return policy, nil
+}
+
+// policySnapshot returns the policy tables, reloading them once they are older than
+// clusterPolicyRefresh. While one caller reloads an expired snapshot, the others keep using
+// it; after invalidate nobody does, so local changes are seen right away.
+func (tb *RedisTokenBucket) policySnapshot(ctx context.Context) (*policySnapshot, error) {
+	c := tb.policies
+	c.mu.Lock()
+	current := c.snapshot
+	fresh := time.Since(c.loadedAt) <= clusterPolicyRefresh
+	if current != nil && (fresh || (c.loading && !c.loadedAt.IsZero())) {
+		c.mu.Unlock()
+		return current, nil
+	}
+	c.loading = true
+	generation := c.generation
+	c.mu.Unlock()
+
+	loaded, err := tb.loadPolicySnapshot(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loading = false
+	if err != nil {
+		return nil, err
+	}
+	c.snapshot = loaded
+	if c.generation == generation {
+		// Otherwise the tables changed during the reload and the next lookup loads them again
+		c.loadedAt = time.Now()
+	}
+	return loaded, nil
+}
+
+// loadPolicySnapshot reads the policy tables from Redis
+func (tb *RedisTokenBucket) loadPolicySnapshot(ctx context.Context) (*policySnapshot, error) {
+	policies, err := tb.ListPolicies(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := tb.ListAssignments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &policySnapshot{
+		policies:    make(map[string]*Policy, len(policies)),
+		assignments: assignments,
+	}
+	for _, policy := range policies {
+		snapshot.policies[policy.Name] = policy
+	}
+	return snapshot, nil
+}
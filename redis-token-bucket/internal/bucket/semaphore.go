@@ -0,0 +1,261 @@
+package bucket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrLeaseLost is returned when renewing a lease that has expired or was released
+var ErrLeaseLost = errors.New("semaphore lease lost")
+
+// SemaphoreConfig holds configuration for the concurrency limiter
+type SemaphoreConfig struct {
+	RedisAddr       string
+	RedisAddrs      []string // Cluster or Sentinel addresses; overrides RedisAddr when set
+	RedisMasterName string   // Sentinel master name
+	RedisPassword   string
+	RedisDB         int
+	Limit           int64         // Maximum concurrent holders per key
+	LeaseTTL        time.Duration // How long a lease lasts unless renewed
+}
+
+// DefaultSemaphoreConfig returns a sensible default configuration
+func DefaultSemaphoreConfig() *SemaphoreConfig {
+	return &SemaphoreConfig{
+		RedisAddr:     "localhost:6379",
+		RedisPassword: "",
+		RedisDB:       0,
+		Limit:         5,                // 5 requests in flight per key
+		LeaseTTL:      30 * time.Second, // Slots of crashed holders free up after 30s
+	}
+}
+
+// RedisSemaphore limits the number of concurrent holders per key across instances. Every
+// holder gets a lease that expires after LeaseTTL, so slots held by crashed processes are
+// reclaimed automatically; long running holders renew their lease.
+type RedisSemaphore struct {
+	client        redis.UniversalClient
+	ownsClient    bool // Close only closes clients created by the constructor
+	config        *SemaphoreConfig
+	acquireScript *redis.Script
+	renewScript   *redis.Script
+}
+
+// SemaphoreLease identifies one held slot
+type SemaphoreLease struct {
+	Key       string    `json:"key"`
+	ID        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SemaphoreResult represents the result of an acquire attempt
+type SemaphoreResult struct {
+	Acquired   bool            `json:"acquired"`
+	InFlight   int64           `json:"in_flight"`
+	Limit      int64           `json:"limit"`
+	RetryAfter float64         `json:"retry_after_seconds,omitempty"` // Until the oldest lease expires at the latest
+	Lease      *SemaphoreLease `json:"lease,omitempty"`
+}
+
+// NewRedisSemaphore creates a new Redis-backed concurrency limiter
+func NewRedisSemaphore(config *SemaphoreConfig) (*RedisSemaphore, error) {
+	if config == nil {
+		config = DefaultSemaphoreConfig()
+	}
+
+	// Create Redis client
+	client := newUniversalClient(config.RedisAddr, config.RedisAddrs, config.RedisMasterName,
+		config.RedisPassword, config.RedisDB)
+
+	sem, err := NewRedisSemaphoreWithClient(client, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	sem.ownsClient = true
+
+	return sem, nil
+}
+
+// NewRedisSemaphoreWithClient creates a concurrency limiter on an existing Redis client. The
+// Redis address fields of the config are ignored and Close leaves the client open.
+func NewRedisSemaphoreWithClient(client redis.UniversalClient, config *SemaphoreConfig) (*RedisSemaphore, error) {
+	if config == nil {
+		config = DefaultSemaphoreConfig()
+	}
+
+	if config.Limit <= 0 || config.LeaseTTL < time.Millisecond {
+		return nil, fmt.Errorf("limit must be positive and lease TTL at least 1ms")
+	}
+
+	// Test connection
+	if err := pingClient(client); err != nil {
+		return nil, err
+	}
+
+	return &RedisSemaphore{
+		client:        client,
+		config:        config,
+		acquireScript: redis.NewScript(semaphoreAcquireScript),
+		renewScript:   redis.NewScript(semaphoreRenewScript),
+	}, nil
+}
+
+// Close closes the Redis connection if the semaphore created it
+func (s *RedisSemaphore) Close() error {
+	if !s.ownsClient {
+		return nil
+	}
+	return s.client.Close()
+}
+
+// Config returns the semaphore configuration
+func (s *RedisSemaphore) Config() *SemaphoreConfig {
+	return s.config
+}
+
+// keyName generates a Redis key for the given semaphore key
+func (s *RedisSemaphore) keyName(key string) string {
+	return hashTagKey("semaphore", key)
+}
+
+// Acquire tries to take a slot for the given key. It does not wait; when every slot is
+// taken the result is not acquired and RetryAfter tells when the oldest lease expires.
+func (s *RedisSemaphore) Acquire(ctx context.Context, key string) (*SemaphoreResult, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate lease ID: %w", err)
+	}
+	leaseID := hex.EncodeToString(id)
+
+	result, err := runScript(ctx, s.client, s.acquireScript, "semaphore_acquire", []string{s.keyName(key)},
+		s.config.Limit, s.config.LeaseTTL.Milliseconds(), leaseID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire semaphore: %w", err)
+	}
+
+	values := result.([]interface{})
+	semResult := &SemaphoreResult{
+		Acquired: parseInt64(values[0]) == 1,
+		InFlight: parseInt64(values[1]),
+		Limit:    s.config.Limit,
+	}
+
+	if semResult.Acquired {
+		semResult.Lease = &SemaphoreLease{
+			Key:       key,
+			ID:        leaseID,
+			ExpiresAt: time.UnixMilli(parseInt64(values[2])),
+		}
+	} else if retryAfter := parseInt64(values[2]); retryAfter > 0 {
+		semResult.RetryAfter = float64(retryAfter) / 1000.0 // Convert to seconds
+	}
+
+	return semResult, nil
+}
+
+// Release gives the slot of a lease back. Releasing a lease that already expired or was
+// released does nothing.
+func (s *RedisSemaphore) Release(ctx context.Context, lease *SemaphoreLease) error {
+	if err := s.client.ZRem(ctx, s.keyName(lease.Key), lease.ID).Err(); err != nil {
+		return fmt.Errorf("failed to release semaphore: %w", err)
+	}
+	return nil
+}
+
+// Renew extends a lease by another LeaseTTL. It returns ErrLeaseLost if the lease already
+// expired, in which case the slot may have been given to someone else.
+func (s *RedisSemaphore) Renew(ctx context.Context, lease *SemaphoreLease) error {
+	result, err := runScript(ctx, s.client, s.renewScript, "semaphore_renew", []string{s.keyName(lease.Key)},
+		s.config.LeaseTTL.Milliseconds(), lease.ID).Result()
+	if err != nil {
+		return fmt.Errorf("failed to renew semaphore lease: %w", err)
+	}
+
+	expiresAt := parseInt64(result)
+	if expiresAt == 0 {
+		return ErrLeaseLost
+	}
+	lease.ExpiresAt = time.UnixMilli(expiresAt)
+
+	return nil
+}
+
+// Reset drops every lease for the given key, freeing all of its slots
+func (s *RedisSemaphore) Reset(ctx context.Context, key string) error {
+	if err := s.client.Del(ctx, s.keyName(key)).Err(); err != nil {
+		return fmt.Errorf("failed to reset semaphore: %w", err)
+	}
+	return nil
+}
+
+// InFlight returns the number of unexpired leases for the given key
+func (s *RedisSemaphore) InFlight(ctx context.Context, key string) (int64, error) {
+	now, err := s.client.Time(ctx).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read Redis time: %w", err)
+	}
+
+	count, err := s.client.ZCount(ctx, s.keyName(key), fmt.Sprintf("(%d", now.UnixMilli()), "+inf").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count semaphore leases: %w", err)
+	}
+
+	return count, nil
+}
+
+// Lua script for acquiring a semaphore slot. Leases are ZSET members scored by their expiry
+// time on the Redis clock.
+const semaphoreAcquireScript = `
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local lease_ttl = tonumber(ARGV[2])
+local lease_id = ARGV[3]
+
+local now = redis.call('TIME')
+local now_ms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+
+-- Reclaim the slots of holders that stopped renewing their lease
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now_ms)
+
+local in_flight = redis.call('ZCARD', key)
+if in_flight < limit then
+    local expires_at = now_ms + lease_ttl
+    redis.call('ZADD', key, expires_at, lease_id)
+    -- Every lease expires within lease_ttl, so the key can too
+    redis.call('PEXPIRE', key, lease_ttl)
+    return {1, in_flight + 1, expires_at}
+end
+
+-- Time until the oldest lease expires
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+return {0, in_flight, tonumber(oldest[2]) - now_ms}
+`
+
+// Lua script for renewing a semaphore lease. Returns the new expiry, or 0 if the lease is gone.
+const semaphoreRenewScript = `
+local key = KEYS[1]
+local lease_ttl = tonumber(ARGV[1])
+local lease_id = ARGV[2]
+
+local now = redis.call('TIME')
+local now_ms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+
+local expires_at = redis.call('ZSCORE', key, lease_id)
+if not expires_at or tonumber(expires_at) <= now_ms then
+    redis.call('ZREM', key, lease_id)
+    return 0
+end
+
+local new_expires_at = now_ms + lease_ttl
+redis.call('ZADD', key, new_expires_at, lease_id)
+redis.call('PEXPIRE', key, lease_ttl)
+
+return new_expires_at
+`
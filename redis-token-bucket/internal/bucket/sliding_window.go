@@ -2,7 +2,10 @@ package bucket
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -10,12 +13,14 @@ import (
 
 // SlidingWindowConfig holds configuration for sliding window rate limiter
 type SlidingWindowConfig struct {
-	RedisAddr     string
-	RedisPassword string
-	RedisDB       int
-	WindowSize    time.Duration // Size of the sliding window
-	MaxRequests   int64         // Maximum requests allowed in the window
-	TTL           time.Duration // TTL for window keys
+	RedisAddr       string
+	RedisAddrs      []string // Cluster or Sentinel addresses; overrides RedisAddr when set
+	RedisMasterName string   // Sentinel master name
+	RedisPassword   string
+	RedisDB         int
+	WindowSize      time.Duration // Size of the sliding window
+	MaxRequests     int64         // Maximum requests allowed in the window
+	TTL             time.Duration // TTL for window keys
 }
 
 // DefaultSlidingWindowConfig returns a sensible default configuration
@@ -32,9 +37,14 @@ func DefaultSlidingWindowConfig() *SlidingWindowConfig {
 
 // RedisSlidingWindow implements a sliding window rate limiter using Redis
 type RedisSlidingWindow struct {
-	client    *redis.Client
-	config    *SlidingWindowConfig
-	luaScript *redis.Script
+	client      redis.UniversalClient
+	ownsClient  bool // Close only closes clients created by the constructor
+	config      *SlidingWindowConfig
+	luaScript   *redis.Script
+	stateScript *redis.Script
+	clock       Clock         // Only stamps log member names; window math uses Redis TIME
+	instanceID  string        // Random ID that keeps log members unique across instances
+	sequence    atomic.Uint64 // Keeps log members unique within this instance
 }
 
 // SlidingWindowResult represents the result of a sliding window check
@@ -53,23 +63,42 @@ func NewRedisSlidingWindow(config *SlidingWindowConfig) (*RedisSlidingWindow, er
 	}
 
 	// Create Redis client
-	client := redis.NewClient(&redis.Options{
-		Addr:     config.RedisAddr,
-		Password: config.RedisPassword,
-		DB:       config.RedisDB,
-	})
+	client := newUniversalClient(config.RedisAddr, config.RedisAddrs, config.RedisMasterName,
+		config.RedisPassword, config.RedisDB)
+
+	sw, err := NewRedisSlidingWindowWithClient(client, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	sw.ownsClient = true
+
+	return sw, nil
+}
+
+// NewRedisSlidingWindowWithClient creates a sliding window on an existing Redis client, so it
+// can share a connection pool with the rest of the application. The Redis address fields of
+// the config are ignored and Close leaves the client open.
+func NewRedisSlidingWindowWithClient(client redis.UniversalClient, config *SlidingWindowConfig) (*RedisSlidingWindow, error) {
+	if config == nil {
+		config = DefaultSlidingWindowConfig()
+	}
 
 	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	if err := pingClient(client); err != nil {
+		return nil, err
+	}
 
-	if err := client.Ping(ctx).Err(); err != nil {
-		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	instanceID := make([]byte, 8)
+	if _, err := rand.Read(instanceID); err != nil {
+		return nil, fmt.Errorf("failed to generate instance ID: %w", err)
 	}
 
 	sw := &RedisSlidingWindow{
-		client: client,
-		config: config,
+		client:     client,
+		config:     config,
+		clock:      RealClock{},
+		instanceID: hex.EncodeToString(instanceID),
 	}
 
 	sw.initLuaScript()
@@ -77,28 +106,41 @@ func NewRedisSlidingWindow(config *SlidingWindowConfig) (*RedisSlidingWindow, er
 	return sw, nil
 }
 
-// Close closes the Redis connection
+// Close closes the Redis connection if the sliding window created it
 func (sw *RedisSlidingWindow) Close() error {
+	if !sw.ownsClient {
+		return nil
+	}
 	return sw.client.Close()
 }
 
 // keyName generates a Redis key for the given window key
 func (sw *RedisSlidingWindow) keyName(key string) string {
-	return fmt.Sprintf("sliding_window:%s", key)
+	return hashTagKey("sliding_window", key)
 }
 
 // IsAllowed checks if a request is allowed within the sliding window
 func (sw *RedisSlidingWindow) IsAllowed(ctx context.Context, key string) (*SlidingWindowResult, error) {
-	now := time.Now()
-	windowStart := now.Add(-sw.config.WindowSize)
+	return sw.IsAllowedN(ctx, key, 1)
+}
+
+// IsAllowedN checks if a request costing cost slots is allowed within the sliding window.
+// The request is recorded only if all of its slots fit.
+func (sw *RedisSlidingWindow) IsAllowedN(ctx context.Context, key string, cost int64) (*SlidingWindowResult, error) {
+	if cost <= 0 || cost > sw.config.MaxRequests {
+		return nil, fmt.Errorf("cost must be between 1 and %d, got %d", sw.config.MaxRequests, cost)
+	}
+
 	redisKey := sw.keyName(key)
 
-	// Run the sliding window Lua script
-	result, err := sw.luaScript.Run(ctx, sw.client, []string{redisKey},
-		windowStart.UnixMilli(),
-		now.UnixMilli(),
+	// Run the sliding window Lua script; the window is measured on the Redis clock so
+	// instances with skewed clocks agree on it
+	result, err := runScript(ctx, sw.client, sw.luaScript, "sliding_window", []string{redisKey},
+		sw.config.WindowSize.Milliseconds(),
 		sw.config.MaxRequests,
-		sw.config.TTL.Seconds()).Result()
+		sw.config.TTL.Seconds(),
+		cost,
+		sw.memberPrefix()).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to check sliding window: %w", err)
 	}
@@ -111,8 +153,8 @@ func (sw *RedisSlidingWindow) IsAllowed(ctx context.Context, key string) (*Slidi
 	slidingResult := &SlidingWindowResult{
 		Allowed:      allowed,
 		CurrentCount: currentCount,
-		WindowStart:  windowStart.UnixMilli(),
-		WindowEnd:    now.UnixMilli(),
+		WindowStart:  parseInt64(values[3]),
+		WindowEnd:    parseInt64(values[4]),
 	}
 
 	if !allowed && retryAfter > 0 {
@@ -124,28 +166,11 @@ func (sw *RedisSlidingWindow) IsAllowed(ctx context.Context, key string) (*Slidi
 
 // GetWindowState returns the current state of the sliding window
 func (sw *RedisSlidingWindow) GetWindowState(ctx context.Context, key string) (*SlidingWindowResult, error) {
-	now := time.Now()
-	windowStart := now.Add(-sw.config.WindowSize)
 	redisKey := sw.keyName(key)
 
 	// Get current count without adding a new request
-	script := `
-		local key = KEYS[1]
-		local window_start = ARGV[1]
-		local window_end = ARGV[2]
-		
-		-- Remove expired entries
-		redis.call('ZREMRANGEBYSCORE', key, '-inf', window_start)
-		
-		-- Count current entries
-		local current_count = redis.call('ZCARD', key)
-		
-		return {current_count}
-	`
-
-	result, err := redis.NewScript(script).Run(ctx, sw.client, []string{redisKey},
-		windowStart.UnixMilli(),
-		now.UnixMilli()).Result()
+	result, err := runScript(ctx, sw.client, sw.stateScript, "sliding_window_state", []string{redisKey},
+		sw.config.WindowSize.Milliseconds()).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get window state: %w", err)
 	}
@@ -156,8 +181,8 @@ func (sw *RedisSlidingWindow) GetWindowState(ctx context.Context, key string) (*
 	return &SlidingWindowResult{
 		Allowed:      currentCount < sw.config.MaxRequests,
 		CurrentCount: currentCount,
-		WindowStart:  windowStart.UnixMilli(),
-		WindowEnd:    now.UnixMilli(),
+		WindowStart:  parseInt64(values[1]),
+		WindowEnd:    parseInt64(values[2]),
 	}, nil
 }
 
@@ -170,10 +195,16 @@ func (sw *RedisSlidingWindow) ClearWindow(ctx context.Context, key string) error
 // Lua script for sliding window rate limiting
 const slidingWindowScript = `
 local key = KEYS[1]
-local window_start = ARGV[1]
-local window_end = ARGV[2]
-local max_requests = tonumber(ARGV[3])
-local ttl = tonumber(ARGV[4])
+local window_size = tonumber(ARGV[1])
+local max_requests = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local member_prefix = ARGV[5]
+
+-- Use the Redis clock so every instance sees the same window
+local now = redis.call('TIME')
+local window_end = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local window_start = window_end - window_size
 
 -- Remove expired entries
 redis.call('ZREMRANGEBYSCORE', key, '-inf', window_start)
@@ -184,18 +215,20 @@ local current_count = redis.call('ZCARD', key)
 local allowed = 0
 local retry_after = 0
 
-if current_count < max_requests then
-    -- Add current request
-    redis.call('ZADD', key, window_end, window_end)
+if current_count + cost <= max_requests then
+    -- Add one uniquely named entry per slot so requests in the same millisecond don't collapse
+    for i = 1, cost do
+        redis.call('ZADD', key, window_end, member_prefix .. ':' .. i)
+    end
     allowed = 1
-    current_count = current_count + 1
+    current_count = current_count + cost
 else
-    -- Calculate retry after (time until oldest entry expires)
-    local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+    -- Calculate retry after (time until enough of the oldest entries expire)
+    local index = current_count + cost - max_requests - 1
+    local oldest = redis.call('ZRANGE', key, index, index, 'WITHSCORES')
     if #oldest > 0 then
         local oldest_time = tonumber(oldest[2])
-        local window_size = tonumber(window_end) - tonumber(window_start)
-        retry_after = oldest_time + window_size - tonumber(window_end)
+        retry_after = oldest_time + window_size - window_end
         if retry_after < 0 then
             retry_after = 0
         end
@@ -205,10 +238,34 @@ end
 -- Set TTL
 redis.call('EXPIRE', key, ttl)
 
-return {allowed, current_count, retry_after}
+return {allowed, current_count, retry_after, window_start, window_end}
 `
 
-// initLuaScript initializes the Lua script
+// Lua script for reading the sliding window count without recording a request
+const windowStateScript = `
+local key = KEYS[1]
+local window_size = tonumber(ARGV[1])
+
+local now = redis.call('TIME')
+local window_end = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local window_start = window_end - window_size
+
+-- Remove expired entries
+redis.call('ZREMRANGEBYSCORE', key, '-inf', window_start)
+
+-- Count current entries
+local current_count = redis.call('ZCARD', key)
+
+return {current_count, window_start, window_end}
+`
+
+// memberPrefix returns a log member prefix that is unique across requests and instances
+func (sw *RedisSlidingWindow) memberPrefix() string {
+	return fmt.Sprintf("%d-%s-%d", sw.clock.Now().UnixMilli(), sw.instanceID, sw.sequence.Add(1))
+}
+
+// initLuaScript initializes the Lua scripts
 func (sw *RedisSlidingWindow) initLuaScript() {
 	sw.luaScript = redis.NewScript(slidingWindowScript)
+	sw.stateScript = redis.NewScript(windowStateScript)
 }
@@ -0,0 +1,209 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisSlidingWindowCounter implements the approximate sliding window counter using Redis.
+// It keeps one counter for the current and one for the previous fixed window and weights
+// the previous count by how much of it still overlaps the sliding window, so memory use
+// is constant regardless of the limit.
+type RedisSlidingWindowCounter struct {
+	client     redis.UniversalClient
+	ownsClient bool // Close only closes clients created by the constructor
+	config     *WindowCounterConfig
+	luaScript  *redis.Script
+}
+
+var _ Limiter = (*RedisSlidingWindowCounter)(nil)
+
+// NewRedisSlidingWindowCounter creates a new Redis-backed sliding window counter rate limiter
+func NewRedisSlidingWindowCounter(config *WindowCounterConfig) (*RedisSlidingWindowCounter, error) {
+	if config == nil {
+		config = DefaultWindowCounterConfig()
+	}
+
+	// Create Redis client
+	client := newUniversalClient(config.RedisAddr, config.RedisAddrs, config.RedisMasterName,
+		config.RedisPassword, config.RedisDB)
+
+	sc, err := NewRedisSlidingWindowCounterWithClient(client, config)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	sc.ownsClient = true
+
+	return sc, nil
+}
+
+// NewRedisSlidingWindowCounterWithClient creates a sliding window counter on an existing Redis client. The Redis address
+// fields of the config are ignored and Close leaves the client open.
+func NewRedisSlidingWindowCounterWithClient(client redis.UniversalClient, config *WindowCounterConfig) (*RedisSlidingWindowCounter, error) {
+	if config == nil {
+		config = DefaultWindowCounterConfig()
+	}
+
+	// Test connection
+	if err := pingClient(client); err != nil {
+		return nil, err
+	}
+
+	return &RedisSlidingWindowCounter{
+		client:    client,
+		config:    config,
+		luaScript: redis.NewScript(slidingWindowCounterScript),
+	}, nil
+}
+
+// Close closes the Redis connection if the sliding window counter created it
+func (sc *RedisSlidingWindowCounter) Close() error {
+	if !sc.ownsClient {
+		return nil
+	}
+	return sc.client.Close()
+}
+
+// keyName generates a Redis key for the given window key
+func (sc *RedisSlidingWindowCounter) keyName(key string) string {
+	return fmt.Sprintf("sliding_window_counter:%s", key)
+}
+
+// Allow implements Limiter by adding n to the current window if the weighted count allows it
+func (sc *RedisSlidingWindowCounter) Allow(ctx context.Context, key string, n float64) (*Result, error) {
+	cost, err := wholeCost(n)
+	if err != nil {
+		return nil, err
+	}
+	return sc.run(ctx, key, cost, true)
+}
+
+// Peek implements Limiter by computing the weighted count without recording a request
+func (sc *RedisSlidingWindowCounter) Peek(ctx context.Context, key string) (*Result, error) {
+	return sc.run(ctx, key, 1, false)
+}
+
+// Reset implements Limiter by deleting both window counters
+func (sc *RedisSlidingWindowCounter) Reset(ctx context.Context, key string) error {
+	return sc.client.Del(ctx, sc.keyName(key)).Err()
+}
+
+// run executes the sliding window counter script, consuming cost only when apply is set
+func (sc *RedisSlidingWindowCounter) run(ctx context.Context, key string, cost int64, apply bool) (*Result, error) {
+	applyFlag := 0
+	if apply {
+		applyFlag = 1
+	}
+
+	result, err := runScript(ctx, sc.client, sc.luaScript, "sliding_window_counter", []string{sc.keyName(key)},
+		cost,
+		sc.config.MaxRequests,
+		sc.config.WindowSize.Milliseconds(),
+		applyFlag).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to check sliding window counter: %w", err)
+	}
+
+	values := result.([]interface{})
+	allowed := parseInt64(values[0]) == 1
+	estimated := parseFloat64(values[1])
+	retryMs := parseInt64(values[2])
+	resetMs := parseInt64(values[3])
+
+	remaining := math.Floor(float64(sc.config.MaxRequests) - estimated)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	counterResult := &Result{
+		Allowed:   allowed,
+		Remaining: remaining,
+		Limit:     sc.config.MaxRequests,
+		ResetAt:   time.Now().Add(time.Duration(resetMs) * time.Millisecond),
+		Window:    sc.config.WindowSize.Seconds(),
+	}
+
+	if !allowed && retryMs > 0 {
+		counterResult.RetryAfter = float64(retryMs) / 1000.0
+	}
+
+	return counterResult, nil
+}
+
+// Lua script for the sliding window counter. The hash stores the index of the current
+// window together with the current and previous window counts.
+const slidingWindowCounterScript = `
+local key = KEYS[1]
+local cost = tonumber(ARGV[1])
+local max_requests = tonumber(ARGV[2])
+local window_ms = tonumber(ARGV[3])
+local apply = tonumber(ARGV[4])
+
+local now = redis.call('TIME')
+local now_ms = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local window = math.floor(now_ms / window_ms)
+local offset = now_ms - window * window_ms
+
+local data = redis.call('HMGET', key, 'window', 'current', 'previous')
+local stored_window = tonumber(data[1]) or window
+local current = tonumber(data[2]) or 0
+local previous = tonumber(data[3]) or 0
+
+-- Roll the counters forward to the window containing now
+if stored_window == window - 1 then
+    previous = current
+    current = 0
+elseif stored_window ~= window then
+    previous = 0
+    current = 0
+end
+
+-- Weight the previous window by the share still covered by the sliding window
+local estimated = previous * (window_ms - offset) / window_ms + current
+
+local allowed = 0
+local retry_ms = 0
+
+if estimated + cost <= max_requests then
+    allowed = 1
+    if apply == 1 then
+        current = current + cost
+        estimated = estimated + cost
+        redis.call('HMSET', key, 'window', window, 'current', current, 'previous', previous)
+        redis.call('PEXPIRE', key, window_ms * 2)
+    end
+else
+    local room = max_requests - cost - current
+    if room >= 0 and previous > 0 then
+        -- Wait within this window until the previous window has decayed enough
+        retry_ms = math.ceil((1 - room / previous) * window_ms) - offset
+    else
+        -- Wait for the next window, where the current count becomes the previous one
+        retry_ms = window_ms - offset
+        local next_room = max_requests - cost
+        if next_room < 0 then
+            retry_ms = retry_ms + window_ms
+        elseif current > next_room then
+            retry_ms = retry_ms + math.ceil((1 - next_room / current) * window_ms)
+        end
+    end
+    if retry_ms < 0 then
+        retry_ms = 0
+    end
+end
+
+-- Time until both windows have fully decayed
+local reset_ms = 0
+if current > 0 then
+    reset_ms = 2 * window_ms - offset
+elseif previous > 0 then
+    reset_ms = window_ms - offset
+end
+
+return {allowed, tostring(estimated), retry_ms, reset_ms}
+`
@@ -226,6 +226,190 @@ func TestSlidingWindow_ConcurrencyTest(t *testing.T) {
 	t.Logf("Sliding window concurrency test: %d successes, %d failures", successCount, failureCount)
 }
 
+func TestSlidingWindow_SameMillisecond(t *testing.T) {
+	sw := createTestSlidingWindow(t, 1*time.Minute, 100)
+	defer sw.Close()
+
+	ctx := context.Background()
+	key := "same_millisecond_test"
+	sw.ClearWindow(ctx, key)
+
+	const numGoroutines = 300
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successCount := 0
+	start := make(chan struct{})
+
+	// Release every goroutine at once so most requests land in the same millisecond
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			<-start
+
+			result, err := sw.IsAllowed(ctx, key)
+			if err != nil {
+				t.Errorf("IsAllowed failed in goroutine %d: %v", index, err)
+				return
+			}
+
+			mu.Lock()
+			if result.Allowed {
+				successCount++
+			}
+			mu.Unlock()
+		}(i)
+	}
+
+	close(start)
+	wg.Wait()
+
+	if successCount != 100 {
+		t.Errorf("Expected exactly 100 successful requests, got %d", successCount)
+	}
+
+	// Every allowed request has its own entry in the log
+	count, err := sw.client.ZCard(ctx, sw.keyName(key)).Result()
+	if err != nil {
+		t.Fatalf("ZCARD failed: %v", err)
+	}
+	if count != 100 {
+		t.Errorf("Expected 100 log entries, got %d", count)
+	}
+}
+
+func TestSlidingWindow_SameMillisecondAcrossInstances(t *testing.T) {
+	first := createTestSlidingWindow(t, 1*time.Minute, 10)
+	defer first.Close()
+	second := createTestSlidingWindow(t, 1*time.Minute, 10)
+	defer second.Close()
+
+	ctx := context.Background()
+	key := "same_millisecond_instances_test"
+	first.ClearWindow(ctx, key)
+
+	// Both instances start their sequence at the same number, so only the instance ID tells them apart
+	for i := 0; i < 5; i++ {
+		if result, err := first.IsAllowed(ctx, key); err != nil || !result.Allowed {
+			t.Fatalf("Expected request %d on the first instance to be allowed: %v", i+1, err)
+		}
+		if result, err := second.IsAllowed(ctx, key); err != nil || !result.Allowed {
+			t.Fatalf("Expected request %d on the second instance to be allowed: %v", i+1, err)
+		}
+	}
+
+	state, err := first.GetWindowState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetWindowState failed: %v", err)
+	}
+	if state.CurrentCount != 10 || state.Allowed {
+		t.Errorf("Expected a full window of 10 requests, got %+v", state)
+	}
+}
+
+// skewedClock is a host clock that runs ahead of or behind the real time
+type skewedClock struct {
+	offset time.Duration
+}
+
+func (c skewedClock) Now() time.Time {
+	return time.Now().Add(c.offset)
+}
+
+func TestSlidingWindow_ClockSkew(t *testing.T) {
+	ahead := createTestSlidingWindow(t, 500*time.Millisecond, 3)
+	defer ahead.Close()
+	behind := createTestSlidingWindow(t, 500*time.Millisecond, 3)
+	defer behind.Close()
+
+	// Two instances whose host clocks are a minute apart
+	ahead.clock = skewedClock{offset: 30 * time.Second}
+	behind.clock = skewedClock{offset: -30 * time.Second}
+
+	ctx := context.Background()
+	key := "clock_skew_test"
+	ahead.ClearWindow(ctx, key)
+
+	for i := 0; i < 3; i++ {
+		if result, err := ahead.IsAllowed(ctx, key); err != nil || !result.Allowed {
+			t.Fatalf("Expected request %d on the fast instance to be allowed: %v", i+1, err)
+		}
+	}
+
+	// The slow instance sees the same full window
+	result, err := behind.IsAllowed(ctx, key)
+	if err != nil {
+		t.Fatalf("IsAllowed failed: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected the slow instance to be denied by the fast instance's requests")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 0.5 {
+		t.Errorf("Expected RetryAfter within the window, got %.3f", result.RetryAfter)
+	}
+
+	aheadState, err := ahead.GetWindowState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetWindowState failed: %v", err)
+	}
+	behindState, err := behind.GetWindowState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetWindowState failed: %v", err)
+	}
+	if diff := aheadState.WindowEnd - behindState.WindowEnd; diff < -100 || diff > 100 {
+		t.Errorf("Expected both instances to use the Redis clock, window ends differ by %dms", diff)
+	}
+
+	// Entries recorded by the fast instance expire on schedule for the slow one
+	time.Sleep(600 * time.Millisecond)
+
+	result, err = behind.IsAllowed(ctx, key)
+	if err != nil {
+		t.Fatalf("IsAllowed failed: %v", err)
+	}
+	if !result.Allowed || result.CurrentCount != 1 {
+		t.Errorf("Expected a fresh window on the slow instance, got %+v", result)
+	}
+}
+
+func TestSlidingWindow_WeightedCost(t *testing.T) {
+	sw := createTestSlidingWindow(t, 1*time.Minute, 10)
+	defer sw.Close()
+
+	ctx := context.Background()
+	key := "weighted_sliding_test"
+	sw.ClearWindow(ctx, key)
+
+	tests := []struct {
+		cost      int64
+		allowed   bool
+		wantCount int64
+	}{
+		{cost: 4, allowed: true, wantCount: 4},
+		{cost: 5, allowed: true, wantCount: 9},
+		{cost: 2, allowed: false, wantCount: 9},
+		{cost: 1, allowed: true, wantCount: 10},
+		{cost: 1, allowed: false, wantCount: 10},
+	}
+
+	for i, tt := range tests {
+		result, err := sw.IsAllowedN(ctx, key, tt.cost)
+		if err != nil {
+			t.Fatalf("IsAllowedN failed: %v", err)
+		}
+		if result.Allowed != tt.allowed || result.CurrentCount != tt.wantCount {
+			t.Errorf("Step %d (cost %d): expected allowed=%v count=%d, got allowed=%v count=%d",
+				i+1, tt.cost, tt.allowed, tt.wantCount, result.Allowed, result.CurrentCount)
+		}
+	}
+
+	// A cost larger than the window can never be allowed
+	if _, err := sw.IsAllowedN(ctx, key, 11); err == nil {
+		t.Error("Expected error for a cost above MaxRequests")
+	}
+}
+
 func BenchmarkSlidingWindow_IsAllowed(b *testing.B) {
 	sw := createTestSlidingWindow(b, 1*time.Minute, 1000000)
 	defer sw.Close()
@@ -267,7 +451,7 @@ func BenchmarkSlidingWindow_GetState(b *testing.B) {
 	})
 }
 
-// Benchmark comparison between token bucket and sliding window
+// Benchmark comparison between token bucket, sliding window and the window counters
 func BenchmarkComparison_TokenBucketVsSlidingWindow(b *testing.B) {
 	// Token bucket setup
 	tb := createTestBucket(b, 1000, 1000.0)
@@ -277,6 +461,12 @@ func BenchmarkComparison_TokenBucketVsSlidingWindow(b *testing.B) {
 	sw := createTestSlidingWindow(b, 1*time.Second, 1000)
 	defer sw.Close()
 
+	// Window counter setup
+	fw := createTestFixedWindow(b, 1*time.Second, 1000)
+	defer fw.Close()
+	sc := createTestSlidingWindowCounter(b, 1*time.Second, 1000)
+	defer sc.Close()
+
 	ctx := context.Background()
 
 	b.Run("TokenBucket", func(b *testing.B) {
@@ -306,4 +496,32 @@ func BenchmarkComparison_TokenBucketVsSlidingWindow(b *testing.B) {
 			}
 		})
 	})
+
+	b.Run("FixedWindow", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				key := fmt.Sprintf("fw_bench_%d", i%10)
+				_, err := fw.Allow(ctx, key, 1)
+				if err != nil {
+					b.Errorf("Allow failed: %v", err)
+				}
+				i++
+			}
+		})
+	})
+
+	b.Run("SlidingWindowCounter", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				key := fmt.Sprintf("sc_bench_%d", i%10)
+				_, err := sc.Allow(ctx, key, 1)
+				if err != nil {
+					b.Errorf("Allow failed: %v", err)
+				}
+				i++
+			}
+		})
+	})
 }
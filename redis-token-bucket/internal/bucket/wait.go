@@ -0,0 +1,114 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Waiter is implemented by limiters that can delay a request until it fits
+// instead of rejecting it immediately
+type Waiter interface {
+	// Wait blocks for at most maxWait until n units are available for the given key
+	Wait(ctx context.Context, key string, n float64, maxWait time.Duration) (*Result, error)
+}
+
+var _ Waiter = (*RedisTokenBucket)(nil)
+
+// WaitTokens reserves the specified number of tokens and blocks until they are available.
+// The tokens are taken from Redis up front, possibly putting the bucket into debt, so
+// concurrent callers are queued in arrival order across instances. If the wait would
+// exceed maxWait (or the context deadline) nothing is reserved and the result is denied
+// with RetryAfter set. If the context is cancelled while waiting, the tokens are refunded.
+func (tb *RedisTokenBucket) WaitTokens(ctx context.Context, key string, tokens float64, maxWait time.Duration) (*TokenResult, error) {
+	if tokens <= 0 {
+		return nil, fmt.Errorf("tokens must be positive")
+	}
+
+	// Never reserve tokens we cannot wait for
+	if deadline, ok := ctx.Deadline(); ok {
+		if untilDeadline := time.Until(deadline); untilDeadline < maxWait {
+			maxWait = untilDeadline
+		}
+	}
+	if maxWait < 0 {
+		maxWait = 0
+	}
+
+	tokenResult, wait, err := tb.reserveTokens(ctx, key, tokens, maxWait.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	if !tokenResult.Allowed {
+		if wait > 0 {
+			tokenResult.RetryAfter = wait
+		}
+		return tokenResult, nil
+	}
+
+	if wait > 0 {
+		timer := time.NewTimer(time.Duration(wait * float64(time.Second)))
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			// Give the reservation back so it is not lost; the request context is gone
+			refundCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := tb.RefundTokens(refundCtx, key, tokens); err != nil {
+				return nil, fmt.Errorf("%w (refund failed: %v)", ctx.Err(), err)
+			}
+			return nil, ctx.Err()
+		}
+	}
+
+	return tokenResult, nil
+}
+
+// reserveTokens runs the reserve tokens script and returns the result with the wait in seconds.
+// A negative maxWait reserves the tokens however long the wait is.
+func (tb *RedisTokenBucket) reserveTokens(ctx context.Context, key string, tokens float64, maxWait float64) (*TokenResult, float64, error) {
+	policyArg, capacity, refillRate, err := tb.policyArgs(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Run the reserve tokens Lua script
+	result, err := runScript(ctx, tb.client, tb.luaScripts["reserve_tokens"], "reserve_tokens", tb.scriptKeys(key),
+		policyArg, tokens, capacity, refillRate, tb.config.TTL.Seconds(), maxWait).Result()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to reserve tokens: %w", err)
+	}
+
+	values := result.([]interface{})
+
+	return &TokenResult{
+		Allowed:         parseInt64(values[0]) == 1,
+		RemainingTokens: parseFloat64(values[1]),
+		Capacity:        parseInt64(values[3]),
+		RefillRate:      parseFloat64(values[4]),
+		Policy:          parseString(values[5]),
+	}, parseFloat64(values[2]), nil
+}
+
+// Wait implements Waiter by waiting for tokens from the bucket
+func (tb *RedisTokenBucket) Wait(ctx context.Context, key string, n float64, maxWait time.Duration) (*Result, error) {
+	result, err := tb.WaitTokens(ctx, key, n, maxWait)
+	if err != nil {
+		return nil, err
+	}
+
+	// A bucket in debt has nothing left to offer
+	return &Result{
+		Allowed:    result.Allowed,
+		Remaining:  math.Max(0, result.RemainingTokens),
+		Limit:      result.Capacity,
+		ResetAt:    resetAt(result.RemainingTokens, result.Capacity, result.RefillRate),
+		Window:     refillWindow(result.Capacity, result.RefillRate),
+		RetryAfter: result.RetryAfter,
+		Policy:     result.Policy,
+	}, nil
+}
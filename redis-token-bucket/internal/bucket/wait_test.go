@@ -0,0 +1,179 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWaitTokens_ImmediateWhenAvailable(t *testing.T) {
+	tb := createTestBucket(t, 10, 1.0) // 10 tokens, 1 token/sec
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "wait_immediate"
+	tb.ResetBucket(ctx, key)
+
+	start := time.Now()
+	result, err := tb.WaitTokens(ctx, key, 3, time.Second)
+	if err != nil {
+		t.Fatalf("WaitTokens failed: %v", err)
+	}
+	if !result.Allowed {
+		t.Error("Expected tokens to be granted")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected no wait with tokens available, waited %v", elapsed)
+	}
+	if result.RemainingTokens != 7 {
+		t.Errorf("Expected 7 remaining tokens, got %.1f", result.RemainingTokens)
+	}
+}
+
+func TestWaitTokens_WaitsForRefill(t *testing.T) {
+	tb := createTestBucket(t, 5, 10.0) // 5 tokens, 10 tokens/sec
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "wait_refill"
+	tb.ResetBucket(ctx, key)
+
+	// Drain the bucket
+	if _, err := tb.TakeTokens(ctx, key, 5); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+
+	// Two more tokens take ~200ms to refill
+	start := time.Now()
+	result, err := tb.WaitTokens(ctx, key, 2, time.Second)
+	if err != nil {
+		t.Fatalf("WaitTokens failed: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	if !result.Allowed {
+		t.Error("Expected tokens to be granted after waiting")
+	}
+	if elapsed < 150*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("Expected to wait about 200ms, waited %v", elapsed)
+	}
+}
+
+func TestWaitTokens_DeniedBeyondMaxWait(t *testing.T) {
+	tb := createTestBucket(t, 5, 1.0) // 5 tokens, 1 token/sec
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "wait_denied"
+	tb.ResetBucket(ctx, key)
+
+	if _, err := tb.TakeTokens(ctx, key, 5); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+
+	// Three tokens need ~3s, more than we are willing to wait
+	start := time.Now()
+	result, err := tb.WaitTokens(ctx, key, 3, 500*time.Millisecond)
+	if err != nil {
+		t.Fatalf("WaitTokens failed: %v", err)
+	}
+	if result.Allowed {
+		t.Error("Expected request to be denied when the wait exceeds maxWait")
+	}
+	if result.RetryAfter < 2.5 {
+		t.Errorf("Expected RetryAfter of about 3s, got %.2f", result.RetryAfter)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected denial without waiting, waited %v", elapsed)
+	}
+
+	// Nothing was reserved
+	state, err := tb.GetBucketState(ctx, key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.CurrentTokens < 0 {
+		t.Errorf("Expected no debt after a denied wait, got %.2f tokens", state.CurrentTokens)
+	}
+}
+
+func TestWaitTokens_CancelRefunds(t *testing.T) {
+	tb := createTestBucket(t, 5, 1.0) // 5 tokens, 1 token/sec
+	defer tb.Close()
+
+	key := "wait_cancel"
+	tb.ResetBucket(context.Background(), key)
+
+	if _, err := tb.TakeTokens(context.Background(), key, 5); err != nil {
+		t.Fatalf("TakeTokens failed: %v", err)
+	}
+
+	// Cancel well before the two tokens could refill
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := tb.WaitTokens(ctx, key, 2, 5*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	// The reservation was returned, so the bucket is not in debt
+	state, err := tb.GetBucketState(context.Background(), key)
+	if err != nil {
+		t.Fatalf("GetBucketState failed: %v", err)
+	}
+	if state.CurrentTokens < 0 {
+		t.Errorf("Expected reservation to be refunded, got %.2f tokens", state.CurrentTokens)
+	}
+}
+
+func TestWaitTokens_QueuesConcurrentWaiters(t *testing.T) {
+	tb := createTestBucket(t, 2, 10.0) // 2 tokens, 10 tokens/sec
+	defer tb.Close()
+
+	ctx := context.Background()
+	key := "wait_queue"
+	tb.ResetBucket(ctx, key)
+
+	const numWaiters = 6
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	granted := 0
+
+	// 2 tokens are available now and 4 more arrive over ~400ms
+	start := time.Now()
+	for i := 0; i < numWaiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			result, err := tb.WaitTokens(ctx, key, 1, time.Second)
+			if err != nil {
+				t.Errorf("WaitTokens failed: %v", err)
+				return
+			}
+
+			mu.Lock()
+			if result.Allowed {
+				granted++
+			}
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if granted != numWaiters {
+		t.Errorf("Expected all %d waiters to be granted, got %d", numWaiters, granted)
+	}
+	if elapsed < 300*time.Millisecond {
+		t.Errorf("Expected waiters to be spread over the refill, finished in %v", elapsed)
+	}
+}
@@ -1,10 +1,16 @@
 package handler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"time"
+
+	"redis-token-bucket/internal/bucket"
 )
 
 // ResetBucket handles POST /api/reset - resets a bucket to full capacity
@@ -20,7 +26,7 @@ func (h *Handler) ResetBucket(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Reset the bucket
-	err := h.bucket.ResetBucket(ctx, key)
+	err := h.bucket.Reset(ctx, key)
 	if err != nil {
 		h.writeErrorResponse(w, http.StatusInternalServerError, "bucket_error",
 			fmt.Sprintf("Failed to reset bucket: %v", err))
@@ -36,48 +42,144 @@ func (h *Handler) ResetBucket(w http.ResponseWriter, r *http.Request) {
 	h.writeJSONResponse(w, http.StatusOK, response)
 }
 
-// BulkConsume handles POST /api/bulk-consume - for testing purposes
+// maxBulkItems caps the number of items in one bulk consume request, and maxBulkBodyBytes the
+// size of its body, which is read before the items can be counted
+const (
+	maxBulkItems     = 1000
+	maxBulkBodyBytes = 1 << 20
+)
+
+// BulkConsumeRequest represents the body for consuming tokens for many keys at once. A bare
+// JSON array of items is accepted as well, with ?atomic=true for an atomic batch.
+type BulkConsumeRequest struct {
+	Items  []bucket.BatchItem `json:"items"`
+	Atomic bool               `json:"atomic"`
+}
+
+// BulkConsumeResponse represents the per-item results of a bulk consume request
+type BulkConsumeResponse struct {
+	*bucket.BatchResult
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+// BulkConsume handles POST /api/bulk-consume - consumes tokens for a batch of keys in one
+// Redis round trip. Items are decided on their own unless the batch is atomic.
 func (h *Handler) BulkConsume(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	if err := r.ParseForm(); err != nil {
-		h.writeErrorResponse(w, http.StatusBadRequest, "parse_error", "Failed to parse request")
+	limiter, ok := h.bucket.(bucket.BatchLimiter)
+	if !ok {
+		h.writeErrorResponse(w, http.StatusNotImplemented, "bulk_unsupported",
+			"The configured limiter does not support bulk consumption")
 		return
 	}
 
-	// For simplicity, using query parameters for bulk test
-	key := r.URL.Query().Get("key")
-	if key == "" {
-		h.writeErrorResponse(w, http.StatusBadRequest, "missing_key", "Key parameter is required")
+	var body json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBulkBodyBytes)).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.writeErrorResponse(w, http.StatusRequestEntityTooLarge, "body_too_large",
+				fmt.Sprintf("Request body must not exceed %d bytes", maxBulkBodyBytes))
+			return
+		}
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_json", "Request body must be valid JSON")
 		return
 	}
 
-	// Simulate multiple rapid requests
-	results := make([]interface{}, 10)
-	for i := 0; i < 10; i++ {
-		result, err := h.bucket.TakeTokens(ctx, key, 1)
-		if err != nil {
-			results[i] = map[string]interface{}{
-				"attempt": i + 1,
-				"error":   err.Error(),
-			}
-		} else {
-			results[i] = map[string]interface{}{
-				"attempt":          i + 1,
-				"allowed":          result.Allowed,
-				"remaining_tokens": result.RemainingTokens,
-				"retry_after":      result.RetryAfter,
-			}
+	var req BulkConsumeRequest
+	var err error
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(trimmed, &req.Items)
+		req.Atomic = r.URL.Query().Get("atomic") == "true"
+	} else {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_json",
+			"Request body must be an array of items or an object with items")
+		return
+	}
+
+	if len(req.Items) == 0 {
+		h.writeErrorResponse(w, http.StatusBadRequest, "missing_items", "At least one item is required")
+		return
+	}
+	if len(req.Items) > maxBulkItems {
+		h.writeErrorResponse(w, http.StatusBadRequest, "too_many_items",
+			fmt.Sprintf("At most %d items are allowed per request", maxBulkItems))
+		return
+	}
+	for i := range req.Items {
+		if req.Items[i].Key == "" {
+			h.writeErrorResponse(w, http.StatusBadRequest, "missing_key",
+				fmt.Sprintf("Item %d has no key", i))
+			return
+		}
+
+		// Default to 1 token
+		if req.Items[i].Tokens == 0 {
+			req.Items[i].Tokens = 1
+		}
+		if req.Items[i].Tokens < 0 {
+			h.writeErrorResponse(w, http.StatusBadRequest, "invalid_tokens",
+				fmt.Sprintf("Item %d: tokens must be a positive number", i))
+			return
 		}
 	}
 
-	response := map[string]interface{}{
-		"success": true,
-		"message": "Bulk consumption test completed",
-		"key":     key,
-		"results": results,
+	result, err := limiter.TakeTokensBatch(ctx, req.Items, req.Atomic)
+	if errors.Is(err, bucket.ErrPolicyNotFound) {
+		h.writeErrorResponse(w, http.StatusNotFound, "policy_not_found", err.Error())
+		return
+	}
+	if errors.Is(err, bucket.ErrConflictingPolicies) {
+		h.writeErrorResponse(w, http.StatusBadRequest, "conflicting_policies", err.Error())
+		return
+	}
+	if errors.Is(err, bucket.ErrCrossSlot) {
+		h.writeErrorResponse(w, http.StatusBadRequest, "cross_slot", err.Error())
+		return
+	}
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "bucket_error",
+			fmt.Sprintf("Failed to consume tokens: %v", err))
+		return
 	}
 
-	h.writeJSONResponse(w, http.StatusOK, response)
+	response := BulkConsumeResponse{
+		BatchResult: result,
+		Success:     true,
+	}
+
+	statusCode := http.StatusOK
+	switch {
+	case result.Allowed:
+		response.Message = fmt.Sprintf("All %d items were allowed", len(result.Items))
+	case req.Atomic:
+		// Nothing was consumed, so the batch as a whole is rate limited
+		response.Success = false
+		response.Message = fmt.Sprintf("Rate limit exceeded at item %d ('%s'); nothing was consumed",
+			result.DeniedIndex, result.Items[result.DeniedIndex].Key)
+		statusCode = http.StatusTooManyRequests
+
+		var retryAfter float64
+		for _, item := range result.Items {
+			retryAfter = math.Max(retryAfter, item.RetryAfter)
+		}
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(retryAfter)))
+		}
+	default:
+		denied := 0
+		for _, item := range result.Items {
+			if !item.Allowed {
+				denied++
+			}
+		}
+		response.Message = fmt.Sprintf("%d of %d items were rate limited", denied, len(result.Items))
+	}
+
+	h.writeJSONResponse(w, statusCode, response)
 }
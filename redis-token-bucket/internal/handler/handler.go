@@ -4,42 +4,147 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 
 	"redis-token-bucket/internal/bucket"
+	"redis-token-bucket/internal/headers"
+	"redis-token-bucket/internal/metrics"
 )
 
-// Handler contains the HTTP handlers for the token bucket API
+// Handler contains the HTTP handlers for the rate limiter API
 type Handler struct {
-	bucket *bucket.RedisTokenBucket
+	bucket     bucket.Limiter
+	penalties  *bucket.RedisPenaltyBox // Optional; enables the block endpoints
+	headerMode headers.Mode            // Which rate limit headers check and consume send
 }
 
-// NewHandler creates a new HTTP handler
-func NewHandler(tb *bucket.RedisTokenBucket) *Handler {
+// NewHandler creates a new HTTP handler backed by any Limiter implementation
+func NewHandler(limiter bucket.Limiter) *Handler {
 	return &Handler{
-		bucket: tb,
+		bucket: limiter,
 	}
 }
 
+// SetHeaderMode selects the rate limit headers sent by the check and consume endpoints
+func (h *Handler) SetHeaderMode(mode headers.Mode) {
+	h.headerMode = mode
+}
+
 // ErrorResponse represents an error response
 type ErrorResponse struct {
 	Error   string `json:"error"`
 	Message string `json:"message,omitempty"`
 }
 
-// CheckRateResponse represents the response for checking bucket state
+// CheckRateResponse represents the response for checking bucket state. The bucket fields
+// of the original token bucket response are kept next to the Limiter result.
 type CheckRateResponse struct {
-	*bucket.BucketState
-	Success bool `json:"success"`
+	*bucket.Result
+	Key     string `json:"key"`
+	Success bool   `json:"success"`
+
+	CurrentTokens  float64    `json:"current_tokens"`
+	Capacity       int64      `json:"capacity"`
+	RefillRate     float64    `json:"refill_rate"`
+	LastRefillTime *time.Time `json:"last_refill_time,omitempty"` // Token buckets only
+	TTL            int64      `json:"ttl_seconds,omitempty"`      // Token buckets only
 }
 
-// ConsumeResponse represents the response for token consumption
+// ConsumeResponse represents the response for token consumption. The bucket fields of the
+// original token bucket response are kept next to the Limiter result.
 type ConsumeResponse struct {
-	*bucket.TokenResult
+	*bucket.Result
 	Success bool   `json:"success"`
 	Message string `json:"message,omitempty"`
+
+	RemainingTokens float64 `json:"remaining_tokens"`
+	Capacity        int64   `json:"capacity"`
+	RefillRate      float64 `json:"refill_rate"`
+}
+
+// stateReader is implemented by the token buckets, whose check response reports the bucket
+// state as it is stored
+type stateReader interface {
+	GetBucketState(ctx context.Context, key string) (*bucket.BucketState, error)
+}
+
+// tokenTaker is implemented by the token buckets, whose consume response reports the bucket
+// as it is stored
+type tokenTaker interface {
+	TakeTokens(ctx context.Context, key string, tokens float64) (*bucket.TokenResult, error)
+}
+
+// rate returns the units a limiter grants per second
+func rate(result *bucket.Result) float64 {
+	if result.Window <= 0 {
+		return 0
+	}
+	return float64(result.Limit) / result.Window
+}
+
+// peek returns the check response of a key
+func (h *Handler) peek(ctx context.Context, key string) (*CheckRateResponse, error) {
+	if tb, ok := h.bucket.(stateReader); ok {
+		state, err := tb.GetBucketState(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return &CheckRateResponse{
+			Result:         state.Result(),
+			Key:            key,
+			Success:        true,
+			CurrentTokens:  state.CurrentTokens,
+			Capacity:       state.Capacity,
+			RefillRate:     state.RefillRate,
+			LastRefillTime: &state.LastRefillTime,
+			TTL:            state.TTL,
+		}, nil
+	}
+
+	result, err := h.bucket.Peek(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &CheckRateResponse{
+		Result:        result,
+		Key:           key,
+		Success:       true,
+		CurrentTokens: result.Remaining,
+		Capacity:      result.Limit,
+		RefillRate:    rate(result),
+	}, nil
+}
+
+// consume takes tokens from a key and returns the consume response
+func (h *Handler) consume(ctx context.Context, key string, tokens float64) (*ConsumeResponse, error) {
+	if tb, ok := h.bucket.(tokenTaker); ok {
+		result, err := tb.TakeTokens(ctx, key, tokens)
+		if err != nil {
+			return nil, err
+		}
+		return &ConsumeResponse{
+			Result:          result.Result(time.Now()),
+			Success:         result.Allowed,
+			RemainingTokens: result.RemainingTokens,
+			Capacity:        result.Capacity,
+			RefillRate:      result.RefillRate,
+		}, nil
+	}
+
+	result, err := h.bucket.Allow(ctx, key, tokens)
+	if err != nil {
+		return nil, err
+	}
+	return &ConsumeResponse{
+		Result:          result,
+		Success:         result.Allowed,
+		RemainingTokens: result.Remaining,
+		Capacity:        result.Limit,
+		RefillRate:      rate(result),
+	}, nil
 }
 
 // writeErrorResponse writes an error response
@@ -72,17 +177,14 @@ func (h *Handler) CheckRate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get bucket state
-	state, err := h.bucket.GetBucketState(ctx, key)
+	response, err := h.peek(ctx, key)
 	if err != nil {
 		h.writeErrorResponse(w, http.StatusInternalServerError, "bucket_error",
 			fmt.Sprintf("Failed to get bucket state: %v", err))
 		return
 	}
 
-	response := CheckRateResponse{
-		BucketState: state,
-		Success:     true,
-	}
+	headers.Set(w.Header(), h.headerMode, response.Result)
 
 	h.writeJSONResponse(w, http.StatusOK, response)
 }
@@ -113,16 +215,19 @@ func (h *Handler) ConsumeTokens(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Attempt to consume tokens
-	result, err := h.bucket.TakeTokens(ctx, key, tokens)
+	response, err := h.consume(ctx, key, tokens)
 	if err != nil {
+		metrics.ObserveDecision(r, "", metrics.DecisionError)
 		h.writeErrorResponse(w, http.StatusInternalServerError, "bucket_error",
 			fmt.Sprintf("Failed to consume tokens: %v", err))
 		return
 	}
 
-	response := ConsumeResponse{
-		TokenResult: result,
-		Success:     result.Allowed,
+	result := response.Result
+	if result.Allowed {
+		metrics.ObserveDecision(r, result.Policy, metrics.DecisionAllowed)
+	} else {
+		metrics.ObserveDecision(r, result.Policy, metrics.DecisionDenied)
 	}
 
 	if result.Allowed {
@@ -131,13 +236,15 @@ func (h *Handler) ConsumeTokens(w http.ResponseWriter, r *http.Request) {
 		response.Message = "Rate limit exceeded"
 	}
 
+	headers.Set(w.Header(), h.headerMode, result)
+
 	// Set appropriate HTTP status code
 	statusCode := http.StatusOK
 	if !result.Allowed {
 		statusCode = http.StatusTooManyRequests
 		// Add Retry-After header if available
 		if result.RetryAfter > 0 {
-			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", result.RetryAfter))
+			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(result.RetryAfter)))
 		}
 	}
 
@@ -32,7 +32,7 @@ func createTestHandler(t *testing.T) *Handler {
 	defer cancel()
 
 	// Reset any test buckets
-	tb.ResetBucket(ctx, "test_user")
+	tb.Reset(ctx, "test_user")
 
 	return NewHandler(tb)
 }
@@ -82,8 +82,8 @@ func TestHandler_CheckRate(t *testing.T) {
 	if !response.Success {
 		t.Error("Expected success to be true")
 	}
-	if response.CurrentTokens != 10 {
-		t.Errorf("Expected 10 tokens, got %.1f", response.CurrentTokens)
+	if response.Remaining != 10 {
+		t.Errorf("Expected 10 tokens, got %.1f", response.Remaining)
 	}
 
 	// Test without key parameter
@@ -97,6 +97,35 @@ func TestHandler_CheckRate(t *testing.T) {
 	}
 }
 
+func TestHandler_KeepsBucketFields(t *testing.T) {
+	h := createTestHandler(t)
+	defer h.bucket.Close()
+
+	fields := func(w *httptest.ResponseRecorder) map[string]interface{} {
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return body
+	}
+
+	w := httptest.NewRecorder()
+	h.ConsumeTokens(w, httptest.NewRequest("POST", "/api/consume?key=fields_user&tokens=3", nil))
+	consumed := fields(w)
+	if consumed["remaining_tokens"] != 7.0 || consumed["capacity"] != 10.0 || consumed["refill_rate"] != 2.0 {
+		t.Errorf("Expected the bucket fields next to the result, got %v", consumed)
+	}
+
+	w = httptest.NewRecorder()
+	h.CheckRate(w, httptest.NewRequest("GET", "/api/check?key=fields_user", nil))
+	checked := fields(w)
+	for _, field := range []string{"current_tokens", "capacity", "refill_rate", "last_refill_time", "ttl_seconds", "remaining", "limit"} {
+		if _, ok := checked[field]; !ok {
+			t.Errorf("Expected %s in the check response, got %v", field, checked)
+		}
+	}
+}
+
 func TestHandler_ConsumeTokens(t *testing.T) {
 	h := createTestHandler(t)
 	defer h.bucket.Close()
@@ -122,8 +151,17 @@ func TestHandler_ConsumeTokens(t *testing.T) {
 	if !response.Allowed {
 		t.Error("Expected consumption to be allowed")
 	}
-	if response.RemainingTokens != 7 {
-		t.Errorf("Expected 7 remaining tokens, got %.1f", response.RemainingTokens)
+	if response.Remaining != 7 {
+		t.Errorf("Expected 7 remaining tokens, got %.1f", response.Remaining)
+	}
+	if got := w.Header().Get("RateLimit-Policy"); got != `"default";q=10;w=5` {
+		t.Errorf("Expected RateLimit-Policy for the bucket capacity, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit"); !strings.HasPrefix(got, `"default";r=7;t=`) {
+		t.Errorf("Expected RateLimit with 7 remaining, got %q", got)
+	}
+	if got := w.Header().Get("X-RateLimit-Limit"); got != "10" {
+		t.Errorf("Expected X-RateLimit-Limit 10, got %q", got)
 	}
 
 	// Test consumption that exceeds capacity
@@ -186,8 +224,8 @@ func TestHandler_ResetBucket(t *testing.T) {
 		t.Fatalf("Failed to parse response: %v", err)
 	}
 
-	if checkResponse.CurrentTokens != 10 {
-		t.Errorf("Expected bucket to be reset to 10 tokens, got %.1f", checkResponse.CurrentTokens)
+	if checkResponse.Remaining != 10 {
+		t.Errorf("Expected bucket to be reset to 10 tokens, got %.1f", checkResponse.Remaining)
 	}
 }
 
@@ -195,32 +233,96 @@ func TestHandler_BulkConsume(t *testing.T) {
 	h := createTestHandler(t)
 	defer h.bucket.Close()
 
-	req := httptest.NewRequest("POST", "/api/bulk-consume?key=bulk_test", nil)
-	w := httptest.NewRecorder()
+	ctx := context.Background()
+	h.bucket.Reset(ctx, "bulk_a")
+	h.bucket.Reset(ctx, "bulk_b")
 
-	h.BulkConsume(w, req)
+	consume := func(target string, body string) (*httptest.ResponseRecorder, BulkConsumeResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.BulkConsume(w, httptest.NewRequest("POST", target, strings.NewReader(body)))
 
+		var response BulkConsumeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		return w, response
+	}
+
+	// Each item is decided on its own; the second draws from what the first left
+	w, response := consume("/api/bulk-consume",
+		`[{"key":"bulk_a","tokens":6},{"key":"bulk_a","tokens":6},{"key":"bulk_b"}]`)
+	if w.Code != http.StatusOK || response.BatchResult == nil || len(response.Items) != 3 {
+		t.Fatalf("Expected 200 with 3 results, got %d: %s", w.Code, w.Body.String())
+	}
+	if !response.Items[0].Allowed || response.Items[1].Allowed || !response.Items[2].Allowed || response.DeniedIndex != 1 {
+		t.Errorf("Expected only the second item to be denied, got %s", w.Body.String())
+	}
+
+	// An atomic batch with a denied item consumes nothing
+	w, response = consume("/api/bulk-consume",
+		`{"atomic":true,"items":[{"key":"bulk_b","tokens":2},{"key":"bulk_a","tokens":5}]}`)
+	if w.Code != http.StatusTooManyRequests || response.Success || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After, got %d: %s", w.Code, w.Body.String())
+	}
+	if result, _ := h.bucket.Peek(ctx, "bulk_b"); result == nil || result.Remaining < 8.9 {
+		t.Errorf("Expected bulk_b to keep its tokens, got %+v", result)
+	}
+
+	w, _ = consume("/api/bulk-consume?atomic=true", `[{"key":"bulk_b","tokens":2},{"key":"bulk_a","tokens":1}]`)
 	if w.Code != http.StatusOK {
-		t.Errorf("Expected status 200, got %d", w.Code)
+		t.Errorf("Expected the atomic batch to pass, got %d: %s", w.Code, w.Body.String())
 	}
 
-	var response map[string]interface{}
-	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
-		t.Fatalf("Failed to parse response: %v", err)
+	invalid := []struct {
+		body   string
+		status int
+	}{
+		{`[]`, http.StatusBadRequest},
+		{`[{"tokens":1}]`, http.StatusBadRequest},
+		{`[{"key":"bulk_a","tokens":-1}]`, http.StatusBadRequest},
+		{`{"items":"bulk_a"}`, http.StatusBadRequest},
+		{`[{"key":"bulk_a","policy":"bulk_missing"}]`, http.StatusNotFound},
+	}
+	for _, test := range invalid {
+		w := httptest.NewRecorder()
+		h.BulkConsume(w, httptest.NewRequest("POST", "/api/bulk-consume", strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.body, test.status, w.Code)
+		}
 	}
+}
 
-	if response["success"] != true {
-		t.Error("Expected success to be true")
+func TestHandler_BulkConsumeLimits(t *testing.T) {
+	h := createTestHandler(t)
+	defer h.bucket.Close()
+
+	items := strings.Repeat(`{"key":"bulk_limit"},`, maxBulkItems+1)
+	testCases := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"Too many items", "[" + strings.TrimSuffix(items, ",") + "]", http.StatusBadRequest, "too_many_items"},
+		{"Body too large", `[{"key":"` + strings.Repeat("a", maxBulkBodyBytes) + `"}]`, http.StatusRequestEntityTooLarge, "body_too_large"},
 	}
 
-	// Check that results array exists and has correct length
-	results, ok := response["results"].([]interface{})
-	if !ok {
-		t.Fatal("Expected results to be an array")
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.BulkConsume(w, httptest.NewRequest("POST", "/api/bulk-consume", strings.NewReader(tc.body)))
+
+			var response ErrorResponse
+			json.Unmarshal(w.Body.Bytes(), &response)
+			if w.Code != tc.status || response.Error != tc.code {
+				t.Errorf("Expected %d %s, got %d: %s", tc.status, tc.code, w.Code, w.Body.String())
+			}
+		})
 	}
 
-	if len(results) != 10 {
-		t.Errorf("Expected 10 results, got %d", len(results))
+	if result, _ := h.bucket.Peek(context.Background(), "bulk_limit"); result != nil && result.Remaining < 10 {
+		t.Errorf("Expected a rejected batch to consume nothing, got %+v", result)
 	}
 }
 
@@ -300,3 +402,315 @@ func TestHandler_ConcurrentRequests(t *testing.T) {
 		t.Errorf("Expected exactly 10 successful requests, got %d", successCount)
 	}
 }
+
+func TestHandler_Policies(t *testing.T) {
+	h := createTestHandler(t)
+	defer h.bucket.Close()
+
+	// Create a policy
+	body := strings.NewReader(`{"name":"handler_tier","capacity":3,"refill_rate":1}`)
+	req := httptest.NewRequest("POST", "/api/policies", body)
+	w := httptest.NewRecorder()
+	h.SetPolicy(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Assign it to a key prefix
+	body = strings.NewReader(`{"pattern":"handler_tier:*","policy":"handler_tier"}`)
+	req = httptest.NewRequest("POST", "/api/policies/assign", body)
+	w = httptest.NewRecorder()
+	h.AssignPolicy(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Consumption under the prefix is limited by the policy capacity
+	req = httptest.NewRequest("POST", "/api/consume?key=handler_tier:1&tokens=4", nil)
+	w = httptest.NewRecorder()
+	h.ConsumeTokens(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", w.Code)
+	}
+
+	var response ConsumeResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Limit != 3 || response.Policy != "handler_tier" {
+		t.Errorf("Expected limit 3 from handler_tier, got %d from %q", response.Limit, response.Policy)
+	}
+
+	// Invalid policies are rejected
+	req = httptest.NewRequest("POST", "/api/policies", strings.NewReader(`{"name":"bad","capacity":0}`))
+	w = httptest.NewRecorder()
+	h.SetPolicy(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+
+	// Delete the policy, then deleting again is a 404
+	req = httptest.NewRequest("DELETE", "/api/policies?name=handler_tier", nil)
+	w = httptest.NewRecorder()
+	h.DeletePolicy(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/policies?name=handler_tier", nil)
+	w = httptest.NewRecorder()
+	h.DeletePolicy(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+}
+
+func TestHandler_ConsumeHierarchy(t *testing.T) {
+	h := createTestHandler(t)
+	defer h.bucket.Close()
+
+	ctx := context.Background()
+	keys := []string{"hierarchy_global", "hierarchy_org:1", "hierarchy_user:1"}
+	for _, key := range keys {
+		h.bucket.Reset(ctx, key)
+	}
+
+	// Drain the user level so the next request is denied there
+	h.bucket.Allow(ctx, "hierarchy_user:1", 10)
+
+	body := strings.NewReader(`{"keys":["hierarchy_global","hierarchy_org:1","hierarchy_user:1"],"tokens":1}`)
+	req := httptest.NewRequest("POST", "/api/consume-hierarchy", body)
+	w := httptest.NewRecorder()
+	h.ConsumeHierarchy(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response ConsumeHierarchyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.DeniedKey != "hierarchy_user:1" || response.DeniedLevel != 2 {
+		t.Errorf("Expected denial at hierarchy_user:1, got %q (level %d)", response.DeniedKey, response.DeniedLevel)
+	}
+	if len(response.Levels) != 3 || response.Levels[0].RemainingTokens != 10 {
+		t.Errorf("Expected the global level to be untouched, got %+v", response.Levels)
+	}
+
+	// A request without keys is rejected
+	req = httptest.NewRequest("POST", "/api/consume-hierarchy", strings.NewReader(`{"keys":[]}`))
+	w = httptest.NewRecorder()
+	h.ConsumeHierarchy(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+
+	// So is a request naming a level twice
+	req = httptest.NewRequest("POST", "/api/consume-hierarchy", strings.NewReader(`{"keys":["hierarchy_global","hierarchy_global"]}`))
+	w = httptest.NewRecorder()
+	h.ConsumeHierarchy(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "duplicate_key") {
+		t.Errorf("Expected 400 duplicate_key, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandler_MemoryBackend(t *testing.T) {
+	clock := bucket.NewManualClock(time.Unix(1700000000, 0))
+	mb, err := bucket.NewMemoryTokenBucketWithClock(&bucket.Config{Capacity: 10, RefillRate: 2.0, TTL: time.Minute}, clock)
+	if err != nil {
+		t.Fatalf("NewMemoryTokenBucketWithClock failed: %v", err)
+	}
+	h := NewHandler(mb)
+	defer h.bucket.Close()
+
+	consume := func(tokens int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/consume?key=memory_user&tokens=%d", tokens), nil)
+		w := httptest.NewRecorder()
+		h.ConsumeTokens(w, req)
+		return w
+	}
+
+	if w := consume(10); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if w := consume(1); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", w.Code)
+	}
+
+	// 2 tokens/sec refills the bucket without sleeping
+	clock.Advance(5 * time.Second)
+
+	req := httptest.NewRequest("GET", "/api/check?key=memory_user", nil)
+	w := httptest.NewRecorder()
+	h.CheckRate(w, req)
+
+	var response CheckRateResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Remaining != 10 {
+		t.Errorf("Expected 10 remaining tokens after refill, got %.1f", response.Remaining)
+	}
+
+	// Hierarchical consumption is not supported by the memory backend
+	req = httptest.NewRequest("POST", "/api/consume-hierarchy", strings.NewReader(`{"keys":["a","b"],"tokens":1}`))
+	w = httptest.NewRecorder()
+	h.ConsumeHierarchy(w, req)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status 501, got %d", w.Code)
+	}
+}
+
+func TestHandler_QuotaUsage(t *testing.T) {
+	q, err := bucket.NewRedisQuota(&bucket.QuotaConfig{
+		RedisAddr: "localhost:6379",
+		RedisDB:   7, // Use quota test DB
+		Limit:     100,
+		Period:    bucket.QuotaMonthly,
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	h := NewHandler(q)
+	defer h.bucket.Close()
+
+	ctx := context.Background()
+	h.bucket.Reset(ctx, "quota_user")
+	h.bucket.Allow(ctx, "quota_user", 30)
+
+	req := httptest.NewRequest("GET", "/api/quota?key=quota_user", nil)
+	w := httptest.NewRecorder()
+	h.QuotaUsage(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response QuotaUsageResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Used != 30 || response.Remaining != 70 || response.Period != "month" {
+		t.Errorf("Expected 30 of 100 used this month, got %+v", response.QuotaResult)
+	}
+	if response.PeriodEnd.Day() != 1 {
+		t.Errorf("Expected the quota to reset on the 1st, got %v", response.PeriodEnd)
+	}
+
+	// A plain token bucket has no calendar quota
+	tb := createTestHandler(t)
+	defer tb.bucket.Close()
+
+	w = httptest.NewRecorder()
+	tb.QuotaUsage(w, httptest.NewRequest("GET", "/api/quota?key=test_user", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status 501, got %d", w.Code)
+	}
+}
+
+func TestHandler_AdminAuth(t *testing.T) {
+	h := createTestHandler(t)
+	defer h.bucket.Close()
+
+	h.bucket.Allow(context.Background(), "test_user", 3)
+	list := h.AdminAuth("s3cret")(http.HandlerFunc(h.ListBuckets))
+	disabled := h.AdminAuth("")(http.HandlerFunc(h.ListBuckets))
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		header  string
+		status  int
+	}{
+		{"no token configured", disabled, "Bearer s3cret", http.StatusForbidden},
+		{"missing credentials", list, "", http.StatusUnauthorized},
+		{"wrong token", list, "Bearer wrong", http.StatusUnauthorized},
+		{"valid token", list, "Bearer s3cret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/admin/buckets?namespace=token_bucket&pattern=test_user", nil)
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			test.handler.ServeHTTP(w, req)
+
+			if w.Code != test.status {
+				t.Errorf("Expected status %d, got %d: %s", test.status, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/api/admin/buckets/inspect?key=test_user", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	w := httptest.NewRecorder()
+	h.AdminAuth("s3cret")(http.HandlerFunc(h.InspectBucket)).ServeHTTP(w, req)
+
+	var response struct {
+		Key bucket.KeyInfo `json:"key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if response.Key.Key != "test_user" || response.Key.Tokens == nil || *response.Key.Tokens != 7 {
+		t.Errorf("Expected test_user with 7 tokens, got %s", w.Body.String())
+	}
+}
+
+func TestHandler_Blocks(t *testing.T) {
+	h := createTestHandler(t)
+	defer h.bucket.Close()
+
+	w := httptest.NewRecorder()
+	h.ListBlocks(w, httptest.NewRequest("GET", "/api/admin/blocks", nil))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status 501 without a penalty box, got %d", w.Code)
+	}
+
+	penalties, err := bucket.NewRedisPenaltyBox(&bucket.PenaltyConfig{
+		RedisAddr:       "localhost:6379",
+		RedisDB:         1,
+		Threshold:       1,
+		ViolationWindow: time.Second,
+		BlockDurations:  []time.Duration{time.Minute},
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	defer penalties.Close()
+	h.SetPenaltyBox(penalties)
+
+	ctx := context.Background()
+	penalties.Lift(ctx, "ip:10.8.0.1")
+	penalties.RecordViolation(ctx, "ip:10.8.0.1")
+
+	w = httptest.NewRecorder()
+	h.ListBlocks(w, httptest.NewRequest("GET", "/api/admin/blocks?pattern=ip:10.8.*", nil))
+	var response struct {
+		Blocks []bucket.Block `json:"blocks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(response.Blocks) != 1 || response.Blocks[0].Key != "ip:10.8.0.1" || response.Blocks[0].Level != 1 {
+		t.Errorf("Expected one block for ip:10.8.0.1, got %s", w.Body.String())
+	}
+
+	statuses := []int{http.StatusOK, http.StatusNotFound}
+	for _, status := range statuses {
+		w = httptest.NewRecorder()
+		h.LiftBlock(w, httptest.NewRequest("DELETE", "/api/admin/blocks?key=ip:10.8.0.1", nil))
+		if w.Code != status {
+			t.Errorf("Expected status %d, got %d: %s", status, w.Code, w.Body.String())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	h.LiftBlock(w, httptest.NewRequest("DELETE", "/api/admin/blocks", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a key, got %d", w.Code)
+	}
+}
@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"redis-token-bucket/internal/bucket"
+)
+
+// ConsumeHierarchyRequest represents the body for consuming tokens from several buckets at once
+type ConsumeHierarchyRequest struct {
+	Keys   []string `json:"keys"`
+	Tokens float64  `json:"tokens"`
+}
+
+// ConsumeHierarchyResponse represents the response for a multi-key token consumption
+type ConsumeHierarchyResponse struct {
+	*bucket.MultiTokenResult
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+}
+
+// ConsumeHierarchy handles POST /api/consume-hierarchy - consumes tokens from every key or none
+func (h *Handler) ConsumeHierarchy(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	limiter, ok := h.bucket.(bucket.HierarchicalLimiter)
+	if !ok {
+		h.writeErrorResponse(w, http.StatusNotImplemented, "hierarchy_unsupported",
+			"The configured limiter does not support multi-key consumption")
+		return
+	}
+
+	var req ConsumeHierarchyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_json", "Request body must be valid JSON")
+		return
+	}
+
+	if len(req.Keys) == 0 {
+		h.writeErrorResponse(w, http.StatusBadRequest, "missing_keys", "At least one key is required")
+		return
+	}
+	for _, key := range req.Keys {
+		if key == "" {
+			h.writeErrorResponse(w, http.StatusBadRequest, "missing_key", "Keys must not be empty")
+			return
+		}
+	}
+
+	// Default to 1 token
+	if req.Tokens == 0 {
+		req.Tokens = 1
+	}
+	if req.Tokens < 0 {
+		h.writeErrorResponse(w, http.StatusBadRequest, "invalid_tokens", "Tokens must be a positive number")
+		return
+	}
+
+	result, err := limiter.TakeTokensMulti(ctx, req.Keys, req.Tokens)
+	if errors.Is(err, bucket.ErrDuplicateKey) {
+		h.writeErrorResponse(w, http.StatusBadRequest, "duplicate_key", err.Error())
+		return
+	}
+	if errors.Is(err, bucket.ErrCrossSlot) {
+		h.writeErrorResponse(w, http.StatusBadRequest, "cross_slot", err.Error())
+		return
+	}
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "bucket_error",
+			fmt.Sprintf("Failed to consume tokens: %v", err))
+		return
+	}
+
+	response := ConsumeHierarchyResponse{
+		MultiTokenResult: result,
+		Success:          result.Allowed,
+	}
+
+	statusCode := http.StatusOK
+	if result.Allowed {
+		response.Message = fmt.Sprintf("Successfully consumed %.1f tokens from %d buckets", req.Tokens, len(req.Keys))
+	} else {
+		response.Message = fmt.Sprintf("Rate limit exceeded at '%s'", result.DeniedKey)
+		statusCode = http.StatusTooManyRequests
+		if result.RetryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", result.RetryAfter))
+		}
+	}
+
+	h.writeJSONResponse(w, statusCode, response)
+}
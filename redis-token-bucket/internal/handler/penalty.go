@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"redis-token-bucket/internal/bucket"
+)
+
+// SetPenaltyBox enables the block endpoints for the penalty box used by the rate limiter
+func (h *Handler) SetPenaltyBox(penalties *bucket.RedisPenaltyBox) {
+	h.penalties = penalties
+}
+
+// penaltyBox returns the penalty box, writing an error response if there is none
+func (h *Handler) penaltyBox(w http.ResponseWriter) (*bucket.RedisPenaltyBox, bool) {
+	if h.penalties == nil {
+		h.writeErrorResponse(w, http.StatusNotImplemented, "penalties_unsupported",
+			"Penalties are not enabled")
+		return nil, false
+	}
+	return h.penalties, true
+}
+
+// ListBlocks handles GET /api/admin/blocks - returns the active blocks, optionally filtered by
+// a client key pattern such as "ip:10.0.*"
+func (h *Handler) ListBlocks(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+
+	penalties, ok := h.penaltyBox(w)
+	if !ok {
+		return
+	}
+
+	blocks, err := penalties.ListBlocks(ctx, r.URL.Query().Get("pattern"))
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "list_failed",
+			fmt.Sprintf("Failed to list blocks: %v", err))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"blocks":  blocks,
+	})
+}
+
+// LiftBlock handles DELETE /api/admin/blocks?key= - lifts the block of a client and forgets
+// its earlier offences
+func (h *Handler) LiftBlock(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	penalties, ok := h.penaltyBox(w)
+	if !ok {
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		h.writeErrorResponse(w, http.StatusBadRequest, "missing_key", "Key parameter is required")
+		return
+	}
+
+	err := penalties.Lift(ctx, key)
+	if errors.Is(err, bucket.ErrNotBlocked) {
+		h.writeErrorResponse(w, http.StatusNotFound, "not_blocked",
+			fmt.Sprintf("Client %q is not blocked", key))
+		return
+	}
+	if err != nil {
+		h.writeErrorResponse(w, http.StatusInternalServerError, "lift_failed",
+			fmt.Sprintf("Failed to lift block: %v", err))
+		return
+	}
+
+	h.writeJSONResponse(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"key":     key,
+	})
+}
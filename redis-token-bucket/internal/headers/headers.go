@@ -0,0 +1,113 @@
+// Package headers writes rate limit response headers: the IETF RateLimit and RateLimit-Policy
+// fields (draft-ietf-httpapi-ratelimit-headers) and the legacy X-RateLimit-* fields
+package headers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"redis-token-bucket/internal/bucket"
+)
+
+// Mode selects which rate limit headers are written
+type Mode int
+
+const (
+	// Both writes the IETF and the legacy headers, so existing clients keep working
+	Both Mode = iota
+	// IETF writes RateLimit and RateLimit-Policy
+	IETF
+	// Legacy writes X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+	Legacy
+)
+
+// ParseMode parses "both", "ietf" or "legacy"
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "both", "":
+		return Both, nil
+	case "ietf":
+		return IETF, nil
+	case "legacy":
+		return Legacy, nil
+	}
+	return Both, fmt.Errorf("unknown rate limit header mode %q (want both, ietf or legacy)", s)
+}
+
+// String returns the name of the mode
+func (m Mode) String() string {
+	switch m {
+	case IETF:
+		return "ietf"
+	case Legacy:
+		return "legacy"
+	}
+	return "both"
+}
+
+// defaultPolicy names the policy of buckets without one
+const defaultPolicy = "default"
+
+// Set writes the rate limit headers for a limiter result. For a policy with quota q granted
+// over w seconds, r remaining and a reset in t seconds it writes
+//
+//	RateLimit-Policy: "<policy>";q=<q>;w=<w>
+//	RateLimit: "<policy>";r=<r>;t=<t>
+//	X-RateLimit-Limit: <q>
+//	X-RateLimit-Remaining: <r>
+//	X-RateLimit-Reset: <Unix time of the reset>
+func Set(h http.Header, mode Mode, result *bucket.Result) {
+	SetAt(h, mode, result, time.Now())
+}
+
+// SetAt is Set with the reset measured from the given time
+func SetAt(h http.Header, mode Mode, result *bucket.Result, now time.Time) {
+	remaining := int64(math.Max(0, math.Floor(result.Remaining)))
+	reset := int64(math.Max(0, math.Ceil(result.ResetAt.Sub(now).Seconds())))
+
+	if mode != Legacy {
+		name := policyItem(result.Policy)
+
+		policy := name + ";q=" + strconv.FormatInt(result.Limit, 10)
+		if window := int64(math.Ceil(result.Window)); window > 0 {
+			policy += ";w=" + strconv.FormatInt(window, 10)
+		}
+		h.Set("RateLimit-Policy", policy)
+		h.Set("RateLimit", name+";r="+strconv.FormatInt(remaining, 10)+";t="+strconv.FormatInt(reset, 10))
+	}
+
+	if mode != IETF {
+		h.Set("X-RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+		h.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(now.Unix()+reset, 10))
+	}
+}
+
+// policyItem returns the policy name as a structured field string (RFC 8941)
+func policyItem(policy string) string {
+	if policy == "" {
+		policy = defaultPolicy
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range policy {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 0x20 || c > 0x7e:
+			// Structured field strings are printable ASCII only
+			b.WriteByte('_')
+		default:
+			b.WriteRune(c)
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
@@ -0,0 +1,79 @@
+package headers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"redis-token-bucket/internal/bucket"
+)
+
+func TestSet(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	result := &bucket.Result{
+		Allowed:   true,
+		Remaining: 7.6,
+		Limit:     10,
+		ResetAt:   now.Add(2400 * time.Millisecond),
+		Window:    5,
+		Policy:    "premium",
+	}
+
+	tests := []struct {
+		mode    Mode
+		headers map[string]string
+	}{
+		{Both, map[string]string{
+			"RateLimit-Policy":      `"premium";q=10;w=5`,
+			"RateLimit":             `"premium";r=7;t=3`,
+			"X-RateLimit-Limit":     "10",
+			"X-RateLimit-Remaining": "7",
+			"X-RateLimit-Reset":     "1700000003",
+		}},
+		{IETF, map[string]string{
+			"RateLimit-Policy":  `"premium";q=10;w=5`,
+			"X-RateLimit-Limit": "",
+		}},
+		{Legacy, map[string]string{
+			"RateLimit":         "",
+			"X-RateLimit-Limit": "10",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode.String(), func(t *testing.T) {
+			h := http.Header{}
+			SetAt(h, test.mode, result, now)
+			for name, expected := range test.headers {
+				if got := h.Get(name); got != expected {
+					t.Errorf("Expected %s: %q, got %q", name, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSet_DefaultPolicyAndExhaustedBucket(t *testing.T) {
+	now := time.Now()
+	h := http.Header{}
+	SetAt(h, IETF, &bucket.Result{Remaining: -0.5, Limit: 60, ResetAt: now.Add(-time.Second)}, now)
+
+	if got := h.Get("RateLimit-Policy"); got != `"default";q=60` {
+		t.Errorf("Expected the default policy without a window, got %q", got)
+	}
+	if got := h.Get("RateLimit"); got != `"default";r=0;t=0` {
+		t.Errorf("Expected nothing remaining and no reset, got %q", got)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, name := range []string{"both", "ietf", "legacy"} {
+		mode, err := ParseMode(name)
+		if err != nil || mode.String() != name {
+			t.Errorf("Expected %s to round trip, got %v (%v)", name, mode, err)
+		}
+	}
+	if _, err := ParseMode("draft"); err == nil {
+		t.Error("Expected an unknown mode to fail")
+	}
+}
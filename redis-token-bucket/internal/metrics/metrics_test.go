@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveDecision(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/api/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		ObserveDecision(r, "", DecisionDenied)
+	})
+
+	counter := Decisions.WithLabelValues("/api/orders/{id}", "default", DecisionDenied)
+	before := testutil.ToFloat64(counter)
+	for i := 0; i < 3; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/orders/"+strconv.Itoa(i), nil))
+	}
+
+	if got := testutil.ToFloat64(counter) - before; got != 3 {
+		t.Errorf("Expected 3 denied decisions under the route template, got %g", got)
+	}
+}
+
+func TestHandler_TextFormat(t *testing.T) {
+	ScriptDuration.WithLabelValues("test_script").Observe(0.002)
+	AdaptiveRate.WithLabelValues("test_policy").Set(12.5)
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	got := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE ratelimit_redis_script_duration_seconds histogram",
+		`ratelimit_redis_script_duration_seconds_bucket{script="test_script",le="0.0025"} 1`,
+		`ratelimit_redis_script_duration_seconds_count{script="test_script"} 1`,
+		"# TYPE ratelimit_adaptive_refill_rate gauge",
+		`ratelimit_adaptive_refill_rate{policy="test_policy"} 12.5`,
+		"# TYPE go_goroutines gauge",
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, got)
+		}
+	}
+}
+
+func TestRouteLabel_UsesTemplate(t *testing.T) {
+	var label string
+	router := mux.NewRouter()
+	router.HandleFunc("/api/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		label = RouteLabel(r)
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users/12345", nil))
+	if label != "/api/users/{id}" {
+		t.Errorf("Expected the route template, got %q", label)
+	}
+
+	if label := RouteLabel(httptest.NewRequest("GET", "/raw/path", nil)); label != "unmatched" {
+		t.Errorf("Expected requests outside a router to be unmatched, got %q", label)
+	}
+}
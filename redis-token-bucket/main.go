@@ -4,27 +4,36 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"redis-token-bucket/internal/bucket"
 	"redis-token-bucket/internal/handler"
+	"redis-token-bucket/internal/headers"
+	"redis-token-bucket/internal/metrics"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
-	// Initialize Redis-backed token bucket
-	tb, err := bucket.NewRedisTokenBucket(&bucket.Config{
-		RedisAddr:     "localhost:6379",
-		RedisPassword: "",
-		RedisDB:       0,
-	})
+	// Initialize the Redis-backed limiter selected by RATE_LIMIT_ALGORITHM
+	limiter, err := newLimiter(os.Getenv("RATE_LIMIT_ALGORITHM"))
 	if err != nil {
-		log.Fatalf("Failed to initialize token bucket: %v", err)
+		log.Fatalf("Failed to initialize limiter: %v", err)
 	}
-	defer tb.Close()
+	defer limiter.Close()
 
 	// Create HTTP handlers
-	h := handler.NewHandler(tb)
+	h := handler.NewHandler(limiter)
+
+	// RATE_LIMIT_HEADERS selects the rate limit response headers: both, ietf or legacy
+	headerMode, err := headers.ParseMode(os.Getenv("RATE_LIMIT_HEADERS"))
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_HEADERS: %v", err)
+	}
+	h.SetHeaderMode(headerMode)
 
 	// Setup routes
 	r := mux.NewRouter()
@@ -32,9 +41,127 @@ func main() {
 	r.HandleFunc("/api/consume", h.ConsumeTokens).Methods("POST")
 	r.HandleFunc("/api/reset", h.ResetBucket).Methods("POST")
 	r.HandleFunc("/api/bulk-consume", h.BulkConsume).Methods("POST")
+	r.HandleFunc("/api/consume-hierarchy", h.ConsumeHierarchy).Methods("POST")
+	r.HandleFunc("/api/quota", h.QuotaUsage).Methods("GET")
+	// Admin routes require "Authorization: Bearer $ADMIN_TOKEN" and are disabled without it.
+	// Policies are admin routes too: a policy assigned to "*" changes every client's limit.
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	policyAPI := r.PathPrefix("/api/policies").Subrouter()
+	policyAPI.Use(h.AdminAuth(adminToken))
+	policyAPI.HandleFunc("", h.ListPolicies).Methods("GET")
+	policyAPI.HandleFunc("", h.SetPolicy).Methods("POST", "PUT")
+	policyAPI.HandleFunc("", h.DeletePolicy).Methods("DELETE")
+	policyAPI.HandleFunc("/assign", h.AssignPolicy).Methods("POST")
+	policyAPI.HandleFunc("/assign", h.UnassignPolicy).Methods("DELETE")
+	adminAPI := r.PathPrefix("/api/admin/buckets").Subrouter()
+	adminAPI.Use(h.AdminAuth(adminToken))
+	adminAPI.HandleFunc("", h.ListBuckets).Methods("GET")
+	adminAPI.HandleFunc("/inspect", h.InspectBucket).Methods("GET")
+	adminAPI.HandleFunc("/reset", h.ResetBuckets).Methods("POST")
+	adminAPI.HandleFunc("/export", h.ExportBuckets).Methods("GET")
+	adminAPI.HandleFunc("/import", h.ImportBuckets).Methods("POST")
 	r.HandleFunc("/health", h.Health).Methods("GET")
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 
 	// Start server
 	fmt.Println("Server starting on :8081")
 	log.Fatal(http.ListenAndServe(":8081", r))
 }
+
+// newLimiter creates the limiter for the given algorithm (token bucket by default)
+func newLimiter(algorithm string) (bucket.Limiter, error) {
+	switch algorithm {
+	case "", "token_bucket":
+		config := bucket.DefaultConfig()
+		config.RedisAddrs = redisAddrs()
+		config.RedisMasterName = os.Getenv("REDIS_MASTER_NAME")
+		return bucket.NewRedisTokenBucket(config)
+	case "leased_token_bucket":
+		config := bucket.DefaultConfig()
+		config.RedisAddrs = redisAddrs()
+		config.RedisMasterName = os.Getenv("REDIS_MASTER_NAME")
+		tb, err := bucket.NewRedisTokenBucket(config)
+		if err != nil {
+			return nil, err
+		}
+		return bucket.NewLeasingBucket(tb, nil)
+	case "gcra":
+		config := bucket.DefaultGCRAConfig()
+		config.RedisAddrs = redisAddrs()
+		config.RedisMasterName = os.Getenv("REDIS_MASTER_NAME")
+		return bucket.NewRedisGCRA(config)
+	case "sliding_window":
+		config := bucket.DefaultSlidingWindowConfig()
+		config.RedisAddrs = redisAddrs()
+		config.RedisMasterName = os.Getenv("REDIS_MASTER_NAME")
+		return bucket.NewRedisSlidingWindow(config)
+	case "memory_token_bucket":
+		// Buckets live in this process, so the Redis settings do not apply
+		return bucket.NewMemoryTokenBucket(bucket.DefaultConfig())
+	case "memory_sliding_window":
+		return bucket.NewMemorySlidingWindow(bucket.DefaultSlidingWindowConfig())
+	case "fixed_window":
+		config := bucket.DefaultWindowCounterConfig()
+		config.RedisAddrs = redisAddrs()
+		config.RedisMasterName = os.Getenv("REDIS_MASTER_NAME")
+		return bucket.NewRedisFixedWindow(config)
+	case "sliding_window_counter":
+		config := bucket.DefaultWindowCounterConfig()
+		config.RedisAddrs = redisAddrs()
+		config.RedisMasterName = os.Getenv("REDIS_MASTER_NAME")
+		return bucket.NewRedisSlidingWindowCounter(config)
+	case "quota":
+		config, err := quotaConfig()
+		if err != nil {
+			return nil, err
+		}
+		config.RedisAddrs = redisAddrs()
+		config.RedisMasterName = os.Getenv("REDIS_MASTER_NAME")
+		return bucket.NewRedisQuota(config)
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+}
+
+// quotaConfig reads the calendar quota from QUOTA_LIMIT, QUOTA_PERIOD, QUOTA_TIMEZONE and
+// QUOTA_TIMEZONES
+func quotaConfig() (*bucket.QuotaConfig, error) {
+	config := bucket.DefaultQuotaConfig()
+
+	if limit := os.Getenv("QUOTA_LIMIT"); limit != "" {
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid QUOTA_LIMIT: %w", err)
+		}
+		config.Limit = n
+	}
+	if period := os.Getenv("QUOTA_PERIOD"); period != "" {
+		p, err := bucket.ParseQuotaPeriod(period)
+		if err != nil {
+			return nil, err
+		}
+		config.Period = p
+	}
+	if tz := os.Getenv("QUOTA_TIMEZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid QUOTA_TIMEZONE: %w", err)
+		}
+		config.Location = loc
+	}
+	locations, err := bucket.ParseQuotaLocations(os.Getenv("QUOTA_TIMEZONES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUOTA_TIMEZONES: %w", err)
+	}
+	config.LocationFunc = locations
+
+	return config, nil
+}
+
+// redisAddrs returns the comma separated cluster or Sentinel addresses from REDIS_ADDRS
+func redisAddrs() []string {
+	if addrs := os.Getenv("REDIS_ADDRS"); addrs != "" {
+		return strings.Split(addrs, ",")
+	}
+	return nil
+}